@@ -2,15 +2,16 @@
 
 import { getDomainNameFromURL } from "../js_lib/domain.js"
 import { FpkiRequest } from "../js_lib/fpki-request.js"
-    import { printMap, cLog, mapGetList, mapGetMap, mapGetSet, trimString } from "../js_lib/helper.js"
+    import { printMap, cLog, mapGetList, mapGetMap, mapGetSet, trimString, checkGoResult } from "../js_lib/helper.js"
 import { config, downloadConfig, initializeConfig, getConfig, saveConfig, resetConfig, setConfig, exportConfigToJSON } from "../js_lib/config.js"
 import { LogEntry, getLogEntryForRequest, downloadLog, printLogEntriesToConsole, getSerializedLogEntries } from "../js_lib/log.js"
 import { FpkiError, errorTypes } from "../js_lib/errors.js"
-import { policyValidateConnection, legacyValidateConnection, legacyValidateConnectionGo, policyValidateConnectionGo } from "../js_lib/validation.js"
-import { hasApplicablePolicy, getShortErrorMessages, hasFailedValidations, LegacyTrustDecisionGo, PolicyTrustDecisionGo, getLegacyValidationErrorMessageGo, getPolicyValidationErrorMessageGo} from "../js_lib/validation-types.js"
+import { policyValidateConnection, legacyValidateConnection, validateConnectionGo } from "../js_lib/validation.js"
+import { hasApplicablePolicy, getShortErrorMessages, hasFailedValidations, LegacyTrustDecisionGo, PolicyTrustDecisionGo, SPKIPinTrustDecisionGo, DANETrustDecisionGo, TOFUTrustDecisionGo, VerdictGo, getSPKIPinValidationErrorMessageGo, getVerdictErrorGo} from "../js_lib/validation-types.js"
 import "../js_lib/wasm_exec.js"
 import { addCertificateChainToCacheIfNecessary, getCertificateEntryByHash } from "../js_lib/cache.js"
 import { VerifyAndGetMissingIDsResponseGo, AddMissingPayloadsResponseGo } from "../js_lib/FP-PKI-accessor.js"
+import { getTLSARecords } from "../js_lib/dane.js"
 
 
 try {
@@ -33,12 +34,17 @@ if (window.GOCACHE) {
         const go = new Go();
         WebAssembly.instantiateStreaming(fetch("../go_wasm/gocachev2.wasm"), go.importObject).then((result) => {
             go.run(result.instance);
-            const nCertificatesAdded = initializeGODatastructures("embedded/ca-certificates", "embedded/pca-certificates", exportConfigToJSON(getConfig()));
-            console.log(`[Go] Initialize cache with trust roots: #certificates = ${nCertificatesAdded[0]}, #policies = ${nCertificatesAdded[1]}`);
+            initializeGoCache();
+            restoreTOFUPins();
+            restoreTreeHeadPins();
 
             // make js classes for encapsulating return values available to WASM
             window.LegacyTrustDecisionGo = LegacyTrustDecisionGo;
             window.PolicyTrustDecisionGo = PolicyTrustDecisionGo;
+            window.SPKIPinTrustDecisionGo = SPKIPinTrustDecisionGo;
+            window.DANETrustDecisionGo = DANETrustDecisionGo;
+            window.TOFUTrustDecisionGo = TOFUTrustDecisionGo;
+            window.VerdictGo = VerdictGo;
             window.VerifyAndGetMissingIDsResponseGo = VerifyAndGetMissingIDsResponseGo;
             window.AddMissingPayloadsResponseGo = AddMissingPayloadsResponseGo;
 
@@ -63,7 +69,7 @@ browser.runtime.onConnect.addListener( (port) => {
         case 'postConfig':
             setConfig(msg.value);
             saveConfig();
-            clearCaches();
+            applyConfigChange();
             break;
         default:
             switch (msg) {
@@ -118,7 +124,7 @@ browser.runtime.onMessage.addListener((request, sender, sendResponse) => {
         case 'resetConfig':
             resetConfig();
             saveConfig();
-            clearCaches();
+            applyConfigChange();
             return Promise.resolve({ "config": config });
         
         default:
@@ -127,8 +133,17 @@ browser.runtime.onMessage.addListener((request, sender, sendResponse) => {
                     console.log("uploading new config value...");
                     setConfig(request['value']);
                     saveConfig();
-                    clearCaches();
+                    applyConfigChange();
                     return Promise.resolve({ "config": config });
+                case "cacheIntrospection":
+                    return Promise.resolve(queryGoCache(request['query'], request['argument']));
+                case "addTrustRoots":
+                case "removeTrustRoot":
+                case "distrustRoot":
+                case "setTrustRootMetadata":
+                    return Promise.resolve(updateGoTrustStore(request['type'], request['value']));
+                case "removeTOFUPin":
+                    return Promise.resolve(removeGoTOFUPin(request['value']));
                 default:
                     console.log(`Received unknown message: ${request}`);
                     break;
@@ -136,12 +151,205 @@ browser.runtime.onMessage.addListener((request, sender, sendResponse) => {
     }
 });
 
+/**
+ * Query the contents of the Go (WASM) caches.
+ * Supported queries: certificates, policies, chains (argument: domain name),
+ * ignoreReason (argument: base64 encoded hash), proofs, statistics, trustRoots,
+ * tofuPins
+ */
+function queryGoCache(query, argument) {
+    if (!window.GOCACHEV2) {
+        return { "error": "Go (WASM) certificate caching is disabled" };
+    }
+    try {
+        switch (query) {
+            case "certificates":
+                return JSON.parse(checkGoResult(getCachedCertificates(argument)));
+            case "policies":
+                return JSON.parse(checkGoResult(getCachedPolicies(argument)));
+            case "chains":
+                return JSON.parse(checkGoResult(getCertificateChains(argument)));
+            case "ignoreReason":
+                return JSON.parse(checkGoResult(getIgnoreReason(argument)));
+            case "proofs":
+                return JSON.parse(checkGoResult(getVerifiedProofs()));
+            case "statistics":
+                return JSON.parse(checkGoResult(getCacheStatistics()));
+            case "trustRoots":
+                return JSON.parse(checkGoResult(getTrustRoots()));
+            case "tofuPins":
+                return JSON.parse(checkGoResult(exportTOFUPins()));
+            default:
+                return { "error": `unknown cache query: ${query}` };
+        }
+    } catch (error) {
+        return { "error": `${error}` };
+    }
+}
+
+/**
+ * Add (value: PEM encoded certificates), remove or distrust (value: base64
+ * encoded certificate hash) trust roots of the Go (WASM) cache or set their
+ * trust metadata (value: {certificateID, metadata}) without reinitializing it. Cached trust decisions are cleared as they may depend on
+ * the changed roots.
+ */
+function updateGoTrustStore(type, value) {
+    if (!window.GOCACHEV2) {
+        return { "error": "Go (WASM) certificate caching is disabled" };
+    }
+    try {
+        let certificateIDs;
+        switch (type) {
+            case "addTrustRoots":
+                const certificates = new TextEncoder().encode(value);
+                certificateIDs = checkGoResult(addTrustRoots(certificates, certificates.length));
+                break;
+            case "removeTrustRoot":
+                certificateIDs = checkGoResult(removeTrustRoot(value));
+                break;
+            case "distrustRoot":
+                certificateIDs = checkGoResult(distrustRoot(value));
+                break;
+            case "setTrustRootMetadata":
+                certificateIDs = checkGoResult(setTrustRootMetadata(value['certificateID'], JSON.stringify(value['metadata'])));
+                break;
+        }
+        trustDecisions = new Map();
+        verdictCache = new Map();
+        return { "certificateIDs": certificateIDs };
+    } catch (error) {
+        return { "error": `${error}` };
+    }
+}
+
+/**
+ * Apply a changed config: cached trust decisions are cleared, but the Go
+ * (WASM) certificate and policy caches are kept and only the proofs of map
+ * servers whose keys changed are invalidated. updateConfig returns an Error
+ * (instead of throwing) if the config cannot be applied incrementally, then
+ * all caches are reinitialized.
+ */
+function applyConfigChange() {
+    if (!window.GOCACHEV2) {
+        clearCaches();
+        return;
+    }
+    trustDecisions = new Map();
+    verdictCache = new Map();
+    const update = updateConfig(exportConfigToJSON(getConfig()));
+    if (update instanceof Error) {
+        if (update.message.includes("busy")) {
+            // an asynchronous request holds the Go cache, retry once it is done
+            setTimeout(applyConfigChange, 100);
+            return;
+        }
+        console.log(`[Go] failed to update config: ${update}`);
+        clearCaches();
+        return;
+    }
+    console.log("[Go] Updated config:", JSON.parse(update));
+}
+
+/**
+ * Restore the TOFU pins of the Go (WASM) cache from the local storage
+ */
+function restoreTOFUPins() {
+    const storedPins = localStorage.getItem("tofu-pins");
+    if (storedPins === null) {
+        return;
+    }
+    const nPins = importTOFUPins(storedPins);
+    if (nPins instanceof Error) {
+        // keep the stored pins, e.g., to restore them with a fixed version
+        console.log(`[Go] failed to restore TOFU pins: ${nPins}`);
+        return;
+    }
+    console.log(`[Go] Restored ${nPins} TOFU pins`);
+}
+
+/**
+ * Make the TOFU pins of the Go (WASM) cache persistent across browser sessions
+ */
+function saveTOFUPins() {
+    const pins = exportTOFUPins();
+    if (pins instanceof Error) {
+        console.log(`[Go] failed to save TOFU pins: ${pins}`);
+        return;
+    }
+    localStorage.setItem("tofu-pins", pins);
+}
+
+/**
+ * Restore the pinned map server tree heads (epochs) of the Go (WASM) cache
+ * from the local storage
+ */
+function restoreTreeHeadPins() {
+    const storedPins = localStorage.getItem("tree-head-pins");
+    if (storedPins === null) {
+        return;
+    }
+    const nPins = importTreeHeadPins(storedPins);
+    if (nPins instanceof Error) {
+        console.log(`[Go] failed to restore tree head pins: ${nPins}`);
+        return;
+    }
+    console.log(`[Go] Restored ${nPins} tree head pins`);
+}
+
+/**
+ * Make the pinned map server tree heads of the Go (WASM) cache persistent
+ * across browser sessions, so that a map server cannot roll the extension
+ * back to an older epoch after a restart. The pins change whenever a map
+ * server response for a new epoch is verified.
+ */
+function saveTreeHeadPins() {
+    const pins = exportTreeHeadPins();
+    if (pins instanceof Error) {
+        console.log(`[Go] failed to save tree head pins: ${pins}`);
+        return;
+    }
+    if (pins !== localStorage.getItem("tree-head-pins")) {
+        localStorage.setItem("tree-head-pins", pins);
+    }
+}
+
+/**
+ * Remove the TOFU pin of a domain (e.g., after a legitimate change of its CA).
+ * Cached trust decisions are cleared as they may depend on the pin.
+ */
+function removeGoTOFUPin(domain) {
+    if (!window.GOCACHEV2) {
+        return { "error": "Go (WASM) certificate caching is disabled" };
+    }
+    const removed = removeTOFUPin(domain);
+    saveTOFUPins();
+    trustDecisions = new Map();
+    verdictCache = new Map();
+    return { "removed": removed };
+}
+
+/**
+ * (Re)initialize the Go (WASM) caches with the trust roots and the current
+ * config. Returns false if the config was rejected (the problems are logged).
+ */
+function initializeGoCache() {
+    try {
+        const nCertificatesAdded = checkGoResult(initializeGODatastructures("embedded/ca-certificates", "embedded/pca-certificates", exportConfigToJSON(getConfig())));
+        console.log(`[Go] Initialize cache with trust roots: #certificates = ${nCertificatesAdded[0]}, #policies = ${nCertificatesAdded[1]}`);
+        return true;
+    } catch (error) {
+        console.log(`[Go] failed to initialize the caches: ${error}`);
+        return false;
+    }
+}
+
 function clearCaches() {
     console.log("Clearing js and golang (WASM) caches...");
     trustDecisions = new Map();
-    legacyTrustDecisionCache = new Map();
-    policyTrustDecisionCache = new Map();
-    initializeGODatastructures("embedded/ca-certificates", "embedded/pca-certificates", exportConfigToJSON(getConfig()));
+    verdictCache = new Map();
+    if (window.GOCACHEV2) {
+        initializeGoCache();
+    }
 }
 
 // window.addEventListener('unhandledrejection', function(event) {
@@ -153,11 +361,8 @@ function clearCaches() {
 
 let trustDecisions = new Map();
 
-// cache mapping (domain, leaf certificate fingerprint) tuples to legacy trust decisions.
-let legacyTrustDecisionCache = new Map();
-
-// cache mapping (domain, leaf certificate fingerprint) tuples to policy trust decisions.
-let policyTrustDecisionCache = new Map();
+// cache mapping (domain, port, leaf certificate fingerprint) tuples to verdicts (combined trust decisions of all validation modes).
+let verdictCache = new Map();
 
 // contains certificates that are trusted even if legacy (and policy) validation fails
 // data structure is a map [domain] => [x509 fingerprint]
@@ -205,6 +410,10 @@ function redirect(details, error, certificateChain=null) {
 
 function shouldValidateDomain(domain) {
     // ignore mapserver addresses since otherwise there would be a circular dependency which could not be resolved
+    // (the same holds for the DNS-over-HTTPS resolver used for DANE validation)
+    if (config.get("dane-validation") && getDomainNameFromURL(config.get("dane-resolver")) === domain) {
+        return false;
+    }
     return config.get("mapservers").every(({ domain: d }) => getDomainNameFromURL(d) !== domain);
 }
 
@@ -314,31 +523,50 @@ async function checkInfo(details) {
                 }
                 // cLog(details.requestId, "await finished for fpki request for ["+domain+", "+mapserver.identity+"]");
             }
-
-            // remember if policy validations has been performed
-            let policyChecksPerformed = false;
+            if (window.GOCACHEV2) {
+                saveTreeHeadPins();
+            }
 
             if (window.GOCACHEV2) {
-                // check if have a cached trust decision for this domain+leaf certificate
-                const key = domain + certificateChain[0].fingerprintSha256;
-                var trustDecision = null;
-                trustDecision = policyTrustDecisionCache.get(key);
+                // check if have a cached verdict for this domain+port+leaf certificate
+                const url = new URL(details.url);
+                const port = url.port === "" ? 443 : parseInt(url.port);
+                const key = domain + ":" + port + certificateChain[0].fingerprintSha256;
+                var verdict = verdictCache.get(key);
                 var currentTime = new Date();
-                if (trustDecision === undefined || currentTime > trustDecision.validUntil) {
-                    trustDecision = policyValidateConnectionGo(certificateChain, domain);
-                    if (trustDecision.policyChain.length > 0 && !trustDecision.domainExcluded) {
-                        policyChecksPerformed = true;
+                if (verdict === undefined || currentTime > verdict.validUntil) {
+                    // fetch the TLSA records of the service via DNS-over-HTTPS
+                    // unless cached (looked up for the domain name used by all
+                    // validation modes)
+                    if (config.get("dane-validation")) {
+                        const recordSet = await getTLSARecords(config.get("dane-resolver"), domain, port);
+                        checkGoResult(addTLSARecords(JSON.stringify(recordSet)));
                     }
-                    policyTrustDecisionCache.set(key, trustDecision)
 
+                    // run all enabled validation modes (see cache_v2.Verify)
+                    verdict = await validateConnectionGo(certificateChain, domain, port);
+                    verdictCache.set(key, verdict);
+                    const tofuTrustDecision = verdict.decisions.find(td => td.type === "tofu");
+                    const tofu = tofuTrustDecision ? tofuTrustDecision.explanation.tofu : null;
+                    if (tofu && (tofu.status === "pinned" || tofu.status === "updated" || tofu.leafSPKIChanged)) {
+                        saveTOFUPins();
+                    }
                 }
-                if (!trustDecision.domainExcluded) {
-                    addTrustDecision(details, trustDecision);
-                    if (trustDecision.evaluationResult !== 1) {
-                        throw new FpkiError(errorTypes.POLICY_MODE_VALIDATION_ERROR, getPolicyValidationErrorMessageGo(trustDecision));
+                verdict.decisions.forEach(td => {
+                    if (verdict.decidingModes.includes(td.type)) {
+                        addTrustDecision(details, td);
                     }
+                    if (td.type === "spki-pinning" && td.violation && td.evaluationResult === 1) {
+                        cLog(details.requestId, "SPKI pin violation (report-only): " + getSPKIPinValidationErrorMessageGo(td));
+                    }
+                });
+                if (verdict.evaluationResult !== 1) {
+                    throw getVerdictErrorGo(verdict);
                 }
             } else {
+                // remember if policy validations has been performed
+                let policyChecksPerformed = false;
+
                 // check each policy and throw an error if one of the verifications fails
                 policiesMap.forEach((p, m) => {
                     // cLog(details.requestId, "starting policy verification for ["+domain+", "+m.identity+"] with policies: "+printMap(p));
@@ -353,26 +581,9 @@ async function checkInfo(details) {
                         throw new FpkiError(errorTypes.POLICY_MODE_VALIDATION_ERROR, getShortErrorMessages(trustDecision)[0]);
                     }
                 });
-            }
-
-            // don't perform legacy validation if policy validation has already taken place
-            if (!policyChecksPerformed) {
-                if(window.GOCACHEV2) {
-                    // check if have a cached trust decision for this domain+leaf certificate
-                    const key = domain+certificateChain[0].fingerprintSha256;
-                    var trustDecision = null;
-                    trustDecision = legacyTrustDecisionCache.get(key);
-                    var currentTime = new Date();
-                    if (trustDecision === undefined || currentTime > trustDecision.validUntil) {
-                        trustDecision = legacyValidateConnectionGo(certificateChain, domain);
-                        legacyTrustDecisionCache.set(key, trustDecision)
 
-                    }
-                    addTrustDecision(details, trustDecision);
-                    if (trustDecision.evaluationResult !== 1) {
-                        throw new FpkiError(errorTypes.LEGACY_MODE_VALIDATION_ERROR, getLegacyValidationErrorMessageGo(trustDecision));
-                    }
-                } else {
+                // don't perform legacy validation if policy validation has already taken place
+                if (!policyChecksPerformed) {
                     // check each policy and throw an error if one of the verifications fails
                     certificatesMap.forEach((c, m) => {
                         cLog(details.requestId, "starting legacy verification for ["+domain+", "+m.identity+"] with policies: "+printMap(c));
@@ -0,0 +1,261 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go_wasm/cache_v2"
+)
+
+// progress of a long-running request (see cache_v2.ProgressFunc for the stages)
+type Progress struct {
+	Stage string
+	Done  int
+	Total int
+}
+
+// called with the current progress of a request
+type ProgressFunc func(Progress)
+
+// the caches in cache_v2 are not safe for concurrent use: all requests that
+// access them must hold the cache lock. Asynchronous requests wait for it
+// (or until they are canceled), synchronous requests fail if it is held, as
+// blocking in a JS callback would block the JS event loop (see TryLockCache)
+var cacheLock = make(chan struct{}, 1)
+
+// acquire the cache lock, waiting until it is available or ctx is done
+func lockCache(ctx context.Context) error {
+	select {
+	case cacheLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire the cache lock if it is available.
+// returns false if another request currently holds it
+func TryLockCache() bool {
+	select {
+	case cacheLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release the cache lock
+func UnlockCache() {
+	<-cacheLock
+}
+
+// error returned by requests that were superseded by a newer request with
+// the same key
+var ErrSuperseded = fmt.Errorf("request was superseded by a newer request")
+
+// currently active requests by key (only requests with a non-empty key)
+var activeRequests = map[string]*activeRequest{}
+var activeRequestsMutex sync.Mutex
+
+type activeRequest struct {
+	cancel context.CancelCauseFunc
+}
+
+// start a request and return its context.
+// if key is not empty, an active request with the same key is canceled
+// (it is superseded by the new request). done must be called when the
+// request completes
+func StartRequest(key string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if key == "" {
+		return ctx, func() { cancel(nil) }
+	}
+
+	request := &activeRequest{cancel: cancel}
+	activeRequestsMutex.Lock()
+	if previous, ok := activeRequests[key]; ok {
+		previous.cancel(ErrSuperseded)
+	}
+	activeRequests[key] = request
+	activeRequestsMutex.Unlock()
+
+	return ctx, func() {
+		activeRequestsMutex.Lock()
+		if activeRequests[key] == request {
+			delete(activeRequests, key)
+		}
+		activeRequestsMutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel the active request with the given key.
+// returns false if there is no such request
+func CancelRequest(key string) bool {
+	activeRequestsMutex.Lock()
+	defer activeRequestsMutex.Unlock()
+	request, ok := activeRequests[key]
+	if ok {
+		request.cancel(context.Canceled)
+		delete(activeRequests, key)
+	}
+	return ok
+}
+
+// returns the reason why ctx was canceled
+func requestError(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return ctx.Err()
+}
+
+// create a cache_v2.ProgressFunc that reports the progress to progress
+// (if not nil) and aborts the processing if ctx is canceled
+func newProgressFunc(ctx context.Context, progress ProgressFunc) cache_v2.ProgressFunc {
+	return func(stage string, done int, total int) error {
+		if ctx.Err() != nil {
+			return requestError(ctx)
+		}
+		if progress != nil {
+			progress(Progress{Stage: stage, Done: done, Total: total})
+		}
+		return nil
+	}
+}
+
+// same as VerifyAndGetMissingIDs, but waits for the cache lock, can be
+// canceled via ctx and reports its progress
+func VerifyAndGetMissingIDsContext(ctx context.Context, request *VerifyAndGetMissingIDsRequest, progress ProgressFunc) (*VerifyAndGetMissingIDsResponse, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result, err := cache_v2.VerifyAndGetMissingIDsWithProgress(request.MapserverID, request.Responses, newProgressFunc(ctx, progress))
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}, nil
+}
+
+// same as VerifyBatchAndGetMissingIDs, but waits for the cache lock, can be
+// canceled via ctx and reports its progress
+func VerifyBatchAndGetMissingIDsContext(ctx context.Context, request *VerifyBatchAndGetMissingIDsRequest, progress ProgressFunc) (*VerifyAndGetMissingIDsResponse, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result, err := cache_v2.VerifyBatchAndGetMissingIDsWithProgress(request.MapserverID, request.Batch, newProgressFunc(ctx, progress))
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}, nil
+}
+
+// same as VerifyPrefixAndGetMissingIDs, but waits for the cache lock, can be
+// canceled via ctx and reports its progress
+func VerifyPrefixAndGetMissingIDsContext(ctx context.Context, request *VerifyPrefixAndGetMissingIDsRequest, progress ProgressFunc) (*VerifyAndGetMissingIDsResponse, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result, err := cache_v2.VerifyPrefixAndGetMissingIDsWithProgress(request.MapserverID, request.DomainNames, request.Responses, newProgressFunc(ctx, progress))
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}, nil
+}
+
+// same as AddMissingPayloads, but waits for the cache lock, can be
+// canceled via ctx and reports its progress.
+// if the request is canceled, payloads that were already processed remain cached
+func AddMissingPayloadsContext(ctx context.Context, request *AddMissingPayloadsRequest, progress ProgressFunc) (*AddMissingPayloadsResponse, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+
+	processedCertificates, processedPolicies, err := cache_v2.AddMissingRawPayloadsWithProgress(request.CertificateIDs, request.PolicyIDs, request.Payloads, newProgressFunc(ctx, progress))
+	if err != nil {
+		return nil, err
+	}
+	return &AddMissingPayloadsResponse{
+		ProcessedCertificateIDs: processedCertificates,
+		ProcessedPolicyIDs:      processedPolicies,
+	}, nil
+}
+
+// same as VerifyLegacy, but waits for the cache lock and can be canceled
+// (before the validation starts) via ctx
+func VerifyLegacyContext(ctx context.Context, request *VerifyRequest) (*LegacyTrustDecision, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+	return VerifyLegacy(request)
+}
+
+// same as VerifyPolicy, but waits for the cache lock and can be canceled
+// (before the validation starts) via ctx
+func VerifyPolicyContext(ctx context.Context, request *VerifyRequest) (*PolicyTrustDecision, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+	return VerifyPolicy(request)
+}
+
+// same as VerifySPKIPins, but waits for the cache lock and can be canceled
+// (before the validation starts) via ctx
+func VerifySPKIPinsContext(ctx context.Context, request *VerifyRequest) (*SPKIPinTrustDecision, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+	return VerifySPKIPins(request)
+}
+
+// same as VerifyDANE, but waits for the cache lock and can be canceled
+// (before the validation starts) via ctx
+func VerifyDANEContext(ctx context.Context, request *VerifyRequest, port int) (*DANETrustDecision, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+	return VerifyDANE(request, port)
+}
+
+// same as Verify, but waits for the cache lock and can be canceled
+// (before the validation starts) via ctx
+func VerifyContext(ctx context.Context, request *VerifyRequest, port int) (*Verdict, error) {
+	if err := lockCache(ctx); err != nil {
+		return nil, requestError(ctx)
+	}
+	defer UnlockCache()
+	return Verify(request, port)
+}
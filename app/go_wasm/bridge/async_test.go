@@ -0,0 +1,102 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go_wasm/cache_v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// check that the progress of all stages is reported
+func TestAddMissingPayloadsContextProgress(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+	leafHash := cache_v2.GetRawCertificateHash(certificateChain[0])
+
+	var progress []Progress
+	ctx, done := StartRequest("leaf1")
+	defer done()
+	response, err := AddMissingPayloadsContext(ctx, &AddMissingPayloadsRequest{
+		CertificateIDs: []string{leafHash},
+		Payloads:       [][]byte{[]byte("unrequested payload"), certificateChain[0].Raw},
+	}, func(p Progress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{leafHash}, response.ProcessedCertificateIDs)
+	require.Equal(t, []Progress{
+		{Stage: cache_v2.PAYLOADS_STAGE, Done: 1, Total: 2},
+		{Stage: cache_v2.PAYLOADS_STAGE, Done: 2, Total: 2},
+		{Stage: cache_v2.CERTIFICATES_STAGE, Done: 1, Total: 1},
+	}, progress)
+}
+
+// check that a request is canceled if a request with the same key is started
+func TestSupersededRequest(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+	request := &AddMissingPayloadsRequest{
+		CertificateIDs: []string{cache_v2.GetRawCertificateHash(certificateChain[0])},
+		Payloads:       [][]byte{certificateChain[0].Raw},
+	}
+
+	ctx, done := StartRequest("leaf1")
+	defer done()
+	otherCtx, otherDone := StartRequest("other")
+	defer otherDone()
+	newCtx, newDone := StartRequest("leaf1")
+	defer newDone()
+
+	_, err := AddMissingPayloadsContext(ctx, request, nil)
+	require.ErrorIs(t, err, ErrSuperseded)
+	require.NoError(t, otherCtx.Err())
+	_, err = AddMissingPayloadsContext(newCtx, request, nil)
+	require.NoError(t, err)
+
+	// completed requests cannot be canceled
+	newDone()
+	require.False(t, CancelRequest("leaf1"))
+}
+
+// check that a request waiting for the cache lock can be canceled
+func TestCancelWaitingRequest(t *testing.T) {
+	initializeTest(t)
+	require.True(t, TryLockCache())
+	require.False(t, TryLockCache())
+
+	ctx, done := StartRequest("leaf1")
+	defer done()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		CancelRequest("leaf1")
+	}()
+	_, err := VerifyLegacyContext(ctx, &VerifyRequest{DNSName: "leaf1"})
+	require.ErrorIs(t, err, context.Canceled)
+
+	UnlockCache()
+	require.True(t, TryLockCache())
+	UnlockCache()
+}
+
+// check that a running request stops processing once it is canceled
+func TestCancelRunningRequest(t *testing.T) {
+	initializeTest(t)
+	responses := createTestMapServerResponses([]string{"a.com", "b.com", "c.com"}, 1, 1)
+
+	ctx, done := StartRequest("a.com")
+	defer done()
+	var progress []Progress
+	_, err := VerifyAndGetMissingIDsContext(ctx, &VerifyAndGetMissingIDsRequest{MapserverID: "local-mapserver", Responses: responses}, func(p Progress) {
+		progress = append(progress, p)
+		CancelRequest("a.com")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []Progress{{Stage: cache_v2.PROOFS_STAGE, Done: 1, Total: 3}}, progress)
+
+	// the cache lock is released
+	require.True(t, TryLockCache())
+	UnlockCache()
+}
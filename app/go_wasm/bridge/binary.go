@@ -0,0 +1,294 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"go_wasm/cache_v2"
+
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// Compact binary encoding of the inputs sent by JS (alternative to JSON).
+//
+// Every binary encoded input starts with BINARY_MAGIC followed by
+// BINARY_VERSION (JSON encoded inputs start with '{' or '['). All counts
+// and lengths are 4 byte big-endian unsigned integers, epochs and timestamps
+// are 8 byte big-endian integers and byte strings
+// (bytes) are encoded as <length><data>. Hashes, certificates and proofs
+// are passed as raw bytes instead of base64 strings.
+//
+// map server responses (verifyAndGetMissingIDs):
+//
+//	<count> { <domain name bytes> <certificate IDs bytes> <policy IDs bytes>
+//	          <proof type (1 byte)> <count> { <proof node bytes> }
+//	          <root bytes> <proof key bytes> <proof value bytes>
+//	          <tree head signature bytes> <key ID bytes> <epoch (8 bytes)>
+//	          <timestamp (8 bytes)> <epoch signature bytes> }
+//
+// payloads (addMissingPayloads):
+//
+//	<count> { <certificate ID bytes> } <count> { <policy ID bytes> } <count> { <payload bytes> }
+//
+// certificate chain (verifyLegacy, verifyPolicy):
+//
+//	<count> { <DER certificate bytes> }
+//
+// The JS encoder is located in js_lib/go-binary-codec.js
+const (
+	BINARY_MAGIC   byte = 0xfb
+	BINARY_VERSION byte = 0x02
+)
+
+// returns true if data is binary encoded (and not JSON)
+func isBinaryEncoded(data []byte) bool {
+	return len(data) >= 2 && data[0] == BINARY_MAGIC
+}
+
+// sequential reader for the binary encoding.
+// the returned byte slices reference the input buffer (no copies)
+type binaryReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func newBinaryReader(data []byte) *binaryReader {
+	r := &binaryReader{data: data}
+	if !isBinaryEncoded(data) {
+		r.err = fmt.Errorf("input is not binary encoded")
+	} else if data[1] != BINARY_VERSION {
+		r.err = fmt.Errorf("unsupported binary encoding version: %d", data[1])
+	}
+	r.offset = 2
+	return r
+}
+
+func (r *binaryReader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.offset+1 > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of input at offset %d", r.offset)
+		return 0
+	}
+	b := r.data[r.offset]
+	r.offset++
+	return b
+}
+
+func (r *binaryReader) readUint32() int {
+	if r.err != nil {
+		return 0
+	}
+	if r.offset+4 > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of input at offset %d", r.offset)
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data[r.offset:])
+	r.offset += 4
+	return int(v)
+}
+
+func (r *binaryReader) readUint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if r.offset+8 > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of input at offset %d", r.offset)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data[r.offset:])
+	r.offset += 8
+	return v
+}
+
+// read a count and check that the remaining input can contain count
+// entries of at least minEntrySize bytes (prevents huge allocations for
+// corrupted inputs)
+func (r *binaryReader) readCount(minEntrySize int) int {
+	count := r.readUint32()
+	if r.err == nil && count*minEntrySize > len(r.data)-r.offset {
+		r.err = fmt.Errorf("invalid count %d at offset %d", count, r.offset-4)
+		return 0
+	}
+	return count
+}
+
+// zero-length byte strings are returned as nil (as null in JSON)
+func (r *binaryReader) readBytes() []byte {
+	length := r.readUint32()
+	if r.err != nil || length == 0 {
+		return nil
+	}
+	if r.offset+length > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of input at offset %d", r.offset)
+		return nil
+	}
+	b := r.data[r.offset : r.offset+length : r.offset+length]
+	r.offset += length
+	return b
+}
+
+func (r *binaryReader) readBytesList() [][]byte {
+	count := r.readCount(4)
+	list := make([][]byte, count)
+	for i := range list {
+		list[i] = r.readBytes()
+	}
+	return list
+}
+
+// check that the whole input was consumed and return the first error
+func (r *binaryReader) finish() error {
+	if r.err == nil && r.offset != len(r.data) {
+		r.err = fmt.Errorf("%d trailing bytes", len(r.data)-r.offset)
+	}
+	return r.err
+}
+
+// writer for the binary encoding (used for tests and benchmarks;
+// the extension encodes the inputs in JS)
+type binaryWriter struct {
+	buffer bytes.Buffer
+}
+
+func newBinaryWriter() *binaryWriter {
+	w := &binaryWriter{}
+	w.buffer.WriteByte(BINARY_MAGIC)
+	w.buffer.WriteByte(BINARY_VERSION)
+	return w
+}
+
+func (w *binaryWriter) writeUint32(v int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.buffer.Write(b[:])
+}
+
+func (w *binaryWriter) writeUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buffer.Write(b[:])
+}
+
+func (w *binaryWriter) writeBytes(b []byte) {
+	w.writeUint32(len(b))
+	w.buffer.Write(b)
+}
+
+func (w *binaryWriter) writeBytesList(list [][]byte) {
+	w.writeUint32(len(list))
+	for _, b := range list {
+		w.writeBytes(b)
+	}
+}
+
+// decode binary encoded map server responses
+func decodeBinaryMapServerResponses(data []byte) ([]cache_v2.MapServerProofResponse, error) {
+	r := newBinaryReader(data)
+	// each response contains at least 10 length prefixes, the proof type,
+	// the epoch and the timestamp
+	responses := make([]cache_v2.MapServerProofResponse, r.readCount(57))
+	for i := range responses {
+		domainEntry := &mapCommon.DomainEntry{}
+		domainEntry.DomainName = string(r.readBytes())
+		domainEntry.CertIDs = r.readBytes()
+		domainEntry.PolicyIDs = r.readBytes()
+		responses[i].DomainEntry = domainEntry
+		responses[i].PoI.ProofType = mapCommon.ProofType(r.readByte())
+		responses[i].PoI.Proof = r.readBytesList()
+		responses[i].PoI.Root = r.readBytes()
+		responses[i].PoI.ProofKey = r.readBytes()
+		responses[i].PoI.ProofValue = r.readBytes()
+		responses[i].TreeHeadSig = r.readBytes()
+		responses[i].KeyID = string(r.readBytes())
+		responses[i].Epoch = r.readUint64()
+		responses[i].Timestamp = int64(r.readUint64())
+		responses[i].EpochSig = r.readBytes()
+	}
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode map server responses: %s", err)
+	}
+	return responses, nil
+}
+
+// binary encode map server responses
+func EncodeBinaryMapServerResponses(responses []cache_v2.MapServerProofResponse) []byte {
+	w := newBinaryWriter()
+	w.writeUint32(len(responses))
+	for _, response := range responses {
+		domainEntry := response.DomainEntry
+		if domainEntry == nil {
+			domainEntry = &mapCommon.DomainEntry{}
+		}
+		w.writeBytes([]byte(domainEntry.DomainName))
+		w.writeBytes(domainEntry.CertIDs)
+		w.writeBytes(domainEntry.PolicyIDs)
+		w.buffer.WriteByte(byte(response.PoI.ProofType))
+		w.writeBytesList(response.PoI.Proof)
+		w.writeBytes(response.PoI.Root)
+		w.writeBytes(response.PoI.ProofKey)
+		w.writeBytes(response.PoI.ProofValue)
+		w.writeBytes(response.TreeHeadSig)
+		w.writeBytes([]byte(response.KeyID))
+		w.writeUint64(response.Epoch)
+		w.writeUint64(uint64(response.Timestamp))
+		w.writeBytes(response.EpochSig)
+	}
+	return w.buffer.Bytes()
+}
+
+// decode binary encoded payloads
+func decodeBinaryAddMissingPayloadsRequest(data []byte) (*AddMissingPayloadsRequest, error) {
+	r := newBinaryReader(data)
+	request := &AddMissingPayloadsRequest{}
+	for _, ids := range []*[]string{&request.CertificateIDs, &request.PolicyIDs} {
+		rawIDs := r.readBytesList()
+		*ids = make([]string, len(rawIDs))
+		for i, rawID := range rawIDs {
+			(*ids)[i] = base64.StdEncoding.EncodeToString(rawID)
+		}
+	}
+	request.Payloads = r.readBytesList()
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode map server payloads: %s", err)
+	}
+	return request, nil
+}
+
+// binary encode payloads
+func EncodeBinaryAddMissingPayloadsRequest(request *AddMissingPayloadsRequest) ([]byte, error) {
+	w := newBinaryWriter()
+	for _, ids := range [][]string{request.CertificateIDs, request.PolicyIDs} {
+		w.writeUint32(len(ids))
+		for _, id := range ids {
+			rawID, err := base64.StdEncoding.DecodeString(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode ID %s: %s", id, err)
+			}
+			w.writeBytes(rawID)
+		}
+	}
+	w.writeBytesList(request.Payloads)
+	return w.buffer.Bytes(), nil
+}
+
+// decode a binary encoded certificate chain
+func decodeBinaryVerifyRequest(dnsName string, data []byte) (*VerifyRequest, error) {
+	r := newBinaryReader(data)
+	request := &VerifyRequest{DNSName: dnsName, ConnectionCertificateChain: r.readBytesList()}
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate chain: %s", err)
+	}
+	return request, nil
+}
+
+// binary encode a certificate chain
+func EncodeBinaryVerifyRequest(request *VerifyRequest) []byte {
+	w := newBinaryWriter()
+	w.writeBytesList(request.ConnectionCertificateChain)
+	return w.buffer.Bytes()
+}
@@ -0,0 +1,309 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"os"
+	"path"
+	"testing"
+
+	"go_wasm/cache_v2"
+
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+	"github.com/stretchr/testify/require"
+)
+
+// directory containing real (PEM encoded) certificates used as benchmark payloads
+const BENCHMARK_CERTIFICATES_DIR = "../cache_v2/embedded/ca-certificates"
+
+// responses of the getproof and getpayloads endpoints used by the benchmarks
+// (in the format returned by the map server, see TestBenchmarkFixtures)
+const (
+	BENCHMARK_GETPROOF_FIXTURE    = "testdata/getproof.json"
+	BENCHMARK_GETPAYLOADS_FIXTURE = "testdata/getpayloads.json"
+)
+
+// number of certificates of BENCHMARK_CERTIFICATES_DIR in the fixtures
+const BENCHMARK_FIXTURE_CERTIFICATES = 32
+
+var updateBenchmarkFixtures = flag.Bool("update-benchmark-fixtures", false, "regenerate the map server responses used by the benchmarks")
+
+// create synthetic map server responses (one per domain) with proofs of the given depth
+func createTestMapServerResponses(domains []string, nIDs int, proofDepth int) []cache_v2.MapServerProofResponse {
+	responses := make([]cache_v2.MapServerProofResponse, len(domains))
+	for i, domain := range domains {
+		var certIDs []byte
+		for j := 0; j < nIDs; j++ {
+			id := sha256.Sum256([]byte{byte(i), byte(j)})
+			certIDs = append(certIDs, id[:]...)
+		}
+		proof := make([][]byte, proofDepth)
+		for j := range proof {
+			node := sha256.Sum256([]byte{byte(i), byte(j), 1})
+			proof[j] = node[:]
+		}
+		root := sha256.Sum256([]byte("root"))
+		proofKey := sha256.Sum256([]byte(domain))
+		responses[i].MapServerResponse = mapCommon.MapServerResponse{
+			DomainEntry: &mapCommon.DomainEntry{DomainName: domain, CertIDs: certIDs},
+			PoI: mapCommon.PoI{
+				ProofType: mapCommon.PoP,
+				Proof:     proof,
+				Root:      root[:],
+				ProofKey:  proofKey[:],
+			},
+			TreeHeadSig: []byte("signature"),
+		}
+	}
+	return responses
+}
+
+// load the DER encoded certificates in dir and create the corresponding request
+func createTestAddMissingPayloadsRequest(t testing.TB, dir string) *AddMissingPayloadsRequest {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	request := &AddMissingPayloadsRequest{CertificateIDs: []string{}, PolicyIDs: []string{}}
+	for _, entry := range entries {
+		pemBytes, err := os.ReadFile(path.Join(dir, entry.Name()))
+		require.NoError(t, err)
+		pemBlock, _ := pem.Decode(pemBytes)
+		if pemBlock == nil {
+			continue
+		}
+		hash := sha256.Sum256(pemBlock.Bytes)
+		request.CertificateIDs = append(request.CertificateIDs, base64.StdEncoding.EncodeToString(hash[:]))
+		request.Payloads = append(request.Payloads, pemBlock.Bytes)
+	}
+	return request
+}
+
+// encode a request in the JSON format sent by JS
+func encodeTestAddMissingPayloadsRequest(t testing.TB, request *AddMissingPayloadsRequest) []byte {
+	response := cache_v2.MapServerMissingPayloadsResponse{
+		CertificateIDs: request.CertificateIDs,
+		PolicyIDs:      request.PolicyIDs,
+		Payloads:       make([]string, len(request.Payloads)),
+	}
+	for i, payload := range request.Payloads {
+		response.Payloads[i] = base64.StdEncoding.EncodeToString(payload)
+	}
+	data, err := json.Marshal(response)
+	require.NoError(t, err)
+	return data
+}
+
+// check that the JSON and the binary encoding decode to the same requests
+func TestBinaryEncoding(t *testing.T) {
+	responses := createTestMapServerResponses([]string{"example.com", "www.example.com"}, 3, 5)
+	responses[1].KeyID = "key"
+	responses[1].Epoch = 3
+	responses[1].Timestamp = 1700000000
+	responses[1].EpochSig = []byte("epoch signature")
+	jsonResponses, err := json.Marshal(responses)
+	require.NoError(t, err)
+	jsonRequest, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", jsonResponses)
+	require.NoError(t, err)
+	binaryRequest, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", EncodeBinaryMapServerResponses(responses))
+	require.NoError(t, err)
+	require.Equal(t, jsonRequest, binaryRequest)
+
+	payloadsRequest := createTestAddMissingPayloadsRequest(t, BENCHMARK_CERTIFICATES_DIR)
+	require.NotEmpty(t, payloadsRequest.Payloads)
+	jsonPayloadsRequest, err := DecodeAddMissingPayloadsRequest(encodeTestAddMissingPayloadsRequest(t, payloadsRequest))
+	require.NoError(t, err)
+	binaryPayloads, err := EncodeBinaryAddMissingPayloadsRequest(payloadsRequest)
+	require.NoError(t, err)
+	binaryPayloadsRequest, err := DecodeAddMissingPayloadsRequest(binaryPayloads)
+	require.NoError(t, err)
+	require.Equal(t, jsonPayloadsRequest, binaryPayloadsRequest)
+	require.Less(t, len(binaryPayloads), len(encodeTestAddMissingPayloadsRequest(t, payloadsRequest)))
+
+	certificateChain := createTestChain(t, "leaf1")
+	jsonVerifyRequest, err := DecodeVerifyRequest("leaf1", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	binaryVerifyRequest, err := DecodeVerifyRequest("leaf1", EncodeBinaryVerifyRequest(jsonVerifyRequest))
+	require.NoError(t, err)
+	require.Equal(t, jsonVerifyRequest, binaryVerifyRequest)
+}
+
+// check that binary encoded inputs are processed like JSON encoded inputs
+func TestBinaryVerifyLegacy(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+
+	request, err := DecodeVerifyRequest("leaf1", EncodeBinaryVerifyRequest(&VerifyRequest{
+		ConnectionCertificateChain: [][]byte{certificateChain[0].Raw, certificateChain[1].Raw},
+	}))
+	require.NoError(t, err)
+	decision, err := VerifyLegacy(request)
+	require.NoError(t, err)
+	require.Equal(t, cache_v2.SUCCESS, decision.EvaluationResult)
+	require.Equal(t, "Test Root", decision.ConnectionTrustLevelCASet)
+}
+
+// check that malformed binary inputs are rejected
+func TestBinaryInvalidInput(t *testing.T) {
+	valid := EncodeBinaryVerifyRequest(&VerifyRequest{ConnectionCertificateChain: [][]byte{[]byte("certificate")}})
+	_, err := DecodeVerifyRequest("leaf1", valid)
+	require.NoError(t, err)
+
+	// truncated input
+	_, err = DecodeVerifyRequest("leaf1", valid[:len(valid)-1])
+	require.Error(t, err)
+
+	// trailing bytes
+	_, err = DecodeVerifyRequest("leaf1", append(append([]byte{}, valid...), 0))
+	require.Error(t, err)
+
+	// unsupported version
+	invalidVersion := append([]byte{}, valid...)
+	invalidVersion[1] = BINARY_VERSION + 1
+	_, err = DecodeVerifyRequest("leaf1", invalidVersion)
+	require.Error(t, err)
+
+	// count exceeding the input size
+	_, err = DecodeVerifyAndGetMissingIDsRequest("local-mapserver", []byte{BINARY_MAGIC, BINARY_VERSION, 0xff, 0xff, 0xff, 0xff})
+	require.Error(t, err)
+	_, err = DecodeAddMissingPayloadsRequest([]byte{BINARY_MAGIC, BINARY_VERSION, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	require.Error(t, err)
+}
+
+// wrap a response of the getpayloads endpoint (a JSON array of base64 encoded
+// payloads) into the request sent by JS, which contains the IDs of the
+// requested certificates and policies (see retrieveMissingCertificatesAndPolicies)
+func wrapGetPayloadsResponse(t testing.TB, data []byte) []byte {
+	var payloads []string
+	require.NoError(t, json.Unmarshal(data, &payloads))
+	response := cache_v2.MapServerMissingPayloadsResponse{CertificateIDs: []string{}, PolicyIDs: []string{}, Payloads: payloads}
+	for _, payload := range payloads {
+		payloadBytes, err := base64.StdEncoding.DecodeString(payload)
+		require.NoError(t, err)
+		hash := sha256.Sum256(payloadBytes)
+		id := base64.StdEncoding.EncodeToString(hash[:])
+		if _, err := x509.ParseCertificate(payloadBytes); err == nil {
+			response.CertificateIDs = append(response.CertificateIDs, id)
+		} else {
+			response.PolicyIDs = append(response.PolicyIDs, id)
+		}
+	}
+	wrapped, err := json.Marshal(response)
+	require.NoError(t, err)
+	return wrapped
+}
+
+// load the map server response of the file set in the environment variable
+// (e.g., FPKI_BENCH_GETPROOF=getproof.json FPKI_BENCH_GETPAYLOADS=getpayloads.json)
+// or of the fixture otherwise
+func loadBenchmarkInput(b *testing.B, env string, fixture string) []byte {
+	fileName := os.Getenv(env)
+	if fileName == "" {
+		fileName = fixture
+	}
+	data, err := os.ReadFile(fileName)
+	require.NoError(b, err)
+	return data
+}
+
+// create the responses of the getproof and getpayloads endpoints for
+// www.example.com whose domain entries contain the IDs of the payloads
+func createBenchmarkFixtures(t *testing.T) (getproof []byte, getpayloads []byte) {
+	request := createTestAddMissingPayloadsRequest(t, BENCHMARK_CERTIFICATES_DIR)
+	require.True(t, len(request.Payloads) >= BENCHMARK_FIXTURE_CERTIFICATES)
+	payloads := make([]string, BENCHMARK_FIXTURE_CERTIFICATES)
+	var certIDs []byte
+	for i, payload := range request.Payloads[:BENCHMARK_FIXTURE_CERTIFICATES] {
+		payloads[i] = base64.StdEncoding.EncodeToString(payload)
+		hash := sha256.Sum256(payload)
+		certIDs = append(certIDs, hash[:]...)
+	}
+	responses := createTestMapServerResponses([]string{"example.com", "www.example.com"}, 0, 32)
+	responses[1].DomainEntry.CertIDs = certIDs
+	getproof, err := json.MarshalIndent(responses, "", "\t")
+	require.NoError(t, err)
+	getpayloads, err = json.MarshalIndent(payloads, "", "\t")
+	require.NoError(t, err)
+	return append(getproof, '\n'), append(getpayloads, '\n')
+}
+
+// check that the fixtures of the benchmarks are up to date and decode like
+// the responses processed by JS
+func TestBenchmarkFixtures(t *testing.T) {
+	getproof, getpayloads := createBenchmarkFixtures(t)
+	if *updateBenchmarkFixtures {
+		require.NoError(t, os.WriteFile(BENCHMARK_GETPROOF_FIXTURE, getproof, 0644))
+		require.NoError(t, os.WriteFile(BENCHMARK_GETPAYLOADS_FIXTURE, getpayloads, 0644))
+		return
+	}
+	for fixture, expected := range map[string][]byte{BENCHMARK_GETPROOF_FIXTURE: getproof, BENCHMARK_GETPAYLOADS_FIXTURE: getpayloads} {
+		data, err := os.ReadFile(fixture)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(expected, data), "%s is outdated, run the test with -update-benchmark-fixtures", fixture)
+	}
+
+	proofRequest, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", getproof)
+	require.NoError(t, err)
+	require.Len(t, proofRequest.Responses, 2)
+
+	payloadsRequest, err := DecodeAddMissingPayloadsRequest(wrapGetPayloadsResponse(t, getpayloads))
+	require.NoError(t, err)
+	require.Len(t, payloadsRequest.CertificateIDs, BENCHMARK_FIXTURE_CERTIFICATES)
+	require.Empty(t, payloadsRequest.PolicyIDs)
+	require.Len(t, payloadsRequest.Payloads, BENCHMARK_FIXTURE_CERTIFICATES)
+	var certIDs []byte
+	for _, id := range payloadsRequest.CertificateIDs {
+		idBytes, err := base64.StdEncoding.DecodeString(id)
+		require.NoError(t, err)
+		certIDs = append(certIDs, idBytes...)
+	}
+	require.Equal(t, proofRequest.Responses[1].DomainEntry.CertIDs, certIDs)
+}
+
+// compare decoding the map server responses of the getproof endpoint
+func BenchmarkDecodeMapServerResponses(b *testing.B) {
+	jsonData := loadBenchmarkInput(b, "FPKI_BENCH_GETPROOF", BENCHMARK_GETPROOF_FIXTURE)
+	request, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", jsonData)
+	require.NoError(b, err)
+	binaryData := EncodeBinaryMapServerResponses(request.Responses)
+
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"json", jsonData}, {"binary", binaryData}} {
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input.data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", input.data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// compare decoding the payloads of the getpayloads endpoint
+func BenchmarkDecodeAddMissingPayloads(b *testing.B) {
+	jsonData := wrapGetPayloadsResponse(b, loadBenchmarkInput(b, "FPKI_BENCH_GETPAYLOADS", BENCHMARK_GETPAYLOADS_FIXTURE))
+	request, err := DecodeAddMissingPayloadsRequest(jsonData)
+	require.NoError(b, err)
+	binaryData, err := EncodeBinaryAddMissingPayloadsRequest(request)
+	require.NoError(b, err)
+
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"json", jsonData}, {"binary", binaryData}} {
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input.data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeAddMissingPayloadsRequest(input.data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+// Package bridge contains the interface between JS and the Go validation
+// logic in cache_v2.
+//
+// The functions in this file operate on typed requests and responses and can
+// be compiled (and tested) natively. codec.go decodes the JSON or binary
+// (binary.go) encoded inputs sent by JS and codec_js.go (js && wasm only)
+// converts between JS values and the typed requests and responses.
+package bridge
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go_wasm/cache_v2"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// initialize all the Go data structures
+func Initialize(request *InitializeRequest) (*InitializeResponse, error) {
+	// decode and validate the config before changing any state
+	config, err := cache_v2.ParseConfig(request.ConfigJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	// initialize certificate cache with root certificates
+	// located in trustStoreDir
+	nCertificates := cache_v2.InitializeCache(request.TrustStoreDir)
+
+	// same for policies
+	nPolicies := cache_v2.InitializePolicyCache(request.PolicyTrustStoreDir)
+
+	// initialize validation data structures and map server info cache
+	cache_v2.InitializeConfig(config)
+
+	return &InitializeResponse{NCertificates: nCertificates, NPolicies: nPolicies}, nil
+}
+
+// apply a changed config without clearing the certificate and policy caches
+func UpdateConfig(request *UpdateConfigRequest) (*cache_v2.ConfigUpdate, error) {
+	config, err := cache_v2.ParseConfig(request.ConfigJSON)
+	if err != nil {
+		return nil, err
+	}
+	return cache_v2.UpdateConfig(config), nil
+}
+
+// verify the map server proofs and determine the missing certificates and policies
+func VerifyAndGetMissingIDs(request *VerifyAndGetMissingIDsRequest) *VerifyAndGetMissingIDsResponse {
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result := cache_v2.VerifyAndGetMissingIDs(request.MapserverID, request.Responses)
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}
+}
+
+// verify the map server proofs of a batch response (with a single signature
+// check) and determine the missing certificates and policies
+func VerifyBatchAndGetMissingIDs(request *VerifyBatchAndGetMissingIDsRequest) *VerifyAndGetMissingIDsResponse {
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result := cache_v2.VerifyBatchAndGetMissingIDs(request.MapserverID, request.Batch)
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}
+}
+
+// derive the map server proofs of the requested domains from the responses of
+// hash prefix queries, verify them and determine the missing certificates and
+// policies
+func VerifyPrefixAndGetMissingIDs(request *VerifyPrefixAndGetMissingIDsRequest) *VerifyAndGetMissingIDsResponse {
+	cache_v2.MSS = 0
+	cache_v2.NCertificatesAdded = 0
+
+	result := cache_v2.VerifyPrefixAndGetMissingIDs(request.MapserverID, request.DomainNames, request.Responses)
+	return &VerifyAndGetMissingIDsResponse{
+		VerificationResults: result.MHTProofVerificationResults,
+		CertificateIDs:      result.MissingCertificateIDs,
+		PolicyIDs:           result.MissingPolicyIDs,
+	}
+}
+
+// add the certificates and policies returned by the map server to the cache
+func AddMissingPayloads(request *AddMissingPayloadsRequest) (*AddMissingPayloadsResponse, error) {
+	processedCertificates, processedPolicies, err := cache_v2.AddMissingRawPayloads(request.CertificateIDs, request.PolicyIDs, request.Payloads)
+	if err != nil {
+		return nil, err
+	}
+	return &AddMissingPayloadsResponse{
+		ProcessedCertificateIDs: processedCertificates,
+		ProcessedPolicyIDs:      processedPolicies,
+	}, nil
+}
+
+// run the legacy validation for the connection
+func VerifyLegacy(request *VerifyRequest) (*LegacyTrustDecision, error) {
+	certificateChain, err := parseCertificateChain(request.ConnectionCertificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	// call the Legacy validation with the connection domain name and certificate chain
+	legacyTrustInfo := cache_v2.NewLegacyTrustInfo(request.DNSName, certificateChain)
+	cache_v2.VerifyLegacy(legacyTrustInfo)
+	return newLegacyTrustDecision(legacyTrustInfo)
+}
+
+// convert the outcome of the legacy validation into a LegacyTrustDecision
+func newLegacyTrustDecision(legacyTrustInfo *cache_v2.LegacyTrustInfo) (*LegacyTrustDecision, error) {
+	explanation, err := legacyTrustInfo.Explanation.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &LegacyTrustDecision{
+		DNSName:                        legacyTrustInfo.DNSName,
+		ConnectionTrustLevel:           legacyTrustInfo.ConnectionTrustLevel,
+		ConnectionTrustLevelCASet:      legacyTrustInfo.ConnectionTrustLevelCASet,
+		ConnectionTrustLevelChainIndex: legacyTrustInfo.ConnectionTrustLevelChainIndex,
+		EvaluationResult:               legacyTrustInfo.EvaluationResult,
+		HighestTrustLevel:              legacyTrustInfo.HighestTrustLevel,
+		HighestTrustLevelCASets:        legacyTrustInfo.HighestTrustLevelCASets,
+		HighestTrustLevelChainIndices:  legacyTrustInfo.HighestTrustLevelChainIndices,
+		HighestTrustLevelChainHashes:   legacyTrustInfo.HighestTrustLevelChainHashes,
+		HighestTrustLevelChainSubjects: legacyTrustInfo.HighestTrustLevelChainSubjects,
+		MaxValidity:                    legacyTrustInfo.MaxValidity.Unix(),
+		ExplanationJSON:                explanation,
+	}, nil
+}
+
+// run the policy validation for the connection
+func VerifyPolicy(request *VerifyRequest) (*PolicyTrustDecision, error) {
+	certificateChain, err := parseCertificateChain(request.ConnectionCertificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	// call the policy validation with the connection domain name and certificate chain
+	policyTrustInfo := cache_v2.NewPolicyTrustInfo(request.DNSName, certificateChain)
+	err = cache_v2.VerifyPolicy(policyTrustInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newPolicyTrustDecision(policyTrustInfo)
+}
+
+// convert the outcome of the policy validation into a PolicyTrustDecision
+func newPolicyTrustDecision(policyTrustInfo *cache_v2.PolicyTrustInfo) (*PolicyTrustDecision, error) {
+	policyChain := make([]string, len(policyTrustInfo.PolicyChain))
+	for i, policy := range policyTrustInfo.PolicyChain {
+		policyJSON, err := common.ToJSON(policy)
+		if err != nil {
+			return nil, err
+		}
+		policyChain[i] = string(policyJSON)
+	}
+	conflictingPolicies := make([]string, len(policyTrustInfo.ConflictingPolicyAttributes))
+	for i, attributes := range policyTrustInfo.ConflictingPolicyAttributes {
+		attributesJSON, err := json.Marshal(attributes)
+		if err != nil {
+			return nil, err
+		}
+		conflictingPolicies[i] = string(attributesJSON)
+	}
+	explanation, err := policyTrustInfo.Explanation.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyTrustDecision{
+		DNSName:             policyTrustInfo.DNSName,
+		EvaluationResult:    policyTrustInfo.EvaluationResult,
+		PolicyChain:         policyChain,
+		ConflictingPolicies: conflictingPolicies,
+		MaxValidity:         policyTrustInfo.MaxValidity.Unix(),
+		DomainExcluded:      policyTrustInfo.DomainExcluded,
+		ExplanationJSON:     explanation,
+	}, nil
+}
+
+// run the SPKI pinning validation for the connection
+func VerifySPKIPins(request *VerifyRequest) (*SPKIPinTrustDecision, error) {
+	certificateChain, err := parseCertificateChain(request.ConnectionCertificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	spkiPinTrustInfo := cache_v2.NewSPKIPinTrustInfo(request.DNSName, certificateChain)
+	cache_v2.VerifySPKIPins(spkiPinTrustInfo)
+	return newSPKIPinTrustDecision(spkiPinTrustInfo)
+}
+
+// convert the outcome of the SPKI pinning validation into a SPKIPinTrustDecision
+func newSPKIPinTrustDecision(spkiPinTrustInfo *cache_v2.SPKIPinTrustInfo) (*SPKIPinTrustDecision, error) {
+	explanation, err := spkiPinTrustInfo.Explanation.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	decision := &SPKIPinTrustDecision{
+		DNSName:           spkiPinTrustInfo.DNSName,
+		EvaluationResult:  spkiPinTrustInfo.EvaluationResult,
+		Violation:         spkiPinTrustInfo.Violation,
+		MatchedChainIndex: spkiPinTrustInfo.MatchedChainIndex,
+		MaxValidity:       spkiPinTrustInfo.MaxValidity.Unix(),
+		ExplanationJSON:   explanation,
+	}
+	if spkiPinTrustInfo.PinSet != nil {
+		decision.PinDomain = spkiPinTrustInfo.PinSet.Domain
+		decision.Mode = spkiPinTrustInfo.PinSet.Mode
+	}
+	return decision, nil
+}
+
+// run the DANE validation for the connection to port
+func VerifyDANE(request *VerifyRequest, port int) (*DANETrustDecision, error) {
+	certificateChain, err := parseCertificateChain(request.ConnectionCertificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	daneTrustInfo := cache_v2.NewDANETrustInfo(request.DNSName, port, certificateChain)
+	cache_v2.VerifyDANE(daneTrustInfo)
+	return newDANETrustDecision(daneTrustInfo)
+}
+
+// convert the outcome of the DANE validation into a DANETrustDecision
+func newDANETrustDecision(daneTrustInfo *cache_v2.DANETrustInfo) (*DANETrustDecision, error) {
+	explanation, err := daneTrustInfo.Explanation.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &DANETrustDecision{
+		DNSName:            daneTrustInfo.DNSName,
+		EvaluationResult:   daneTrustInfo.EvaluationResult,
+		TLSAName:           cache_v2.TLSAName(daneTrustInfo.DNSName, daneTrustInfo.Port),
+		DNSSECStatus:       daneTrustInfo.DNSSECStatus,
+		Applicable:         daneTrustInfo.Applicable,
+		MatchedRecordIndex: daneTrustInfo.MatchedRecordIndex,
+		MatchedChainIndex:  daneTrustInfo.MatchedChainIndex,
+		MaxValidity:        daneTrustInfo.MaxValidity.Unix(),
+		ExplanationJSON:    explanation,
+	}, nil
+}
+
+// convert the outcome of the TOFU validation into a TOFUTrustDecision
+func newTOFUTrustDecision(tofuTrustInfo *cache_v2.TOFUTrustInfo) (*TOFUTrustDecision, error) {
+	explanation, err := tofuTrustInfo.Explanation.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &TOFUTrustDecision{
+		DNSName:          tofuTrustInfo.DNSName,
+		EvaluationResult: tofuTrustInfo.EvaluationResult,
+		Status:           tofuTrustInfo.Result.Status,
+		MaxValidity:      tofuTrustInfo.MaxValidity.Unix(),
+		ExplanationJSON:  explanation,
+	}, nil
+}
+
+// run all enabled validation modes for the connection to port and combine
+// their results (see cache_v2.Verify)
+func Verify(request *VerifyRequest, port int) (*Verdict, error) {
+	certificateChain, err := parseCertificateChain(request.ConnectionCertificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	verdict := cache_v2.Verify(request.DNSName, port, certificateChain)
+	resultsJSON, err := json.Marshal(verdict.Results)
+	if err != nil {
+		return nil, err
+	}
+	response := &Verdict{
+		DNSName:          request.DNSName,
+		EvaluationResult: verdict.EvaluationResult,
+		Precedence:       verdict.Precedence,
+		DecidingModes:    verdict.DecidingModes,
+		MaxValidity:      verdict.MaxValidity.Unix(),
+		Decisions:        []any{},
+		ResultsJSON:      string(resultsJSON),
+	}
+	for _, result := range verdict.Results {
+		var decision any
+		switch trustInfo := result.TrustInfo.(type) {
+		case nil:
+			// skipped
+			continue
+		case *cache_v2.LegacyTrustInfo:
+			decision, err = newLegacyTrustDecision(trustInfo)
+		case *cache_v2.PolicyTrustInfo:
+			decision, err = newPolicyTrustDecision(trustInfo)
+		case *cache_v2.SPKIPinTrustInfo:
+			decision, err = newSPKIPinTrustDecision(trustInfo)
+		case *cache_v2.DANETrustInfo:
+			decision, err = newDANETrustDecision(trustInfo)
+		case *cache_v2.TOFUTrustInfo:
+			decision, err = newTOFUTrustDecision(trustInfo)
+		default:
+			err = fmt.Errorf("unsupported trust info of mode %s", result.Mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		response.Decisions = append(response.Decisions, decision)
+	}
+	return response, nil
+}
+
+// add the TLSA records of a service (used by VerifyDANE until they expire)
+func AddTLSARecords(request *AddTLSARecordsRequest) error {
+	var recordSet cache_v2.TLSARecordSet
+	if err := json.Unmarshal(request.RecordSetJSON, &recordSet); err != nil {
+		return fmt.Errorf("failed to decode TLSA records: %s", err)
+	}
+	return cache_v2.AddTLSARecords(&recordSet, time.Now())
+}
+
+// add trust roots without reinitializing the caches
+func AddTrustRoots(request *AddTrustRootsRequest) (*AddTrustRootsResponse, error) {
+	certificates, err := cache_v2.ParseCertificates(request.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	return &AddTrustRootsResponse{AddedCertificateIDs: cache_v2.AddTrustRoots(certificates)}, nil
+}
+
+// remove a trust root and the certificates depending on it
+func RemoveTrustRoot(request *TrustRootRequest) (*TrustRootResponse, error) {
+	removed, err := cache_v2.RemoveTrustRoot(request.CertificateID)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustRootResponse{RemovedCertificateIDs: removed}, nil
+}
+
+// distrust a trust root and remove the certificates depending on it
+func DistrustRoot(request *TrustRootRequest) (*TrustRootResponse, error) {
+	removed, err := cache_v2.DistrustRoot(request.CertificateID)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustRootResponse{RemovedCertificateIDs: removed}, nil
+}
+
+// set the trust metadata of a trust root and remove the certificates
+// that are no longer trusted
+func SetTrustRootMetadata(request *SetTrustRootMetadataRequest) (*TrustRootResponse, error) {
+	if request.Metadata == nil {
+		return nil, fmt.Errorf("missing trust root metadata")
+	}
+	removed, err := cache_v2.SetTrustRootMetadata(request.CertificateID, request.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustRootResponse{RemovedCertificateIDs: removed}, nil
+}
+
+// verify the signed root of a map server and pin it if its epoch is newer
+// than the pinned epoch. fails if the epoch is older than the pinned epoch
+func PinTreeHead(request *PinTreeHeadRequest) error {
+	var treeHead cache_v2.MapServerTreeHead
+	if err := json.Unmarshal(request.TreeHeadJSON, &treeHead); err != nil {
+		return fmt.Errorf("failed to decode map server tree head: %s", err)
+	}
+	return cache_v2.PinTreeHead(request.MapserverID, &treeHead)
+}
+
+// encode all tree head pins as JSON
+func ExportTreeHeadPins() (string, error) {
+	pinsJSON, err := cache_v2.ExportTreeHeadPins()
+	if err != nil {
+		return "", err
+	}
+	return string(pinsJSON), nil
+}
+
+// replace all tree head pins by the exported pins
+func ImportTreeHeadPins(request *ImportTreeHeadPinsRequest) (*ImportTreeHeadPinsResponse, error) {
+	nPins, err := cache_v2.ImportTreeHeadPins(request.PinsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &ImportTreeHeadPinsResponse{NPins: nPins}, nil
+}
+
+// encode all TOFU pins as JSON
+func ExportTOFUPins() (string, error) {
+	pinsJSON, err := cache_v2.ExportTOFUPins()
+	if err != nil {
+		return "", err
+	}
+	return string(pinsJSON), nil
+}
+
+// replace all TOFU pins by the exported pins
+func ImportTOFUPins(request *ImportTOFUPinsRequest) (*ImportTOFUPinsResponse, error) {
+	nPins, err := cache_v2.ImportTOFUPins(request.PinsJSON, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &ImportTOFUPinsResponse{NPins: nPins}, nil
+}
+
+// parse a list of DER encoded certificates
+func parseCertificateChain(certificateChainDER [][]byte) ([]*x509.Certificate, error) {
+	certificateChain := make([]*x509.Certificate, len(certificateChainDER))
+	for i, certificateDER := range certificateChainDER {
+		certificateParsed, err := x509.ParseCertificate(certificateDER)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %s", err)
+		}
+		certificateChain[i] = certificateParsed
+	}
+	return certificateChain, nil
+}
@@ -0,0 +1,304 @@
+package bridge
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"math/rand"
+	"os"
+	"testing"
+
+	"go_wasm/cache_v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// directories within cache_v2/embedded
+const TEST_TRUST_STORE_DIR = "embedded/unit_test/cache/root_certificates"
+const TEST_CONFIG = "../cache_v2/embedded/unit_test/validation/config_explanation.json"
+
+// initialize the caches with the unit test root certificate and config
+func initializeTest(t *testing.T) {
+	configJSON, err := os.ReadFile(TEST_CONFIG)
+	require.NoError(t, err)
+	response, err := Initialize(&InitializeRequest{
+		TrustStoreDir: TEST_TRUST_STORE_DIR,
+		// contains no policy certificates
+		PolicyTrustStoreDir: TEST_TRUST_STORE_DIR,
+		ConfigJSON:          configJSON,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, response.NCertificates)
+	require.Equal(t, 0, response.NPolicies)
+}
+
+// create a leaf certificate for dnsName issued by the unit test root
+func createTestChain(t *testing.T, dnsName string) []*x509.Certificate {
+	pemBytes, err := os.ReadFile("../cache_v2/embedded/unit_test/cache/root_certificates/root_certificate.pem")
+	require.NoError(t, err)
+	pemBlock, _ := pem.Decode(pemBytes)
+	root, err := x509.ParseCertificate(pemBlock.Bytes)
+	require.NoError(t, err)
+	pemBytes, err = os.ReadFile("../cache_v2/embedded/unit_test/cache/root_privatekeys/root_privatekey.pem")
+	require.NoError(t, err)
+	pemBlock, _ = pem.Decode(pemBytes)
+	var rootKey *rsa.PrivateKey
+	rootKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	require.NoError(t, err)
+
+	template, err := cache_v2.CreateCertificateTemplate(big.NewInt(int64(2)), []string{dnsName}, 1, 1, 1, 1, false, root, x509.SHA256WithRSA)
+	require.NoError(t, err)
+	privateKey, err := cache_v2.CreateAndStoreRSAPrivateKey(rand.New(rand.NewSource(int64(2))))
+	require.NoError(t, err)
+	pemBytes, err = cache_v2.CreateCertificate(template, privateKey.Public(), root, rootKey, rand.New(rand.NewSource(int64(0))))
+	require.NoError(t, err)
+	pemBlock, _ = pem.Decode(pemBytes)
+	leaf, err := x509.ParseCertificate(pemBlock.Bytes)
+	require.NoError(t, err)
+	return []*x509.Certificate{leaf, root}
+}
+
+// encode a certificate chain as sent by JS
+func encodeTestChain(t *testing.T, certificateChain []*x509.Certificate) []byte {
+	request := verifyRequestJSON{}
+	for _, certificate := range certificateChain {
+		request.ConnectionCertificateChainb64 = append(request.ConnectionCertificateChainb64, base64.StdEncoding.EncodeToString(certificate.Raw))
+	}
+	data, err := json.Marshal(request)
+	require.NoError(t, err)
+	return data
+}
+
+// check that invalid inputs are reported instead of being ignored
+func TestDecodeInvalidInput(t *testing.T) {
+	_, err := DecodeVerifyRequest("leaf1", []byte("{"))
+	require.Error(t, err)
+	_, err = DecodeAddMissingPayloadsRequest([]byte("[]"))
+	require.Error(t, err)
+	_, err = DecodeVerifyAndGetMissingIDsRequest("local-mapserver", []byte("{}"))
+	require.Error(t, err)
+	_, err = DecodeVerifyBatchAndGetMissingIDsRequest("local-mapserver", []byte("[]"))
+	require.Error(t, err)
+	_, err = DecodeVerifyBatchAndGetMissingIDsRequest("local-mapserver", []byte("null"))
+	require.Error(t, err)
+	_, err = DecodeVerifyPrefixAndGetMissingIDsRequest("local-mapserver", []byte("null"))
+	require.Error(t, err)
+	require.Error(t, PinTreeHead(&PinTreeHeadRequest{MapserverID: "local-mapserver", TreeHeadJSON: []byte("not json")}))
+	_, err = ImportTreeHeadPins(&ImportTreeHeadPinsRequest{PinsJSON: []byte(`[null]`)})
+	require.Error(t, err)
+	_, err = DecodeVerifyPrefixAndGetMissingIDsRequest("local-mapserver", []byte(`{"DomainNames": ["a.com"], "Responses": [null]}`))
+	require.Error(t, err)
+	_, err = Initialize(&InitializeRequest{TrustStoreDir: TEST_TRUST_STORE_DIR, ConfigJSON: []byte("not json")})
+	require.Error(t, err)
+
+	_, err = DecodeVerifyRequest("leaf1", []byte(`{"ConnectionCertificateChainb64": ["not base64!"]}`))
+	require.Error(t, err)
+	request, err := DecodeVerifyRequest("leaf1", []byte(`{"ConnectionCertificateChainb64": ["bm90IGEgY2VydGlmaWNhdGU="]}`))
+	require.NoError(t, err)
+	_, err = VerifyLegacy(request)
+	require.Error(t, err)
+}
+
+// check the legacy validation through the bridge
+func TestVerifyLegacy(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+
+	request, err := DecodeVerifyRequest("leaf1", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	decision, err := VerifyLegacy(request)
+	require.NoError(t, err)
+	require.Equal(t, "leaf1", decision.DNSName)
+	require.Equal(t, cache_v2.SUCCESS, decision.EvaluationResult)
+	require.Equal(t, 1, decision.ConnectionTrustLevel)
+	require.Equal(t, "Test Root", decision.ConnectionTrustLevelCASet)
+
+	var explanation cache_v2.ValidationExplanation
+	require.NoError(t, json.Unmarshal([]byte(decision.ExplanationJSON), &explanation))
+	require.Equal(t, cache_v2.LEGACY_MODE, explanation.Mode)
+}
+
+// check the policy validation through the bridge
+func TestVerifyPolicy(t *testing.T) {
+	initializeTest(t)
+	// the policy validation needs a domain with a registrable E2LD
+	certificateChain := createTestChain(t, "www.example.com")
+
+	request, err := DecodeVerifyRequest("www.example.com", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	decision, err := VerifyPolicy(request)
+	require.NoError(t, err)
+	require.Equal(t, cache_v2.SUCCESS, decision.EvaluationResult)
+	require.Empty(t, decision.PolicyChain)
+	require.Empty(t, decision.ConflictingPolicies)
+}
+
+// check that the combined verdict contains the decisions of the modes that were run
+func TestVerify(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+
+	request, err := DecodeVerifyRequest("leaf1", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	verdict, err := Verify(request, 443)
+	require.NoError(t, err)
+	require.Equal(t, cache_v2.SUCCESS, verdict.EvaluationResult)
+	require.Equal(t, cache_v2.VERDICT_POLICY_OVERRIDES_LEGACY, verdict.Precedence)
+	require.Equal(t, []string{cache_v2.LEGACY_MODE}, verdict.DecidingModes)
+	require.Len(t, verdict.Decisions, 3)
+	legacyTrustDecision, ok := verdict.Decisions[2].(*LegacyTrustDecision)
+	require.True(t, ok)
+	require.Equal(t, "Test Root", legacyTrustDecision.ConnectionTrustLevelCASet)
+
+	var results []*cache_v2.ModeResult
+	require.NoError(t, json.Unmarshal([]byte(verdict.ResultsJSON), &results))
+	require.Len(t, results, 3)
+	require.Equal(t, cache_v2.SPKI_PINNING_MODE, results[0].Mode)
+	require.False(t, results[0].Applicable)
+}
+
+// check that the TOFU decision is part of the verdict if tofu-pinning is set
+func TestVerifyTOFU(t *testing.T) {
+	initializeTest(t)
+	configJSON, err := os.ReadFile(TEST_CONFIG)
+	require.NoError(t, err)
+	var config map[string]any
+	require.NoError(t, json.Unmarshal(configJSON, &config))
+	config["tofu-pinning"] = true
+	configJSON, err = json.Marshal(config)
+	require.NoError(t, err)
+	_, err = UpdateConfig(&UpdateConfigRequest{ConfigJSON: configJSON})
+	require.NoError(t, err)
+	_, err = ImportTOFUPins(&ImportTOFUPinsRequest{PinsJSON: []byte("[]")})
+	require.NoError(t, err)
+	t.Cleanup(func() { cache_v2.RemoveTOFUPin("tofu.test") })
+
+	request, err := DecodeVerifyRequest("tofu.test", encodeTestChain(t, createTestChain(t, "tofu.test")))
+	require.NoError(t, err)
+	verdict, err := Verify(request, 443)
+	require.NoError(t, err)
+	require.Equal(t, cache_v2.SUCCESS, verdict.EvaluationResult)
+	require.Contains(t, verdict.DecidingModes, cache_v2.TOFU_MODE)
+	tofuTrustDecision, ok := verdict.Decisions[len(verdict.Decisions)-1].(*TOFUTrustDecision)
+	require.True(t, ok)
+	require.Equal(t, cache_v2.TOFU_PINNED, tofuTrustDecision.Status)
+	require.Contains(t, tofuTrustDecision.ExplanationJSON, `"mode":"tofu"`)
+}
+
+// check that TLSA records in the format sent by JS are used by the DANE validation
+func TestVerifyDANE(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "dane.test")
+	rootSPKIHash := sha256.Sum256(certificateChain[1].RawSubjectPublicKeyInfo)
+
+	require.NoError(t, AddTLSARecords(&AddTLSARecordsRequest{RecordSetJSON: []byte(`{
+		"name": "_8443._tcp.dane.test", "ttl": 300, "authenticatedData": true,
+		"records": [{"usage": 2, "selector": 1, "matchingType": 1, "data": "` + hex.EncodeToString(rootSPKIHash[:]) + `"}]
+	}`)}))
+	require.Error(t, AddTLSARecords(&AddTLSARecordsRequest{RecordSetJSON: []byte(`{"records": []}`)}))
+
+	request, err := DecodeVerifyRequest("dane.test", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	decision, err := VerifyDANE(request, 8443)
+	require.NoError(t, err)
+	require.Equal(t, cache_v2.SUCCESS, decision.EvaluationResult)
+	require.Equal(t, "_8443._tcp.dane.test", decision.TLSAName)
+	require.Equal(t, cache_v2.DNSSEC_RESOLVER_VALIDATED, decision.DNSSECStatus)
+	require.True(t, decision.Applicable)
+	require.Equal(t, 1, decision.MatchedChainIndex)
+
+	decision, err = VerifyDANE(request, 443)
+	require.NoError(t, err)
+	require.False(t, decision.Applicable)
+}
+
+// check that payloads decoded from the JS wire format are added to the cache
+func TestAddMissingPayloads(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+	leafHash := cache_v2.GetRawCertificateHash(certificateChain[0])
+
+	data, err := json.Marshal(map[string][]string{
+		"certificateIDs": {leafHash},
+		"policyIDs":      {},
+		"payloads":       {base64.StdEncoding.EncodeToString(certificateChain[0].Raw)},
+	})
+	require.NoError(t, err)
+	request, err := DecodeAddMissingPayloadsRequest(data)
+	require.NoError(t, err)
+	require.Equal(t, []string{leafHash}, request.CertificateIDs)
+
+	response, err := AddMissingPayloads(request)
+	require.NoError(t, err)
+	require.Equal(t, []string{leafHash}, response.ProcessedCertificateIDs)
+	require.Empty(t, response.ProcessedPolicyIDs)
+}
+
+// check that an empty map server response is handled
+func TestVerifyAndGetMissingIDs(t *testing.T) {
+	initializeTest(t)
+	request, err := DecodeVerifyAndGetMissingIDsRequest("local-mapserver", []byte("[]"))
+	require.NoError(t, err)
+	response := VerifyAndGetMissingIDs(request)
+	require.Empty(t, response.VerificationResults)
+	require.Empty(t, response.CertificateIDs)
+	require.Empty(t, response.PolicyIDs)
+}
+
+// check the trust store management through the bridge
+func TestTrustRoots(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+	rootHash := cache_v2.GetRawCertificateHash(certificateChain[1])
+	leafHash := cache_v2.GetRawCertificateHash(certificateChain[0])
+	// NOTE: the WASM build overrides the validity period of payloads (see cache_v2.SetPayloadNotAfterOverride)
+	require.Equal(t, []string{leafHash}, cache_v2.AddCertificatesToCache(certificateChain[:1]))
+
+	response, err := RemoveTrustRoot(&TrustRootRequest{CertificateID: rootHash})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{rootHash, leafHash}, response.RemovedCertificateIDs)
+	_, err = RemoveTrustRoot(&TrustRootRequest{CertificateID: rootHash})
+	require.Error(t, err)
+
+	require.Empty(t, cache_v2.GetCachedCertificatesForDomain("leaf1"))
+
+	_, err = AddTrustRoots(&AddTrustRootsRequest{Certificates: []byte("not a certificate")})
+	require.Error(t, err)
+	addResponse, err := AddTrustRoots(&AddTrustRootsRequest{Certificates: cache_v2.EncodePEM(certificateChain[1].Raw, cache_v2.CERTIFICATE)})
+	require.NoError(t, err)
+	require.Equal(t, []string{rootHash}, addResponse.AddedCertificateIDs)
+}
+
+// check that a config update changes the trust preferences but keeps the cached certificates
+func TestUpdateConfig(t *testing.T) {
+	initializeTest(t)
+	certificateChain := createTestChain(t, "leaf1")
+	cache_v2.AddCertificatesToCache(certificateChain[:1])
+
+	configJSON, err := os.ReadFile(TEST_CONFIG)
+	require.NoError(t, err)
+	var config map[string]any
+	require.NoError(t, json.Unmarshal(configJSON, &config))
+	config["trust-levels"].(map[string]any)["Low Trust"] = 3
+	configJSON, err = json.Marshal(config)
+	require.NoError(t, err)
+
+	update, err := UpdateConfig(&UpdateConfigRequest{ConfigJSON: configJSON})
+	require.NoError(t, err)
+	require.True(t, update.LegacyTrustPreferencesChanged)
+	require.Len(t, cache_v2.GetCachedCertificatesForDomain("leaf1"), 1)
+
+	request, err := DecodeVerifyRequest("leaf1", encodeTestChain(t, certificateChain))
+	require.NoError(t, err)
+	decision, err := VerifyLegacy(request)
+	require.NoError(t, err)
+	require.Equal(t, 3, decision.ConnectionTrustLevel)
+
+	_, err = UpdateConfig(&UpdateConfigRequest{ConfigJSON: []byte(`{"trust-levels": {"Low Trust": "high"}}`)})
+	require.ErrorContains(t, err, `trust-levels["Low Trust"]: expected a number`)
+}
@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"go_wasm/cache_v2"
+)
+
+// wire format of the certificate chain sent by JS
+type verifyRequestJSON struct {
+	ConnectionCertificateChainb64 []string
+}
+
+// decode the JSON or binary encoded getproof responses sent by JS
+func DecodeVerifyAndGetMissingIDsRequest(mapserverID string, data []byte) (*VerifyAndGetMissingIDsRequest, error) {
+	request := &VerifyAndGetMissingIDsRequest{MapserverID: mapserverID}
+	if isBinaryEncoded(data) {
+		responses, err := decodeBinaryMapServerResponses(data)
+		if err != nil {
+			return nil, err
+		}
+		request.Responses = responses
+		return request, nil
+	}
+	if err := json.Unmarshal(data, &request.Responses); err != nil {
+		return nil, fmt.Errorf("failed to decode map server responses: %s", err)
+	}
+	return request, nil
+}
+
+// decode the JSON encoded getproofs response sent by JS
+func DecodeVerifyBatchAndGetMissingIDsRequest(mapserverID string, data []byte) (*VerifyBatchAndGetMissingIDsRequest, error) {
+	request := &VerifyBatchAndGetMissingIDsRequest{MapserverID: mapserverID}
+	if err := json.Unmarshal(data, &request.Batch); err != nil {
+		return nil, fmt.Errorf("failed to decode map server batch response: %s", err)
+	}
+	if request.Batch == nil {
+		return nil, fmt.Errorf("failed to decode map server batch response: null")
+	}
+	return request, nil
+}
+
+// decode the JSON encoded prefix responses and the domains whose proofs are
+// derived from them ({"DomainNames": [...], "Responses": [...]}) sent by JS
+func DecodeVerifyPrefixAndGetMissingIDsRequest(mapserverID string, data []byte) (*VerifyPrefixAndGetMissingIDsRequest, error) {
+	request := &VerifyPrefixAndGetMissingIDsRequest{}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to decode map server prefix responses: %s", err)
+	}
+	if request == nil {
+		return nil, fmt.Errorf("failed to decode map server prefix responses: null")
+	}
+	for _, response := range request.Responses {
+		if response == nil {
+			return nil, fmt.Errorf("failed to decode map server prefix responses: null response")
+		}
+	}
+	request.MapserverID = mapserverID
+	return request, nil
+}
+
+// decode the JSON or binary encoded getpayloads response sent by JS
+func DecodeAddMissingPayloadsRequest(data []byte) (*AddMissingPayloadsRequest, error) {
+	if isBinaryEncoded(data) {
+		return decodeBinaryAddMissingPayloadsRequest(data)
+	}
+	var response cache_v2.MapServerMissingPayloadsResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode map server payloads: %s", err)
+	}
+	request := &AddMissingPayloadsRequest{
+		CertificateIDs: response.CertificateIDs,
+		PolicyIDs:      response.PolicyIDs,
+		Payloads:       make([][]byte, len(response.Payloads)),
+	}
+	for i, b64payload := range response.Payloads {
+		payload, err := base64.StdEncoding.DecodeString(b64payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %s", err)
+		}
+		request.Payloads[i] = payload
+	}
+	return request, nil
+}
+
+// decode the JSON or binary encoded connection certificate chain sent by JS
+func DecodeVerifyRequest(dnsName string, data []byte) (*VerifyRequest, error) {
+	if isBinaryEncoded(data) {
+		return decodeBinaryVerifyRequest(dnsName, data)
+	}
+	var requestJSON verifyRequestJSON
+	if err := json.Unmarshal(data, &requestJSON); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate chain: %s", err)
+	}
+	request := &VerifyRequest{
+		DNSName:                    dnsName,
+		ConnectionCertificateChain: make([][]byte, len(requestJSON.ConnectionCertificateChainb64)),
+	}
+	for i, certificateb64 := range requestJSON.ConnectionCertificateChainb64 {
+		certificate, err := base64.StdEncoding.DecodeString(certificateb64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode certificate: %s", err)
+		}
+		request.ConnectionCertificateChain[i] = certificate
+	}
+	return request, nil
+}
+
+// decode the JSON encoded trust metadata of a trust root sent by JS
+func DecodeSetTrustRootMetadataRequest(certificateID string, data []byte) (*SetTrustRootMetadataRequest, error) {
+	request := &SetTrustRootMetadataRequest{CertificateID: certificateID}
+	if err := json.Unmarshal(data, &request.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode trust root metadata: %s", err)
+	}
+	return request, nil
+}
+
+// encode the result of a cache introspection query as JSON string
+func EncodeJSON(result any) (string, error) {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(resultJSON), nil
+}
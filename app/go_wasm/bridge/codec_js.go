@@ -0,0 +1,866 @@
+//go:build js && wasm
+
+package bridge
+
+import (
+	"fmt"
+	"syscall/js"
+	"time"
+
+	"go_wasm/cache_v2"
+)
+
+// "publish" the functions in JavaScript
+func Register() {
+	// NOTE: most certificates stored at the map server are expired, so their
+	// validity period is extended for testing (see README.md)
+	cache_v2.SetPayloadNotAfterOverride(time.Date(2024, 8, 30, 12, 0, 0, 0, time.UTC))
+
+	js.Global().Set("initializeGODatastructures", initializeGODatastructuresWrapper())
+	js.Global().Set("updateConfig", updateConfigWrapper())
+	js.Global().Set("verifyAndGetMissingIDs", verifyAndGetMissingIDsWrapper())
+	js.Global().Set("verifyBatchAndGetMissingIDs", verifyBatchAndGetMissingIDsWrapper())
+	js.Global().Set("verifyPrefixAndGetMissingIDs", verifyPrefixAndGetMissingIDsWrapper())
+	js.Global().Set("addMissingPayloads", addMissingPayloadsWrapper())
+	js.Global().Set("verifyLegacy", verifyLegacyWrapper())
+	js.Global().Set("verifyPolicy", verifyPolicyWrapper())
+	js.Global().Set("verifySPKIPins", verifySPKIPinsWrapper())
+	js.Global().Set("verifyDANE", verifyDANEWrapper())
+	js.Global().Set("verify", verifyWrapper())
+
+	// asynchronous variants returning Promises (see asyncOptions)
+	js.Global().Set("verifyAndGetMissingIDsAsync", verifyAndGetMissingIDsAsyncWrapper())
+	js.Global().Set("verifyBatchAndGetMissingIDsAsync", verifyBatchAndGetMissingIDsAsyncWrapper())
+	js.Global().Set("verifyPrefixAndGetMissingIDsAsync", verifyPrefixAndGetMissingIDsAsyncWrapper())
+	js.Global().Set("addMissingPayloadsAsync", addMissingPayloadsAsyncWrapper())
+	js.Global().Set("verifyLegacyAsync", verifyLegacyAsyncWrapper())
+	js.Global().Set("verifyPolicyAsync", verifyPolicyAsyncWrapper())
+	js.Global().Set("verifySPKIPinsAsync", verifySPKIPinsAsyncWrapper())
+	js.Global().Set("verifyDANEAsync", verifyDANEAsyncWrapper())
+	js.Global().Set("verifyAsync", verifyAsyncWrapper())
+	js.Global().Set("cancelGoRequest", cancelGoRequestWrapper())
+
+	// runtime trust store management
+	js.Global().Set("addTrustRoots", addTrustRootsWrapper())
+	js.Global().Set("removeTrustRoot", trustRootWrapper(RemoveTrustRoot))
+	js.Global().Set("distrustRoot", trustRootWrapper(DistrustRoot))
+	js.Global().Set("setTrustRootMetadata", setTrustRootMetadataWrapper())
+
+	// trust-on-first-use pins (persisted by JS)
+	js.Global().Set("exportTOFUPins", exportTOFUPinsWrapper())
+	js.Global().Set("importTOFUPins", importTOFUPinsWrapper())
+	js.Global().Set("removeTOFUPin", removeTOFUPinWrapper())
+
+	// map server roots (fetched and persisted by JS)
+	js.Global().Set("pinTreeHead", pinTreeHeadWrapper())
+	js.Global().Set("exportTreeHeadPins", exportTreeHeadPinsWrapper())
+	js.Global().Set("importTreeHeadPins", importTreeHeadPinsWrapper())
+
+	// TLSA records for DANE validation (fetched by JS)
+	js.Global().Set("addTLSARecords", addTLSARecordsWrapper())
+
+	// cache introspection (e.g., for the debug page and tests)
+	js.Global().Set("getCachedCertificates", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetCachedCertificatesForDomain(args[0].String())
+	}))
+	js.Global().Set("getCachedPolicies", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetCachedPoliciesForDomain(args[0].String())
+	}))
+	js.Global().Set("getCertificateChains", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetCertificateChainsWithTrustLevels(args[0].String())
+	}))
+	js.Global().Set("getIgnoreReason", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetIgnoreReason(args[0].String())
+	}))
+	js.Global().Set("getVerifiedProofs", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetVerifiedProofsByMapserver()
+	}))
+	js.Global().Set("getCacheStatistics", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetCacheStatistics()
+	}))
+	js.Global().Set("getTrustRoots", introspectionWrapper(func(args []js.Value) any {
+		return cache_v2.GetTrustRoots()
+	}))
+}
+
+// error reported by synchronous functions if an asynchronous request is running
+var errCacheBusy = fmt.Errorf("the Go cache is busy with an asynchronous request, use the asynchronous functions instead")
+
+// convert an error into a JS Error object.
+// synchronous functions return errors instead of panicking, since a panic in
+// a js.FuncOf callback stops the Go program (and thereby all later calls).
+// JS checks the results with checkGoResult (js_lib/helper.js)
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
+
+// create a synchronous JS function running f. an error returned by f (or a
+// panic of f) is returned to JS as an Error object
+func syncFuncOf(f func(args []js.Value) (any, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result any) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = jsError(fmt.Errorf("%v", r))
+			}
+		}()
+		value, err := f(args)
+		if err != nil {
+			return jsError(err)
+		}
+		return value
+	})
+}
+
+// same as syncFuncOf, but f is run while holding the cache lock.
+// synchronous functions must not wait for the lock, as this would block
+// the JS event loop and thereby the asynchronous request holding it, so
+// errCacheBusy is returned if the lock is held
+func lockedSyncFuncOf(f func(args []js.Value) (any, error)) js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		if !TryLockCache() {
+			return nil, errCacheBusy
+		}
+		defer UnlockCache()
+		return f(args)
+	})
+}
+
+// copy a JS Uint8Array into a buffer sized from the input length
+func copyBytesFromJS(value js.Value, length int) []byte {
+	buffer := make([]byte, length)
+	js.CopyBytesToGo(buffer, value)
+	return buffer
+}
+
+// convert a LegacyTrustDecision into a JS object of type LegacyTrustDecisionGo
+func (d *LegacyTrustDecision) toJSValue() js.Value {
+	legacyTrustDecisionClass := js.Global().Get("LegacyTrustDecisionGo")
+	return legacyTrustDecisionClass.New(d.DNSName, d.ConnectionTrustLevel,
+		d.ConnectionTrustLevelCASet, d.ConnectionTrustLevelChainIndex,
+		d.EvaluationResult, d.HighestTrustLevel,
+		cache_v2.TransformListToInterfaceType(d.HighestTrustLevelCASets),
+		cache_v2.TransformListToInterfaceType(d.HighestTrustLevelChainIndices),
+		cache_v2.TransformNestedListsToInterfaceType(d.HighestTrustLevelChainHashes),
+		cache_v2.TransformNestedListsToInterfaceType(d.HighestTrustLevelChainSubjects),
+		d.MaxValidity, d.ExplanationJSON)
+}
+
+// convert a PolicyTrustDecision into a JS object of type PolicyTrustDecisionGo
+func (d *PolicyTrustDecision) toJSValue() js.Value {
+	policyTrustDecisionClass := js.Global().Get("PolicyTrustDecisionGo")
+	return policyTrustDecisionClass.New(d.DNSName, d.EvaluationResult,
+		cache_v2.TransformListToInterfaceType(d.PolicyChain),
+		cache_v2.TransformListToInterfaceType(d.ConflictingPolicies),
+		d.MaxValidity, d.DomainExcluded, d.ExplanationJSON)
+}
+
+// convert a SPKIPinTrustDecision into a JS object of type SPKIPinTrustDecisionGo
+func (d *SPKIPinTrustDecision) toJSValue() js.Value {
+	spkiPinTrustDecisionClass := js.Global().Get("SPKIPinTrustDecisionGo")
+	return spkiPinTrustDecisionClass.New(d.DNSName, d.EvaluationResult,
+		d.PinDomain, d.Mode, d.Violation, d.MatchedChainIndex,
+		d.MaxValidity, d.ExplanationJSON)
+}
+
+// convert a DANETrustDecision into a JS object of type DANETrustDecisionGo
+func (d *DANETrustDecision) toJSValue() js.Value {
+	daneTrustDecisionClass := js.Global().Get("DANETrustDecisionGo")
+	return daneTrustDecisionClass.New(d.DNSName, d.EvaluationResult,
+		d.TLSAName, d.DNSSECStatus, d.Applicable, d.MatchedRecordIndex,
+		d.MatchedChainIndex, d.MaxValidity, d.ExplanationJSON)
+}
+
+// convert a TOFUTrustDecision into a JS object of type TOFUTrustDecisionGo
+func (d *TOFUTrustDecision) toJSValue() js.Value {
+	tofuTrustDecisionClass := js.Global().Get("TOFUTrustDecisionGo")
+	return tofuTrustDecisionClass.New(d.DNSName, d.EvaluationResult, d.Status,
+		d.MaxValidity, d.ExplanationJSON)
+}
+
+// convert a Verdict into a JS object of type VerdictGo
+// (the decisions of the individual modes are converted into their JS types)
+func (v *Verdict) toJSValue() js.Value {
+	decisions := make([]any, len(v.Decisions))
+	for i, decision := range v.Decisions {
+		decisions[i] = decision.(interface{ toJSValue() js.Value }).toJSValue()
+	}
+	verdictClass := js.Global().Get("VerdictGo")
+	return verdictClass.New(v.DNSName, v.EvaluationResult, v.Precedence,
+		cache_v2.TransformListToInterfaceType(v.DecidingModes), decisions,
+		v.MaxValidity, v.ResultsJSON)
+}
+
+// convert a VerifyAndGetMissingIDsResponse into a JS object of type VerifyAndGetMissingIDsResponseGo
+func (r *VerifyAndGetMissingIDsResponse) toJSValue() js.Value {
+	responseClass := js.Global().Get("VerifyAndGetMissingIDsResponseGo")
+	return responseClass.New(cache_v2.TransformListToInterfaceType(r.VerificationResults),
+		cache_v2.TransformListToInterfaceType(r.CertificateIDs),
+		cache_v2.TransformListToInterfaceType(r.PolicyIDs))
+}
+
+// convert an AddMissingPayloadsResponse into a JS object of type AddMissingPayloadsResponseGo
+func (r *AddMissingPayloadsResponse) toJSValue() js.Value {
+	responseClass := js.Global().Get("AddMissingPayloadsResponseGo")
+	return responseClass.New(cache_v2.TransformListToInterfaceType(r.ProcessedCertificateIDs),
+		cache_v2.TransformListToInterfaceType(r.ProcessedPolicyIDs))
+}
+
+// initialize all the Go data structures
+// param 1: path to directory containing trust store certificates
+// param 2: path to directory containing trust store policy certificates
+// param 3: JSON encoded config
+// Note: directories must be within cache_v2/embedded
+func initializeGODatastructuresWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		response, err := Initialize(&InitializeRequest{
+			TrustStoreDir:       args[0].String(),
+			PolicyTrustStoreDir: args[1].String(),
+			ConfigJSON:          []byte(args[2].String()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{response.NCertificates, response.NPolicies}, nil
+	})
+}
+
+// wrapper to make UpdateConfig visible from JavaScript
+// param 1: JSON encoded config
+// returns: the JSON encoded summary of the applied changes (cache_v2.ConfigUpdate)
+func updateConfigWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		update, err := UpdateConfig(&UpdateConfigRequest{ConfigJSON: []byte(args[0].String())})
+		if err != nil {
+			return nil, err
+		}
+		updateJSON, err := EncodeJSON(update)
+		if err != nil {
+			return nil, err
+		}
+		return updateJSON, nil
+	})
+}
+
+// wrapper to make addMissingPayloads visible from JavaScript
+// param 1: JSON or binary encoded map server response containing the certificates and policies
+// param 2: length of response in bytes
+// returns: an object containing a list of hashes of all certificates and policies provided as input
+func addMissingPayloadsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeAddMissingPayloadsRequest(copyBytesFromJS(args[0], args[1].Int()))
+		if err != nil {
+			return nil, err
+		}
+		response, err := AddMissingPayloads(request)
+		if err != nil {
+			return nil, err
+		}
+		return response.toJSValue(), nil
+	})
+}
+
+// wrapper to make verifyAndGetMissingIDs visible from JavaScript
+// param 1: map server identity
+// param 2: JSON or binary encoded map server responses
+// param 3: length of the map server responses in bytes
+// returns: an object consisting of the MHT proof verification results, a list of hashes of all missing certificates, and a list of hashes of all missing policies
+func verifyAndGetMissingIDsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyAndGetMissingIDsRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		return VerifyAndGetMissingIDs(request).toJSValue(), nil
+	})
+}
+
+// wrapper to make verifyBatchAndGetMissingIDs visible from JavaScript
+// param 1: map server identity
+// param 2: JSON encoded response of the map server's getproofs endpoint
+// param 3: length of the response in bytes
+// returns: same as verifyAndGetMissingIDs (one MHT proof verification result per response of the batch)
+func verifyBatchAndGetMissingIDsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyBatchAndGetMissingIDsRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		return VerifyBatchAndGetMissingIDs(request).toJSValue(), nil
+	})
+}
+
+// wrapper to make verifyPrefixAndGetMissingIDs visible from JavaScript
+// param 1: map server identity
+// param 2: JSON encoded domain names and responses of the map server's prefix endpoint
+// ({"DomainNames": [...], "Responses": [...]})
+// param 3: length of the request in bytes
+// returns: same as verifyAndGetMissingIDs (one MHT proof verification result per domain name)
+func verifyPrefixAndGetMissingIDsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyPrefixAndGetMissingIDsRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		return VerifyPrefixAndGetMissingIDs(request).toJSValue(), nil
+	})
+}
+
+// wrapper to make VerifyLegacy visible from JavaScript
+// param 1: the dns name the client connects to
+// param 2: JSON or binary encoded certificate chain received in the
+// connection attempt
+// param 3: length of the encoded certificate chain in bytes
+// this function returns a JavaScript object that is cached on the JS side
+func verifyLegacyWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		decision, err := VerifyLegacy(request)
+		if err != nil {
+			return nil, err
+		}
+		return decision.toJSValue(), nil
+	})
+}
+
+// wrapper to make VerifyPolicy visible from JavaScript
+// param 1: the dns name the client connects to
+// param 2: JSON or binary encoded certificate chain received in the
+// connection attempt
+// param 3: length of the encoded certificate chain in bytes
+// this function returns a JavaScript object that is cached on the JS side
+func verifyPolicyWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		decision, err := VerifyPolicy(request)
+		if err != nil {
+			return nil, err
+		}
+		return decision.toJSValue(), nil
+	})
+}
+
+// wrapper to make VerifySPKIPins visible from JavaScript
+// param 1: the dns name the client connects to
+// param 2: JSON or binary encoded certificate chain received in the
+// connection attempt
+// param 3: length of the encoded certificate chain in bytes
+// returns: a SPKIPinTrustDecisionGo object
+func verifySPKIPinsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		decision, err := VerifySPKIPins(request)
+		if err != nil {
+			return nil, err
+		}
+		return decision.toJSValue(), nil
+	})
+}
+
+// wrapper to make VerifyDANE visible from JavaScript
+// param 1: the dns name the client connects to
+// param 2: JSON or binary encoded certificate chain received in the
+// connection attempt
+// param 3: length of the encoded certificate chain in bytes
+// param 4: the port the client connects to
+// returns: a DANETrustDecisionGo object
+func verifyDANEWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		decision, err := VerifyDANE(request, args[3].Int())
+		if err != nil {
+			return nil, err
+		}
+		return decision.toJSValue(), nil
+	})
+}
+
+// wrapper to make Verify visible from JavaScript
+// param 1-4: see verifyDANEWrapper
+// returns: a VerdictGo object
+func verifyWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeVerifyRequest(args[0].String(), copyBytesFromJS(args[1], args[2].Int()))
+		if err != nil {
+			return nil, err
+		}
+		verdict, err := Verify(request, args[3].Int())
+		if err != nil {
+			return nil, err
+		}
+		return verdict.toJSValue(), nil
+	})
+}
+
+// wrapper to make PinTreeHead visible from JavaScript
+// param 1: map server identity
+// param 2: JSON encoded response of the map server's root endpoint
+// returns: nothing (an Error if the tree head is invalid or older than the
+// pinned tree head)
+func pinTreeHeadWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		if err := PinTreeHead(&PinTreeHeadRequest{MapserverID: args[0].String(), TreeHeadJSON: []byte(args[1].String())}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+}
+
+// wrapper to make ExportTreeHeadPins visible from JavaScript.
+// the pins have their own lock (same as the TOFU pins)
+// returns: the JSON encoded pins
+func exportTreeHeadPinsWrapper() js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		return ExportTreeHeadPins()
+	})
+}
+
+// wrapper to make ImportTreeHeadPins visible from JavaScript
+// param 1: JSON encoded pins (as returned by exportTreeHeadPins)
+// returns: the number of imported pins
+func importTreeHeadPinsWrapper() js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		response, err := ImportTreeHeadPins(&ImportTreeHeadPinsRequest{PinsJSON: []byte(args[0].String())})
+		if err != nil {
+			return nil, err
+		}
+		return response.NPins, nil
+	})
+}
+
+// wrapper to make AddTLSARecords visible from JavaScript
+// param 1: JSON encoded TLSA record set
+// returns: nothing (an Error if the record set is invalid)
+func addTLSARecordsWrapper() js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		if err := AddTLSARecords(&AddTLSARecordsRequest{RecordSetJSON: []byte(args[0].String())}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+}
+
+// wrapper to make AddTrustRoots visible from JavaScript
+// param 1: PEM encoded certificates (one or more) or a DER encoded certificate
+// param 2: length of the certificates in bytes
+// returns: a list of hashes of the added trust roots
+func addTrustRootsWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		response, err := AddTrustRoots(&AddTrustRootsRequest{Certificates: copyBytesFromJS(args[0], args[1].Int())})
+		if err != nil {
+			return nil, err
+		}
+		return cache_v2.TransformListToInterfaceType(response.AddedCertificateIDs), nil
+	})
+}
+
+// wrapper to make RemoveTrustRoot and DistrustRoot visible from JavaScript
+// param 1: base64 encoded hash of the trust root
+// returns: a list of hashes of all removed certificates
+func trustRootWrapper(f func(*TrustRootRequest) (*TrustRootResponse, error)) js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		response, err := f(&TrustRootRequest{CertificateID: args[0].String()})
+		if err != nil {
+			return nil, err
+		}
+		return cache_v2.TransformListToInterfaceType(response.RemovedCertificateIDs), nil
+	})
+}
+
+// wrapper to make SetTrustRootMetadata visible from JavaScript
+// param 1: base64 encoded hash of the trust root
+// param 2: JSON encoded trust metadata ({serverAuth, distrustAfter, permittedDNSDomains, excludedDNSDomains})
+// returns: a list of hashes of all removed certificates
+func setTrustRootMetadataWrapper() js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		request, err := DecodeSetTrustRootMetadataRequest(args[0].String(), []byte(args[1].String()))
+		if err != nil {
+			return nil, err
+		}
+		response, err := SetTrustRootMetadata(request)
+		if err != nil {
+			return nil, err
+		}
+		return cache_v2.TransformListToInterfaceType(response.RemovedCertificateIDs), nil
+	})
+}
+
+// wrapper to make ExportTOFUPins visible from JavaScript.
+// the pins have their own lock, so the TOFU functions can also be called
+// while an asynchronous request is running
+// returns: the JSON encoded pins
+func exportTOFUPinsWrapper() js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		return ExportTOFUPins()
+	})
+}
+
+// wrapper to make ImportTOFUPins visible from JavaScript
+// param 1: JSON encoded pins (as returned by exportTOFUPins)
+// returns: the number of imported pins
+func importTOFUPinsWrapper() js.Func {
+	return syncFuncOf(func(args []js.Value) (any, error) {
+		response, err := ImportTOFUPins(&ImportTOFUPinsRequest{PinsJSON: []byte(args[0].String())})
+		if err != nil {
+			return nil, err
+		}
+		return response.NPins, nil
+	})
+}
+
+// wrapper to make RemoveTOFUPin visible from JavaScript
+// param 1: domain name
+// returns: true if a pin was removed
+func removeTOFUPinWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		return cache_v2.RemoveTOFUPin(args[0].String())
+	})
+	return jsf
+}
+
+// wrapper to make a cache introspection query visible from JavaScript
+// returns: the JSON encoded query result
+func introspectionWrapper(query func(args []js.Value) any) js.Func {
+	return lockedSyncFuncOf(func(args []js.Value) (any, error) {
+		resultJSON, err := EncodeJSON(query(args))
+		if err != nil {
+			return nil, err
+		}
+		return resultJSON, nil
+	})
+}
+
+// minimum time between two yields to the JS event loop
+const yieldInterval = 20 * time.Millisecond
+
+// let the JS event loop process pending events (e.g., messages and network
+// responses). Go's WASM runtime only returns control to JS once all
+// goroutines are blocked, so a running goroutine has to sleep to yield
+func yieldToEventLoop() {
+	time.Sleep(time.Millisecond)
+}
+
+// optional last argument of the asynchronous functions:
+//
+//	{
+//	  requestKey: "...", // a running request with the same key is canceled
+//	  onProgress: (progress) => {...}, // called with {stage, done, total}
+//	}
+//
+// canceled requests are rejected with an error
+type asyncOptions struct {
+	requestKey string
+	onProgress js.Value
+}
+
+func parseAsyncOptions(args []js.Value, index int) *asyncOptions {
+	options := &asyncOptions{}
+	if len(args) <= index || args[index].Type() != js.TypeObject {
+		return options
+	}
+	if requestKey := args[index].Get("requestKey"); requestKey.Type() == js.TypeString {
+		options.requestKey = requestKey.String()
+	}
+	if onProgress := args[index].Get("onProgress"); onProgress.Type() == js.TypeFunction {
+		options.onProgress = onProgress
+	}
+	return options
+}
+
+// create a ProgressFunc that calls the JS progress callback (if any) and
+// regularly yields to the JS event loop
+func (o *asyncOptions) progressFunc() ProgressFunc {
+	lastYield := time.Now()
+	return func(progress Progress) {
+		if o.onProgress.Truthy() {
+			o.onProgress.Invoke(map[string]any{"stage": progress.Stage, "done": progress.Done, "total": progress.Total})
+		}
+		if time.Since(lastYield) >= yieldInterval {
+			yieldToEventLoop()
+			lastYield = time.Now()
+		}
+	}
+}
+
+// create a JS Promise that is settled with the result of run, which is
+// executed in a new goroutine
+func newPromise(run func() (any, error)) js.Value {
+	var executor js.Func
+	executor = js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer executor.Release()
+			defer func() {
+				if r := recover(); r != nil {
+					reject.Invoke(js.Global().Get("Error").New(fmt.Sprint(r)))
+				}
+			}()
+			// let the caller continue before starting the work
+			yieldToEventLoop()
+			result, err := run()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+// asynchronous variant of verifyAndGetMissingIDs
+// param 1-3: see verifyAndGetMissingIDsWrapper
+// param 4 (optional): asyncOptions
+// returns: a Promise resolving to a VerifyAndGetMissingIDsResponseGo object
+func verifyAndGetMissingIDsAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		mapserverID := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyAndGetMissingIDsRequest(mapserverID, data)
+			if err != nil {
+				return nil, err
+			}
+			response, err := VerifyAndGetMissingIDsContext(ctx, request, options.progressFunc())
+			if err != nil {
+				return nil, err
+			}
+			return response.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifyBatchAndGetMissingIDs
+// param 1-3: see verifyBatchAndGetMissingIDsWrapper
+// param 4 (optional): asyncOptions
+// returns: a Promise resolving to a VerifyAndGetMissingIDsResponseGo object
+func verifyBatchAndGetMissingIDsAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		mapserverID := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyBatchAndGetMissingIDsRequest(mapserverID, data)
+			if err != nil {
+				return nil, err
+			}
+			response, err := VerifyBatchAndGetMissingIDsContext(ctx, request, options.progressFunc())
+			if err != nil {
+				return nil, err
+			}
+			return response.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifyPrefixAndGetMissingIDs
+// param 1-3: see verifyPrefixAndGetMissingIDsWrapper
+// param 4 (optional): asyncOptions
+// returns: a Promise resolving to a VerifyAndGetMissingIDsResponseGo object
+func verifyPrefixAndGetMissingIDsAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		mapserverID := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyPrefixAndGetMissingIDsRequest(mapserverID, data)
+			if err != nil {
+				return nil, err
+			}
+			response, err := VerifyPrefixAndGetMissingIDsContext(ctx, request, options.progressFunc())
+			if err != nil {
+				return nil, err
+			}
+			return response.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of addMissingPayloads
+// param 1-2: see addMissingPayloadsWrapper
+// param 3 (optional): asyncOptions
+// returns: a Promise resolving to an AddMissingPayloadsResponseGo object
+func addMissingPayloadsAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		data := copyBytesFromJS(args[0], args[1].Int())
+		options := parseAsyncOptions(args, 2)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeAddMissingPayloadsRequest(data)
+			if err != nil {
+				return nil, err
+			}
+			response, err := AddMissingPayloadsContext(ctx, request, options.progressFunc())
+			if err != nil {
+				return nil, err
+			}
+			return response.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifyLegacy
+// param 1-3: see verifyLegacyWrapper
+// param 4 (optional): asyncOptions (progress is not reported)
+// returns: a Promise resolving to a LegacyTrustDecisionGo object
+func verifyLegacyAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		dnsName := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyRequest(dnsName, data)
+			if err != nil {
+				return nil, err
+			}
+			decision, err := VerifyLegacyContext(ctx, request)
+			if err != nil {
+				return nil, err
+			}
+			return decision.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifyPolicy
+// param 1-3: see verifyPolicyWrapper
+// param 4 (optional): asyncOptions (progress is not reported)
+// returns: a Promise resolving to a PolicyTrustDecisionGo object
+func verifyPolicyAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		dnsName := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyRequest(dnsName, data)
+			if err != nil {
+				return nil, err
+			}
+			decision, err := VerifyPolicyContext(ctx, request)
+			if err != nil {
+				return nil, err
+			}
+			return decision.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifySPKIPins
+// param 1-3: see verifySPKIPinsWrapper
+// param 4 (optional): asyncOptions (progress is not reported)
+// returns: a Promise resolving to a SPKIPinTrustDecisionGo object
+func verifySPKIPinsAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		dnsName := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		options := parseAsyncOptions(args, 3)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyRequest(dnsName, data)
+			if err != nil {
+				return nil, err
+			}
+			decision, err := VerifySPKIPinsContext(ctx, request)
+			if err != nil {
+				return nil, err
+			}
+			return decision.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verifyDANE
+// param 1-4: see verifyDANEWrapper
+// param 5 (optional): asyncOptions (progress is not reported)
+// returns: a Promise resolving to a DANETrustDecisionGo object
+func verifyDANEAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		dnsName := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		port := args[3].Int()
+		options := parseAsyncOptions(args, 4)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyRequest(dnsName, data)
+			if err != nil {
+				return nil, err
+			}
+			decision, err := VerifyDANEContext(ctx, request, port)
+			if err != nil {
+				return nil, err
+			}
+			return decision.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// asynchronous variant of verify
+// param 1-4: see verifyDANEWrapper
+// param 5 (optional): asyncOptions (progress is not reported)
+// returns: a Promise resolving to a VerdictGo object
+func verifyAsyncWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		dnsName := args[0].String()
+		data := copyBytesFromJS(args[1], args[2].Int())
+		port := args[3].Int()
+		options := parseAsyncOptions(args, 4)
+		ctx, done := StartRequest(options.requestKey)
+		return newPromise(func() (any, error) {
+			defer done()
+			request, err := DecodeVerifyRequest(dnsName, data)
+			if err != nil {
+				return nil, err
+			}
+			verdict, err := VerifyContext(ctx, request, port)
+			if err != nil {
+				return nil, err
+			}
+			return verdict.toJSValue(), nil
+		})
+	})
+	return jsf
+}
+
+// cancel a running asynchronous request
+// param 1: the requestKey passed to the asynchronous function
+// returns: true if a running request was canceled
+func cancelGoRequestWrapper() js.Func {
+	jsf := js.FuncOf(func(this js.Value, args []js.Value) any {
+		return CancelRequest(args[0].String())
+	})
+	return jsf
+}
@@ -0,0 +1,242 @@
+package bridge
+
+import (
+	"go_wasm/cache_v2"
+)
+
+// request to initialize all the Go data structures
+// NOTE: the trust store directories must be within cache_v2/embedded
+type InitializeRequest struct {
+	// directory containing trust store certificates
+	TrustStoreDir string
+
+	// directory containing root policy certificates
+	PolicyTrustStoreDir string
+
+	// JSON encoded config (as exported by the extension)
+	ConfigJSON []byte
+}
+
+type InitializeResponse struct {
+	NCertificates int
+	NPolicies     int
+}
+
+// config to apply without reinitializing the caches
+type UpdateConfigRequest struct {
+	// JSON encoded config (as exported by the extension)
+	ConfigJSON []byte
+}
+
+// map server responses of the getproof endpoint for a domain
+type VerifyAndGetMissingIDsRequest struct {
+	MapserverID string
+	Responses   []cache_v2.MapServerProofResponse
+}
+
+// response of the getproofs endpoint for several domains
+type VerifyBatchAndGetMissingIDsRequest struct {
+	MapserverID string
+	Batch       *cache_v2.MapServerBatchResponse
+}
+
+// responses of the prefix endpoint and the domains whose proofs are derived
+// from them
+type VerifyPrefixAndGetMissingIDsRequest struct {
+	MapserverID string
+	DomainNames []string
+	Responses   []*cache_v2.MapServerPrefixResponse
+}
+
+type VerifyAndGetMissingIDsResponse struct {
+	VerificationResults []string
+	CertificateIDs      []string
+	PolicyIDs           []string
+}
+
+// payloads of the getpayloads endpoint and the IDs that were requested
+type AddMissingPayloadsRequest struct {
+	// base64 encoded hashes of the requested certificates and policies
+	CertificateIDs []string
+	PolicyIDs      []string
+
+	// DER encoded certificates and JSON encoded policies
+	Payloads [][]byte
+}
+
+type AddMissingPayloadsResponse struct {
+	ProcessedCertificateIDs []string
+	ProcessedPolicyIDs      []string
+}
+
+// certificate chain received in the connection attempt to DNSName
+type VerifyRequest struct {
+	DNSName string
+
+	// DER encoded certificates, starting with the leaf
+	ConnectionCertificateChain [][]byte
+}
+
+// trust roots to add at runtime
+type AddTrustRootsRequest struct {
+	// one or more PEM encoded certificates or a single DER encoded certificate
+	Certificates []byte
+}
+
+type AddTrustRootsResponse struct {
+	AddedCertificateIDs []string
+}
+
+// trust root to remove or distrust (base64 encoded certificate hash)
+type TrustRootRequest struct {
+	CertificateID string
+}
+
+type TrustRootResponse struct {
+	// removed certificates (the root and dependent certificates)
+	RemovedCertificateIDs []string
+}
+
+// trust metadata to set for a trust root (base64 encoded certificate hash)
+type SetTrustRootMetadataRequest struct {
+	CertificateID string
+	Metadata      *cache_v2.TrustRootMetadata
+}
+
+// TOFU pins to restore (e.g., from the browser's local storage)
+type ImportTOFUPinsRequest struct {
+	// JSON encoded pins as returned by ExportTOFUPins
+	PinsJSON []byte
+}
+
+type ImportTOFUPinsResponse struct {
+	// number of imported (non-expired) pins
+	NPins int
+}
+
+// response of the root endpoint of a map server
+type PinTreeHeadRequest struct {
+	MapserverID string
+
+	// JSON encoded cache_v2.MapServerTreeHead
+	TreeHeadJSON []byte
+}
+
+type ImportTreeHeadPinsRequest struct {
+	// JSON encoded pins as returned by ExportTreeHeadPins
+	PinsJSON []byte
+}
+
+type ImportTreeHeadPinsResponse struct {
+	NPins int
+}
+
+// TLSA records fetched by JS (e.g., using DNS-over-HTTPS)
+type AddTLSARecordsRequest struct {
+	// JSON encoded cache_v2.TLSARecordSet
+	RecordSetJSON []byte
+}
+
+// result of the legacy validation (mirrors LegacyTrustDecisionGo in JS)
+type LegacyTrustDecision struct {
+	DNSName                        string
+	ConnectionTrustLevel           int
+	ConnectionTrustLevelCASet      string
+	ConnectionTrustLevelChainIndex int
+	EvaluationResult               int
+	HighestTrustLevel              int
+	HighestTrustLevelCASets        []string
+	HighestTrustLevelChainIndices  []int
+	HighestTrustLevelChainHashes   [][]string
+	HighestTrustLevelChainSubjects [][]string
+	MaxValidity                    int64
+	ExplanationJSON                string
+}
+
+// result of the policy validation (mirrors PolicyTrustDecisionGo in JS)
+type PolicyTrustDecision struct {
+	DNSName          string
+	EvaluationResult int
+
+	// JSON encoded policy certificates and conflicting policy attributes
+	PolicyChain         []string
+	ConflictingPolicies []string
+
+	MaxValidity     int64
+	DomainExcluded  bool
+	ExplanationJSON string
+}
+
+// result of the SPKI pinning validation (mirrors SPKIPinTrustDecisionGo in JS)
+type SPKIPinTrustDecision struct {
+	DNSName          string
+	EvaluationResult int
+
+	// domain for which the applied pins are defined and their mode
+	// (empty if no pins apply to the connection)
+	PinDomain string
+	Mode      string
+
+	// true if the connection violates the pins (also in report-only mode)
+	Violation bool
+
+	// index of the certificate whose public key is pinned (-1 if none)
+	MatchedChainIndex int
+
+	MaxValidity     int64
+	ExplanationJSON string
+}
+
+// result of the DANE validation (mirrors DANETrustDecisionGo in JS)
+type DANETrustDecision struct {
+	DNSName          string
+	EvaluationResult int
+
+	// service name of the TLSA records and their DNSSEC status
+	TLSAName     string
+	DNSSECStatus string
+
+	// true if authenticated and usable TLSA records exist
+	Applicable bool
+
+	// index of the matching record and certificate (-1 if none)
+	MatchedRecordIndex int
+	MatchedChainIndex  int
+
+	MaxValidity     int64
+	ExplanationJSON string
+}
+
+// result of the TOFU validation (mirrors TOFUTrustDecisionGo in JS)
+type TOFUTrustDecision struct {
+	DNSName          string
+	EvaluationResult int
+
+	// outcome of the check against the pin of the domain
+	// (e.g., cache_v2.TOFU_PINNED or cache_v2.TOFU_VIOLATION)
+	Status string
+
+	MaxValidity     int64
+	ExplanationJSON string
+}
+
+// combined result of all enabled validation modes (mirrors VerdictGo in JS)
+type Verdict struct {
+	DNSName          string
+	EvaluationResult int
+
+	// precedence policy used to combine the modes and the modes whose
+	// results are part of the final decision
+	Precedence    string
+	DecidingModes []string
+
+	MaxValidity int64
+
+	// decisions of the modes that were run (*LegacyTrustDecision,
+	// *PolicyTrustDecision, *SPKIPinTrustDecision, *DANETrustDecision or
+	// *TOFUTrustDecision)
+	Decisions []any
+
+	// JSON encoded results of all enabled modes (cache_v2.ModeResult)
+	ResultsJSON string
+}
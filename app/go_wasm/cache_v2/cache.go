@@ -6,9 +6,15 @@ import (
 	"embed"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path"
 	"strings"
 	"time"
 )
@@ -30,6 +36,9 @@ type CertificateCacheEntry struct {
 
 	// flag indicating whether the certificate is a trust root
 	trustRoot bool
+
+	// trust metadata of the trust root (nil for other certificates)
+	trustRootMetadata *TrustRootMetadata
 }
 
 type SubjectSKICacheEntry struct {
@@ -64,7 +73,8 @@ var dnsNameCache = map[string][]string{}
 // map containing all certificate hashes that should be ignored
 // (not be requested from the map server again) in the future
 // (e.g., because they correspond to expired certificates)
-var ignoredCertificateHashes = map[string]struct{}{}
+// and the reason why they are ignored
+var ignoredCertificateHashes = map[string]string{}
 
 // reasons why a certificate should be ignored
 // TODO: maybe include other reasons in the future
@@ -82,6 +92,15 @@ var UnhandledCriticalExtensionWhitelist = []asn1.ObjectIdentifier{CTPoison, CTKe
 //go:embed embedded/*
 var cacheFileSystem embed.FS
 
+// destination of the log messages of the caches and validation modes
+// (stdout, i.e., the console of the extension, by default)
+var logOutput io.Writer = os.Stdout
+
+// redirect the log messages (e.g., to stderr or io.Discard)
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+}
+
 // some variables used to measure runtime
 var MS int64 = 0
 var MSS int64 = 0
@@ -167,20 +186,44 @@ func GetRawCertificateIssuerAKIHash(certificate *x509.Certificate) string {
 // initialize the caches based on the certificates in
 // the trust store (trust store location: trustStoreDir)
 func InitializeCache(trustStoreDir string) int {
+	return InitializeCacheFromFS(cacheFileSystem, trustStoreDir)
+}
+
+// optional file in the trust store directory containing the trust metadata
+// of the roots (JSON object mapping certificate hashes to TrustRootMetadata).
+// roots without metadata use DefaultTrustRootMetadata
+const TRUST_METADATA_FILE = "trust_metadata.json"
+
+// initialize the caches based on the certificates in the trust store
+// located at trustStoreDir within fileSystem
+// (e.g., os.DirFS for trust stores outside of the embedded directory)
+func InitializeCacheFromFS(fileSystem fs.FS, trustStoreDir string) int {
 	subjectSKICache = map[string]*SubjectSKICacheEntry{}
 	certificateCache = map[string]*CertificateCacheEntry{}
 	dnsNameCache = map[string][]string{}
-	ignoredCertificateHashes = map[string]struct{}{}
+	ignoredCertificateHashes = map[string]string{}
+	distrustedPublicKeys = map[string]string{}
+	certificateLookups = LookupCounter{}
 
-	files, err := cacheFileSystem.ReadDir(trustStoreDir)
+	files, err := fs.ReadDir(fileSystem, trustStoreDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	trustRootMetadata := map[string]*TrustRootMetadata{}
+	metadataBytes, err := fs.ReadFile(fileSystem, path.Join(trustStoreDir, TRUST_METADATA_FILE))
+	if err == nil {
+		if err := json.Unmarshal(metadataBytes, &trustRootMetadata); err != nil {
+			log.Fatalf("Error during parsing of %s: %s", TRUST_METADATA_FILE, err)
+		}
+	}
 	added := 0
 	for _, file := range files {
+		if file.Name() == TRUST_METADATA_FILE {
+			continue
+		}
 
 		// parse trust root certificate
-		fileBytes, err := cacheFileSystem.ReadFile(trustStoreDir + "/" + file.Name())
+		fileBytes, err := fs.ReadFile(fileSystem, path.Join(trustStoreDir, file.Name()))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -195,21 +238,11 @@ func InitializeCache(trustStoreDir string) int {
 		}
 
 		// add certificate to the caches as trust root
-		certificateHash := GetRawCertificateHash(certificate)
-		certificateSubjectSKIHash := GetRawCertificateSubjectSKIHash(certificate)
-		certificateCacheEntry := &CertificateCacheEntry{
-			certificate:   certificate,
-			issuerAKIHash: certificateSubjectSKIHash, // self-issued
-			trustRoot:     true,
-		}
-		certificateCache[certificateHash] = certificateCacheEntry
-
-		subjectSKICacheEntry, cached := subjectSKICache[certificateSubjectSKIHash]
-		if !cached {
-			subjectSKICacheEntry = newSubjectSKICacheEntry()
-			subjectSKICache[certificateSubjectSKIHash] = subjectSKICacheEntry
+		metadata, ok := trustRootMetadata[GetRawCertificateHash(certificate)]
+		if !ok {
+			metadata = DefaultTrustRootMetadata()
 		}
-		subjectSKICacheEntry.certificates[certificateHash] = struct{}{}
+		addTrustRootToCache(certificate, metadata)
 
 		added += 1
 	}
@@ -230,10 +263,14 @@ func GetMissingCertificateHashesList(certificateHashes []string) []string {
 		// be requested again)
 		_, ignore := ignoredCertificateHashes[certificateHash]
 		if ignore {
+			certificateLookups.Ignored++
 			continue
 		}
 		if certificateCache[certificateHash] == nil {
+			certificateLookups.Misses++
 			missingCertificateHashes = append(missingCertificateHashes, certificateHash)
+		} else {
+			certificateLookups.Hits++
 		}
 	}
 	return missingCertificateHashes
@@ -261,7 +298,8 @@ func ignoreError(err error) bool {
 // the first return value indicates whether these checks all succeeded
 // the second return value indicates whether the certificate should still
 // be remembered in case of a failing check
-func verifyChildWithParentCertificate(certificate *x509.Certificate, parentCertificate *x509.Certificate) (bool, bool) {
+// the third return value contains the errors of the failing checks (if any)
+func verifyChildWithParentCertificate(certificate *x509.Certificate, parentCertificate *x509.Certificate) (bool, bool, error) {
 
 	var errs []error
 
@@ -283,13 +321,13 @@ func verifyChildWithParentCertificate(certificate *x509.Certificate, parentCerti
 
 	for _, err = range errs {
 		if !ignoreError(err) {
-			return false, false
+			return false, false, errors.Join(errs...)
 		}
 	}
 
 	// track total time spent doing signature checks
 	MSS = MSS + time.Now().Sub(now).Milliseconds()
-	return len(errs) == 0, true
+	return len(errs) == 0, true, errors.Join(errs...)
 }
 
 // allocate entries in the certificateCache, dnsNameCache, subjectSKICache
@@ -334,7 +372,7 @@ func verifyChildWithParentAndAllocateCaches(certificate *x509.Certificate, paren
 	certificateHash string,
 	certificateSubjectSKIHash string,
 	certificateIssuerAKIHash string) bool {
-	checksPassed, ignore := verifyChildWithParentCertificate(certificate, parentCertificate)
+	checksPassed, ignore, err := verifyChildWithParentCertificate(certificate, parentCertificate)
 
 	// if all checks are passed, allocate new cache entries if necessary
 	if checksPassed {
@@ -344,7 +382,7 @@ func verifyChildWithParentAndAllocateCaches(certificate *x509.Certificate, paren
 		// ignore certificate for future requests if it wasn't added to the cache
 		// (e.g., because it was already expired)
 		if ignore {
-			ignoredCertificateHashes[certificateHash] = struct{}{}
+			ignoredCertificateHashes[certificateHash] = err.Error()
 		}
 		return false
 	}
@@ -377,6 +415,10 @@ func processCertificate(certificate *x509.Certificate,
 	if ignored {
 		return processedCertificateHashes, false
 	}
+	if reason, distrusted := distrustedPublicKeys[getPublicKeyHash(certificate)]; distrusted {
+		ignoredCertificateHashes[certificateHash] = reason
+		return processedCertificateHashes, false
+	}
 
 	// remove white-listed unhandled critical extensions
 	// (e.g., CT Poison)
@@ -388,9 +430,11 @@ func processCertificate(certificate *x509.Certificate,
 	ownSubjectSKICacheEntry := subjectSKICache[certificateSubjectSKIHash]
 	if certificate.Subject.String() == certificate.Issuer.String() && ownSubjectSKICacheEntry != nil {
 		isTrustRoot := false
+		var trustRootMetadata *TrustRootMetadata
 		for certificateHash, _ := range ownSubjectSKICacheEntry.certificates {
 			if certificateCache[certificateHash].trustRoot {
 				isTrustRoot = true
+				trustRootMetadata = certificateCache[certificateHash].trustRootMetadata
 			}
 		}
 		if !isTrustRoot {
@@ -400,16 +444,17 @@ func processCertificate(certificate *x509.Certificate,
 		err := certificate.IsValid(x509.LeafCertificate, []*x509.Certificate{}, &x509.VerifyOptions{})
 		if err != nil {
 			if ignoreError(err) {
-				ignoredCertificateHashes[certificateHash] = struct{}{}
+				ignoredCertificateHashes[certificateHash] = err.Error()
 			}
 			return processedCertificateHashes, false
 		}
 
 		// add the certificate as trust root to both caches
 		certificateCacheEntry := &CertificateCacheEntry{
-			certificate:   certificate,
-			issuerAKIHash: certificateSubjectSKIHash, // self-issued
-			trustRoot:     true,
+			certificate:       certificate,
+			issuerAKIHash:     certificateSubjectSKIHash, // self-issued
+			trustRoot:         true,
+			trustRootMetadata: trustRootMetadata,
 		}
 		certificateCacheEntry.certificate = certificate
 		certificateCacheEntry.issuerAKIHash = certificateSubjectSKIHash
@@ -444,6 +489,13 @@ func processCertificate(certificate *x509.Certificate,
 		return processedCertificateHashes, false
 	}
 
+	// certificates issued directly by trust roots must satisfy the
+	// trust metadata of the roots (e.g., server authentication trust bit)
+	if reason := checkIssuingTrustRoots(certificate, issuerAKICacheEntry); reason != "" {
+		ignoredCertificateHashes[certificateHash] = reason
+		return processedCertificateHashes, false
+	}
+
 	// check signature
 
 	// get any potential parent certificate (all parent certificates
@@ -466,6 +518,15 @@ func processCertificate(certificate *x509.Certificate,
 // TODO: pot. hashing the certificates is unnecessary as the hashes might already
 // be available from the first mapserver response
 func AddCertificatesToCache(certificates []*x509.Certificate) []string {
+	processedCertificateHashes, _ := AddCertificatesToCacheWithProgress(certificates, nil)
+	return processedCertificateHashes
+}
+
+// same as AddCertificatesToCache, but calls progress (if not nil) after each
+// processed certificate. If progress returns an error, the remaining
+// certificates are not processed and the error is returned
+// (certificates that were already added remain cached)
+func AddCertificatesToCacheWithProgress(certificates []*x509.Certificate, progress ProgressFunc) ([]string, error) {
 
 	nEntriesBefore := len(certificateCache)
 	now := time.Now()
@@ -488,26 +549,32 @@ func AddCertificatesToCache(certificates []*x509.Certificate) []string {
 	// skip certificates that have already been added
 	// in a recursive step
 	var processedCertificateHashes []string
-	for _, certificate := range certificates {
+	var err error
+	for i, certificate := range certificates {
 		if !certificatesInRequestProcessed[certificate] {
 			hashes, added := processCertificate(certificate, certificatesInRequestProcessed, certificatesInRequest)
 			processedCertificateHashes = append(processedCertificateHashes, hashes...)
 			if added {
 				NCertificatesAdded++
 			} else {
-				fmt.Printf("[Go] Did not add certificate with subject: " + certificate.Subject.String() + " " + certificate.Issuer.String() + "\n")
+				fmt.Fprintf(logOutput, "[Go] Did not add certificate with subject: %s %s\n", certificate.Subject.String(), certificate.Issuer.String())
+			}
+		}
+		if progress != nil {
+			if err = progress(CERTIFICATES_STAGE, i+1, len(certificates)); err != nil {
+				break
 			}
 		}
 	}
 	MS = MS + time.Now().Sub(now).Milliseconds()
-	fmt.Printf("[Go] Added %d certificates to cache\n", len(certificateCache)-nEntriesBefore)
-	fmt.Printf("[Go] Total # cache entries: %d\n", len(certificateCache))
-	fmt.Printf("[Go] Time spent checking signatures: %d ms\n ", MSS)
+	fmt.Fprintf(logOutput, "[Go] Added %d certificates to cache\n", len(certificateCache)-nEntriesBefore)
+	fmt.Fprintf(logOutput, "[Go] Total # cache entries: %d\n", len(certificateCache))
+	fmt.Fprintf(logOutput, "[Go] Time spent checking signatures: %d ms\n ", MSS)
 
 	MS = 0
 	NCertificatesAdded = int64(len(certificateCache) - nEntriesBefore)
 
-	return processedCertificateHashes
+	return processedCertificateHashes, err
 }
 
 // helper function to recursively build certificate chains
@@ -540,27 +607,54 @@ func buildChains(certificateHash string) []*CertificateChainInfo {
 	}
 }
 
-// returns all the certificate chains in the cache for a specific dns name
-func GetCertificateChainsForDomain(dnsName string) []*CertificateChainInfo {
-
-	// query with full dnsName and dnsName with last subdomain replaced as a wildcard
+// returns the dns name and the dns name with the last subdomain
+// replaced as a wildcard
+func getDNSNameAndWildcard(dnsName string) []string {
 	dnsNames := []string{dnsName}
 	split := strings.Split(dnsName, ".")
 	if len(split) >= 2 {
 		split[0] = "*"
 		dnsNames = append(dnsNames, strings.Join(split, "."))
 	}
+	return dnsNames
+}
+
+// a cached certificate chain that violates the trust metadata of its root
+type prunedCertificateChain struct {
+	chainInfo *CertificateChainInfo
+	reason    string
+}
+
+// returns all the certificate chains in the cache for a specific dns name
+func GetCertificateChainsForDomain(dnsName string) []*CertificateChainInfo {
+	chains, _ := getCertificateChainsForDomainAndPruned(dnsName)
+	return chains
+}
+
+// returns all the certificate chains in the cache for a specific dns name
+// that satisfy the trust metadata of their root and the chains that were
+// pruned because they violate it
+func getCertificateChainsForDomainAndPruned(dnsName string) ([]*CertificateChainInfo, []*prunedCertificateChain) {
+
+	// query with full dnsName and dnsName with last subdomain replaced as a wildcard
 	var chains []*CertificateChainInfo
-	for _, currentDNSName := range dnsNames {
+	var prunedChains []*prunedCertificateChain
+	for _, currentDNSName := range getDNSNameAndWildcard(dnsName) {
 		certificateHashes, inCache := dnsNameCache[currentDNSName]
 		if !inCache {
 			continue
 		} else {
 			for _, certificateHash := range certificateHashes {
 				currentChains := buildChains(certificateHash)
-				chains = append(chains, currentChains...)
+				for _, chain := range currentChains {
+					if err := checkChainTrustRootMetadata(chain.certificateChain); err != nil {
+						prunedChains = append(prunedChains, &prunedCertificateChain{chainInfo: chain, reason: err.Error()})
+					} else {
+						chains = append(chains, chain)
+					}
+				}
 			}
 		}
 	}
-	return chains
+	return chains, prunedChains
 }
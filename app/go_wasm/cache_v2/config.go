@@ -0,0 +1,486 @@
+package cache_v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// current version of the config schema.
+// configs without "config-version" were exported before the schema was
+// versioned and are treated as version 1
+const CONFIG_VERSION = 1
+
+// config of the extension as exported by the config page
+// (see js_lib/default_config.js for the default config)
+type Config struct {
+	Version int `json:"config-version"`
+
+	// maps the names of the trust levels to their values
+	TrustLevels map[string]int `json:"trust-levels"`
+
+	// inverse of TrustLevels (only used by JS)
+	TrustLevelsRev map[string]string `json:"trust-levels-rev"`
+
+	// legacy validation
+	CASets                 map[string]*CASetConfig                   `json:"ca-sets"`
+	LegacyTrustPreferences map[string][]*LegacyTrustPreferenceConfig `json:"legacy-trust-preference"`
+
+	// policy validation
+	PolicyCASets           map[string]*PolicyCASetConfig             `json:"policy-ca-sets"`
+	PolicyCAs              map[string]*PolicyCAConfig                `json:"policy-cas"`
+	PolicyTrustPreferences map[string][]*PolicyTrustPreferenceConfig `json:"policy-trust-preference"`
+
+	// SPKI pinning validation
+	SPKIPins map[string]*SPKIPinConfig `json:"spki-pins"`
+
+	Mapservers []*MapserverConfig `json:"mapservers"`
+
+	// trust-on-first-use pinning (TOFU mode) for domains without policies and
+	// explicit legacy trust preferences, pins expire after TOFUPinExpiry
+	// milliseconds (0: pins do not expire)
+	TOFUPinning   bool  `json:"tofu-pinning"`
+	TOFUPinExpiry int64 `json:"tofu-pin-expiry"`
+
+	// DANE validation using TLSA records fetched by JS from a
+	// DNS-over-HTTPS resolver (https URL)
+	DANEValidation bool   `json:"dane-validation"`
+	DANEResolver   string `json:"dane-resolver"`
+
+	// validation modes run by Verify (empty: legacy, policy, spki-pinning,
+	// dane if DANEValidation is set and tofu if TOFUPinning is set) and how
+	// their results are combined
+	VerifyModes       []string `json:"verify-modes"`
+	VerdictPrecedence string   `json:"verdict-precedence"`
+
+	// options only used by JS
+	CacheTimeout              int64 `json:"cache-timeout"`
+	MaxConnectionSetupTime    int64 `json:"max-connection-setup-time"`
+	ProofFetchTimeout         int64 `json:"proof-fetch-timeout"`
+	ProofFetchMaxTries        int   `json:"proof-fetch-max-tries"`
+	MapserverQuorum           int   `json:"mapserver-quorum"`
+	MapserverInstancesQueried int   `json:"mapserver-instances-queried"`
+	SendLogEntriesViaEvent    bool  `json:"send-log-entries-via-event"`
+	WasmCertificateParsing    bool  `json:"wasm-certificate-parsing"`
+	WasmCertificateCaching    bool  `json:"wasm-certificate-caching"`
+	WasmBinaryEncoding        bool  `json:"wasm-binary-encoding"`
+}
+
+// set of CAs identified by their subject names (certificate.Subject.String())
+type CASetConfig struct {
+	Description string   `json:"description"`
+	CAs         []string `json:"cas"`
+}
+
+type LegacyTrustPreferenceConfig struct {
+	CASet string `json:"ca-set"`
+	Level string `json:"level,omitempty"`
+
+	// connections to the domain and its subdomains fail if their chain
+	// contains a CA of the CA set (forbidden preferences have no level)
+	Forbidden bool `json:"forbidden,omitempty"`
+}
+
+// set of policy CAs identified by their names in Config.PolicyCAs
+type PolicyCASetConfig struct {
+	Description string   `json:"description"`
+	PCAs        []string `json:"pcas"`
+}
+
+type PolicyCAConfig struct {
+	// base64 encoded DER public key
+	PublicKey string `json:"publickey"`
+}
+
+type PolicyTrustPreferenceConfig struct {
+	PolicyCASet string `json:"policy-ca-set"`
+	Level       string `json:"level"`
+}
+
+// public keys allowed for a domain and its subdomains
+type SPKIPinConfig struct {
+	Description string `json:"description"`
+
+	// "enforce" (default) or "report-only"
+	Mode string `json:"mode"`
+
+	// base64 encoded SHA-256 hashes of the DER encoded SubjectPublicKeyInfo
+	// of allowed leaf certificates and CAs
+	LeafSPKIHashes []string `json:"leaf-spki-hashes"`
+	CASPKIHashes   []string `json:"ca-spki-hashes"`
+}
+
+// how JS queries a map server
+const (
+	// proofs of the domain and its parent domains (getproof endpoint)
+	MAPSERVER_QUERY_GET = "lfpki-http-get"
+
+	// proofs of the domain and its parent domains under a single signed root
+	// (getproofs endpoint), see VerifyBatchAndGetMissingIDs
+	MAPSERVER_QUERY_BATCH = "lfpki-http-batch"
+
+	// entries under a prefix of the hash of the domain and its parent domains
+	// (prefix endpoint), see VerifyPrefixAndGetMissingIDs
+	MAPSERVER_QUERY_PREFIX = "lfpki-http-prefix"
+)
+
+// range of the prefix length of prefix queries supported by the map server
+const (
+	MIN_MAPSERVER_PREFIX_BITS = 8
+	MAX_MAPSERVER_PREFIX_BITS = 32
+)
+
+type MapserverConfig struct {
+	Identity  string `json:"identity"`
+	Domain    string `json:"domain"`
+	QueryType string `json:"querytype"`
+
+	// prefix length (in bits) of queries of the type MAPSERVER_QUERY_PREFIX
+	// (0: default of JS)
+	PrefixBits int `json:"prefix-bits,omitempty"`
+
+	// base64 encoded DER public key (map servers without public keys are ignored)
+	PublicKey string `json:"publickey,omitempty"`
+
+	// further keys of the map server (e.g., the next key while the map server
+	// rotates its key). the key verifying a response is selected by the key
+	// ID of the response
+	Keys []*MapserverKeyConfig `json:"keys,omitempty"`
+}
+
+// public key of a map server with an optional validity window
+type MapserverKeyConfig struct {
+	// base64 encoded DER public key
+	PublicKey string `json:"publickey"`
+
+	// the key is only accepted between not-before and not-after (RFC 3339
+	// timestamps, unbounded if not set)
+	NotBefore string `json:"not-before,omitempty"`
+	NotAfter  string `json:"not-after,omitempty"`
+}
+
+// a problem found in a config
+type ConfigError struct {
+	// location of the problem (e.g., legacy-trust-preference["*"][0].level)
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// all problems found in a config
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid config (%d problems): %s", len(e), strings.Join(messages, "; "))
+}
+
+func (e *ConfigErrors) add(path string, format string, a ...any) {
+	*e = append(*e, &ConfigError{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// decode and validate a JSON encoded config.
+// returns ConfigErrors listing every problem (unknown keys, wrong types and
+// references to undefined trust levels, CA sets and policy CAs)
+func ParseConfig(data []byte) (*Config, error) {
+	var errs ConfigErrors
+	config := &Config{}
+	decodeConfigValue("", data, config, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if config.Version == 0 {
+		config.Version = 1
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// check the references within the config.
+// returns ConfigErrors listing every problem
+func (config *Config) Validate() error {
+	var errs ConfigErrors
+	if config.Version > CONFIG_VERSION || config.Version < 0 {
+		errs.add("config-version", "unsupported config version %d (supported: up to %d)", config.Version, CONFIG_VERSION)
+		return errs
+	}
+
+	for _, name := range sortedKeys(config.CASets) {
+		if config.CASets[name] == nil {
+			errs.add(fmt.Sprintf("ca-sets[%q]", name), "missing CA set")
+		}
+	}
+	for _, domain := range sortedKeys(config.LegacyTrustPreferences) {
+		for i, preference := range config.LegacyTrustPreferences[domain] {
+			path := fmt.Sprintf("legacy-trust-preference[%q][%d]", domain, i)
+			if preference == nil {
+				errs.add(path, "missing trust preference")
+				continue
+			}
+			if _, ok := config.CASets[preference.CASet]; !ok {
+				errs.add(path+".ca-set", "undefined CA set %q", preference.CASet)
+			}
+			if preference.Forbidden {
+				if preference.Level != "" {
+					errs.add(path+".level", "forbidden preference cannot have a trust level")
+				}
+			} else if _, ok := config.TrustLevels[preference.Level]; !ok {
+				errs.add(path+".level", "undefined trust level %q", preference.Level)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(config.PolicyCAs) {
+		path := fmt.Sprintf("policy-cas[%q]", name)
+		if config.PolicyCAs[name] == nil {
+			errs.add(path, "missing policy CA")
+		} else if _, err := util.DERBase64ToRSAPublic(config.PolicyCAs[name].PublicKey); err != nil {
+			errs.add(path+".publickey", "invalid RSA public key: %s", err)
+		}
+	}
+	for _, name := range sortedKeys(config.PolicyCASets) {
+		path := fmt.Sprintf("policy-ca-sets[%q]", name)
+		if config.PolicyCASets[name] == nil {
+			errs.add(path, "missing policy CA set")
+			continue
+		}
+		for i, pca := range config.PolicyCASets[name].PCAs {
+			if _, ok := config.PolicyCAs[pca]; !ok {
+				errs.add(fmt.Sprintf("%s.pcas[%d]", path, i), "undefined policy CA %q", pca)
+			}
+		}
+	}
+	for _, domain := range sortedKeys(config.PolicyTrustPreferences) {
+		for i, preference := range config.PolicyTrustPreferences[domain] {
+			path := fmt.Sprintf("policy-trust-preference[%q][%d]", domain, i)
+			if preference == nil {
+				errs.add(path, "missing trust preference")
+				continue
+			}
+			if _, ok := config.PolicyCASets[preference.PolicyCASet]; !ok {
+				errs.add(path+".policy-ca-set", "undefined policy CA set %q", preference.PolicyCASet)
+			}
+			if _, ok := config.TrustLevels[preference.Level]; !ok {
+				errs.add(path+".level", "undefined trust level %q", preference.Level)
+			}
+		}
+	}
+
+	for _, domain := range sortedKeys(config.SPKIPins) {
+		path := fmt.Sprintf("spki-pins[%q]", domain)
+		pins := config.SPKIPins[domain]
+		if pins == nil {
+			errs.add(path, "missing SPKI pins")
+			continue
+		}
+		if pins.Mode != "" && pins.Mode != SPKI_PIN_ENFORCE && pins.Mode != SPKI_PIN_REPORT_ONLY {
+			errs.add(path+".mode", "unknown mode %q (expected %q or %q)", pins.Mode, SPKI_PIN_ENFORCE, SPKI_PIN_REPORT_ONLY)
+		}
+		if len(pins.LeafSPKIHashes) == 0 && len(pins.CASPKIHashes) == 0 {
+			errs.add(path, "no pinned public keys")
+		}
+		for i, hash := range pins.LeafSPKIHashes {
+			if !isSPKIHash(hash) {
+				errs.add(fmt.Sprintf("%s.leaf-spki-hashes[%d]", path, i), "invalid SPKI hash %q (expected base64 encoded SHA-256 hash)", hash)
+			}
+		}
+		for i, hash := range pins.CASPKIHashes {
+			if !isSPKIHash(hash) {
+				errs.add(fmt.Sprintf("%s.ca-spki-hashes[%d]", path, i), "invalid SPKI hash %q (expected base64 encoded SHA-256 hash)", hash)
+			}
+		}
+	}
+
+	if config.TOFUPinExpiry < 0 {
+		errs.add("tofu-pin-expiry", "negative expiry %d", config.TOFUPinExpiry)
+	}
+	for i, mode := range config.VerifyModes {
+		if _, ok := verificationModes[mode]; !ok {
+			errs.add(fmt.Sprintf("verify-modes[%d]", i), "unknown validation mode %q", mode)
+		}
+		if mode == TOFU_MODE && !config.TOFUPinning {
+			errs.add(fmt.Sprintf("verify-modes[%d]", i), "validation mode %q requires tofu-pinning", mode)
+		}
+	}
+	if config.VerdictPrecedence != "" && config.VerdictPrecedence != VERDICT_POLICY_OVERRIDES_LEGACY && config.VerdictPrecedence != VERDICT_ALL_MUST_PASS {
+		errs.add("verdict-precedence", "unknown precedence policy %q (expected %q or %q)", config.VerdictPrecedence, VERDICT_POLICY_OVERRIDES_LEGACY, VERDICT_ALL_MUST_PASS)
+	}
+	if config.DANEValidation && !strings.HasPrefix(config.DANEResolver, "https://") {
+		errs.add("dane-resolver", "expected an https URL of a DNS-over-HTTPS resolver, got %q", config.DANEResolver)
+	}
+
+	identities := map[string]bool{}
+	for i, mapserver := range config.Mapservers {
+		path := fmt.Sprintf("mapservers[%d]", i)
+		if mapserver == nil {
+			errs.add(path, "missing map server")
+			continue
+		}
+		if mapserver.Identity == "" {
+			errs.add(path+".identity", "missing identity")
+		} else if identities[mapserver.Identity] {
+			errs.add(path+".identity", "duplicate identity %q", mapserver.Identity)
+		}
+		identities[mapserver.Identity] = true
+		switch mapserver.QueryType {
+		case "", MAPSERVER_QUERY_GET, MAPSERVER_QUERY_BATCH, MAPSERVER_QUERY_PREFIX:
+		default:
+			errs.add(path+".querytype", "unknown query type %q (expected %q, %q or %q)", mapserver.QueryType, MAPSERVER_QUERY_GET, MAPSERVER_QUERY_BATCH, MAPSERVER_QUERY_PREFIX)
+		}
+		if mapserver.PrefixBits != 0 && (mapserver.PrefixBits < MIN_MAPSERVER_PREFIX_BITS || mapserver.PrefixBits > MAX_MAPSERVER_PREFIX_BITS) {
+			errs.add(path+".prefix-bits", "prefix length %d out of range (expected %d to %d)", mapserver.PrefixBits, MIN_MAPSERVER_PREFIX_BITS, MAX_MAPSERVER_PREFIX_BITS)
+		}
+		if mapserver.PublicKey != "" {
+			if _, err := util.DERBase64ToRSAPublic(mapserver.PublicKey); err != nil {
+				errs.add(path+".publickey", "invalid RSA public key: %s", err)
+			}
+		}
+		publicKeys := map[string]bool{mapserver.PublicKey: mapserver.PublicKey != ""}
+		for j, key := range mapserver.Keys {
+			keyPath := fmt.Sprintf("%s.keys[%d]", path, j)
+			if key == nil {
+				errs.add(keyPath, "missing key")
+				continue
+			}
+			if _, err := util.DERBase64ToRSAPublic(key.PublicKey); err != nil {
+				errs.add(keyPath+".publickey", "invalid RSA public key: %s", err)
+			} else if publicKeys[key.PublicKey] {
+				errs.add(keyPath+".publickey", "duplicate key")
+			}
+			publicKeys[key.PublicKey] = true
+			notBefore, notBeforeErr := parseKeyValidity(key.NotBefore)
+			if notBeforeErr != nil {
+				errs.add(keyPath+".not-before", "%s", notBeforeErr)
+			}
+			notAfter, notAfterErr := parseKeyValidity(key.NotAfter)
+			if notAfterErr != nil {
+				errs.add(keyPath+".not-after", "%s", notAfterErr)
+			}
+			if notBeforeErr == nil && notAfterErr == nil && !notBefore.IsZero() && !notAfter.IsZero() && !notBefore.Before(notAfter) {
+				errs.add(keyPath+".not-after", "not after not-before %q", key.NotBefore)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// check if hash is a base64 encoded SHA-256 hash
+func isSPKIHash(hash string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// decode JSON into v (a pointer), rejecting unknown object keys.
+// objects and arrays are decoded entry by entry to report the problems of
+// all entries with their path
+func decodeConfigValue(path string, data []byte, v any, errs *ConfigErrors) {
+	value := reflect.ValueOf(v).Elem()
+	switch value.Kind() {
+	case reflect.Pointer:
+		if string(bytes.TrimSpace(data)) == "null" {
+			return
+		}
+		value.Set(reflect.New(value.Type().Elem()))
+		decodeConfigValue(path, data, value.Interface(), errs)
+	case reflect.Struct:
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			errs.add(path, "expected an object")
+			return
+		}
+		fields := map[string]int{}
+		for i := 0; i < value.NumField(); i++ {
+			name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+			fields[name] = i
+		}
+		for _, key := range sortedKeys(entries) {
+			entryPath := key
+			if path != "" {
+				entryPath = path + "." + key
+			}
+			i, known := fields[key]
+			if !known {
+				errs.add(entryPath, "unknown key")
+				continue
+			}
+			decodeConfigValue(entryPath, entries[key], value.Field(i).Addr().Interface(), errs)
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			errs.add(path, "expected an object")
+			return
+		}
+		decoded := reflect.MakeMapWithSize(value.Type(), len(entries))
+		for _, key := range sortedKeys(entries) {
+			entry := reflect.New(value.Type().Elem())
+			decodeConfigValue(fmt.Sprintf("%s[%q]", path, key), entries[key], entry.Interface(), errs)
+			decoded.SetMapIndex(reflect.ValueOf(key), entry.Elem())
+		}
+		value.Set(decoded)
+	case reflect.Slice:
+		var entries []json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			errs.add(path, "expected an array")
+			return
+		}
+		decoded := reflect.MakeSlice(value.Type(), len(entries), len(entries))
+		for i, entryData := range entries {
+			decodeConfigValue(fmt.Sprintf("%s[%d]", path, i), entryData, decoded.Index(i).Addr().Interface(), errs)
+		}
+		value.Set(decoded)
+	default:
+		if err := json.Unmarshal(data, v); err != nil {
+			// configs saved by earlier versions of the config page contain
+			// numbers and booleans as strings (e.g., "3600000" or "true")
+			var quoted string
+			if value.Kind() != reflect.String && json.Unmarshal(data, &quoted) == nil && json.Unmarshal([]byte(quoted), v) == nil {
+				return
+			}
+			errs.add(path, "expected a %s", jsonTypeName(value.Kind()))
+		}
+	}
+}
+
+// name of the JSON type of a basic Go type (for error messages)
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "number"
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
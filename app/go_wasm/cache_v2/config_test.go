@@ -0,0 +1,159 @@
+package cache_v2
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// check that a valid config is decoded into the typed config
+func TestParseConfig(t *testing.T) {
+	config := loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json")
+	require.Equal(t, CONFIG_VERSION, config.Version)
+	require.Equal(t, 2, config.TrustLevels["High Trust"])
+	require.Equal(t, []string{"SERIALNUMBER=1,CN=intmCA2"}, config.CASets["Test Intermediate 2"].CAs)
+	require.Equal(t, "Test Intermediate 2", config.LegacyTrustPreferences["leaf1"][1].CASet)
+	require.Empty(t, config.Mapservers)
+
+	InitializeLegacyTrustPreferences(config)
+	require.Equal(t, 2, legacyTrustPreferences["leaf1"][1].TrustLevel)
+}
+
+// check that every problem of an invalid config is reported with its path
+func TestParseInvalidConfig(t *testing.T) {
+	configBytes, err := cacheFileSystem.ReadFile("embedded/unit_test/validation/config_invalid.json")
+	require.NoError(t, err)
+
+	// decoding problems
+	_, err = ParseConfig(configBytes)
+	require.Error(t, err)
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	paths := []string{}
+	for _, configError := range errs {
+		paths = append(paths, configError.Path)
+	}
+	require.Equal(t, []string{`ca-sets["Test Root"].cas[1]`, "cache-timeuot", "mapservers[0].url"}, paths)
+	require.Equal(t, `ca-sets["Test Root"].cas[1]: expected a string`, errs[0].Error())
+	require.Equal(t, "mapservers[0].url: unknown key", errs[2].Error())
+
+	// reference problems (only reported once the config can be decoded)
+	_, err = ParseConfig([]byte(`{
+		"trust-levels": {"High Trust": 2},
+		"ca-sets": {"Test Root": {"cas": []}},
+		"legacy-trust-preference": {"leaf1": [{"ca-set": "Test Root", "level": "Hihg Trust"}, {"ca-set": "Test Intermediate", "level": "High Trust"}]},
+		"policy-trust-preference": {"*": [{"policy-ca-set": "PCAs", "level": "High Trust"}]},
+		"mapservers": [{"identity": "a", "publickey": "not a key"}, {"identity": "a"}]
+	}`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 5)
+	require.Equal(t, `legacy-trust-preference["leaf1"][0].level: undefined trust level "Hihg Trust"`, errs[0].Error())
+	require.Equal(t, `legacy-trust-preference["leaf1"][1].ca-set: undefined CA set "Test Intermediate"`, errs[1].Error())
+	require.Equal(t, `policy-trust-preference["*"][0].policy-ca-set`, errs[2].Path)
+	require.Equal(t, "mapservers[0].publickey", errs[3].Path)
+	require.Equal(t, "mapservers[1].identity", errs[4].Path)
+
+	_, err = ParseConfig([]byte(`{"mapservers": [
+		{"identity": "a", "querytype": "lfpki-http-prefix", "prefix-bits": 16},
+		{"identity": "d", "querytype": "lfpki-http-batch"},
+		{"identity": "b", "querytype": "lfpki-http-post"},
+		{"identity": "c", "querytype": "lfpki-http-prefix", "prefix-bits": 4}
+	]}`))
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	require.Equal(t, "mapservers[2].querytype", errs[0].Path)
+	require.Equal(t, "mapservers[3].prefix-bits: prefix length 4 out of range (expected 8 to 32)", errs[1].Error())
+
+	_, err = ParseConfig([]byte(`{"config-version": 2}`))
+	require.ErrorContains(t, err, "unsupported config version 2")
+	_, err = ParseConfig([]byte(`[]`))
+	require.Error(t, err)
+}
+
+// check that numbers and booleans stored as strings (by earlier versions of
+// the config page) are accepted
+func TestParseConfigStringValues(t *testing.T) {
+	config, err := ParseConfig([]byte(`{"cache-timeout": "3600000", "mapserver-quorum": "1", "wasm-binary-encoding": "false", "send-log-entries-via-event": "true"}`))
+	require.NoError(t, err)
+	require.Equal(t, int64(3600000), config.CacheTimeout)
+	require.Equal(t, 1, config.MapserverQuorum)
+	require.False(t, config.WasmBinaryEncoding)
+	require.True(t, config.SendLogEntriesViaEvent)
+
+	_, err = ParseConfig([]byte(`{"cache-timeout": "one hour", "wasm-binary-encoding": "no"}`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	require.Equal(t, "cache-timeout: expected a number", errs[0].Error())
+	require.Equal(t, "wasm-binary-encoding: expected a boolean", errs[1].Error())
+}
+
+// create a base64 encoded DER RSA public key for a map server
+func createTestMapserverKey(t *testing.T, seed int64) string {
+	privateKey, err := rsa.GenerateKey(rand.New(rand.NewSource(seed)), 1024)
+	require.NoError(t, err)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(publicKeyDER)
+}
+
+// check that a config update only invalidates the proofs and verified tree
+// heads of map servers whose key changed and keeps the certificate cache
+func TestUpdateConfig(t *testing.T) {
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	config := loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json")
+	key1, key2 := createTestMapserverKey(t, 1), createTestMapserverKey(t, 2)
+	config.Mapservers = []*MapserverConfig{
+		{Identity: "mapserver1", PublicKey: key1},
+		{Identity: "mapserver2", PublicKey: key2},
+		{Identity: "mapserver3", PublicKey: key2},
+	}
+	InitializeConfig(config)
+	for _, mapserverID := range []string{"mapserver1", "mapserver2", "mapserver3"} {
+		proofCache["proof-"+mapserverID] = newProofCacheEntry(nil, nil, mapserverID, "", nil, nil, nil)
+		domainProofCacheKeys["a.com"] = append(domainProofCacheKeys["a.com"], "proof-"+mapserverID)
+		verifiedTreeHeads["tree-head-"+mapserverID] = &verifiedTreeHead{mapserverID: mapserverID}
+	}
+	domainProofCacheKeys["b.com"] = []string{"proof-mapserver1"}
+	nCertificates := len(certificateCache)
+
+	// unchanged config
+	update := UpdateConfig(loadTestConfigWithMapservers(t, config.Mapservers))
+	require.False(t, update.LegacyTrustPreferencesChanged)
+	require.Equal(t, 0, update.InvalidatedProofs)
+
+	// changed trust preferences and map server keys
+	newConfig := loadTestConfigWithMapservers(t, []*MapserverConfig{
+		{Identity: "mapserver1", PublicKey: key2},
+		{Identity: "mapserver2", PublicKey: key2},
+		{Identity: "mapserver4", PublicKey: key1},
+	})
+	newConfig.LegacyTrustPreferences["leaf1"][0].Level = "High Trust"
+	update = UpdateConfig(newConfig)
+	require.True(t, update.LegacyTrustPreferencesChanged)
+	require.False(t, update.PolicyTrustPreferencesChanged)
+	require.Equal(t, []string{"mapserver4"}, update.AddedMapservers)
+	require.Equal(t, []string{"mapserver3"}, update.RemovedMapservers)
+	require.Equal(t, []string{"mapserver1"}, update.ChangedMapservers)
+	require.Equal(t, 2, update.InvalidatedProofs)
+
+	require.Len(t, proofCache, 1)
+	require.Equal(t, []string{"proof-mapserver2"}, domainProofCacheKeys["a.com"])
+	require.NotContains(t, domainProofCacheKeys, "b.com")
+	require.Len(t, verifiedTreeHeads, 1)
+	require.Equal(t, "mapserver2", verifiedTreeHeads["tree-head-mapserver2"].mapserverID)
+	require.Equal(t, 2, legacyTrustPreferences["leaf1"][0].TrustLevel)
+	require.Equal(t, nCertificates, len(certificateCache))
+}
+
+// load the unit test config with the given map servers
+func loadTestConfigWithMapservers(t *testing.T, mapservers []*MapserverConfig) *Config {
+	config := loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json")
+	config.Mapservers = mapservers
+	return config
+}
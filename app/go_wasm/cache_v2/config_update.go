@@ -0,0 +1,160 @@
+package cache_v2
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// config applied by the last InitializeConfig or UpdateConfig call
+// (nil if the config was never applied)
+var currentConfig *Config
+
+// summary of the changes applied by UpdateConfig
+type ConfigUpdate struct {
+	LegacyTrustPreferencesChanged bool `json:"legacyTrustPreferencesChanged"`
+	PolicyTrustPreferencesChanged bool `json:"policyTrustPreferencesChanged"`
+	SPKIPinsChanged               bool `json:"spkiPinsChanged"`
+
+	// identities of the map servers (with public key) that were added,
+	// removed or whose public keys changed
+	AddedMapservers   []string `json:"addedMapservers"`
+	RemovedMapservers []string `json:"removedMapservers"`
+	ChangedMapservers []string `json:"changedMapservers"`
+
+	// number of removed proof cache entries (of removed map servers and
+	// changed map servers that no longer accept one of their previous keys)
+	InvalidatedProofs int `json:"invalidatedProofs"`
+}
+
+// initialize the trust preferences, SPKI pins, the map server info cache, the
+// TOFU settings and the modes combined by Verify with a (validated) config.
+// Cached proofs are removed
+func InitializeConfig(config *Config) {
+	InitializeLegacyTrustPreferences(config)
+	InitializePolicyTrustPreferences(config)
+	InitializeMapserverInfoCache(config)
+	InitializeSPKIPins(config)
+	InitializeTOFU(config)
+	InitializeVerify(config)
+	currentConfig = config
+}
+
+// apply a (validated) config without reinitializing the caches:
+// the trust preferences (including CA sets and trust levels), SPKI pins,
+// TOFU settings, the modes combined by Verify and map server keys are
+// replaced, certificates, policies and TOFU pins remain cached and only the
+// proofs (and tree head pins and verified tree heads) of map servers that
+// were removed or that no longer accept one of their previous keys are removed
+func UpdateConfig(config *Config) *ConfigUpdate {
+	update := &ConfigUpdate{
+		AddedMapservers:   []string{},
+		RemovedMapservers: []string{},
+		ChangedMapservers: []string{},
+	}
+
+	// trust preferences are computed on demand, so they can simply be replaced
+	update.LegacyTrustPreferencesChanged = currentConfig == nil ||
+		!reflect.DeepEqual(currentConfig.TrustLevels, config.TrustLevels) ||
+		!reflect.DeepEqual(currentConfig.CASets, config.CASets) ||
+		!reflect.DeepEqual(currentConfig.LegacyTrustPreferences, config.LegacyTrustPreferences)
+	update.PolicyTrustPreferencesChanged = currentConfig == nil ||
+		!reflect.DeepEqual(currentConfig.TrustLevels, config.TrustLevels) ||
+		!reflect.DeepEqual(currentConfig.PolicyCAs, config.PolicyCAs) ||
+		!reflect.DeepEqual(currentConfig.PolicyCASets, config.PolicyCASets) ||
+		!reflect.DeepEqual(currentConfig.PolicyTrustPreferences, config.PolicyTrustPreferences)
+	update.SPKIPinsChanged = currentConfig == nil ||
+		!reflect.DeepEqual(currentConfig.SPKIPins, config.SPKIPins)
+	InitializeLegacyTrustPreferences(config)
+	InitializePolicyTrustPreferences(config)
+	InitializeSPKIPins(config)
+	InitializeTOFU(config)
+	InitializeVerify(config)
+
+	// diff the map server keys. map servers that only gained keys (e.g., the
+	// next key of a key rotation) keep their proofs and tree head pins
+	newMapserverInfoCache := map[string]*MapServerInfo{}
+	for _, mapserver := range config.Mapservers {
+		mapserverInfo, err := newMapServerInfo(mapserver)
+		if err != nil {
+			fmt.Fprintf(logOutput, "[Go] Ignoring map server with invalid public key: %s\n", mapserver.Identity)
+			continue
+		}
+		if mapserverInfo != nil {
+			newMapserverInfoCache[mapserver.Identity] = mapserverInfo
+		}
+	}
+	invalidatedMapservers := map[string]bool{}
+	for id, mapserverInfo := range mapserverInfoCache {
+		newMapserverInfo, ok := newMapserverInfoCache[id]
+		if !ok {
+			update.RemovedMapservers = append(update.RemovedMapservers, id)
+			invalidatedMapservers[id] = true
+		} else if !newMapserverInfo.hasKeysOf(mapserverInfo) {
+			update.ChangedMapservers = append(update.ChangedMapservers, id)
+			invalidatedMapservers[id] = true
+		} else if !mapserverInfo.hasKeysOf(newMapserverInfo) {
+			update.ChangedMapservers = append(update.ChangedMapservers, id)
+		}
+	}
+	for id := range newMapserverInfoCache {
+		if _, ok := mapserverInfoCache[id]; !ok {
+			update.AddedMapservers = append(update.AddedMapservers, id)
+		}
+	}
+	sort.Strings(update.AddedMapservers)
+	sort.Strings(update.RemovedMapservers)
+	sort.Strings(update.ChangedMapservers)
+	mapserverInfoCache = newMapserverInfoCache
+	update.InvalidatedProofs = removeMapserverProofs(invalidatedMapservers)
+	removeTreeHeadPins(invalidatedMapservers)
+	removeVerifiedTreeHeads(invalidatedMapservers)
+
+	currentConfig = config
+	fmt.Fprintf(logOutput, "[Go] Updated config: %d map servers added, %d removed, %d changed, %d proofs invalidated\n",
+		len(update.AddedMapservers), len(update.RemovedMapservers), len(update.ChangedMapservers), update.InvalidatedProofs)
+	return update
+}
+
+// forget the verified signatures of the tree heads of the given map servers,
+// which may have been verified with a key that is no longer accepted.
+// returns the number of removed tree heads
+func removeVerifiedTreeHeads(mapserverIDs map[string]bool) int {
+	removed := 0
+	for treeHeadKey, verified := range verifiedTreeHeads {
+		if mapserverIDs[verified.mapserverID] {
+			delete(verifiedTreeHeads, treeHeadKey)
+			removed++
+		}
+	}
+	return removed
+}
+
+// remove all cached proofs received from the given map servers.
+// returns the number of removed proofs
+func removeMapserverProofs(mapserverIDs map[string]bool) int {
+	if len(mapserverIDs) == 0 {
+		return 0
+	}
+	removed := 0
+	for proofCacheKey, proofCacheEntry := range proofCache {
+		if mapserverIDs[proofCacheEntry.mapserverID] {
+			delete(proofCache, proofCacheKey)
+			removed++
+		}
+	}
+	for domain, proofCacheKeys := range domainProofCacheKeys {
+		var remainingKeys []string
+		for _, proofCacheKey := range proofCacheKeys {
+			if _, ok := proofCache[proofCacheKey]; ok {
+				remainingKeys = append(remainingKeys, proofCacheKey)
+			}
+		}
+		if len(remainingKeys) == 0 {
+			delete(domainProofCacheKeys, domain)
+		} else {
+			domainProofCacheKeys[domain] = remainingKeys
+		}
+	}
+	return removed
+}
@@ -0,0 +1,184 @@
+package cache_v2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// signed root of an epoch of a map server (as returned by its root endpoint).
+// the map server keeps a history of its roots, each new root starts a new
+// epoch (starting at 1), which is signed together with the root and the
+// commit time. map servers without root history do not set the epoch
+type MapServerTreeHead struct {
+	Root        []byte
+	TreeHeadSig []byte
+
+	// ID of the key that signed TreeHeadSig and EpochSig (not set by map
+	// servers without key IDs, then any valid key of the map server is
+	// accepted)
+	KeyID string
+
+	Epoch uint64
+
+	// commit time of the root (unix time in seconds)
+	Timestamp int64
+
+	// signature of the root, epoch and timestamp (see epochSignatureInput)
+	EpochSig []byte
+}
+
+// content signed by the epoch signature, the map server signs the JSON
+// encoding of this struct
+type epochSignatureInput struct {
+	Epoch     uint64
+	Timestamp int64
+	Root      []byte
+}
+
+// maps a map server identity to the tree head with the newest epoch that was
+// accepted from this map server. responses for older epochs are rejected, so
+// a map server cannot roll clients back to an older root.
+// the pins are not part of the proof cache (they are persisted by JS using
+// ExportTreeHeadPins and ImportTreeHeadPins), so they have their own lock
+var treeHeadPins = map[string]*MapServerTreeHead{}
+var treeHeadPinsMutex sync.Mutex
+
+// verify the epoch signature of a tree head and compare its epoch against the
+// pinned tree head of the map server. the tree head is pinned if its epoch is
+// newer. the root signature must be verified by the caller.
+// tree heads without epoch are only accepted until a tree head with epoch was
+// pinned for the map server
+func checkTreeHeadEpoch(mapserverID string, treeHead *MapServerTreeHead) error {
+	treeHeadPinsMutex.Lock()
+	defer treeHeadPinsMutex.Unlock()
+	pin := treeHeadPins[mapserverID]
+
+	if treeHead.Epoch == 0 {
+		if pin != nil {
+			return fmt.Errorf("tree head without epoch (pinned epoch: %d)", pin.Epoch)
+		}
+		return nil
+	}
+
+	// the pinned tree head was already verified
+	if pin != nil && treeHead.Epoch == pin.Epoch && treeHead.Timestamp == pin.Timestamp &&
+		bytes.Equal(treeHead.Root, pin.Root) && bytes.Equal(treeHead.EpochSig, pin.EpochSig) {
+		return nil
+	}
+
+	mapserverInfo, ok := mapserverInfoCache[mapserverID]
+	if !ok {
+		return fmt.Errorf("unknown map server %s", mapserverID)
+	}
+	signatureInput, err := json.Marshal(&epochSignatureInput{Epoch: treeHead.Epoch, Timestamp: treeHead.Timestamp, Root: treeHead.Root})
+	if err != nil {
+		return err
+	}
+	_, err = mapserverInfo.verifySignedBytes(signatureInput, treeHead.EpochSig, treeHead.KeyID)
+	if err != nil {
+		return fmt.Errorf("invalid signature of epoch %d: %s", treeHead.Epoch, err)
+	}
+
+	if pin != nil {
+		switch {
+		case treeHead.Epoch < pin.Epoch:
+			return fmt.Errorf("epoch %d is older than the pinned epoch %d", treeHead.Epoch, pin.Epoch)
+		case treeHead.Epoch == pin.Epoch && !bytes.Equal(treeHead.Root, pin.Root):
+			return fmt.Errorf("root of epoch %d differs from the pinned root of this epoch", treeHead.Epoch)
+		case treeHead.Epoch > pin.Epoch && treeHead.Timestamp < pin.Timestamp:
+			return fmt.Errorf("epoch %d has an earlier timestamp than the pinned epoch %d", treeHead.Epoch, pin.Epoch)
+		case treeHead.Epoch == pin.Epoch:
+			return nil
+		}
+	}
+	pinned := *treeHead
+	treeHeadPins[mapserverID] = &pinned
+	return nil
+}
+
+// verify a tree head of the map server with identity mapserverID (e.g., the
+// response of its root endpoint) and pin it if its epoch is newer than the
+// pinned epoch
+func PinTreeHead(mapserverID string, treeHead *MapServerTreeHead) error {
+	err := verifyTreeHeadSignature(treeHead.Root, treeHead.TreeHeadSig, mapserverID, treeHead.KeyID)
+	if err != nil {
+		return fmt.Errorf("Failed to verify signature of map server %s: %s", mapserverID, err)
+	}
+	err = checkTreeHeadEpoch(mapserverID, treeHead)
+	if err != nil {
+		return fmt.Errorf("Rejected tree head of map server %s: %s", mapserverID, err)
+	}
+	return nil
+}
+
+// the pinned tree head of a map server (nil if none is pinned)
+func GetPinnedTreeHead(mapserverID string) *MapServerTreeHead {
+	treeHeadPinsMutex.Lock()
+	defer treeHeadPinsMutex.Unlock()
+	pin, ok := treeHeadPins[mapserverID]
+	if !ok {
+		return nil
+	}
+	treeHead := *pin
+	return &treeHead
+}
+
+// remove the pins of the given map servers (e.g., if their key changed).
+// returns the number of removed pins
+func removeTreeHeadPins(mapserverIDs map[string]bool) int {
+	treeHeadPinsMutex.Lock()
+	defer treeHeadPinsMutex.Unlock()
+	removed := 0
+	for mapserverID := range mapserverIDs {
+		if _, ok := treeHeadPins[mapserverID]; ok {
+			delete(treeHeadPins, mapserverID)
+			removed++
+		}
+	}
+	return removed
+}
+
+// pinned tree head of a map server in the format of ExportTreeHeadPins
+type TreeHeadPin struct {
+	MapserverID string `json:"mapserverID"`
+	MapServerTreeHead
+}
+
+// encode all tree head pins as JSON (e.g., to persist them across browser
+// sessions)
+func ExportTreeHeadPins() ([]byte, error) {
+	treeHeadPinsMutex.Lock()
+	defer treeHeadPinsMutex.Unlock()
+	pins := []*TreeHeadPin{}
+	for mapserverID, treeHead := range treeHeadPins {
+		pins = append(pins, &TreeHeadPin{MapserverID: mapserverID, MapServerTreeHead: *treeHead})
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].MapserverID < pins[j].MapserverID })
+	return json.Marshal(pins)
+}
+
+// replace all tree head pins by JSON encoded pins (as returned by
+// ExportTreeHeadPins). returns the number of imported pins
+func ImportTreeHeadPins(data []byte) (int, error) {
+	var pins []*TreeHeadPin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return 0, fmt.Errorf("failed to decode tree head pins: %s", err)
+	}
+	importedPins := map[string]*MapServerTreeHead{}
+	for i, pin := range pins {
+		if pin == nil || pin.MapserverID == "" || pin.Epoch == 0 || len(pin.Root) == 0 {
+			return 0, fmt.Errorf("invalid tree head pin at index %d", i)
+		}
+		treeHead := pin.MapServerTreeHead
+		importedPins[pin.MapserverID] = &treeHead
+	}
+
+	treeHeadPinsMutex.Lock()
+	defer treeHeadPinsMutex.Unlock()
+	treeHeadPins = importedPins
+	fmt.Fprintf(logOutput, "[Go] Imported %d tree head pins\n", len(importedPins))
+	return len(importedPins), nil
+}
@@ -0,0 +1,137 @@
+package cache_v2
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tree head of an epoch signed with key (the root signature is not set)
+func createTestTreeHead(t *testing.T, key *rsa.PrivateKey, root []byte, epoch uint64, timestamp int64) *MapServerTreeHead {
+	signatureInput, err := json.Marshal(&epochSignatureInput{Epoch: epoch, Timestamp: timestamp, Root: root})
+	require.NoError(t, err)
+	hash := sha256.Sum256(signatureInput)
+	epochSig, err := rsa.SignPKCS1v15(rand.Reader, key, gocrypto.SHA256, hash[:])
+	require.NoError(t, err)
+	return &MapServerTreeHead{Root: root, Epoch: epoch, Timestamp: timestamp, EpochSig: epochSig}
+}
+
+// check that tree heads of older epochs are rejected
+func TestCheckTreeHeadEpoch(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	mapserverInfo, err := newMapServerInfo(&MapserverConfig{Identity: "epoch-mapserver", PublicKey: encodeTestPublicKey(t, key)})
+	require.NoError(t, err)
+	mapserverInfoCache = map[string]*MapServerInfo{"epoch-mapserver": mapserverInfo}
+	treeHeadPins = map[string]*MapServerTreeHead{}
+
+	// tree heads without epoch are accepted until an epoch is pinned
+	require.NoError(t, checkTreeHeadEpoch("epoch-mapserver", &MapServerTreeHead{Root: []byte{1}}))
+	require.Nil(t, GetPinnedTreeHead("epoch-mapserver"))
+
+	require.NoError(t, checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{2}, 2, 200)))
+	require.Equal(t, uint64(2), GetPinnedTreeHead("epoch-mapserver").Epoch)
+	require.NoError(t, checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{2}, 2, 200)))
+
+	err = checkTreeHeadEpoch("epoch-mapserver", &MapServerTreeHead{Root: []byte{1}})
+	require.ErrorContains(t, err, "without epoch")
+	err = checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{1}, 1, 100))
+	require.ErrorContains(t, err, "older than the pinned epoch 2")
+	err = checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{3}, 2, 200))
+	require.ErrorContains(t, err, "differs from the pinned root")
+	err = checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{3}, 3, 100))
+	require.ErrorContains(t, err, "earlier timestamp")
+	treeHead := createTestTreeHead(t, key, []byte{3}, 3, 300)
+	treeHead.Epoch = 4
+	err = checkTreeHeadEpoch("epoch-mapserver", treeHead)
+	require.ErrorContains(t, err, "invalid signature")
+	require.Equal(t, uint64(2), GetPinnedTreeHead("epoch-mapserver").Epoch)
+
+	require.NoError(t, checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{3}, 3, 300)))
+	require.Equal(t, []byte{3}, GetPinnedTreeHead("epoch-mapserver").Root)
+
+	// the pins can be exported and imported
+	pinsJSON, err := ExportTreeHeadPins()
+	require.NoError(t, err)
+	treeHeadPins = map[string]*MapServerTreeHead{}
+	nPins, err := ImportTreeHeadPins(pinsJSON)
+	require.NoError(t, err)
+	require.Equal(t, 1, nPins)
+	err = checkTreeHeadEpoch("epoch-mapserver", createTestTreeHead(t, key, []byte{2}, 2, 200))
+	require.ErrorContains(t, err, "older than the pinned epoch 3")
+	_, err = ImportTreeHeadPins([]byte(`[{"mapserverID": "epoch-mapserver"}]`))
+	require.Error(t, err)
+
+	// the pins of map servers whose key changed are removed
+	require.Equal(t, 1, removeTreeHeadPins(map[string]bool{"epoch-mapserver": true}))
+	require.Nil(t, GetPinnedTreeHead("epoch-mapserver"))
+}
+
+// check that batches without epoch are rejected once an epoch is pinned
+func TestVerifyBatchEpoch(t *testing.T) {
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "local-mapserver", PublicKey: TEST_MAPSERVER_PUBLIC_KEY}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+	treeHeadPins = map[string]*MapServerTreeHead{}
+
+	result := VerifyBatchAndGetMissingIDs("local-mapserver", createTestBatch())
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+
+	treeHeadPins["local-mapserver"] = &MapServerTreeHead{Root: []byte{1}, Epoch: 1}
+	result = VerifyBatchAndGetMissingIDs("local-mapserver", createTestBatch())
+	require.Len(t, result.MHTProofVerificationResults, 3)
+	for _, verificationResult := range result.MHTProofVerificationResults {
+		require.Contains(t, verificationResult, "Rejected tree head")
+	}
+	treeHeadPins = map[string]*MapServerTreeHead{}
+}
+
+// check that getproof responses for an older root than the pinned root are
+// rejected and that newer roots are pinned
+func TestVerifyProofResponseEpoch(t *testing.T) {
+	epochKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "local-mapserver", PublicKey: TEST_MAPSERVER_PUBLIC_KEY,
+		Keys: []*MapserverKeyConfig{{PublicKey: encodeTestPublicKey(t, epochKey)}}}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+	treeHeadPins = map[string]*MapServerTreeHead{}
+	t.Cleanup(func() { treeHeadPins = map[string]*MapServerTreeHead{} })
+	createResponses := func() []MapServerProofResponse {
+		var responses []MapServerProofResponse
+		for _, response := range createTestBatch().Responses {
+			response.TreeHeadSig = createTestBatch().TreeHeadSig
+			responses = append(responses, MapServerProofResponse{MapServerResponse: response})
+		}
+		return responses
+	}
+
+	result := VerifyAndGetMissingIDs("local-mapserver", createResponses())
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+
+	treeHeadPins["local-mapserver"] = &MapServerTreeHead{Root: []byte{1}, Epoch: 1, Timestamp: 100}
+	result = VerifyAndGetMissingIDs("local-mapserver", createResponses())
+	require.Len(t, result.MHTProofVerificationResults, 3)
+	for _, verificationResult := range result.MHTProofVerificationResults {
+		require.Contains(t, verificationResult, "Rejected tree head")
+	}
+	require.Empty(t, result.MissingCertificateIDs)
+	require.Empty(t, result.MissingPolicyIDs)
+
+	responses := createResponses()
+	for i := range responses {
+		treeHead := createTestTreeHead(t, epochKey, responses[i].PoI.Root, 2, 200)
+		responses[i].Epoch, responses[i].Timestamp, responses[i].EpochSig = treeHead.Epoch, treeHead.Timestamp, treeHead.EpochSig
+	}
+	responses[2].Epoch = 1
+	result = VerifyAndGetMissingIDs("local-mapserver", responses)
+	require.Equal(t, "success", result.MHTProofVerificationResults[0])
+	require.Equal(t, "success", result.MHTProofVerificationResults[1])
+	require.Contains(t, result.MHTProofVerificationResults[2], "invalid signature of epoch 1")
+	require.Equal(t, uint64(2), GetPinnedTreeHead("local-mapserver").Epoch)
+}
@@ -0,0 +1,310 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// validation modes used in explanations
+const (
+	LEGACY_MODE       = "legacy"
+	POLICY_MODE       = "policy"
+	SPKI_PINNING_MODE = "spki-pinning"
+	DANE_MODE         = "dane"
+	TOFU_MODE         = "tofu"
+)
+
+// JSON-serializable report describing how a validation verdict was reached.
+// Each call to VerifyLegacy, VerifyPolicy, VerifySPKIPins, VerifyDANE and VerifyTOFU fills in one explanation, which
+// is passed to JS (e.g., to be rendered in the popup or attached to bug reports)
+type ValidationExplanation struct {
+	// validation mode that produced this explanation
+	Mode string `json:"mode"`
+
+	// domain name used in the connection
+	DNSName string `json:"dnsName"`
+
+	// final verdict (SUCCESS or FAILURE)
+	EvaluationResult int `json:"evaluationResult"`
+
+	// the certificate chain received in the connection and its trust level
+	ConnectionChain *ChainExplanation `json:"connectionChain"`
+
+	// all cached certificate chains considered during legacy validation
+	Chains []*ChainExplanation `json:"chains"`
+
+	// cached certificate chains removed by lazy evaluation
+	PrunedChains []*PrunedChainExplanation `json:"prunedChains"`
+
+	// policy certificates applied during policy validation
+	Policies []*PolicyExplanation `json:"policies"`
+
+	// map server proofs covering the domain or one of its parents
+	Proofs []*ProofExplanation `json:"proofs"`
+
+	// trust-on-first-use check of the connection (TOFU mode only)
+	TOFU *TOFUResult `json:"tofu"`
+
+	// SPKI pins applied during SPKI pinning validation
+	// (nil if no pins are defined for the domain)
+	SPKIPins *SPKIPinExplanation `json:"spkiPins"`
+
+	// TLSA records evaluated during DANE validation
+	DANE *DANEExplanation `json:"dane"`
+
+	// free-form notes (e.g., why no policy was applied)
+	Notes []string `json:"notes"`
+}
+
+// a certificate chain and the trust level computed for it
+type ChainExplanation struct {
+	CertificateHashes   []string `json:"certificateHashes"`
+	CertificateSubjects []string `json:"certificateSubjects"`
+	TrustLevel          int      `json:"trustLevel"`
+
+	// legacy trust preference that produced the trust level
+	// (nil if the default trust level applies)
+	TrustRule *TrustRuleExplanation `json:"trustRule"`
+
+	// true if the chain had the highest trust level among the cached
+	// chains in the final evaluation round
+	HighestTrustLevel bool `json:"highestTrustLevel"`
+
+	// forbidden CA contained in the chain (nil if there is none)
+	ForbiddenCA *ForbiddenCAExplanation `json:"forbiddenCA"`
+}
+
+// the legacy trust preference rule that assigned a trust level to a chain
+type TrustRuleExplanation struct {
+	// domain (or wildcard/parent domain) for which the preference is defined
+	Domain     string `json:"domain"`
+	CASet      string `json:"caSet"`
+	TrustLevel int    `json:"trustLevel"`
+
+	// index of the certificate in the chain that matched the CA set
+	ChainIndex int    `json:"chainIndex"`
+	Subject    string `json:"subject"`
+}
+
+// a CA in a chain whose CA set is forbidden for the domain
+type ForbiddenCAExplanation struct {
+	// domain (or wildcard/parent domain) for which the CA set is forbidden
+	Domain string `json:"domain"`
+	CASet  string `json:"caSet"`
+
+	// index of the forbidden CA in the chain
+	ChainIndex int    `json:"chainIndex"`
+	Subject    string `json:"subject"`
+}
+
+// a cached chain that was removed during lazy evaluation
+type PrunedChainExplanation struct {
+	Chain  *ChainExplanation `json:"chain"`
+	Reason string            `json:"reason"`
+}
+
+// a policy certificate applied during policy validation and its outcome
+type PolicyExplanation struct {
+	Domain        string                  `json:"domain"`
+	Hash          string                  `json:"hash"`
+	ImmutableHash string                  `json:"immutableHash"`
+	Issuance      time.Time               `json:"issuance"`
+	Attributes    common.PolicyAttributes `json:"attributes"`
+
+	// conflicts between the connection and this policy certificate
+	Conflicts []*common.PolicyAttributes `json:"conflicts"`
+}
+
+// the SPKI pins applied to a connection and the public keys of its chain
+type SPKIPinExplanation struct {
+	// domain (or wildcard/parent domain) for which the pins are defined
+	Domain         string   `json:"domain"`
+	Mode           string   `json:"mode"`
+	LeafSPKIHashes []string `json:"leafSPKIHashes"`
+	CASPKIHashes   []string `json:"caSPKIHashes"`
+
+	// public key hashes of the connection chain (starting with the leaf)
+	ChainSPKIHashes []string `json:"chainSPKIHashes"`
+
+	// index of the certificate whose public key is pinned (-1 if none)
+	MatchedChainIndex int `json:"matchedChainIndex"`
+}
+
+// TLSA records of the service and the record matching the connection chain
+type DANEExplanation struct {
+	// service name of the records (e.g., _443._tcp.example.com)
+	Name         string                   `json:"name"`
+	DNSSECStatus string                   `json:"dnssecStatus"`
+	Records      []*TLSARecordExplanation `json:"records"`
+
+	// index of the first record matching the connection chain (-1 if none)
+	MatchedRecordIndex int `json:"matchedRecordIndex"`
+}
+
+// a TLSA record and whether it matches the connection chain
+type TLSARecordExplanation struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matchingType"`
+	Data         string `json:"data"`
+	Usable       bool   `json:"usable"`
+
+	// why the record cannot be used
+	Reason string `json:"reason,omitempty"`
+
+	// index of the certificate matching the record (-1 if none)
+	MatchedChainIndex int `json:"matchedChainIndex"`
+}
+
+// a map server proof for the domain (or one of its parents)
+type ProofExplanation struct {
+	Domain      string `json:"domain"`
+	MapserverID string `json:"mapserverId"`
+	ProofType   string `json:"proofType"`
+	Root        string `json:"root"`
+	Evaluated   bool   `json:"evaluated"`
+	Verified    bool   `json:"verified"`
+	Error       string `json:"error,omitempty"`
+}
+
+// helper function to allocate a new ValidationExplanation
+func newValidationExplanation(mode string, dnsName string) *ValidationExplanation {
+	return &ValidationExplanation{
+		Mode:         mode,
+		DNSName:      dnsName,
+		Chains:       []*ChainExplanation{},
+		PrunedChains: []*PrunedChainExplanation{},
+		Policies:     []*PolicyExplanation{},
+		Proofs:       []*ProofExplanation{},
+		Notes:        []string{},
+	}
+}
+
+// encode the explanation as JSON string
+func (e *ValidationExplanation) ToJSON() (string, error) {
+	explanationJSON, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(explanationJSON), nil
+}
+
+// describe a certificate chain by its certificate hashes and subjects
+func explainChain(certificateChain []*x509.Certificate) *ChainExplanation {
+	chainExplanation := &ChainExplanation{}
+	for _, certificate := range certificateChain {
+		chainExplanation.CertificateHashes = append(chainExplanation.CertificateHashes, GetRawCertificateHash(certificate))
+		chainExplanation.CertificateSubjects = append(chainExplanation.CertificateSubjects, certificate.Subject.String())
+	}
+	return chainExplanation
+}
+
+// describe a certificate chain and the legacy trust level it has for dnsName
+func explainLegacyChain(dnsName string, certificateChain []*x509.Certificate) *ChainExplanation {
+	chainExplanation := explainChain(certificateChain)
+	trustLevel, caSetID, chainIndex, domain := ComputeChainTrustLevelForDomainAndParents(dnsName, certificateChain)
+	chainExplanation.TrustLevel = trustLevel
+	if domain != "" {
+		chainExplanation.TrustRule = &TrustRuleExplanation{
+			Domain:     domain,
+			CASet:      caSetID,
+			TrustLevel: trustLevel,
+			ChainIndex: chainIndex,
+			Subject:    certificateChain[chainIndex].Subject.String(),
+		}
+	}
+	if forbiddenCA := FindForbiddenCA(dnsName, certificateChain); forbiddenCA != nil {
+		chainExplanation.ForbiddenCA = &ForbiddenCAExplanation{
+			Domain:     forbiddenCA.Domain,
+			CASet:      forbiddenCA.CASetIdentifier,
+			ChainIndex: forbiddenCA.ChainIndex,
+			Subject:    forbiddenCA.Subject,
+		}
+	}
+	return chainExplanation
+}
+
+// describe a policy certificate applied to the connection
+func explainPolicy(policy *common.PolicyCertificate) *PolicyExplanation {
+	return &PolicyExplanation{
+		Domain:        policy.Domain(),
+		Hash:          getPolicyHash(policy),
+		ImmutableHash: getImmutablePolicyHash(policy),
+		Issuance:      policy.TimeStamp,
+		Attributes:    policy.PolicyAttributes,
+		Conflicts:     []*common.PolicyAttributes{},
+	}
+}
+
+// collect the cached map server proofs for dnsName and its wildcard and
+// parent domains
+func explainProofs(dnsName string) []*ProofExplanation {
+	proofExplanations := []*ProofExplanation{}
+	visited := map[string]struct{}{}
+	for _, domain := range generateWildcardAndParentDomain(dnsName) {
+		if _, ok := visited[domain]; ok || domain == "" {
+			continue
+		}
+		visited[domain] = struct{}{}
+		for _, proofCacheKey := range domainProofCacheKeys[domain] {
+			proofCacheEntry, ok := proofCache[proofCacheKey]
+			if !ok {
+				continue
+			}
+			proofExplanation := explainProof(domain, proofCacheEntry)
+			proofExplanations = append(proofExplanations, proofExplanation)
+		}
+	}
+	return proofExplanations
+}
+
+// describe a cached map server proof for domain
+func explainProof(domain string, proofCacheEntry *ProofCacheEntry) *ProofExplanation {
+	proofExplanation := &ProofExplanation{
+		Domain:      domain,
+		MapserverID: proofCacheEntry.mapserverID,
+		ProofType:   "absence",
+		Root:        base64.StdEncoding.EncodeToString(proofCacheEntry.poi.Root),
+		Evaluated:   proofCacheEntry.evaluated,
+		Verified:    proofCacheEntry.evaluated && proofCacheEntry.result,
+	}
+	if proofCacheEntry.poi.ProofType == mapCommon.PoP {
+		proofExplanation.ProofType = "presence"
+	}
+	if proofCacheEntry.lastError != nil {
+		proofExplanation.Error = proofCacheEntry.lastError.Error()
+	}
+	return proofExplanation
+}
+
+// describe the SPKI pins applied to a certificate chain
+func explainSPKIPins(pinSet *SPKIPinSet, certificateChain []*x509.Certificate) *SPKIPinExplanation {
+	spkiPinExplanation := &SPKIPinExplanation{
+		Domain:            pinSet.Domain,
+		Mode:              pinSet.Mode,
+		LeafSPKIHashes:    append([]string{}, pinSet.LeafSPKIHashes...),
+		CASPKIHashes:      append([]string{}, pinSet.CASPKIHashes...),
+		ChainSPKIHashes:   []string{},
+		MatchedChainIndex: -1,
+	}
+	for _, certificate := range certificateChain {
+		spkiPinExplanation.ChainSPKIHashes = append(spkiPinExplanation.ChainSPKIHashes, getPublicKeyHash(certificate))
+	}
+	return spkiPinExplanation
+}
+
+// explain a TLSA record (before it is matched against the connection chain)
+func explainTLSARecord(record *TLSARecord) *TLSARecordExplanation {
+	return &TLSARecordExplanation{
+		Usage:             record.Usage,
+		Selector:          record.Selector,
+		MatchingType:      record.MatchingType,
+		Data:              record.Data,
+		MatchedChainIndex: -1,
+	}
+}
@@ -0,0 +1,104 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// read and validate a config in the format exported by the extension
+func loadTestConfig(t *testing.T, path string) *Config {
+	configBytes, err := cacheFileSystem.ReadFile(path)
+	require.NoError(t, err)
+	config, err := ParseConfig(configBytes)
+	require.NoError(t, err)
+	return config
+}
+
+// check that a failed legacy validation explains which cached chain
+// had a higher trust level and which preference produced it
+func TestLegacyExplanation(t *testing.T) {
+	reset(t)
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeLegacyTrustPreferences(loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json"))
+
+	AddCertificatesToCache([]*x509.Certificate{cc[4], cc[3]})
+	legacyTrustInfo := NewLegacyTrustInfo("leaf1", []*x509.Certificate{cc[2], cc[1], cc[0]})
+	VerifyLegacy(legacyTrustInfo)
+	require.Equal(t, FAILURE, legacyTrustInfo.EvaluationResult)
+
+	explanation := legacyTrustInfo.Explanation
+	require.Equal(t, LEGACY_MODE, explanation.Mode)
+	require.Equal(t, FAILURE, explanation.EvaluationResult)
+	require.Equal(t, 1, explanation.ConnectionChain.TrustLevel)
+	require.Equal(t, "Test Root", explanation.ConnectionChain.TrustRule.CASet)
+
+	require.Len(t, explanation.Chains, 1)
+	require.Equal(t, 2, explanation.Chains[0].TrustLevel)
+	require.True(t, explanation.Chains[0].HighestTrustLevel)
+	require.Equal(t, "leaf1", explanation.Chains[0].TrustRule.Domain)
+	require.Equal(t, "Test Intermediate 2", explanation.Chains[0].TrustRule.CASet)
+	require.Equal(t, cc[3].Subject.String(), explanation.Chains[0].TrustRule.Subject)
+	require.Empty(t, explanation.PrunedChains)
+
+	// the explanation must survive a JSON round trip
+	explanationJSON, err := explanation.ToJSON()
+	require.NoError(t, err)
+	var decoded ValidationExplanation
+	require.NoError(t, json.Unmarshal([]byte(explanationJSON), &decoded))
+	require.Equal(t, explanation.Chains[0].CertificateHashes, decoded.Chains[0].CertificateHashes)
+}
+
+// check that a connection chain containing a forbidden CA fails regardless
+// of the cached chains, that cached chains containing a forbidden CA are
+// pruned and that the explanation names the forbidden CA
+func TestLegacyForbiddenCASet(t *testing.T) {
+	reset(t)
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeLegacyTrustPreferences(loadTestConfig(t, "embedded/unit_test/validation/config_forbidden.json"))
+	connectionChain := []*x509.Certificate{cc[2], cc[1], cc[0]}
+
+	// forbidden preferences do not assign trust levels and apply to subdomains
+	require.Len(t, legacyTrustPreferences["leaf1"], 1)
+	require.Nil(t, FindForbiddenCA("leaf1", []*x509.Certificate{cc[4], cc[3], cc[0]}))
+	forbiddenCA := FindForbiddenCA("www.leaf1", connectionChain)
+	require.NotNil(t, forbiddenCA)
+	require.Equal(t, "leaf1", forbiddenCA.Domain)
+	require.Equal(t, 1, forbiddenCA.ChainIndex)
+
+	// the connection chain fails even though nothing is cached for the domain
+	legacyTrustInfo := NewLegacyTrustInfo("leaf1", connectionChain)
+	VerifyLegacy(legacyTrustInfo)
+	require.Equal(t, FAILURE, legacyTrustInfo.EvaluationResult)
+	require.Equal(t, "Test Intermediate 1", legacyTrustInfo.ForbiddenCA.CASetIdentifier)
+	explanation := legacyTrustInfo.Explanation
+	require.Equal(t, FAILURE, explanation.EvaluationResult)
+	require.Equal(t, "Test Intermediate 1", explanation.ConnectionChain.ForbiddenCA.CASet)
+	require.Equal(t, cc[1].Subject.String(), explanation.ConnectionChain.ForbiddenCA.Subject)
+	require.Len(t, explanation.Notes, 1)
+	require.Contains(t, explanation.Notes[0], cc[1].Subject.String())
+
+	// a cached chain containing the forbidden CA does not prevent other chains
+	AddCertificatesToCache([]*x509.Certificate{cc[2], cc[1]})
+	legacyTrustInfo = NewLegacyTrustInfo("leaf1", []*x509.Certificate{cc[4], cc[3], cc[0]})
+	VerifyLegacy(legacyTrustInfo)
+	require.Equal(t, SUCCESS, legacyTrustInfo.EvaluationResult)
+	require.Nil(t, legacyTrustInfo.ForbiddenCA)
+	require.Empty(t, legacyTrustInfo.Explanation.Chains)
+	require.Len(t, legacyTrustInfo.Explanation.PrunedChains, 1)
+	require.Equal(t, "Test Intermediate 1", legacyTrustInfo.Explanation.PrunedChains[0].Chain.ForbiddenCA.CASet)
+
+	// forbidden preferences cannot have a trust level
+	_, err := ParseConfig([]byte(`{
+		"trust-levels": {"High Trust": 2},
+		"ca-sets": {"Test Root": {"cas": []}},
+		"legacy-trust-preference": {"leaf1": [{"ca-set": "Test Root", "level": "High Trust", "forbidden": true}]}
+	}`))
+	require.ErrorContains(t, err, `legacy-trust-preference["leaf1"][0].level: forbidden preference cannot have a trust level`)
+}
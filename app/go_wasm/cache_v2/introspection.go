@@ -0,0 +1,245 @@
+package cache_v2
+
+import (
+	"sort"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// number of cache lookups and how they were resolved
+type LookupCounter struct {
+	// entry was already cached
+	Hits int64 `json:"hits"`
+
+	// entry was not cached (and has to be requested)
+	Misses int64 `json:"misses"`
+
+	// entry was previously rejected and is ignored
+	Ignored int64 `json:"ignored"`
+}
+
+// fraction of lookups of entries that are not ignored that were answered
+// from the cache (ignored lookups are only reported by Ignored)
+func (c LookupCounter) HitRate() float64 {
+	total := c.Hits + c.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(total)
+}
+
+// lookup counters for the certificate, policy and proof caches
+// (reset when the corresponding cache is initialized)
+var certificateLookups = LookupCounter{}
+var policyLookups = LookupCounter{}
+var proofLookups = LookupCounter{}
+var treeHeadLookups = LookupCounter{}
+
+// summary of a cached certificate
+type CachedCertificateInfo struct {
+	Hash      string    `json:"hash"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	IsCA      bool      `json:"isCA"`
+	TrustRoot bool      `json:"trustRoot"`
+
+	// only set for trust roots
+	TrustRootMetadata *TrustRootMetadata `json:"trustRootMetadata,omitempty"`
+}
+
+// summary of a cached policy certificate
+type CachedPolicyInfo struct {
+	Hash          string                  `json:"hash"`
+	ImmutableHash string                  `json:"immutableHash"`
+	Domain        string                  `json:"domain"`
+	Issuance      time.Time               `json:"issuance"`
+	Attributes    common.PolicyAttributes `json:"attributes"`
+}
+
+// reason why a certificate or policy hash is ignored
+type IgnoreInfo struct {
+	Hash    string `json:"hash"`
+	Ignored bool   `json:"ignored"`
+
+	// "certificate" or "policy"
+	Type   string `json:"type,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// summary statistics over all caches
+type CacheStatistics struct {
+	Certificates        int   `json:"certificates"`
+	TrustRoots          int   `json:"trustRoots"`
+	CertificateBytes    int64 `json:"certificateBytes"`
+	IgnoredCertificates int   `json:"ignoredCertificates"`
+	CertificateDNSNames int   `json:"certificateDnsNames"`
+
+	Policies        int   `json:"policies"`
+	PolicyBytes     int64 `json:"policyBytes"`
+	IgnoredPolicies int   `json:"ignoredPolicies"`
+	PolicyDNSNames  int   `json:"policyDnsNames"`
+
+	MapServers     int `json:"mapServers"`
+	Proofs         int `json:"proofs"`
+	VerifiedProofs int `json:"verifiedProofs"`
+
+	CertificateLookups     LookupCounter `json:"certificateLookups"`
+	CertificateHitRate     float64       `json:"certificateHitRate"`
+	PolicyLookups          LookupCounter `json:"policyLookups"`
+	PolicyHitRate          float64       `json:"policyHitRate"`
+	ProofLookups           LookupCounter `json:"proofLookups"`
+	ProofHitRate           float64       `json:"proofHitRate"`
+	TreeHeadLookups        LookupCounter `json:"treeHeadLookups"`
+	LegacyTrustPreferences int           `json:"legacyTrustPreferences"`
+	PolicyTrustPreferences int           `json:"policyTrustPreferences"`
+}
+
+// helper function to create a CachedCertificateInfo from a cache entry
+func newCachedCertificateInfo(certificateHash string, certificateCacheEntry *CertificateCacheEntry) *CachedCertificateInfo {
+	certificate := certificateCacheEntry.certificate
+	return &CachedCertificateInfo{
+		Hash:      certificateHash,
+		Subject:   certificate.Subject.String(),
+		Issuer:    certificate.Issuer.String(),
+		DNSNames:  certificate.DNSNames,
+		NotBefore: certificate.NotBefore,
+		NotAfter:  certificate.NotAfter,
+		IsCA:      certificate.IsCA,
+		TrustRoot: certificateCacheEntry.trustRoot,
+
+		TrustRootMetadata: certificateCacheEntry.trustRootMetadata,
+	}
+}
+
+// list all cached leaf certificates for a dns name
+// (including certificates for the corresponding wildcard name)
+func GetCachedCertificatesForDomain(dnsName string) []*CachedCertificateInfo {
+	cachedCertificates := []*CachedCertificateInfo{}
+	for _, currentDNSName := range getDNSNameAndWildcard(dnsName) {
+		for _, certificateHash := range dnsNameCache[currentDNSName] {
+			certificateCacheEntry, inCache := certificateCache[certificateHash]
+			if !inCache {
+				continue
+			}
+			cachedCertificates = append(cachedCertificates, newCachedCertificateInfo(certificateHash, certificateCacheEntry))
+		}
+	}
+	return cachedCertificates
+}
+
+// get a cached certificate (leaf, intermediate or root) by its hash
+func GetCachedCertificate(certificateHash string) (*CachedCertificateInfo, bool) {
+	certificateCacheEntry, inCache := certificateCache[certificateHash]
+	if !inCache {
+		return nil, false
+	}
+	return newCachedCertificateInfo(certificateHash, certificateCacheEntry), true
+}
+
+// list all cached policy certificates issued for a dns name
+func GetCachedPoliciesForDomain(dnsName string) []*CachedPolicyInfo {
+	cachedPolicies := []*CachedPolicyInfo{}
+	for _, policyHash := range policyDnsNameCache[dnsName] {
+		policyCacheEntry, inCache := policyCache[policyHash]
+		if !inCache {
+			continue
+		}
+		policy := policyCacheEntry.policy
+		cachedPolicies = append(cachedPolicies, &CachedPolicyInfo{
+			Hash:          policyHash,
+			ImmutableHash: policyCacheEntry.immutableHash,
+			Domain:        policy.Domain(),
+			Issuance:      policy.TimeStamp,
+			Attributes:    policy.PolicyAttributes,
+		})
+	}
+	return cachedPolicies
+}
+
+// build all cached certificate chains for a dns name and compute
+// their legacy trust levels
+func GetCertificateChainsWithTrustLevels(dnsName string) []*ChainExplanation {
+	chains := []*ChainExplanation{}
+	for _, certificateChainInfo := range GetCertificateChainsForDomain(dnsName) {
+		chains = append(chains, explainLegacyChain(dnsName, certificateChainInfo.certificateChain))
+	}
+	return chains
+}
+
+// determine whether (and why) a certificate or policy hash is ignored
+func GetIgnoreReason(hash string) *IgnoreInfo {
+	if reason, ignored := ignoredCertificateHashes[hash]; ignored {
+		return &IgnoreInfo{Hash: hash, Ignored: true, Type: "certificate", Reason: reason}
+	}
+	if reason, ignored := ignoredPolicyHashes[hash]; ignored {
+		return &IgnoreInfo{Hash: hash, Ignored: true, Type: "policy", Reason: reason}
+	}
+	return &IgnoreInfo{Hash: hash, Ignored: false}
+}
+
+// list all successfully verified proofs grouped by map server identifier
+func GetVerifiedProofsByMapserver() map[string][]*ProofExplanation {
+	verifiedProofs := map[string][]*ProofExplanation{}
+	domains := make([]string, 0, len(domainProofCacheKeys))
+	for domain := range domainProofCacheKeys {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		for _, proofCacheKey := range domainProofCacheKeys[domain] {
+			proofCacheEntry, inCache := proofCache[proofCacheKey]
+			if !inCache || !proofCacheEntry.evaluated || !proofCacheEntry.result {
+				continue
+			}
+			mapserverID := proofCacheEntry.mapserverID
+			verifiedProofs[mapserverID] = append(verifiedProofs[mapserverID], explainProof(domain, proofCacheEntry))
+		}
+	}
+	return verifiedProofs
+}
+
+// compute summary statistics over all caches
+func GetCacheStatistics() *CacheStatistics {
+	statistics := &CacheStatistics{
+		Certificates:        len(certificateCache),
+		IgnoredCertificates: len(ignoredCertificateHashes),
+		CertificateDNSNames: len(dnsNameCache),
+		Policies:            len(policyCache),
+		IgnoredPolicies:     len(ignoredPolicyHashes),
+		PolicyDNSNames:      len(policyDnsNameCache),
+		MapServers:          len(mapserverInfoCache),
+		Proofs:              len(proofCache),
+		CertificateLookups:  certificateLookups,
+		CertificateHitRate:  certificateLookups.HitRate(),
+		PolicyLookups:       policyLookups,
+		PolicyHitRate:       policyLookups.HitRate(),
+		ProofLookups:        proofLookups,
+		ProofHitRate:        proofLookups.HitRate(),
+		TreeHeadLookups:     treeHeadLookups,
+
+		LegacyTrustPreferences: len(legacyTrustPreferences),
+		PolicyTrustPreferences: len(policyTrustPreferences),
+	}
+	for _, certificateCacheEntry := range certificateCache {
+		statistics.CertificateBytes += int64(len(certificateCacheEntry.certificate.Raw))
+		if certificateCacheEntry.trustRoot {
+			statistics.TrustRoots++
+		}
+	}
+	for _, policyCacheEntry := range policyCache {
+		policyBytes, err := common.ToJSON(policyCacheEntry.policy)
+		if err == nil {
+			statistics.PolicyBytes += int64(len(policyBytes))
+		}
+	}
+	for _, proofCacheEntry := range proofCache {
+		if proofCacheEntry.evaluated && proofCacheEntry.result {
+			statistics.VerifiedProofs++
+		}
+	}
+	return statistics
+}
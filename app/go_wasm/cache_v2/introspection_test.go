@@ -0,0 +1,113 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// check that the cache contents, chains and statistics for a domain
+// can be queried
+func TestCacheIntrospection(t *testing.T) {
+	reset(t)
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeLegacyTrustPreferences(loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json"))
+	AddCertificatesToCache([]*x509.Certificate{cc[1], cc[2], cc[3], cc[4]})
+
+	cachedCertificates := GetCachedCertificatesForDomain("leaf1")
+	require.Len(t, cachedCertificates, 2)
+	for _, cachedCertificate := range cachedCertificates {
+		require.Equal(t, []string{"leaf1"}, cachedCertificate.DNSNames)
+		require.False(t, cachedCertificate.TrustRoot)
+	}
+
+	rootInfo, cached := GetCachedCertificate(GetRawCertificateHash(cc[0]))
+	require.True(t, cached)
+	require.True(t, rootInfo.TrustRoot)
+
+	trustLevels := []int{}
+	for _, chain := range GetCertificateChainsWithTrustLevels("leaf1") {
+		require.Len(t, chain.CertificateHashes, 3)
+		trustLevels = append(trustLevels, chain.TrustLevel)
+	}
+	require.ElementsMatch(t, []int{1, 2}, trustLevels)
+
+	missing := GetMissingCertificateHashesList([]string{GetRawCertificateHash(cc[2]), "not-cached"})
+	require.Equal(t, []string{"not-cached"}, missing)
+
+	statistics := GetCacheStatistics()
+	require.Equal(t, 5, statistics.Certificates)
+	require.Equal(t, 1, statistics.TrustRoots)
+	require.Equal(t, int64(1), statistics.CertificateLookups.Hits)
+	require.Equal(t, int64(1), statistics.CertificateLookups.Misses)
+	require.Equal(t, 0.5, statistics.CertificateHitRate)
+	require.Equal(t, 1, statistics.LegacyTrustPreferences)
+}
+
+// check that the reason for ignoring an expired certificate is reported
+func TestIgnoreReason(t *testing.T) {
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+
+	pemBytes, err := cacheFileSystem.ReadFile("embedded/unit_test/cache/root_certificates/root_certificate.pem")
+	require.NoError(t, err)
+	pemBlock, _ := pem.Decode(pemBytes)
+	root, err := x509.ParseCertificate(pemBlock.Bytes)
+	require.NoError(t, err)
+	pemBytes, err = cacheFileSystem.ReadFile("embedded/unit_test/cache/root_privatekeys/root_privatekey.pem")
+	require.NoError(t, err)
+	pemBlock, _ = pem.Decode(pemBytes)
+	rootKey, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	require.NoError(t, err)
+
+	// create a leaf certificate that expired yesterday
+	template, err := CreateCertificateTemplate(big.NewInt(int64(5)), []string{"expired"}, 1, 1, 1, 1, false, root, x509.SHA256WithRSA)
+	require.NoError(t, err)
+	template.NotBefore = time.Now().AddDate(0, 0, -2)
+	template.NotAfter = time.Now().AddDate(0, 0, -1)
+	privateKey, err := CreateAndStoreRSAPrivateKey(rand.New(rand.NewSource(int64(5))))
+	require.NoError(t, err)
+	pemBytes, err = CreateCertificate(template, privateKey.Public(), root, rootKey, rand.New(rand.NewSource(int64(0))))
+	require.NoError(t, err)
+	pemBlock, _ = pem.Decode(pemBytes)
+	expired, err := x509.ParseCertificate(pemBlock.Bytes)
+	require.NoError(t, err)
+
+	AddCertificatesToCache([]*x509.Certificate{expired})
+	ignoreInfo := GetIgnoreReason(GetRawCertificateHash(expired))
+	require.True(t, ignoreInfo.Ignored)
+	require.Equal(t, "certificate", ignoreInfo.Type)
+	require.Contains(t, ignoreInfo.Reason, "expired")
+
+	require.False(t, GetIgnoreReason(GetRawCertificateHash(root)).Ignored)
+	require.Empty(t, GetMissingCertificateHashesList([]string{GetRawCertificateHash(expired)}))
+	statistics := GetCacheStatistics()
+	require.Equal(t, int64(1), statistics.CertificateLookups.Ignored)
+	require.Equal(t, 0.0, statistics.CertificateHitRate)
+}
+
+// check that policy lookups are counted against the policy cache and that
+// ignored lookups are not counted as hits
+func TestPolicyLookups(t *testing.T) {
+	policyCache = map[string]*PolicyCacheEntry{"cached": {}}
+	ignoredPolicyHashes = map[string]string{"ignored": "expired"}
+	policyLookups = LookupCounter{}
+	t.Cleanup(func() {
+		policyCache = map[string]*PolicyCacheEntry{}
+		ignoredPolicyHashes = map[string]string{}
+	})
+
+	missing := GetMissingPolicyHashesList([]string{"cached", "ignored", "not-cached"})
+	require.Equal(t, []string{"not-cached"}, missing)
+
+	statistics := GetCacheStatistics()
+	require.Equal(t, LookupCounter{Hits: 1, Misses: 1, Ignored: 1}, statistics.PolicyLookups)
+	require.Equal(t, 0.5, statistics.PolicyHitRate)
+}
@@ -0,0 +1,151 @@
+package cache_v2
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// public key of a map server. map servers rotating their key have several
+// keys, the tree heads they sign carry the ID of the signing key
+type MapServerKey struct {
+	// base64 encoded SHA-256 hash of the DER encoded public key
+	// (SubjectPublicKeyInfo), the same ID as computed by the map server
+	keyID string
+
+	// TODO: allow for other algorithms than RSA
+	publicKey *rsa.PublicKey
+
+	// the key is only accepted between notBefore and notAfter (zero values
+	// are unbounded)
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// ID of a map server key (see MapServerKey.keyID)
+func mapserverKeyID(publicKey *rsa.PublicKey) (string, error) {
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	keyHash := sha256.Sum256(publicKeyDER)
+	return base64.StdEncoding.EncodeToString(keyHash[:]), nil
+}
+
+// parse a not-before or not-after timestamp of a map server key (the zero
+// time if it is not set)
+func parseKeyValidity(timestamp string) (time.Time, error) {
+	if timestamp == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 timestamp, got %q", timestamp)
+	}
+	return t, nil
+}
+
+func newMapServerKey(publicKeyBase64 string, notBefore string, notAfter string) (*MapServerKey, error) {
+	publicKey, err := util.DERBase64ToRSAPublic(publicKeyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot extract RSA public key from DER: %s", err)
+	}
+	keyID, err := mapserverKeyID(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot compute key ID: %s", err)
+	}
+	key := &MapServerKey{keyID: keyID, publicKey: publicKey}
+	if key.notBefore, err = parseKeyValidity(notBefore); err != nil {
+		return nil, err
+	}
+	if key.notAfter, err = parseKeyValidity(notAfter); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// the map server info of a map server config with its public key and
+// further keys. returns nil if the map server has no public key
+func newMapServerInfo(mapserver *MapserverConfig) (*MapServerInfo, error) {
+	mapserverInfo := &MapServerInfo{identifier: mapserver.Identity}
+	if mapserver.PublicKey != "" {
+		key, err := newMapServerKey(mapserver.PublicKey, "", "")
+		if err != nil {
+			return nil, err
+		}
+		mapserverInfo.keys = append(mapserverInfo.keys, key)
+	}
+	for _, keyConfig := range mapserver.Keys {
+		key, err := newMapServerKey(keyConfig.PublicKey, keyConfig.NotBefore, keyConfig.NotAfter)
+		if err != nil {
+			return nil, err
+		}
+		mapserverInfo.keys = append(mapserverInfo.keys, key)
+	}
+	if len(mapserverInfo.keys) == 0 {
+		return nil, nil
+	}
+	return mapserverInfo, nil
+}
+
+// returns true if the key is accepted at time t
+func (k *MapServerKey) validAt(t time.Time) bool {
+	return (k.notBefore.IsZero() || !t.Before(k.notBefore)) && (k.notAfter.IsZero() || !t.After(k.notAfter))
+}
+
+// verify a signature of the map server with the key identified by keyID.
+// if keyID is empty (e.g., for responses in the format of the fpki
+// responder), the signature is accepted if any currently valid key verifies it.
+// returns the key that verified the signature
+func (info *MapServerInfo) verifySignedBytes(data []byte, signature []byte, keyID string) (*MapServerKey, error) {
+	now := time.Now()
+	if keyID != "" {
+		for _, key := range info.keys {
+			if key.keyID != keyID {
+				continue
+			}
+			if !key.validAt(now) {
+				return nil, fmt.Errorf("key %s is not valid at %s", keyID, now.UTC().Format(time.RFC3339))
+			}
+			if err := crypto.VerifySignedBytes(data, signature, key.publicKey); err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+
+	err := fmt.Errorf("no valid key")
+	for _, key := range info.keys {
+		if !key.validAt(now) {
+			continue
+		}
+		if err = crypto.VerifySignedBytes(data, signature, key.publicKey); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// returns true if info accepts all keys of other with the same validity
+func (info *MapServerInfo) hasKeysOf(other *MapServerInfo) bool {
+	for _, otherKey := range other.keys {
+		found := false
+		for _, key := range info.keys {
+			if key.keyID == otherKey.keyID && key.notBefore.Equal(otherKey.notBefore) && key.notAfter.Equal(otherKey.notAfter) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
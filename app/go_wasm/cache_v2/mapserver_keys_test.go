@@ -0,0 +1,128 @@
+package cache_v2
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// base64 encoded DER public key of key (the format of the config)
+func encodeTestPublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(publicKeyDER)
+}
+
+// sign data the same way as the map server signs its roots
+func signTestBytes(t *testing.T, key *rsa.PrivateKey, data []byte) []byte {
+	hash := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, gocrypto.SHA256, hash[:])
+	require.NoError(t, err)
+	return signature
+}
+
+// check that the key verifying a tree head is selected by its key ID and
+// only accepted within its validity window (also for cached tree heads)
+func TestMapServerKeyRotation(t *testing.T) {
+	keys := make([]*rsa.PrivateKey, 3)
+	keyIDs := make([]string, 3)
+	for i := range keys {
+		var err error
+		keys[i], err = rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		keyIDs[i], err = mapserverKeyID(&keys[i].PublicKey)
+		require.NoError(t, err)
+	}
+	now := time.Now().UTC()
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{
+		Identity:  "rotating-mapserver",
+		PublicKey: encodeTestPublicKey(t, keys[0]),
+		Keys: []*MapserverKeyConfig{
+			{PublicKey: encodeTestPublicKey(t, keys[1]), NotBefore: now.Add(-time.Hour).Format(time.RFC3339)},
+			{PublicKey: encodeTestPublicKey(t, keys[2]), NotAfter: now.Add(-time.Hour).Format(time.RFC3339)},
+		},
+	}})
+	require.NoError(t, config.Validate())
+	require.True(t, InitializeMapserverInfoCache(config))
+
+	root := []byte("root")
+	for i := 0; i < 2; i++ {
+		signature := signTestBytes(t, keys[i], root)
+		require.NoError(t, verifyTreeHeadSignature(root, signature, "rotating-mapserver", keyIDs[i]))
+		require.Error(t, verifyTreeHeadSignature(root, signature, "rotating-mapserver", keyIDs[1-i]))
+		require.NoError(t, verifyTreeHeadSignature(root, signature, "rotating-mapserver", ""))
+	}
+	err := verifyTreeHeadSignature(root, signTestBytes(t, keys[2], root), "rotating-mapserver", keyIDs[2])
+	require.ErrorContains(t, err, "is not valid at")
+
+	// verified tree heads are no longer accepted once their key expired
+	signature := signTestBytes(t, keys[1], root)
+	require.NoError(t, verifyTreeHeadSignature(root, signature, "rotating-mapserver", keyIDs[1]))
+	mapserverInfoCache["rotating-mapserver"].keys[1].notAfter = now.Add(-time.Minute)
+	err = verifyTreeHeadSignature(root, signature, "rotating-mapserver", keyIDs[1])
+	require.ErrorContains(t, err, "is not valid at")
+	mapserverInfoCache["rotating-mapserver"].keys[1].notAfter = time.Time{}
+	require.Error(t, verifyTreeHeadSignature(root, signTestBytes(t, keys[2], root), "rotating-mapserver", ""))
+	err = verifyTreeHeadSignature(root, signTestBytes(t, keys[0], root), "rotating-mapserver", "unknown")
+	require.ErrorContains(t, err, "unknown key")
+
+	// batches are verified with the key of their key ID
+	config = loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "local-mapserver", PublicKey: TEST_MAPSERVER_PUBLIC_KEY,
+		Keys: []*MapserverKeyConfig{{PublicKey: encodeTestPublicKey(t, keys[1])}}}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+	treeHeadPins = map[string]*MapServerTreeHead{}
+	batch := createTestBatch()
+	batch.KeyID = keyIDs[1]
+	result := VerifyBatchAndGetMissingIDs("local-mapserver", batch)
+	require.False(t, result.Success())
+	batch.KeyID = mapserverInfoCache["local-mapserver"].keys[0].keyID
+	result = VerifyBatchAndGetMissingIDs("local-mapserver", batch)
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+}
+
+// check that adding a key keeps the proofs of a map server, while removing a
+// key invalidates them
+func TestUpdateConfigKeyRotation(t *testing.T) {
+	key1, key2 := createTestMapserverKey(t, 1), createTestMapserverKey(t, 2)
+	InitializeMapserverInfoCache(loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "mapserver1", PublicKey: key1}}))
+	proofCache["proof"] = newProofCacheEntry(nil, nil, "mapserver1", "", nil, nil, nil)
+
+	update := UpdateConfig(loadTestConfigWithMapservers(t, []*MapserverConfig{
+		{Identity: "mapserver1", PublicKey: key1, Keys: []*MapserverKeyConfig{{PublicKey: key2}}}}))
+	require.Equal(t, []string{"mapserver1"}, update.ChangedMapservers)
+	require.Equal(t, 0, update.InvalidatedProofs)
+	require.Len(t, mapserverInfoCache["mapserver1"].keys, 2)
+
+	update = UpdateConfig(loadTestConfigWithMapservers(t, []*MapserverConfig{
+		{Identity: "mapserver1", Keys: []*MapserverKeyConfig{{PublicKey: key2}}}}))
+	require.Equal(t, []string{"mapserver1"}, update.ChangedMapservers)
+	require.Equal(t, 1, update.InvalidatedProofs)
+	require.Empty(t, proofCache)
+}
+
+// check the validation of the keys of a map server
+func TestValidateMapserverKeys(t *testing.T) {
+	key1, key2 := createTestMapserverKey(t, 1), createTestMapserverKey(t, 2)
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "mapserver1", PublicKey: key1, Keys: []*MapserverKeyConfig{
+		{PublicKey: key1},
+		{PublicKey: key2, NotBefore: "2024-01-01"},
+		{PublicKey: createTestMapserverKey(t, 3), NotBefore: "2024-02-01T00:00:00Z", NotAfter: "2024-01-01T00:00:00Z"},
+		nil,
+	}}})
+	err := config.Validate()
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 4)
+	require.Equal(t, "mapservers[0].keys[0].publickey: duplicate key", errs[0].Error())
+	require.Equal(t, "mapservers[0].keys[1].not-before", errs[1].Path)
+	require.Equal(t, "mapservers[0].keys[2].not-after", errs[2].Path)
+	require.Equal(t, "mapservers[0].keys[3]", errs[3].Path)
+}
@@ -0,0 +1,350 @@
+package cache_v2
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// payloads returned by the map server's getpayloads endpoint together
+// with the certificate and policy IDs that were requested
+type MapServerMissingPayloadsResponse struct {
+	CertificateIDs []string
+	PolicyIDs      []string
+	Payloads       []string
+}
+
+// response of the map server's getproof endpoint for a domain (or one of its
+// parent domains) together with the epoch of its root (see MapServerTreeHead).
+// map servers without root history (e.g., the fpki responder) only return the
+// embedded response
+type MapServerProofResponse struct {
+	mapCommon.MapServerResponse
+
+	// ID of the key that signed the root (see MapServerTreeHead)
+	KeyID string
+
+	// epoch of the root (see MapServerTreeHead)
+	Epoch     uint64
+	Timestamp int64
+	EpochSig  []byte
+
+	// leaf value of a proof of presence if it is not the hash of the sorted
+	// certificate and policy IDs (responses derived from the entries of
+	// prefix responses, see MapServerPrefixEntry)
+	leafHash []byte
+}
+
+// the tree head of the root of a getproof response
+func (r *MapServerProofResponse) treeHead() *MapServerTreeHead {
+	return &MapServerTreeHead{Root: r.PoI.Root, TreeHeadSig: r.TreeHeadSig, KeyID: r.KeyID,
+		Epoch: r.Epoch, Timestamp: r.Timestamp, EpochSig: r.EpochSig}
+}
+
+// response of the map server's getproofs endpoint: the proofs for several
+// domains (and their parent domains) under a single signed root
+type MapServerBatchResponse struct {
+	Root        []byte
+	TreeHeadSig []byte
+	Responses   []mapCommon.MapServerResponse
+
+	// ID of the key that signed the root (see MapServerTreeHead)
+	KeyID string
+
+	// epoch of the root (see MapServerTreeHead)
+	Epoch     uint64
+	Timestamp int64
+	EpochSig  []byte
+
+	// queried domains for which no proofs were returned and the reason
+	Errors map[string]string
+}
+
+// stages reported to a ProgressFunc
+const (
+	PROOFS_STAGE       = "proofs"
+	PAYLOADS_STAGE     = "payloads"
+	CERTIFICATES_STAGE = "certificates"
+	POLICIES_STAGE     = "policies"
+)
+
+// called after each processed item of a (potentially long-running) stage
+// with the number of processed items and the total number of items.
+// returning an error aborts the processing (e.g., if the request was canceled)
+type ProgressFunc func(stage string, done int, total int) error
+
+// result of verifying the map server responses for a domain
+type VerifyAndGetMissingIDsResult struct {
+	// one result per map server response ("success" or an error message)
+	MHTProofVerificationResults []string
+
+	// base64 encoded hashes of certificates and policies that are not cached
+	MissingCertificateIDs []string
+	MissingPolicyIDs      []string
+}
+
+// returns true if all map server proofs could be verified
+func (r *VerifyAndGetMissingIDsResult) Success() bool {
+	for _, verificationResult := range r.MHTProofVerificationResults {
+		if verificationResult != "success" {
+			return false
+		}
+	}
+	return true
+}
+
+// verify the MHT proofs in the responses of the map server with identity
+// mapserverID and determine which certificates and policies are not yet cached
+func VerifyAndGetMissingIDs(mapserverID string, responses []MapServerProofResponse) *VerifyAndGetMissingIDsResult {
+	result, _ := VerifyAndGetMissingIDsWithProgress(mapserverID, responses, nil)
+	return result
+}
+
+// same as VerifyAndGetMissingIDs, but calls progress (if not nil) after
+// each verified map server response.
+// the tree head of each response is verified with the key of its key ID (any
+// valid key of the map server if not set). responses for a root older than
+// the pinned root of the map server are rejected (see checkTreeHeadEpoch),
+// newer roots are pinned
+func VerifyAndGetMissingIDsWithProgress(mapserverID string, responses []MapServerProofResponse, progress ProgressFunc) (*VerifyAndGetMissingIDsResult, error) {
+	mhtProofVerificationResults := []string{}
+	missingCertificates := make(map[string]struct{})
+	missingPolicies := make(map[string]struct{})
+	for i, response := range responses {
+		if progress != nil && i > 0 {
+			if err := progress(PROOFS_STAGE, i, len(responses)); err != nil {
+				return nil, err
+			}
+		}
+		certIDs := common.BytesToIDs(response.DomainEntry.CertIDs)
+		base64IDs := make([]string, len(certIDs))
+		for i, id := range certIDs {
+			base64IDs[i] = base64.StdEncoding.EncodeToString(id[:])
+		}
+
+		policyIDs := common.BytesToIDs(response.DomainEntry.PolicyIDs)
+		base64PolicyIDs := make([]string, len(policyIDs))
+		for i, id := range policyIDs {
+			base64PolicyIDs[i] = base64.StdEncoding.EncodeToString(id[:])
+		}
+
+		// reject responses for a root older than the pinned root. the epoch
+		// signature covers the root, the root signature is verified with the
+		// MHT proof
+		if err := checkTreeHeadEpoch(mapserverID, response.treeHead()); err != nil {
+			mhtProofVerificationResults = append(mhtProofVerificationResults, fmt.Sprintf("Rejected tree head of map server %s: %s", mapserverID, err))
+			continue
+		}
+
+		// verify MHT proof
+		proofCacheKey, err := addMapServerResponseToCache(response.MapServerResponse, certIDs, policyIDs, mapserverID, response.KeyID, response.leafHash)
+		if err != nil {
+			mhtProofVerificationResults = append(mhtProofVerificationResults, "Failed to add map server response to cache: "+err.Error())
+			continue
+		}
+		proofEntry := VerifyProof(proofCacheKey)
+		if proofEntry == nil {
+			mhtProofVerificationResults = append(mhtProofVerificationResults, "Failed to add entry to proof cache")
+			continue
+		} else if !proofEntry.Evaluated() || !proofEntry.Result() {
+			verificationResult := fmt.Sprintf("MHT Verification for %s and map server %s failed", response.DomainEntry.DomainName, mapserverID)
+			if proofEntry.LastError() != nil {
+				verificationResult += fmt.Sprintf(": %s", proofEntry.LastError().Error())
+			}
+			mhtProofVerificationResults = append(mhtProofVerificationResults, verificationResult)
+			continue
+		} else {
+			mhtProofVerificationResults = append(mhtProofVerificationResults, "success")
+		}
+
+		certificates := GetMissingCertificateHashesList(base64IDs)
+		uniqueCerts := make(map[string]struct{})
+		for _, id := range certificates {
+			missingCertificates[id] = struct{}{}
+			uniqueCerts[id] = struct{}{}
+		}
+		if len(uniqueCerts) < len(certificates) {
+			fmt.Fprintf(logOutput, "[Go] Duplicate certificates detected for %s: %v\n", response.DomainEntry.DomainName, certificates)
+		}
+
+		policies := GetMissingPolicyHashesList(base64PolicyIDs)
+		uniquePolicies := make(map[string]struct{})
+		for _, id := range policies {
+			missingPolicies[id] = struct{}{}
+			uniquePolicies[id] = struct{}{}
+		}
+		if len(uniquePolicies) < len(policies) {
+			fmt.Fprintf(logOutput, "[Go] Duplicate policies detected for %s: %v\n", response.DomainEntry.DomainName, policies)
+		}
+	}
+
+	result := &VerifyAndGetMissingIDsResult{
+		MHTProofVerificationResults: mhtProofVerificationResults,
+		MissingCertificateIDs:       []string{},
+		MissingPolicyIDs:            []string{},
+	}
+	for id := range missingCertificates {
+		result.MissingCertificateIDs = append(result.MissingCertificateIDs, id)
+	}
+	for id := range missingPolicies {
+		result.MissingPolicyIDs = append(result.MissingPolicyIDs, id)
+	}
+	sort.Strings(result.MissingCertificateIDs)
+	sort.Strings(result.MissingPolicyIDs)
+	if progress != nil && len(responses) > 0 {
+		if err := progress(PROOFS_STAGE, len(responses), len(responses)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// verify the MHT proofs of a batch response of the map server with identity
+// mapserverID and determine which certificates and policies are not yet cached
+func VerifyBatchAndGetMissingIDs(mapserverID string, batch *MapServerBatchResponse) *VerifyAndGetMissingIDsResult {
+	result, _ := VerifyBatchAndGetMissingIDsWithProgress(mapserverID, batch, nil)
+	return result
+}
+
+// same as VerifyBatchAndGetMissingIDs, but calls progress (if not nil) after
+// each verified map server response.
+// the signature of the batch root is verified once, the proofs of the
+// responses are then verified against the signed root
+func VerifyBatchAndGetMissingIDsWithProgress(mapserverID string, batch *MapServerBatchResponse, progress ProgressFunc) (*VerifyAndGetMissingIDsResult, error) {
+	err := verifyTreeHeadSignature(batch.Root, batch.TreeHeadSig, mapserverID, batch.KeyID)
+	if err != nil {
+		return failedBatchResult(len(batch.Responses), fmt.Sprintf("Failed to verify batch signature of map server %s: %s", mapserverID, err)), nil
+	}
+	// reject batches for a root older than the pinned root
+	err = checkTreeHeadEpoch(mapserverID, &MapServerTreeHead{Root: batch.Root, TreeHeadSig: batch.TreeHeadSig, KeyID: batch.KeyID,
+		Epoch: batch.Epoch, Timestamp: batch.Timestamp, EpochSig: batch.EpochSig})
+	if err != nil {
+		return failedBatchResult(len(batch.Responses), fmt.Sprintf("Rejected tree head of map server %s: %s", mapserverID, err)), nil
+	}
+
+	// a proof for a different root fails, since the batch signature does not
+	// match its root
+	responses := make([]MapServerProofResponse, len(batch.Responses))
+	for i, response := range batch.Responses {
+		response.TreeHeadSig = batch.TreeHeadSig
+		responses[i] = MapServerProofResponse{MapServerResponse: response, KeyID: batch.KeyID,
+			Epoch: batch.Epoch, Timestamp: batch.Timestamp, EpochSig: batch.EpochSig}
+	}
+	return VerifyAndGetMissingIDsWithProgress(mapserverID, responses, progress)
+}
+
+// result of a batch whose responses all failed with the same error
+func failedBatchResult(nResponses int, verificationResult string) *VerifyAndGetMissingIDsResult {
+	result := &VerifyAndGetMissingIDsResult{
+		MHTProofVerificationResults: make([]string, nResponses),
+		MissingCertificateIDs:       []string{},
+		MissingPolicyIDs:            []string{},
+	}
+	for i := range result.MHTProofVerificationResults {
+		result.MHTProofVerificationResults[i] = verificationResult
+	}
+	return result
+}
+
+// parse the payloads returned by the map server and add the requested
+// certificates and policies to the cache.
+// returns the hashes of all processed certificates and policies
+func AddMissingPayloads(response *MapServerMissingPayloadsResponse) ([]string, []string, error) {
+	payloads := make([][]byte, len(response.Payloads))
+	for i, b64payload := range response.Payloads {
+		payload, err := base64.StdEncoding.DecodeString(b64payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode payload: %s", err)
+		}
+		payloads[i] = payload
+	}
+	return AddMissingRawPayloads(response.CertificateIDs, response.PolicyIDs, payloads)
+}
+
+// end of the validity period of certificates added from map server payloads
+// (zero: the validity period of the certificates is kept)
+var payloadNotAfterOverride time.Time
+
+// replace the end of the validity period (NotAfter) of all certificates added
+// from map server payloads by notAfter. the zero time (default) disables the
+// override. only meant for testing with map servers storing expired
+// certificates (see README.md)
+func SetPayloadNotAfterOverride(notAfter time.Time) {
+	payloadNotAfterOverride = notAfter
+}
+
+// same as AddMissingPayloads, but takes the raw payloads (DER encoded
+// certificates and JSON encoded policies) instead of their base64 encoding.
+// certificateIDs and policyIDs are the base64 encoded hashes of the
+// requested payloads
+func AddMissingRawPayloads(certificateIDs []string, policyIDs []string, payloads [][]byte) ([]string, []string, error) {
+	return AddMissingRawPayloadsWithProgress(certificateIDs, policyIDs, payloads, nil)
+}
+
+// same as AddMissingRawPayloads, but calls progress (if not nil) after each
+// parsed payload and each processed certificate and policy
+func AddMissingRawPayloadsWithProgress(certificateIDs []string, policyIDs []string, payloads [][]byte, progress ProgressFunc) ([]string, []string, error) {
+	// split certificates and policies
+	certificateMissingIDSet := SliceToSet(certificateIDs)
+	fmt.Fprintf(logOutput, "[Go] cert missing set: %v\n", certificateMissingIDSet)
+	policyMissingIDSet := SliceToSet(policyIDs)
+	fmt.Fprintf(logOutput, "[Go] pol missing set: %v\n", policyMissingIDSet)
+
+	var certificatePayloads []*x509.Certificate
+	var policyPayloads []*common.PolicyCertificate
+	for i, payload := range payloads {
+		if progress != nil && i > 0 {
+			if err := progress(PAYLOADS_STAGE, i, len(payloads)); err != nil {
+				return nil, nil, err
+			}
+		}
+		payloadHash := sha256.Sum256(payload)
+		hash := base64.StdEncoding.EncodeToString(payloadHash[:])
+
+		if _, ok := certificateMissingIDSet[hash]; ok {
+			certificateParsed, err := x509.ParseCertificate(payload)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse certificate: %s", err)
+			}
+			if !payloadNotAfterOverride.IsZero() {
+				certificateParsed.NotAfter = payloadNotAfterOverride
+			}
+			certificatePayloads = append(certificatePayloads, certificateParsed)
+		} else if _, ok := policyMissingIDSet[hash]; ok {
+			policy, err := common.FromJSON(payload)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse policy: %s", err)
+			}
+			policyCertificate, ok := policy.(*common.PolicyCertificate)
+			if !ok {
+				return nil, nil, fmt.Errorf("payload with ID (%s) is not a policy certificate", hash)
+			}
+			policyPayloads = append(policyPayloads, policyCertificate)
+		} else {
+			// ignoring payloads that were not requested
+			fmt.Fprintf(logOutput, "Ignoring payload with ID (%v)\n", hash)
+		}
+	}
+
+	if progress != nil && len(payloads) > 0 {
+		if err := progress(PAYLOADS_STAGE, len(payloads), len(payloads)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	processedCertificates, err := AddCertificatesToCacheWithProgress(certificatePayloads, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	processedPolicies, err := AddPoliciesToCacheWithProgress(policyPayloads, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	return processedCertificates, processedPolicies, nil
+}
@@ -0,0 +1,47 @@
+package cache_v2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// check that only requested payloads are added to the cache
+func TestAddMissingPayloads(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+
+	response := &MapServerMissingPayloadsResponse{
+		CertificateIDs: []string{GetRawCertificateHash(cc[1]), GetRawCertificateHash(cc[2])},
+		Payloads: []string{
+			base64.StdEncoding.EncodeToString(cc[1].Raw),
+			base64.StdEncoding.EncodeToString(cc[2].Raw),
+			base64.StdEncoding.EncodeToString(cc[3].Raw),
+		},
+	}
+	var logs bytes.Buffer
+	SetLogOutput(&logs)
+	t.Cleanup(func() { SetLogOutput(os.Stdout) })
+	processedCertificates, processedPolicies, err := AddMissingPayloads(response)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "Ignoring payload with ID")
+	// a certificate can be processed more than once if it is also the
+	// parent of another certificate of the response
+	require.Equal(t, SliceToSet(response.CertificateIDs), SliceToSet(processedCertificates))
+	require.Empty(t, processedPolicies)
+	require.NotContains(t, certificateCache, GetRawCertificateHash(cc[3]))
+
+	// payloads that cannot be parsed are reported
+	invalidPayload := base64.StdEncoding.EncodeToString(cc[3].Raw[1:])
+	_, invalidPayloadHash := GetPayloadAndHash(invalidPayload)
+	response = &MapServerMissingPayloadsResponse{
+		CertificateIDs: []string{invalidPayloadHash},
+		Payloads:       []string{invalidPayload},
+	}
+	_, _, err = AddMissingPayloads(response)
+	require.Error(t, err)
+}
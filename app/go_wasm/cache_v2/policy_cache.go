@@ -4,8 +4,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"io/fs"
 	"log"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 
@@ -50,7 +51,8 @@ var immutablePolicyCache = map[string]*ImmutablePolicyCacheEntry{}
 // map containing all policy hashes that should be ignored
 // (not be requested from the map server again) in the future
 // (e.g., because they correspond to expired policies)
-var ignoredPolicyHashes = map[string]struct{}{}
+// and the reason why they are ignored
+var ignoredPolicyHashes = map[string]string{}
 
 // cache mapping a dns name to a list of policy hashes
 // of policies that correspond to this dns name
@@ -59,12 +61,19 @@ var policyDnsNameCache = map[string][]string{}
 // initialize the caches based on the (root) policy certificates in
 // the PCA trust store (trust store location: trustStoreDir)
 func InitializePolicyCache(trustStoreDir string) int {
+	return InitializePolicyCacheFromFS(cacheFileSystem, trustStoreDir)
+}
+
+// initialize the caches based on the (root) policy certificates in the
+// PCA trust store located at trustStoreDir within fileSystem
+func InitializePolicyCacheFromFS(fileSystem fs.FS, trustStoreDir string) int {
 	policyCache = map[string]*PolicyCacheEntry{}
 	immutablePolicyCache = map[string]*ImmutablePolicyCacheEntry{}
-	ignoredPolicyHashes = map[string]struct{}{}
+	ignoredPolicyHashes = map[string]string{}
 	policyDnsNameCache = map[string][]string{}
+	policyLookups = LookupCounter{}
 
-	files, err := cacheFileSystem.ReadDir(trustStoreDir)
+	files, err := fs.ReadDir(fileSystem, trustStoreDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -75,17 +84,17 @@ func InitializePolicyCache(trustStoreDir string) int {
 		}
 
 		// parse trust root certificate
-		path := filepath.Join(trustStoreDir, file.Name())
-		fileBytes, err := cacheFileSystem.ReadFile(path)
+		filePath := path.Join(trustStoreDir, file.Name())
+		fileBytes, err := fs.ReadFile(fileSystem, filePath)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		fmt.Printf("initializing with root (%s): %s\n", file, fileBytes)
+		fmt.Fprintf(logOutput, "initializing with root (%s): %s\n", file, fileBytes)
 
 		policy, err := util.PolicyCertificateFromBytes(fileBytes)
 		if err != nil {
-			log.Fatalf("loading policy certificate from trust store (%s): %s", path, err)
+			log.Fatalf("loading policy certificate from trust store (%s): %s", filePath, err)
 		}
 
 		policyHash := getPolicyHash(policy)
@@ -113,10 +122,14 @@ func GetMissingPolicyHashesList(policyHashes []string) []string {
 		// be requested again)
 		_, ignore := ignoredPolicyHashes[policyHash]
 		if ignore {
+			policyLookups.Ignored++
 			continue
 		}
-		if certificateCache[policyHash] == nil {
+		if policyCache[policyHash] == nil {
+			policyLookups.Misses++
 			missingPolicyHashes = append(missingPolicyHashes, policyHash)
+		} else {
+			policyLookups.Hits++
 		}
 	}
 	return missingPolicyHashes
@@ -126,10 +139,17 @@ func GetMissingPolicyHashesList(policyHashes []string) []string {
 // TODO: pot. hashing the certificates is unnecessary as the hashes might already
 // be available from the first mapserver response
 func AddPoliciesToCache(policies []*common.PolicyCertificate) []string {
+	processedPolicyHashes, _ := AddPoliciesToCacheWithProgress(policies, nil)
+	return processedPolicyHashes
+}
+
+// same as AddPoliciesToCache, but calls progress (if not nil) after each
+// processed policy (see AddCertificatesToCacheWithProgress)
+func AddPoliciesToCacheWithProgress(policies []*common.PolicyCertificate, progress ProgressFunc) ([]string, error) {
 	nEntriesBefore := len(policyCache)
 	now := time.Now()
 
-	// fmt.Printf("policy 0: %v\n", policies[0])
+	// fmt.Fprintf(logOutput, "policy 0: %v\n", policies[0])
 	// create a map of all policies in the request, indicating whether
 	// the policy has already been processed
 	policiesInRequestProcessed := map[*common.PolicyCertificate]bool{}
@@ -149,26 +169,32 @@ func AddPoliciesToCache(policies []*common.PolicyCertificate) []string {
 	// skip certificates that have already been added
 	// in a recursive step
 	var processedPolicyHashes []string
-	for _, policy := range policies {
+	var err error
+	for i, policy := range policies {
 		if !policiesInRequestProcessed[policy] {
 			hashes, added := processPolicy(policy, policiesInRequestProcessed, policiesInRequest)
 			processedPolicyHashes = append(processedPolicyHashes, hashes...)
 			if added {
 				NCertificatesAdded++
 			} else {
-				fmt.Printf("[Go] Did not add policy: %v\n", policy)
+				fmt.Fprintf(logOutput, "[Go] Did not add policy: %v\n", policy)
+			}
+		}
+		if progress != nil {
+			if err = progress(POLICIES_STAGE, i+1, len(policies)); err != nil {
+				break
 			}
 		}
 	}
 	MS = MS + time.Now().Sub(now).Milliseconds()
-	fmt.Printf("[Go] Added %d policies to cache\n", len(policyCache)-nEntriesBefore)
-	fmt.Printf("[Go] Total # cache entries: %d\n", len(policyCache))
-	fmt.Printf("[Go] Time spent checking signatures: %d ms\n ", MSS)
+	fmt.Fprintf(logOutput, "[Go] Added %d policies to cache\n", len(policyCache)-nEntriesBefore)
+	fmt.Fprintf(logOutput, "[Go] Total # cache entries: %d\n", len(policyCache))
+	fmt.Fprintf(logOutput, "[Go] Time spent checking signatures: %d ms\n ", MSS)
 
 	MS = 0
 	NCertificatesAdded = int64(len(policyCache) - nEntriesBefore)
 
-	return processedPolicyHashes
+	return processedPolicyHashes, err
 }
 
 // process a certificate by potentially adding
@@ -251,7 +277,7 @@ func verifyPolicyAndAllocateCaches(
 	} else {
 		// ignore certificate for future requests if it wasn't added to the cache
 		// (e.g., because it was already expired)
-		ignoredCertificateHashes[policyHash] = struct{}{}
+		ignoredPolicyHashes[policyHash] = err.Error()
 		return false
 	}
 }
@@ -280,7 +306,7 @@ func allocatePolicyCacheEntries(policy *common.PolicyCertificate,
 	policyHash string,
 	immutablePolicyHash string,
 	immutableIssuerPolicyHash string) {
-	fmt.Printf("allocating policy: imm hash = %s, imm issuer hash = %s\n", immutablePolicyHash, immutableIssuerPolicyHash)
+	fmt.Fprintf(logOutput, "allocating policy: imm hash = %s, imm issuer hash = %s\n", immutablePolicyHash, immutableIssuerPolicyHash)
 
 	// add to policy cache
 	var policyCacheEntry *PolicyCacheEntry
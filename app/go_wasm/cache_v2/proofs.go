@@ -2,27 +2,23 @@ package cache_v2
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"sort"
+	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
-	"github.com/netsec-ethz/fpki/pkg/common/crypto"
 	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/trie"
-	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
 type MapServerInfo struct {
 	// some identifier of the map server
 	identifier string
 
-	// TODO: allow for other algorithms than RSA
-	// the public key used to verify the map server's MHT signature
-	publicKey *rsa.PublicKey
+	// the public keys used to verify the map server's MHT signature
+	keys []*MapServerKey
 }
 
 type ProofCacheEntry struct {
@@ -46,6 +42,10 @@ type ProofCacheEntry struct {
 	// map server that sent the inclusion proof
 	mapserverID string
 
+	// ID of the key that signed the tree head ("" if the response does not
+	// contain it, then any valid key of the map server is accepted)
+	keyID string
+
 	// true if the proof has been validated
 	evaluated bool
 
@@ -75,28 +75,47 @@ var mapserverInfoCache = map[string]*MapServerInfo{}
 // cache mapping base64 encoded (leaf hash + map server identifier) to a ProofCacheEntry
 var proofCache = map[string]*ProofCacheEntry{}
 
-func InitializeMapserverInfoCache(configMap map[string]interface{}) bool {
+// cache mapping a domain name to the keys of all proofCache entries
+// received for this domain
+var domainProofCacheKeys = map[string][]string{}
+
+// tree heads whose signature was verified, identified by
+// hash(root, tree head signature, mapserverID + key ID)
+var verifiedTreeHeads = map[string]*verifiedTreeHead{}
+
+// map server and key that verified the signature of a tree head. the tree
+// head is only accepted from the cache while the key is valid
+type verifiedTreeHead struct {
+	mapserverID string
+	key         *MapServerKey
+}
+
+// initialize the map server info cache with the map servers of a
+// (validated) config and their keys. returns false if a public key cannot be
+// parsed
+func InitializeMapserverInfoCache(config *Config) bool {
 	mapserverInfoCache = map[string]*MapServerInfo{}
 	proofCache = map[string]*ProofCacheEntry{}
+	domainProofCacheKeys = map[string][]string{}
+	verifiedTreeHeads = map[string]*verifiedTreeHead{}
+	proofLookups = LookupCounter{}
+	treeHeadLookups = LookupCounter{}
 
 	identities := []string{}
-	mapserversJSON := configMap["mapservers"].([]interface{})
-	for _, entryInterface := range mapserversJSON {
-		entry := entryInterface.(map[string]interface{})
-		id := entry["identity"].(string)
-		publicKeyDERBase64, ok := entry["publickey"]
-		if ok {
-			publicKey, err := util.DERBase64ToRSAPublic(publicKeyDERBase64.(string))
-			if err != nil {
-				log.Panicf("Cannot extract RSA public key from DER: %s", err)
-			}
-			mapserverInfoCache[id] = &MapServerInfo{identifier: id, publicKey: publicKey}
-			identities = append(identities, id)
-		} else {
-			fmt.Printf("Ignoring map server without public key: %s\n", id)
+	for _, mapserver := range config.Mapservers {
+		mapserverInfo, err := newMapServerInfo(mapserver)
+		if err != nil {
+			fmt.Fprintf(logOutput, "%s\n", err)
+			return false
 		}
+		if mapserverInfo == nil {
+			fmt.Fprintf(logOutput, "Ignoring map server without public key: %s\n", mapserver.Identity)
+			continue
+		}
+		mapserverInfoCache[mapserver.Identity] = mapserverInfo
+		identities = append(identities, mapserver.Identity)
 	}
-	fmt.Printf("Added %d map servers: %s\n", len(identities), identities)
+	fmt.Fprintf(logOutput, "Added %d map servers: %s\n", len(identities), identities)
 	return true
 }
 
@@ -120,35 +139,54 @@ func GetProofCacheKey(proofKey []byte, leafHash []byte, mapserverID string) (str
 	return base64.StdEncoding.EncodeToString(hash), nil
 }
 
-// add a new cache entry for this map server response if it does not exist yet and return the key used in the cache
-func AddMapServerResponseToCacheIfNecessary(response mapCommon.MapServerResponse, certIDs, policyIDs []*common.SHA256Output, mapserverID string) (string, error) {
-	// merge and sort cert and policy IDs
+// merge and sort the cert and policy IDs of a domain entry and calculate the
+// leaf hash (i.e., sha256 hash of the sorted concatenated IDs)
+func sortedIDsAndLeafHash(certIDs, policyIDs []*common.SHA256Output) ([]*common.SHA256Output, []byte) {
 	ids := append(certIDs[:0:0], certIDs...)
 	ids = append(ids, policyIDs...)
 	sort.Slice(ids, func(i, j int) bool {
 		return bytes.Compare(ids[i][:], ids[j][:]) == -1
 	})
+	concatenatedLeafHashes := common.IDsToBytes(ids)
+	return ids, common.SHA256Hash(concatenatedLeafHashes)
+}
 
-	// generate proof key
-	proofKey := common.SHA256Hash([]byte(response.DomainEntry.DomainName))
+// add a new cache entry for this map server response if it does not exist yet and return the key used in the cache
+func AddMapServerResponseToCacheIfNecessary(response mapCommon.MapServerResponse, certIDs, policyIDs []*common.SHA256Output, mapserverID string) (string, error) {
+	return addMapServerResponseToCache(response, certIDs, policyIDs, mapserverID, "", nil)
+}
 
+// same as AddMapServerResponseToCacheIfNecessary, but for a response whose
+// tree head was signed with the key keyID ("" if unknown) and whose leaf
+// value is entryLeafHash (nil if it is the hash of the IDs)
+func addMapServerResponseToCache(response mapCommon.MapServerResponse, certIDs, policyIDs []*common.SHA256Output, mapserverID string, keyID string, entryLeafHash []byte) (string, error) {
 	// calculate leaf hash to compare leaf values in PoPs (ignored in PoAs)
-	concatenatedLeafHashes := common.IDsToBytes(ids)
-	leafHash := common.SHA256Hash(concatenatedLeafHashes)
+	ids, leafHash := sortedIDsAndLeafHash(certIDs, policyIDs)
+	if entryLeafHash != nil {
+		leafHash = entryLeafHash
+	}
+
+	// generate proof key
+	proofKey := common.SHA256Hash([]byte(response.DomainEntry.DomainName))
 
 	// add entry to cache if necessary
 	proofCacheKey, err := GetProofCacheKey(proofKey, leafHash, mapserverID)
 	if err != nil {
 		return "", err
 	}
-	if _, ok := proofCache[proofCacheKey]; !ok {
-		proofCache[proofCacheKey] = newProofCacheEntry(&response.PoI, proofKey, mapserverID, response.TreeHeadSig, ids, leafHash)
+	if _, ok := proofCache[proofCacheKey]; ok {
+		proofLookups.Hits++
+	} else {
+		proofLookups.Misses++
+		proofCache[proofCacheKey] = newProofCacheEntry(&response.PoI, proofKey, mapserverID, keyID, response.TreeHeadSig, ids, leafHash)
+		domainName := response.DomainEntry.DomainName
+		domainProofCacheKeys[domainName] = append(domainProofCacheKeys[domainName], proofCacheKey)
 	}
 	return proofCacheKey, nil
 }
 
 // helper function to allocate a new ProofCacheEntry
-func newProofCacheEntry(poi *mapCommon.PoI, proofKey []byte, mapserverID string, treeHeadSignature []byte,
+func newProofCacheEntry(poi *mapCommon.PoI, proofKey []byte, mapserverID string, keyID string, treeHeadSignature []byte,
 	sortedCertificateHashes []*common.SHA256Output, leafHash []byte) *ProofCacheEntry {
 	proofCacheEntry := ProofCacheEntry{
 		poi:                     poi,
@@ -157,6 +195,7 @@ func newProofCacheEntry(poi *mapCommon.PoI, proofKey []byte, mapserverID string,
 		calculatedLeafHash:      leafHash,
 		calculatedProofKey:      proofKey,
 		mapserverID:             mapserverID,
+		keyID:                   keyID,
 		evaluated:               false,
 		result:                  false,
 		lastError:               nil,
@@ -215,8 +254,8 @@ func VerifyProof(proofCacheKey string) *ProofCacheEntry {
 		}
 	}
 
-	// verify the STH signature
-	err := crypto.VerifySignedBytes(poi.Root, proofCacheEntry.treeHeadSignature, mapserverInfoCache[proofCacheEntry.mapserverID].publicKey)
+	// verify the STH signature with the key that signed it
+	err := verifyTreeHeadSignature(poi.Root, proofCacheEntry.treeHeadSignature, proofCacheEntry.mapserverID, proofCacheEntry.keyID)
 	if err != nil {
 		proofCacheEntry.result = false
 		proofCacheEntry.evaluated = true
@@ -228,3 +267,35 @@ func VerifyProof(proofCacheKey string) *ProofCacheEntry {
 	proofCacheEntry.evaluated = true
 	return proofCacheEntry
 }
+
+// verify the map server's signature of a tree head with the key keyID (any
+// valid key if keyID is ""). the signature of each tree head is only verified
+// once, such that proofs sharing a root (e.g., the proofs of a batch response)
+// require a single signature check
+func verifyTreeHeadSignature(root []byte, treeHeadSignature []byte, mapserverID string, keyID string) error {
+	// same construction as the proof cache key: hash(root, signature, mapserverID + keyID)
+	treeHeadKey, err := GetProofCacheKey(root, treeHeadSignature, mapserverID+"\x00"+keyID)
+	if err != nil {
+		return err
+	}
+	if verified, ok := verifiedTreeHeads[treeHeadKey]; ok {
+		if verified.key.validAt(time.Now()) {
+			treeHeadLookups.Hits++
+			return nil
+		}
+		// the key expired since the signature was verified
+		delete(verifiedTreeHeads, treeHeadKey)
+	}
+	treeHeadLookups.Misses++
+
+	mapserverInfo, ok := mapserverInfoCache[mapserverID]
+	if !ok {
+		return fmt.Errorf("unknown map server %s", mapserverID)
+	}
+	key, err := mapserverInfo.verifySignedBytes(root, treeHeadSignature, keyID)
+	if err != nil {
+		return err
+	}
+	verifiedTreeHeads[treeHeadKey] = &verifiedTreeHead{mapserverID: mapserverID, key: key}
+	return nil
+}
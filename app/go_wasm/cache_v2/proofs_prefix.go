@@ -0,0 +1,363 @@
+package cache_v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// height of the map server's sparse Merkle tree (SHA-256 keys)
+const mhtHeight = 256
+
+// value of empty subtrees in the map server's sparse Merkle tree
+var mhtDefaultLeaf = []byte{0}
+
+// response of a hash prefix query: instead of a domain name, the client sends
+// the first PrefixBits bits of the hash of the domain name and the map server
+// returns all entries in the subtree of this prefix and the audit path of the
+// subtree. the client derives the proofs of the domains it is interested in
+// locally, such that the map server does not learn which domain was queried
+type MapServerPrefixResponse struct {
+	Root        []byte
+	TreeHeadSig []byte
+
+	// ID of the key that signed the root (see MapServerTreeHead)
+	KeyID string
+
+	// epoch of the root (see MapServerTreeHead)
+	Epoch     uint64
+	Timestamp int64
+	EpochSig  []byte
+
+	// the queried prefix of the hash of the domain name
+	Prefix     []byte
+	PrefixBits int
+
+	// audit path of the subtree, starting with the sibling closest to the
+	// subtree. the map server stops at a subtree with at most one entry, so
+	// the audit path may be shorter than PrefixBits
+	Proof [][]byte
+
+	// all entries of the subtree
+	Entries []*MapServerPrefixEntry
+}
+
+// entry of a prefix response in the format of the map server: the domain
+// name and its serialized domain entry. the leaf value of the domain is the
+// hash of the serialized entry (unlike the leaves of the fpki responder,
+// which are the hash of the sorted certificate and policy IDs)
+type MapServerPrefixEntry struct {
+	Domain           string
+	DomainEntryBytes []byte
+}
+
+// the parts of a serialized domain entry of the map server used by the
+// client: the certificates (and their chains) of each CA. the RPCs and SPs of
+// the entry are not policy certificates and are ignored
+type serializedDomainEntry struct {
+	DomainName string
+	CAEntry    []struct {
+		DomainCerts      [][]byte
+		DomainCertChains [][][]byte
+	}
+}
+
+// the DER encoded certificates of the entry (without duplicates)
+func (e *MapServerPrefixEntry) certificates() ([][]byte, error) {
+	var domainEntry serializedDomainEntry
+	if err := json.Unmarshal(e.DomainEntryBytes, &domainEntry); err != nil {
+		return nil, fmt.Errorf("failed to decode entry %s: %s", e.Domain, err)
+	}
+	if domainEntry.DomainName != e.Domain {
+		return nil, fmt.Errorf("entry %s contains the domain entry of %s", e.Domain, domainEntry.DomainName)
+	}
+	var certificates [][]byte
+	seen := map[[sha256.Size]byte]struct{}{}
+	add := func(certificate []byte) {
+		id := sha256.Sum256(certificate)
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			certificates = append(certificates, certificate)
+		}
+	}
+	for _, caEntry := range domainEntry.CAEntry {
+		for _, certificate := range caEntry.DomainCerts {
+			add(certificate)
+		}
+		for _, chain := range caEntry.DomainCertChains {
+			for _, certificate := range chain {
+				add(certificate)
+			}
+		}
+	}
+	return certificates, nil
+}
+
+// first bits bits of the hash of the domain name (the last byte is padded
+// with zeros)
+func PrefixOfDomain(domainName string, bits int) []byte {
+	prefix := common.SHA256Hash([]byte(domainName))[:(bits+7)/8]
+	if bits%8 != 0 {
+		prefix[len(prefix)-1] &= byte(0xff << (8 - bits%8))
+	}
+	return prefix
+}
+
+// returns true if the bit of key at depth is set (most significant bit first)
+func bitIsSet(key []byte, depth int) bool {
+	return key[depth/8]&(0x80>>(depth%8)) != 0
+}
+
+// returns true if the first bits bits of key and prefix are equal
+func hasPrefix(key []byte, prefix []byte, bits int) bool {
+	if bits > 8*len(key) || bits > 8*len(prefix) {
+		return false
+	}
+	for depth := 0; depth < bits; depth++ {
+		if bitIsSet(key, depth) != bitIsSet(prefix, depth) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns true if the prefix of the response covers the domain name
+func (r *MapServerPrefixResponse) Covers(domainName string) bool {
+	return hasPrefix(common.SHA256Hash([]byte(domainName)), r.Prefix, r.PrefixBits)
+}
+
+// sparse Merkle subtree of the entries of a prefix response
+type prefixSubtree struct {
+	// depth of the subtree root
+	depth int
+
+	// sorted keys (hash of the domain name), values (leaf hash) and entries
+	keys    [][]byte
+	values  [][]byte
+	entries []*MapServerPrefixEntry
+}
+
+func newPrefixSubtree(r *MapServerPrefixResponse) (*prefixSubtree, error) {
+	depth := len(r.Proof)
+	if depth > r.PrefixBits {
+		return nil, fmt.Errorf("audit path of %d nodes for a prefix of %d bits", depth, r.PrefixBits)
+	}
+	if depth < r.PrefixBits && len(r.Entries) > 1 {
+		return nil, fmt.Errorf("%d entries in a subtree of depth %d", len(r.Entries), depth)
+	}
+
+	for _, entry := range r.Entries {
+		if entry == nil {
+			return nil, fmt.Errorf("null entry")
+		}
+	}
+	subtree := &prefixSubtree{depth: depth, entries: append(r.Entries[:0:0], r.Entries...)}
+	sort.Slice(subtree.entries, func(i, j int) bool {
+		return bytes.Compare(common.SHA256Hash([]byte(subtree.entries[i].Domain)), common.SHA256Hash([]byte(subtree.entries[j].Domain))) == -1
+	})
+	for _, entry := range subtree.entries {
+		key := common.SHA256Hash([]byte(entry.Domain))
+		if !hasPrefix(key, r.Prefix, depth) {
+			return nil, fmt.Errorf("entry %s is not in the subtree of the prefix", entry.Domain)
+		}
+		if len(subtree.keys) > 0 && bytes.Equal(subtree.keys[len(subtree.keys)-1], key) {
+			return nil, fmt.Errorf("duplicate entry %s", entry.Domain)
+		}
+		subtree.keys = append(subtree.keys, key)
+		subtree.values = append(subtree.values, common.SHA256Hash(entry.DomainEntryBytes))
+	}
+	return subtree, nil
+}
+
+// hash of the node at the given depth containing the keys [start, end)
+func (s *prefixSubtree) hash(start, end, depth int) []byte {
+	switch end - start {
+	case 0:
+		return mhtDefaultLeaf
+	case 1:
+		return common.SHA256Hash(s.keys[start], s.values[start], []byte{byte(mhtHeight - depth)})
+	}
+	split := s.splitIndex(start, end, depth)
+	return common.SHA256Hash(s.hash(start, split, depth+1), s.hash(split, end, depth+1))
+}
+
+// index of the first key in [start, end) whose bit at depth is set
+func (s *prefixSubtree) splitIndex(start, end, depth int) int {
+	return start + sort.Search(end-start, func(i int) bool { return bitIsSet(s.keys[start+i], depth) })
+}
+
+// derive the map server response (the proof of presence or absence) of
+// domainName from the entries of the subtree. for a proof of presence, the
+// certificate IDs of the response are the IDs of the certificates of the
+// entry, which are returned as well
+func (r *MapServerPrefixResponse) proveDomain(domainName string) (*MapServerProofResponse, [][]byte, error) {
+	if !r.Covers(domainName) {
+		return nil, nil, fmt.Errorf("domain %s is not covered by the prefix %x/%d", domainName, r.Prefix, r.PrefixBits)
+	}
+	subtree, err := newPrefixSubtree(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// audit path within the subtree (starting with the sibling closest to the
+	// leaf), followed by the audit path of the subtree
+	key := common.SHA256Hash([]byte(domainName))
+	start, end := 0, len(subtree.keys)
+	var auditPath [][]byte
+	for depth := subtree.depth; end-start > 1; depth++ {
+		split := subtree.splitIndex(start, end, depth)
+		if bitIsSet(key, depth) {
+			auditPath = append([][]byte{subtree.hash(start, split, depth+1)}, auditPath...)
+			start = split
+		} else {
+			auditPath = append([][]byte{subtree.hash(split, end, depth+1)}, auditPath...)
+			end = split
+		}
+	}
+	auditPath = append(auditPath, r.Proof...)
+
+	response := &MapServerProofResponse{
+		MapServerResponse: mapCommon.MapServerResponse{
+			DomainEntry: &mapCommon.DomainEntry{DomainName: domainName},
+			PoI:         mapCommon.PoI{ProofType: mapCommon.PoA, Proof: auditPath, Root: r.Root},
+			TreeHeadSig: r.TreeHeadSig,
+		},
+		KeyID:     r.KeyID,
+		Epoch:     r.Epoch,
+		Timestamp: r.Timestamp,
+		EpochSig:  r.EpochSig,
+	}
+	var certificates [][]byte
+	if end-start == 1 {
+		if bytes.Equal(subtree.keys[start], key) {
+			certificates, err = subtree.entries[start].certificates()
+			if err != nil {
+				return nil, nil, err
+			}
+			var certIDs []*common.SHA256Output
+			for _, certificate := range certificates {
+				id := common.SHA256Output(sha256.Sum256(certificate))
+				certIDs = append(certIDs, &id)
+			}
+			response.DomainEntry.CertIDs = common.IDsToBytes(certIDs)
+			response.PoI.ProofType = mapCommon.PoP
+			response.PoI.ProofValue = subtree.values[start]
+			response.leafHash = subtree.values[start]
+		} else {
+			// the path of the domain ends in the leaf of another domain
+			response.PoI.ProofKey = subtree.keys[start]
+			response.PoI.ProofValue = subtree.values[start]
+		}
+	}
+	return response, certificates, nil
+}
+
+// derive the map server responses of domainNames from the prefix responses of
+// the map server with identity mapserverID, verify them and add the
+// certificates of the verified entries to the cache.
+// each domain name must be covered by one of the responses, otherwise its
+// verification fails. since the proofs are derived from all entries of the
+// subtree, an omitted or modified entry results in a different root and the
+// verification of the proofs of all domains in the subtree fails.
+// the prefix responses contain the certificates of all entries, so the
+// client does not need to fetch payloads (which would reveal the domains).
+// the missing IDs of the result are the certificates of verified proofs
+// that are neither cached nor in the entries (there are no missing policies,
+// see serializedDomainEntry)
+func VerifyPrefixAndGetMissingIDs(mapserverID string, domainNames []string, responses []*MapServerPrefixResponse) *VerifyAndGetMissingIDsResult {
+	result, _ := VerifyPrefixAndGetMissingIDsWithProgress(mapserverID, domainNames, responses, nil)
+	return result
+}
+
+// same as VerifyPrefixAndGetMissingIDs, but calls progress (if not nil) after
+// each verified map server response and each added certificate
+func VerifyPrefixAndGetMissingIDsWithProgress(mapserverID string, domainNames []string, responses []*MapServerPrefixResponse, progress ProgressFunc) (*VerifyAndGetMissingIDsResult, error) {
+	// reject responses for a root older than the pinned root
+	treeHeadErrors := make([]error, len(responses))
+	for i, r := range responses {
+		treeHeadErrors[i] = PinTreeHead(mapserverID, &MapServerTreeHead{Root: r.Root, TreeHeadSig: r.TreeHeadSig, KeyID: r.KeyID,
+			Epoch: r.Epoch, Timestamp: r.Timestamp, EpochSig: r.EpochSig})
+	}
+
+	// responses that could not be derived are not verified, their errors are
+	// merged into the results afterwards
+	derivationErrors := make([]string, len(domainNames))
+	var derivedResponses []MapServerProofResponse
+	var derivedCertificates [][][]byte
+	for i, domainName := range domainNames {
+		var response *MapServerPrefixResponse
+		var treeHeadErr error
+		for j, r := range responses {
+			if r.Covers(domainName) {
+				response, treeHeadErr = r, treeHeadErrors[j]
+				break
+			}
+		}
+		if response == nil {
+			derivationErrors[i] = fmt.Sprintf("No prefix response of map server %s covers %s", mapserverID, domainName)
+			continue
+		}
+		if treeHeadErr != nil {
+			derivationErrors[i] = treeHeadErr.Error()
+			continue
+		}
+		derivedResponse, certificates, err := response.proveDomain(domainName)
+		if err != nil {
+			derivationErrors[i] = fmt.Sprintf("Failed to derive proof for %s from prefix response of map server %s: %s", domainName, mapserverID, err)
+			continue
+		}
+		derivedResponses = append(derivedResponses, *derivedResponse)
+		derivedCertificates = append(derivedCertificates, certificates)
+	}
+
+	result, err := VerifyAndGetMissingIDsWithProgress(mapserverID, derivedResponses, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	// add the certificates of the verified entries. certificates that are not
+	// added to the cache (e.g., without a chain to a trust root) are provided
+	// by the entries and not missing
+	var payloads [][]byte
+	provided := map[string]struct{}{}
+	for i, verificationResult := range result.MHTProofVerificationResults {
+		if verificationResult == "success" {
+			for _, certificate := range derivedCertificates[i] {
+				id := sha256.Sum256(certificate)
+				provided[base64.StdEncoding.EncodeToString(id[:])] = struct{}{}
+			}
+			payloads = append(payloads, derivedCertificates[i]...)
+		}
+	}
+	if len(result.MissingCertificateIDs) > 0 {
+		if _, _, err = AddMissingRawPayloadsWithProgress(result.MissingCertificateIDs, nil, payloads, progress); err != nil {
+			return nil, err
+		}
+		missingCertificateIDs := []string{}
+		for _, id := range result.MissingCertificateIDs {
+			if _, ok := provided[id]; !ok {
+				missingCertificateIDs = append(missingCertificateIDs, id)
+			}
+		}
+		result.MissingCertificateIDs = missingCertificateIDs
+	}
+
+	verificationResults := make([]string, len(domainNames))
+	next := 0
+	for i := range domainNames {
+		if derivationErrors[i] != "" {
+			verificationResults[i] = derivationErrors[i]
+		} else {
+			verificationResults[i] = result.MHTProofVerificationResults[next]
+			next++
+		}
+	}
+	result.MHTProofVerificationResults = verificationResults
+	return result, nil
+}
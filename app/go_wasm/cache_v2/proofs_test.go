@@ -1,6 +1,9 @@
 package cache_v2
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"testing"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
@@ -106,6 +109,167 @@ func TestVerifyProof(t *testing.T) {
 	require.False(t, e.result)
 }
 
+// public key of the map server that signed the test responses
+const TEST_MAPSERVER_PUBLIC_KEY = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEArrrQ5MN4mdcp5XouqmcmPG489eRtbkIn9elKOCDLgpA9OFASKM26Vskm0jwR9unrVE8NXXdRbotQfVpL7iAPGOPfoSglBXKmiAdmRG0idw6+xRlpffgHE3CDhNnz1tpVXBTE+U84f48v+sVd1gnK4oA/uT7X7D6vO5cHK1M9rmpo+SiKlcYSHvF19/qgiwF9cc1z3ug6M4SciqEbUNdW1R3BSW+9ulTZluT4Hbml4C8hkktN9zlHUpWdHzH1NlcRqzObBp7ZvB/OrKh8iA0WBXLXNzlBdB9EXSHjqJcI/sKn0Zf/5RO9QYT8wjDDbj8H+4+/wRd2q8Y10yQomIy6WQIDAQAB"
+
+// batch response containing the test responses (which share the same root)
+func createTestBatch() *MapServerBatchResponse {
+	batch := &MapServerBatchResponse{}
+	for _, create := range []func() (mapCommon.MapServerResponse, []*common.SHA256Output, []*common.SHA256Output){
+		CreatePoPMapserverResponse, CreatePoADefaultParentLeafMapserverResponse, CreatePoAExistingParentLeafMapserverResponse} {
+		response, _, _ := create()
+		batch.Root = response.PoI.Root
+		batch.TreeHeadSig = response.TreeHeadSig
+		response.TreeHeadSig = nil
+		batch.Responses = append(batch.Responses, response)
+	}
+	return batch
+}
+
+// check that the proofs of a batch are verified with a single signature check
+func TestVerifyBatch(t *testing.T) {
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "local-mapserver", PublicKey: TEST_MAPSERVER_PUBLIC_KEY}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+
+	result := VerifyBatchAndGetMissingIDs("local-mapserver", createTestBatch())
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+	require.Len(t, result.MHTProofVerificationResults, 3)
+	require.NotEmpty(t, result.MissingCertificateIDs)
+	require.Equal(t, int64(1), treeHeadLookups.Misses)
+	require.Equal(t, int64(3), treeHeadLookups.Hits)
+
+	// wrong batch signature: no proof is accepted
+	require.True(t, InitializeMapserverInfoCache(config))
+	batch := createTestBatch()
+	batch.TreeHeadSig[0] = 42
+	result = VerifyBatchAndGetMissingIDs("local-mapserver", batch)
+	require.Len(t, result.MHTProofVerificationResults, 3)
+	for _, verificationResult := range result.MHTProofVerificationResults {
+		require.Contains(t, verificationResult, "Failed to verify batch signature")
+	}
+	require.Empty(t, result.MissingCertificateIDs)
+
+	// proof for a root other than the signed root of the batch
+	require.True(t, InitializeMapserverInfoCache(config))
+	batch = createTestBatch()
+	batch.Responses[1].PoI.Root = []byte{42}
+	result = VerifyBatchAndGetMissingIDs("local-mapserver", batch)
+	require.Equal(t, "success", result.MHTProofVerificationResults[0])
+	require.Contains(t, result.MHTProofVerificationResults[1], "failed")
+	require.Equal(t, "success", result.MHTProofVerificationResults[2])
+
+	// unknown map server
+	result = VerifyBatchAndGetMissingIDs("unknown-mapserver", createTestBatch())
+	require.False(t, result.Success())
+}
+
+// prefix response for the subtree containing the domain of a test response.
+// the audit path of the test response ends in the subtree, such that the
+// subtree contains only the entry of the response (if any)
+func createTestPrefixResponse(response mapCommon.MapServerResponse, bits int) *MapServerPrefixResponse {
+	return &MapServerPrefixResponse{
+		Root:        response.PoI.Root,
+		TreeHeadSig: response.TreeHeadSig,
+		Prefix:      PrefixOfDomain(response.DomainEntry.DomainName, bits),
+		PrefixBits:  bits,
+		Proof:       response.PoI.Proof,
+		Entries:     []*MapServerPrefixEntry{},
+	}
+}
+
+// check that proofs of absence derived from prefix responses are verified
+// (see TestVerifyPrefixMemoryBackend for proofs of presence)
+func TestVerifyPrefix(t *testing.T) {
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "local-mapserver", PublicKey: TEST_MAPSERVER_PUBLIC_KEY}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+
+	poa, _, _ := CreatePoADefaultParentLeafMapserverResponse()
+	responses := []*MapServerPrefixResponse{createTestPrefixResponse(poa, 20)}
+	result := VerifyPrefixAndGetMissingIDs("local-mapserver", []string{"cookielaw.org"}, responses)
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+	require.Len(t, result.MHTProofVerificationResults, 1)
+	require.Empty(t, result.MissingCertificateIDs)
+
+	// domain not covered by any prefix
+	result = VerifyPrefixAndGetMissingIDs("local-mapserver", []string{"baidu.com", "cookielaw.org"}, responses)
+	require.Contains(t, result.MHTProofVerificationResults[0], "No prefix response")
+	require.Equal(t, "success", result.MHTProofVerificationResults[1])
+
+	// more than one entry in a subtree above the prefix
+	responses[0].Entries = []*MapServerPrefixEntry{{Domain: "cookielaw.org"}, {Domain: "baidu.com"}}
+	result = VerifyPrefixAndGetMissingIDs("local-mapserver", []string{"cookielaw.org"}, responses)
+	require.Contains(t, result.MHTProofVerificationResults[0], "Failed to derive proof")
+}
+
+// prefix proof of the map server's memory backend generated by
+// TestPrefixProofFixture of the mapserver and domains covered by the prefix
+// that are not in the tree
+type prefixProofFixture struct {
+	MapServerPrefixResponse
+	AbsentDomains []string
+}
+
+// check that the proofs derived from a prefix proof of the map server's memory
+// backend (a subtree with several entries) are verified and the certificates
+// of the entries are added without fetching payloads
+func TestVerifyPrefixMemoryBackend(t *testing.T) {
+	fixtureBytes, err := cacheFileSystem.ReadFile("embedded/unit_test/prefix/prefix_proof.json")
+	require.NoError(t, err)
+	var fixture prefixProofFixture
+	require.NoError(t, json.Unmarshal(fixtureBytes, &fixture))
+	require.Greater(t, len(fixture.Entries), 2)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	config := loadTestConfigWithMapservers(t, []*MapserverConfig{{Identity: "memory-mapserver", PublicKey: encodeTestPublicKey(t, key)}})
+	require.True(t, InitializeMapserverInfoCache(config))
+	resetCache(t)
+
+	response := &fixture.MapServerPrefixResponse
+	response.TreeHeadSig = signTestBytes(t, key, response.Root)
+	var domainNames []string
+	for _, entry := range response.Entries {
+		domainNames = append(domainNames, entry.Domain)
+	}
+	domainNames = append(domainNames, fixture.AbsentDomains...)
+	result := VerifyPrefixAndGetMissingIDs("memory-mapserver", domainNames, []*MapServerPrefixResponse{response})
+	require.True(t, result.Success(), result.MHTProofVerificationResults)
+	require.Len(t, result.MHTProofVerificationResults, len(domainNames))
+	require.Empty(t, result.MissingCertificateIDs)
+	require.Empty(t, result.MissingPolicyIDs)
+
+	// the certificate IDs of the derived proofs of presence are the IDs of the
+	// certificates in the entries (the certificate of the domain and the CA)
+	proof, certificates, err := response.proveDomain(response.Entries[0].Domain)
+	require.NoError(t, err)
+	require.Equal(t, mapCommon.PoP, proof.PoI.ProofType)
+	require.Len(t, certificates, 2)
+	require.Len(t, common.BytesToIDs(proof.DomainEntry.CertIDs), 2)
+
+	// a modified entry changes the root of the subtree
+	proofCache = map[string]*ProofCacheEntry{}
+	var domainEntry map[string]any
+	require.NoError(t, json.Unmarshal(response.Entries[1].DomainEntryBytes, &domainEntry))
+	domainEntry["CAEntry"] = []any{}
+	modifiedEntryBytes, err := json.Marshal(domainEntry)
+	require.NoError(t, err)
+	response.Entries[1] = &MapServerPrefixEntry{Domain: response.Entries[1].Domain, DomainEntryBytes: modifiedEntryBytes}
+	result = VerifyPrefixAndGetMissingIDs("memory-mapserver", domainNames, []*MapServerPrefixResponse{response})
+	for _, verificationResult := range result.MHTProofVerificationResults {
+		require.Contains(t, verificationResult, "failed")
+	}
+
+	// an omitted entry changes the root of the subtree
+	proofCache = map[string]*ProofCacheEntry{}
+	response.Entries = response.Entries[2:]
+	result = VerifyPrefixAndGetMissingIDs("memory-mapserver", domainNames, []*MapServerPrefixResponse{response})
+	for _, verificationResult := range result.MHTProofVerificationResults {
+		require.Contains(t, verificationResult, "failed")
+	}
+}
+
 func CreatePoAExistingParentLeafMapserverResponse() (mapCommon.MapServerResponse, []*common.SHA256Output, []*common.SHA256Output) {
 	response := mapCommon.MapServerResponse{
 		DomainEntry: &mapCommon.DomainEntry{
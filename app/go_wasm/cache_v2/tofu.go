@@ -0,0 +1,317 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outcomes of the trust-on-first-use (TOFU) check of a connection
+const (
+	// TOFU is disabled or the domain has policies or explicit legacy trust preferences
+	TOFU_NOT_APPLICABLE = "not-applicable"
+
+	// first connection to the domain (or the previous pin expired), a new pin was created
+	TOFU_PINNED = "pinned"
+
+	// the issuing CA of the connection is pinned
+	TOFU_MATCH = "match"
+
+	// the issuing CA changed, but a cached (map server) certificate for the
+	// domain was issued by the new CA, which was therefore added to the pin
+	TOFU_UPDATED = "updated"
+
+	// the issuing CA changed without a corresponding map server record
+	TOFU_VIOLATION = "violation"
+)
+
+// the issuing CAs, CA sets and leaf public keys of the connections to a
+// domain that were accepted since the pin was created
+type TOFUPin struct {
+	DNSName string `json:"dnsName"`
+
+	// subjects of the CAs that issued the connection leaf certificates
+	IssuerSubjects []string `json:"issuerSubjects"`
+
+	// CA sets of the connection chains, each a sorted list of base64 encoded
+	// hashes of the CA certificates (i.e., all certificates but the leaf)
+	CASets [][]string `json:"caSets"`
+
+	// base64 encoded hashes of the leaf RawSubjectPublicKeyInfo
+	LeafSPKIHashes []string `json:"leafSPKIHashes"`
+
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	// the pin is ignored (and replaced) after this time
+	// (zero if pins do not expire)
+	Expiry time.Time `json:"expiry"`
+}
+
+// result of the TOFU check of a connection
+type TOFUResult struct {
+	Status string `json:"status"`
+
+	// issuing CA of the connection leaf certificate
+	IssuerSubject string `json:"issuerSubject"`
+
+	// CA set of the connection chain
+	CASet []string `json:"caSet"`
+
+	// true if the connection CA set was not pinned before, but its issuing CA
+	// was (informational, e.g., a reissued intermediate or another root)
+	CASetChanged bool `json:"caSetChanged"`
+
+	// true if the connection leaf public key was not pinned before
+	// (informational, leaf keys change on most certificate renewals)
+	LeafSPKIChanged bool `json:"leafSPKIChanged"`
+
+	// the pin after the check (nil if TOFU is not applicable)
+	Pin *TOFUPin `json:"pin"`
+}
+
+type TOFUTrustInfo struct {
+	// domain name used in the connection
+	DNSName string
+
+	// certificate chain received during the connection establishment
+	CertificateChain []*x509.Certificate
+
+	// result of the check against the pin of the domain
+	Result *TOFUResult
+
+	// result of TOFU validation (FAILURE on a TOFU_VIOLATION)
+	EvaluationResult int
+
+	// timestamp indicating how long this
+	// validation outcome can be cached
+	MaxValidity time.Time
+
+	// report describing how the validation outcome was reached
+	Explanation *ValidationExplanation
+}
+
+// maps a domain name to its TOFU pin.
+// the pins are not part of the certificate cache (they are persisted by JS
+// using ExportTOFUPins and ImportTOFUPins), so they have their own lock
+var tofuPins = map[string]*TOFUPin{}
+var tofuPinsMutex sync.Mutex
+
+// TOFU settings of the config
+var tofuPinning = false
+var tofuPinExpiry time.Duration = 0
+
+// initialize the TOFU settings with a (validated) config.
+// existing pins are kept
+func InitializeTOFU(config *Config) {
+	tofuPinning = config.TOFUPinning
+	tofuPinExpiry = time.Duration(config.TOFUPinExpiry) * time.Millisecond
+}
+
+// TOFU only applies to domains without policies and without legacy trust
+// preferences other than the global ("*") preferences
+func isTOFUApplicable(dnsName string) bool {
+	if !tofuPinning {
+		return false
+	}
+	for _, domain := range generateWildcardAndParentDomain(dnsName) {
+		if domain == "" || domain == "*" {
+			continue
+		}
+		if len(legacyTrustPreferences[domain]) > 0 || len(forbiddenLegacyTrustPreferences[domain]) > 0 {
+			return false
+		}
+		if len(policyDnsNameCache[domain]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// check if a cached certificate chain for the domain (i.e., a certificate
+// logged and returned by a map server) was issued by issuerSubject
+func hasCachedChainWithIssuer(dnsName string, issuerSubject string) bool {
+	for _, certificateChainInfo := range GetCertificateChainsForDomain(dnsName) {
+		if len(certificateChainInfo.certificateChain) > 1 && certificateChainInfo.certificateChain[1].Subject.String() == issuerSubject {
+			return true
+		}
+	}
+	return false
+}
+
+// the CA set of a certificate chain (see TOFUPin.CASets)
+func getCASet(certificateChain []*x509.Certificate) []string {
+	caSet := []string{}
+	for _, certificate := range certificateChain[1:] {
+		caSet = append(caSet, GetRawCertificateHash(certificate))
+	}
+	slices.Sort(caSet)
+	return slices.Compact(caSet)
+}
+
+// returns true if caSet is one of the pinned CA sets
+func (pin *TOFUPin) hasCASet(caSet []string) bool {
+	return slices.ContainsFunc(pin.CASets, func(pinnedCASet []string) bool { return slices.Equal(pinnedCASet, caSet) })
+}
+
+// check the connection certificate chain (that passed the other validation
+// modes) against the TOFU pin of the domain and create or extend the pin.
+// pins are only created or extended by connections that are not flagged
+func CheckTOFUPin(dnsName string, certificateChain []*x509.Certificate, now time.Time) *TOFUResult {
+	if len(certificateChain) < 2 || !isTOFUApplicable(dnsName) {
+		return &TOFUResult{Status: TOFU_NOT_APPLICABLE}
+	}
+	issuerSubject := certificateChain[1].Subject.String()
+	caSet := getCASet(certificateChain)
+	leafSPKIHash := getPublicKeyHash(certificateChain[0])
+	result := &TOFUResult{IssuerSubject: issuerSubject, CASet: caSet}
+
+	tofuPinsMutex.Lock()
+	defer tofuPinsMutex.Unlock()
+	pin, ok := tofuPins[dnsName]
+	if !ok || (!pin.Expiry.IsZero() && now.After(pin.Expiry)) {
+		pin = &TOFUPin{
+			DNSName:        dnsName,
+			IssuerSubjects: []string{issuerSubject},
+			CASets:         [][]string{caSet},
+			LeafSPKIHashes: []string{leafSPKIHash},
+			FirstSeen:      now,
+			LastSeen:       now,
+		}
+		if tofuPinExpiry > 0 {
+			pin.Expiry = now.Add(tofuPinExpiry)
+		}
+		tofuPins[dnsName] = pin
+		result.Status = TOFU_PINNED
+		result.Pin = pin.copy()
+		return result
+	}
+
+	result.Status = TOFU_MATCH
+	if !slices.Contains(pin.IssuerSubjects, issuerSubject) {
+		if !hasCachedChainWithIssuer(dnsName, issuerSubject) {
+			result.Status = TOFU_VIOLATION
+			result.Pin = pin.copy()
+			return result
+		}
+		result.Status = TOFU_UPDATED
+		pin.IssuerSubjects = append(pin.IssuerSubjects, issuerSubject)
+	}
+	if !pin.hasCASet(caSet) {
+		// pins imported from older versions have no CA sets
+		result.CASetChanged = result.Status == TOFU_MATCH && len(pin.CASets) > 0
+		pin.CASets = append(pin.CASets, caSet)
+	}
+	if !slices.Contains(pin.LeafSPKIHashes, leafSPKIHash) {
+		result.LeafSPKIChanged = true
+		pin.LeafSPKIHashes = append(pin.LeafSPKIHashes, leafSPKIHash)
+	}
+	pin.LastSeen = now
+	result.Pin = pin.copy()
+	return result
+}
+
+// create new TOFUTrustInfo
+func NewTOFUTrustInfo(dnsName string, certificateChain []*x509.Certificate) *TOFUTrustInfo {
+	tofuTrustInfo := &TOFUTrustInfo{
+		DNSName:          dnsName,
+		CertificateChain: certificateChain,
+		EvaluationResult: 0,
+		Explanation:      newValidationExplanation(TOFU_MODE, dnsName),
+	}
+	tofuTrustInfo.Explanation.ConnectionChain = explainChain(certificateChain)
+	return tofuTrustInfo
+}
+
+// Evaluate whether the connection should be allowed according to the TOFU
+// pin of the domain and create or extend the pin (see CheckTOFUPin).
+// Verify only runs this mode for connections that passed all other modes
+func VerifyTOFU(trustInfo *TOFUTrustInfo) {
+	if trustInfo.Explanation == nil {
+		trustInfo.Explanation = newValidationExplanation(TOFU_MODE, trustInfo.DNSName)
+	}
+	explanation := trustInfo.Explanation
+	trustInfo.MaxValidity = time.Now().Add(10 * time.Minute)
+	trustInfo.Result = CheckTOFUPin(trustInfo.DNSName, trustInfo.CertificateChain, time.Now())
+	explanation.TOFU = trustInfo.Result
+
+	trustInfo.EvaluationResult = SUCCESS
+	switch trustInfo.Result.Status {
+	case TOFU_NOT_APPLICABLE:
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("TOFU does not apply to %s", trustInfo.DNSName))
+	case TOFU_VIOLATION:
+		trustInfo.EvaluationResult = FAILURE
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("issuing CA %s is not pinned for %s (pinned: %s) and no map server record for it exists",
+			trustInfo.Result.IssuerSubject, trustInfo.DNSName, strings.Join(trustInfo.Result.Pin.IssuerSubjects, "; ")))
+	}
+	explanation.EvaluationResult = trustInfo.EvaluationResult
+}
+
+// deep copy of a pin (pins are extended in place)
+func (pin *TOFUPin) copy() *TOFUPin {
+	pinCopy := *pin
+	pinCopy.IssuerSubjects = append([]string{}, pin.IssuerSubjects...)
+	pinCopy.CASets = [][]string{}
+	for _, caSet := range pin.CASets {
+		pinCopy.CASets = append(pinCopy.CASets, append([]string{}, caSet...))
+	}
+	pinCopy.LeafSPKIHashes = append([]string{}, pin.LeafSPKIHashes...)
+	return &pinCopy
+}
+
+// get all TOFU pins sorted by domain name
+func GetTOFUPins() []*TOFUPin {
+	tofuPinsMutex.Lock()
+	defer tofuPinsMutex.Unlock()
+	pins := []*TOFUPin{}
+	for _, dnsName := range sortedKeys(tofuPins) {
+		pins = append(pins, tofuPins[dnsName].copy())
+	}
+	return pins
+}
+
+// remove the TOFU pin of a domain (e.g., after the user confirmed a
+// legitimate change of the CA). returns false if no pin exists
+func RemoveTOFUPin(dnsName string) bool {
+	tofuPinsMutex.Lock()
+	defer tofuPinsMutex.Unlock()
+	if _, ok := tofuPins[dnsName]; !ok {
+		return false
+	}
+	delete(tofuPins, dnsName)
+	return true
+}
+
+// encode all TOFU pins as JSON (e.g., to persist them across browser sessions)
+func ExportTOFUPins() ([]byte, error) {
+	return json.Marshal(GetTOFUPins())
+}
+
+// replace all TOFU pins by JSON encoded pins (as returned by ExportTOFUPins).
+// expired pins are dropped. returns the number of imported pins
+func ImportTOFUPins(data []byte, now time.Time) (int, error) {
+	var pins []*TOFUPin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return 0, fmt.Errorf("failed to decode TOFU pins: %s", err)
+	}
+	importedPins := map[string]*TOFUPin{}
+	for i, pin := range pins {
+		if pin == nil || pin.DNSName == "" || len(pin.IssuerSubjects) == 0 {
+			return 0, fmt.Errorf("invalid TOFU pin at index %d", i)
+		}
+		if !pin.Expiry.IsZero() && now.After(pin.Expiry) {
+			continue
+		}
+		importedPins[pin.DNSName] = pin
+	}
+
+	tofuPinsMutex.Lock()
+	defer tofuPinsMutex.Unlock()
+	tofuPins = importedPins
+	fmt.Fprintf(logOutput, "[Go] Imported %d of %d TOFU pins\n", len(importedPins), len(pins))
+	return len(importedPins), nil
+}
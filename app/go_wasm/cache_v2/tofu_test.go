@@ -0,0 +1,165 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// load the unit test config without explicit legacy trust preferences and
+// with TOFU pinning enabled (disabled again after the test)
+func loadTestConfigWithTOFU(t *testing.T, pinExpiry time.Duration) *Config {
+	t.Cleanup(func() { InitializeTOFU(&Config{}) })
+	config := loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json")
+	config.LegacyTrustPreferences = map[string][]*LegacyTrustPreferenceConfig{}
+	config.TOFUPinning = true
+	config.TOFUPinExpiry = pinExpiry.Milliseconds()
+	return config
+}
+
+// check that the issuing CA is pinned on first use and that a change of the
+// issuing CA is only accepted if a cached certificate was issued by the new CA
+func TestTOFUPinning(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeConfig(loadTestConfigWithTOFU(t, 0))
+	_, err := ImportTOFUPins([]byte("[]"), time.Now())
+	require.NoError(t, err)
+	chain1 := []*x509.Certificate{cc[2], cc[1], cc[0]}
+	chain2 := []*x509.Certificate{cc[4], cc[3], cc[0]}
+
+	// legacy validation does not create pins
+	legacyTrustInfo := NewLegacyTrustInfo("leaf1", chain1)
+	VerifyLegacy(legacyTrustInfo)
+	require.Equal(t, SUCCESS, legacyTrustInfo.EvaluationResult)
+	require.Empty(t, GetTOFUPins())
+
+	// first use
+	tofuTrustInfo := NewTOFUTrustInfo("leaf1", chain1)
+	VerifyTOFU(tofuTrustInfo)
+	require.Equal(t, SUCCESS, tofuTrustInfo.EvaluationResult)
+	require.Equal(t, TOFU_PINNED, tofuTrustInfo.Result.Status)
+	require.Equal(t, []string{cc[1].Subject.String()}, tofuTrustInfo.Result.Pin.IssuerSubjects)
+	require.Equal(t, [][]string{getCASet(chain1)}, tofuTrustInfo.Result.Pin.CASets)
+	require.ElementsMatch(t, []string{GetRawCertificateHash(cc[1]), GetRawCertificateHash(cc[0])}, getCASet(chain1))
+	require.True(t, tofuTrustInfo.Result.Pin.Expiry.IsZero())
+
+	tofuTrustInfo = NewTOFUTrustInfo("leaf1", chain1)
+	VerifyTOFU(tofuTrustInfo)
+	require.Equal(t, SUCCESS, tofuTrustInfo.EvaluationResult)
+	require.Equal(t, TOFU_MATCH, tofuTrustInfo.Result.Status)
+	require.False(t, tofuTrustInfo.Result.LeafSPKIChanged)
+	require.False(t, tofuTrustInfo.Result.CASetChanged)
+
+	// the same issuing CA with another CA set extends the pin
+	result := CheckTOFUPin("leaf1", []*x509.Certificate{cc[2], cc[1]}, time.Now())
+	require.Equal(t, TOFU_MATCH, result.Status)
+	require.True(t, result.CASetChanged)
+	require.Len(t, result.Pin.CASets, 2)
+
+	// the issuing CA changed without a map server record
+	tofuTrustInfo = NewTOFUTrustInfo("leaf1", chain2)
+	VerifyTOFU(tofuTrustInfo)
+	require.Equal(t, FAILURE, tofuTrustInfo.EvaluationResult)
+	require.Equal(t, TOFU_VIOLATION, tofuTrustInfo.Result.Status)
+	require.Equal(t, cc[3].Subject.String(), tofuTrustInfo.Explanation.TOFU.IssuerSubject)
+	require.Len(t, tofuTrustInfo.Explanation.Notes, 1)
+	require.Len(t, GetTOFUPins()[0].IssuerSubjects, 1)
+
+	// the new issuing CA is corroborated by a cached certificate
+	AddCertificatesToCache([]*x509.Certificate{cc[4], cc[3]})
+	tofuTrustInfo = NewTOFUTrustInfo("leaf1", chain2)
+	VerifyTOFU(tofuTrustInfo)
+	require.Equal(t, SUCCESS, tofuTrustInfo.EvaluationResult)
+	require.Equal(t, TOFU_UPDATED, tofuTrustInfo.Result.Status)
+	require.Equal(t, []string{cc[1].Subject.String(), cc[3].Subject.String()}, GetTOFUPins()[0].IssuerSubjects)
+	require.Equal(t, [][]string{getCASet(chain1), getCASet([]*x509.Certificate{cc[2], cc[1]}), getCASet(chain2)}, GetTOFUPins()[0].CASets)
+	require.False(t, tofuTrustInfo.Result.CASetChanged)
+
+	// TOFU does not apply to domains with explicit preferences
+	InitializeConfig(loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json"))
+	require.Equal(t, TOFU_NOT_APPLICABLE, CheckTOFUPin("leaf1", chain1, time.Now()).Status)
+	require.True(t, RemoveTOFUPin("leaf1"))
+	require.False(t, RemoveTOFUPin("leaf1"))
+}
+
+// check that pins expire and that only non-expired pins are imported
+func TestTOFUPinExpiryAndExport(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeConfig(loadTestConfigWithTOFU(t, 24*time.Hour))
+	_, err := ImportTOFUPins([]byte("[]"), time.Now())
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	result := CheckTOFUPin("leaf1", []*x509.Certificate{cc[2], cc[1], cc[0]}, now)
+	require.Equal(t, TOFU_PINNED, result.Status)
+	require.Equal(t, now.Add(24*time.Hour), result.Pin.Expiry)
+	require.Equal(t, TOFU_PINNED, CheckTOFUPin("leaf2", []*x509.Certificate{cc[4], cc[3], cc[0]}, now.Add(12*time.Hour)).Status)
+
+	// an expired pin is replaced by the next connection
+	require.Equal(t, TOFU_VIOLATION, CheckTOFUPin("leaf1", []*x509.Certificate{cc[4], cc[3], cc[0]}, now.Add(time.Hour)).Status)
+	result = CheckTOFUPin("leaf1", []*x509.Certificate{cc[4], cc[3], cc[0]}, now.Add(25*time.Hour))
+	require.Equal(t, TOFU_PINNED, result.Status)
+	require.Equal(t, []string{cc[3].Subject.String()}, result.Pin.IssuerSubjects)
+
+	// export and import (the pin of leaf2 expired in the meantime)
+	pinsJSON, err := ExportTOFUPins()
+	require.NoError(t, err)
+	nPins, err := ImportTOFUPins(pinsJSON, now.Add(40*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, nPins)
+	pins := GetTOFUPins()
+	require.Len(t, pins, 1)
+	require.Equal(t, "leaf1", pins[0].DNSName)
+	require.Equal(t, now.Add(25*time.Hour), pins[0].FirstSeen)
+
+	_, err = ImportTOFUPins([]byte(`[{"dnsName": "leaf1"}]`), now)
+	require.ErrorContains(t, err, "invalid TOFU pin")
+	require.Len(t, GetTOFUPins(), 1)
+}
+
+// check that Verify only runs the TOFU mode if tofu-pinning is set and only
+// for connections that passed the other modes
+func TestVerifyTOFUMode(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	t.Cleanup(func() { InitializeVerify(&Config{}) })
+	_, err := ImportTOFUPins([]byte("[]"), time.Now())
+	require.NoError(t, err)
+	chain1 := []*x509.Certificate{cc[2], cc[1], cc[0]}
+
+	// disabled by default
+	config := loadTestConfigWithTOFU(t, 0)
+	config.TOFUPinning = false
+	InitializeConfig(config)
+	verdict := Verify("leaf1", 443, chain1)
+	require.NotContains(t, verdict.DecidingModes, TOFU_MODE)
+	require.Empty(t, GetTOFUPins())
+
+	// flagged connections do not create pins
+	InitializeConfig(loadTestConfigWithTOFU(t, 0))
+	stubVerificationMode(t, LEGACY_MODE, true, FAILURE)
+	verdict = Verify("leaf1", 443, chain1)
+	require.Equal(t, FAILURE, verdict.EvaluationResult)
+	require.Equal(t, TOFU_MODE, verdict.Results[len(verdict.Results)-1].Mode)
+	require.NotEmpty(t, verdict.Results[len(verdict.Results)-1].Skipped)
+	require.Empty(t, GetTOFUPins())
+
+	stubVerificationMode(t, LEGACY_MODE, true, SUCCESS)
+	verdict = Verify("leaf1", 443, chain1)
+	require.Equal(t, SUCCESS, verdict.EvaluationResult)
+	require.Contains(t, verdict.DecidingModes, TOFU_MODE)
+	require.Len(t, GetTOFUPins(), 1)
+
+	// the mode requires tofu-pinning
+	config = loadTestConfigWithTOFU(t, 0)
+	config.TOFUPinning = false
+	config.VerifyModes = []string{LEGACY_MODE, TOFU_MODE}
+	require.ErrorContains(t, config.Validate(), "verify-modes[1]")
+}
@@ -0,0 +1,463 @@
+package cache_v2
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trust metadata of a trust root (e.g., as defined in Mozilla's root store)
+type TrustRootMetadata struct {
+	// the root is trusted to issue server authentication certificates
+	ServerAuth bool `json:"serverAuth"`
+
+	// leaf certificates issued (NotBefore) after this date are not trusted
+	// (zero value: no distrust date)
+	DistrustAfter time.Time `json:"distrustAfter"`
+
+	// name constraints imposed on leaf certificates issued under the root
+	// (in addition to the name constraints in the certificates).
+	// "example.com" matches example.com and its subdomains,
+	// ".example.com" only matches subdomains
+	PermittedDNSDomains []string `json:"permittedDNSDomains,omitempty"`
+	ExcludedDNSDomains  []string `json:"excludedDNSDomains,omitempty"`
+}
+
+// trust metadata of roots without explicit metadata
+func DefaultTrustRootMetadata() *TrustRootMetadata {
+	return &TrustRootMetadata{ServerAuth: true}
+}
+
+// map containing the base64 encoded hashes of distrusted public keys
+// (RawSubjectPublicKeyInfo) and the reason why they are distrusted.
+// certificates with a distrusted public key are not added to the cache
+var distrustedPublicKeys = map[string]string{}
+
+// compute the base64 encoded hash of certificate.RawSubjectPublicKeyInfo
+func getPublicKeyHash(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// add a certificate to the caches as trust root
+// (replaces an existing non-root entry for the same certificate)
+func addTrustRootToCache(certificate *x509.Certificate, metadata *TrustRootMetadata) string {
+	certificateHash := GetRawCertificateHash(certificate)
+	certificateSubjectSKIHash := GetRawCertificateSubjectSKIHash(certificate)
+	certificateCacheEntry := &CertificateCacheEntry{
+		certificate:       certificate,
+		issuerAKIHash:     certificateSubjectSKIHash, // self-issued
+		trustRoot:         true,
+		trustRootMetadata: metadata,
+	}
+	certificateCache[certificateHash] = certificateCacheEntry
+
+	subjectSKICacheEntry, cached := subjectSKICache[certificateSubjectSKIHash]
+	if !cached {
+		subjectSKICacheEntry = newSubjectSKICacheEntry()
+		subjectSKICache[certificateSubjectSKIHash] = subjectSKICacheEntry
+	}
+	subjectSKICacheEntry.certificates[certificateHash] = struct{}{}
+	return certificateHash
+}
+
+// remove a certificate from the certificateCache, subjectSKICache and dnsNameCache
+func removeCertificateFromCache(certificateHash string) {
+	certificateCacheEntry, inCache := certificateCache[certificateHash]
+	if !inCache {
+		return
+	}
+	certificate := certificateCacheEntry.certificate
+	delete(certificateCache, certificateHash)
+
+	certificateSubjectSKIHash := GetRawCertificateSubjectSKIHash(certificate)
+	if subjectSKICacheEntry, ok := subjectSKICache[certificateSubjectSKIHash]; ok {
+		delete(subjectSKICacheEntry.certificates, certificateHash)
+		if len(subjectSKICacheEntry.certificates) == 0 {
+			delete(subjectSKICache, certificateSubjectSKIHash)
+		}
+	}
+
+	for _, dnsName := range certificate.DNSNames {
+		var certificateHashes []string
+		for _, hash := range dnsNameCache[dnsName] {
+			if hash != certificateHash {
+				certificateHashes = append(certificateHashes, hash)
+			}
+		}
+		if len(certificateHashes) == 0 {
+			delete(dnsNameCache, dnsName)
+		} else {
+			dnsNameCache[dnsName] = certificateHashes
+		}
+	}
+}
+
+// remove all cached certificates that can no longer be linked to a
+// trust root that is trusted for server authentication (e.g., after
+// removing a trust root). Trust roots are not removed.
+// returns the (sorted) hashes of the removed certificates
+func removeUnanchoredCertificates() []string {
+	anchored := map[string]bool{}
+	for certificateHash, certificateCacheEntry := range certificateCache {
+		if certificateCacheEntry.trustRoot && certificateCacheEntry.trustRootMetadata.ServerAuth {
+			anchored[certificateHash] = true
+		}
+	}
+
+	// iteratively mark certificates with an anchored parent as anchored
+	for changed := true; changed; {
+		changed = false
+		for certificateHash, certificateCacheEntry := range certificateCache {
+			if anchored[certificateHash] {
+				continue
+			}
+			subjectSKICacheEntry, ok := subjectSKICache[certificateCacheEntry.issuerAKIHash]
+			if !ok {
+				continue
+			}
+			for parentHash := range subjectSKICacheEntry.certificates {
+				if anchored[parentHash] {
+					anchored[certificateHash] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	removed := []string{}
+	for certificateHash, certificateCacheEntry := range certificateCache {
+		if !anchored[certificateHash] && !certificateCacheEntry.trustRoot {
+			removed = append(removed, certificateHash)
+		}
+	}
+	for _, certificateHash := range removed {
+		removeCertificateFromCache(certificateHash)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// parse one or more PEM encoded certificates or a single DER encoded certificate
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %s", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) > 0 {
+		return certificates, nil
+	}
+
+	// not PEM encoded
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	return []*x509.Certificate{certificate}, nil
+}
+
+// add trust roots (e.g., roots of the browser's trust store or enterprise
+// roots) without reinitializing the caches.
+// explicitly adding a root revokes a previous distrust of its public key.
+// returns the hashes of the added roots
+func AddTrustRoots(certificates []*x509.Certificate) []string {
+	return AddTrustRootsWithMetadata(certificates, DefaultTrustRootMetadata())
+}
+
+// same as AddTrustRoots, but with explicit trust metadata for the roots
+func AddTrustRootsWithMetadata(certificates []*x509.Certificate, metadata *TrustRootMetadata) []string {
+	addedHashes := []string{}
+	for _, certificate := range certificates {
+		publicKeyHash := getPublicKeyHash(certificate)
+		if reason, distrusted := distrustedPublicKeys[publicKeyHash]; distrusted {
+			// certificates ignored because of the distrust can be requested again
+			for certificateHash, ignoreReason := range ignoredCertificateHashes {
+				if ignoreReason == reason {
+					delete(ignoredCertificateHashes, certificateHash)
+				}
+			}
+			delete(distrustedPublicKeys, publicKeyHash)
+		}
+		certificateHash := addTrustRootToCache(certificate, metadata)
+		delete(ignoredCertificateHashes, certificateHash)
+		clearTrustRootIgnoreReasons(certificateHash)
+		addedHashes = append(addedHashes, certificateHash)
+	}
+	fmt.Fprintf(logOutput, "[Go] Added %d trust roots\n", len(addedHashes))
+	return addedHashes
+}
+
+// remove a trust root and all cached certificates that can no longer be
+// linked to a trust root. The root may still be added as intermediate
+// certificate (e.g., if it is cross-signed) in the future.
+// returns the hashes of the removed certificates (including the root)
+func RemoveTrustRoot(certificateHash string) ([]string, error) {
+	certificateCacheEntry, inCache := certificateCache[certificateHash]
+	if !inCache || !certificateCacheEntry.trustRoot {
+		return nil, fmt.Errorf("certificate %s is not a trust root", certificateHash)
+	}
+	removeCertificateFromCache(certificateHash)
+	removed := append([]string{certificateHash}, removeUnanchoredCertificates()...)
+	fmt.Fprintf(logOutput, "[Go] Removed trust root %s and %d dependent certificates\n", certificateCacheEntry.certificate.Subject.String(), len(removed)-1)
+	return removed, nil
+}
+
+// distrust a trust root: remove all cached certificates with the root's
+// public key (the root and, e.g., cross-signed intermediates) and all
+// certificates depending on them. Certificates with this public key
+// will be ignored in the future (until it is added as trust root again).
+// returns the hashes of the removed certificates
+func DistrustRoot(certificateHash string) ([]string, error) {
+	certificateCacheEntry, inCache := certificateCache[certificateHash]
+	if !inCache || !certificateCacheEntry.trustRoot {
+		return nil, fmt.Errorf("certificate %s is not a trust root", certificateHash)
+	}
+	certificate := certificateCacheEntry.certificate
+	publicKeyHash := getPublicKeyHash(certificate)
+	reason := fmt.Sprintf("distrusted public key %s (%s)", publicKeyHash, certificate.Subject.String())
+	distrustedPublicKeys[publicKeyHash] = reason
+
+	removed := []string{}
+	for hash, cacheEntry := range certificateCache {
+		if getPublicKeyHash(cacheEntry.certificate) == publicKeyHash {
+			removed = append(removed, hash)
+		}
+	}
+	for _, hash := range removed {
+		removeCertificateFromCache(hash)
+		ignoredCertificateHashes[hash] = reason
+	}
+	sort.Strings(removed)
+	removed = append(removed, removeUnanchoredCertificates()...)
+	fmt.Fprintf(logOutput, "[Go] Distrusted %s and removed %d certificates\n", certificate.Subject.String(), len(removed))
+	return removed, nil
+}
+
+// set the trust metadata of a trust root.
+// certificates that are no longer trusted under the new metadata are
+// removed and certificates previously rejected because of the old metadata
+// can be added again.
+// returns the hashes of the removed certificates
+func SetTrustRootMetadata(certificateHash string, metadata *TrustRootMetadata) ([]string, error) {
+	certificateCacheEntry, inCache := certificateCache[certificateHash]
+	if !inCache || !certificateCacheEntry.trustRoot {
+		return nil, fmt.Errorf("certificate %s is not a trust root", certificateHash)
+	}
+	certificateCacheEntry.trustRootMetadata = metadata
+	clearTrustRootIgnoreReasons(certificateHash)
+
+	// certificates issued directly by the root
+	removed := []string{}
+	for hash, cacheEntry := range certificateCache {
+		if cacheEntry.trustRoot || cacheEntry.issuerAKIHash != GetRawCertificateSubjectSKIHash(certificateCacheEntry.certificate) {
+			continue
+		}
+		if reason := checkIssuingTrustRoots(cacheEntry.certificate, subjectSKICache[cacheEntry.issuerAKIHash]); reason != "" {
+			removed = append(removed, hash)
+			ignoredCertificateHashes[hash] = reason
+		}
+	}
+	for _, hash := range removed {
+		removeCertificateFromCache(hash)
+	}
+	sort.Strings(removed)
+	removed = append(removed, removeUnanchoredCertificates()...)
+	fmt.Fprintf(logOutput, "[Go] Updated trust metadata of %s and removed %d certificates\n", certificateCacheEntry.certificate.Subject.String(), len(removed))
+	return removed, nil
+}
+
+// prefix of the ignore reasons of certificates rejected by a trust root
+func trustRootIgnoreReasonPrefix(rootHash string) string {
+	return fmt.Sprintf("rejected by trust root %s: ", rootHash)
+}
+
+// allow certificates rejected by the trust root with the given hash to be added again
+func clearTrustRootIgnoreReasons(rootHash string) {
+	prefix := trustRootIgnoreReasonPrefix(rootHash)
+	for certificateHash, reason := range ignoredCertificateHashes {
+		if strings.HasPrefix(reason, prefix) {
+			delete(ignoredCertificateHashes, certificateHash)
+		}
+	}
+}
+
+// check whether the potential issuers of a certificate are trusted to issue
+// certificates for server authentication (the distrust date and name
+// constraints are checked when building the chains, see checkChainTrustRootMetadata).
+// returns the reason why the certificate is rejected or an empty string if
+// the certificate is accepted by at least one issuer (or some issuer is not
+// a trust root)
+func checkIssuingTrustRoots(certificate *x509.Certificate, issuers *SubjectSKICacheEntry) string {
+	if issuers == nil {
+		return ""
+	}
+	reason := ""
+	for issuerHash := range issuers.certificates {
+		issuerCacheEntry := certificateCache[issuerHash]
+		if !issuerCacheEntry.trustRoot {
+			return ""
+		}
+		if issuerCacheEntry.trustRootMetadata.ServerAuth {
+			return ""
+		}
+		if reason == "" {
+			reason = trustRootIgnoreReasonPrefix(issuerHash) + "root is not trusted for server authentication"
+		}
+	}
+	return reason
+}
+
+// check a certificate chain (starting with the leaf and ending with the
+// trust root) against the trust metadata of its root
+func checkChainTrustRootMetadata(certificateChain []*x509.Certificate) error {
+	root := certificateChain[len(certificateChain)-1]
+	rootCacheEntry, inCache := certificateCache[GetRawCertificateHash(root)]
+	if !inCache || !rootCacheEntry.trustRoot {
+		return fmt.Errorf("chain does not end with a trust root")
+	}
+	return checkTrustRootMetadata(rootCacheEntry.trustRootMetadata, certificateChain[0])
+}
+
+// check a certificate issued under a trust root against the root's trust metadata.
+// the distrust date and name constraints only apply to leaf certificates
+func checkTrustRootMetadata(metadata *TrustRootMetadata, certificate *x509.Certificate) error {
+	if !metadata.ServerAuth {
+		return fmt.Errorf("root is not trusted for server authentication")
+	}
+	if certificate.IsCA {
+		return nil
+	}
+	if !metadata.DistrustAfter.IsZero() && certificate.NotBefore.After(metadata.DistrustAfter) {
+		return fmt.Errorf("leaf certificate issued on %s after the root's distrust date %s",
+			certificate.NotBefore.Format(time.DateOnly), metadata.DistrustAfter.Format(time.DateOnly))
+	}
+	for _, dnsName := range certificate.DNSNames {
+		for _, excluded := range metadata.ExcludedDNSDomains {
+			if matchesExcludedDomainConstraint(dnsName, excluded) {
+				return fmt.Errorf("dns name %s is excluded by the root's name constraint %s", dnsName, excluded)
+			}
+		}
+		if len(metadata.PermittedDNSDomains) == 0 {
+			continue
+		}
+		permitted := false
+		for _, permittedDomain := range metadata.PermittedDNSDomains {
+			if matchesDomainConstraint(dnsName, permittedDomain) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("dns name %s is not permitted by the root's name constraints", dnsName)
+		}
+	}
+	return nil
+}
+
+// check whether a dns name (pot. a wildcard) matches a dns name constraint.
+// a wildcard only matches if all names it covers match, which is the case
+// if the constraint matches the wildcard literally (constraints do not
+// contain wildcards)
+func matchesDomainConstraint(dnsName string, constraint string) bool {
+	dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(dnsName, constraint)
+	}
+	return dnsName == constraint || strings.HasSuffix(dnsName, "."+constraint)
+}
+
+// check whether a dns name (pot. a wildcard) matches an excluded dns name
+// constraint. a wildcard matches if any name it covers matches (e.g.,
+// *.example.com matches the excluded constraint www.example.com)
+func matchesExcludedDomainConstraint(dnsName string, constraint string) bool {
+	if matchesDomainConstraint(dnsName, constraint) {
+		return true
+	}
+	dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	constraint = strings.ToLower(constraint)
+	if !strings.HasPrefix(dnsName, "*.") || strings.HasPrefix(constraint, ".") {
+		return false
+	}
+	// the wildcard covers the constraint if it replaces its first label
+	label, parent, found := strings.Cut(constraint, ".")
+	return found && label != "" && parent == dnsName[2:]
+}
+
+// check the connection certificate chain (starting with the leaf) against
+// the trust metadata of its root. the chain either ends with the trust root
+// or with a certificate issued by it (browsers do not always send the root).
+// returns the reason why the chain is rejected or an empty string if the chain
+// is accepted by at least one root (or its root is not a cached trust root)
+func checkConnectionChainTrustRoot(certificateChain []*x509.Certificate) string {
+	if len(certificateChain) == 0 {
+		return ""
+	}
+	last := certificateChain[len(certificateChain)-1]
+	rootHash := GetRawCertificateHash(last)
+	if rootCacheEntry, inCache := certificateCache[rootHash]; inCache && rootCacheEntry.trustRoot {
+		if err := checkTrustRootMetadata(rootCacheEntry.trustRootMetadata, certificateChain[0]); err != nil {
+			return trustRootIgnoreReasonPrefix(rootHash) + err.Error()
+		}
+		return ""
+	}
+
+	// the trust roots issuing the last certificate must not be distrusted
+	// for server authentication and their distrust date and name
+	// constraints apply to the leaf (see checkIssuingTrustRoots)
+	issuers := subjectSKICache[GetRawCertificateIssuerAKIHash(last)]
+	if issuers == nil {
+		return ""
+	}
+	reason := ""
+	for issuerHash := range issuers.certificates {
+		issuerCacheEntry := certificateCache[issuerHash]
+		if !issuerCacheEntry.trustRoot {
+			return ""
+		}
+		err := checkTrustRootMetadata(issuerCacheEntry.trustRootMetadata, certificateChain[0])
+		if err == nil {
+			return ""
+		}
+		if reason == "" {
+			reason = trustRootIgnoreReasonPrefix(issuerHash) + err.Error()
+		}
+	}
+	return reason
+}
+
+// list all trust roots (sorted by subject)
+func GetTrustRoots() []*CachedCertificateInfo {
+	trustRoots := []*CachedCertificateInfo{}
+	for certificateHash, certificateCacheEntry := range certificateCache {
+		if certificateCacheEntry.trustRoot {
+			trustRoots = append(trustRoots, newCachedCertificateInfo(certificateHash, certificateCacheEntry))
+		}
+	}
+	sort.Slice(trustRoots, func(i, j int) bool {
+		if trustRoots[i].Subject != trustRoots[j].Subject {
+			return trustRoots[i].Subject < trustRoots[j].Subject
+		}
+		return trustRoots[i].Hash < trustRoots[j].Hash
+	})
+	return trustRoots
+}
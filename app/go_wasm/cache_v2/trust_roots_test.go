@@ -0,0 +1,236 @@
+package cache_v2
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// create a certificate for dnsName signed by parent (self-signed if parent is nil)
+func createTestCertificate(t *testing.T, serialNr int64, dnsName string, isCA bool, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	template, err := CreateCertificateTemplate(big.NewInt(serialNr), []string{dnsName}, 1, 1, 1, 1, isCA, parent, x509.SHA256WithRSA)
+	require.NoError(t, err)
+	privateKey, err := CreateAndStoreRSAPrivateKey(rand.New(rand.NewSource(serialNr)))
+	require.NoError(t, err)
+	if parentKey == nil {
+		parentKey = privateKey
+	}
+	pemBytes, err := CreateCertificate(template, privateKey.Public(), parent, parentKey, rand.New(rand.NewSource(int64(0))))
+	require.NoError(t, err)
+	pemBlock, _ := pem.Decode(pemBytes)
+	certificate, err := x509.ParseCertificate(pemBlock.Bytes)
+	require.NoError(t, err)
+	return certificate, privateKey
+}
+
+// create a second trust root with an intermediate CA and a leaf for dnsName
+func createSecondRootChain(t *testing.T, dnsName string) []*x509.Certificate {
+	root, rootKey := createTestCertificate(t, 20, "root2", true, nil, nil)
+	intermediate, intermediateKey := createTestCertificate(t, 21, "intmCA2", true, root, rootKey)
+	leaf, _ := createTestCertificate(t, 22, dnsName, false, intermediate, intermediateKey)
+	return []*x509.Certificate{root, intermediate, leaf}
+}
+
+// check that PEM bundles and DER encoded certificates can be parsed
+func TestParseCertificates(t *testing.T) {
+	chain := createSecondRootChain(t, "leaf2")
+	bundle := append(EncodePEM(chain[0].Raw, CERTIFICATE), EncodePEM(chain[1].Raw, CERTIFICATE)...)
+	certificates, err := ParseCertificates(bundle)
+	require.NoError(t, err)
+	require.Len(t, certificates, 2)
+	require.Equal(t, chain[1].Raw, certificates[1].Raw)
+
+	certificates, err = ParseCertificates(chain[2].Raw)
+	require.NoError(t, err)
+	require.Len(t, certificates, 1)
+
+	_, err = ParseCertificates([]byte("not a certificate"))
+	require.Error(t, err)
+}
+
+// check that removing a trust root only removes the certificates depending on it
+func TestRemoveTrustRoot(t *testing.T) {
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	chain, _ := testSimpleChainCreate(t, nil, nil)
+	secondChain := createSecondRootChain(t, "leaf2")
+
+	// certificates issued by the second root are only added once it is trusted
+	AddCertificatesToCache(secondChain[1:])
+	require.Empty(t, GetCachedCertificatesForDomain("leaf2"))
+	added := AddTrustRoots(secondChain[:1])
+	require.Equal(t, []string{GetRawCertificateHash(secondChain[0])}, added)
+	AddCertificatesToCache(append(chain[1:], secondChain[1:]...))
+	require.Len(t, GetCachedCertificatesForDomain("leaf1"), 1)
+	require.Len(t, GetCachedCertificatesForDomain("leaf2"), 1)
+	require.Len(t, GetTrustRoots(), 2)
+
+	removed, err := RemoveTrustRoot(GetRawCertificateHash(chain[0]))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{GetRawCertificateHash(chain[0]), GetRawCertificateHash(chain[1]), GetRawCertificateHash(chain[2])}, removed)
+	require.Empty(t, GetCachedCertificatesForDomain("leaf1"))
+	require.Empty(t, GetCertificateChainsForDomain("leaf1"))
+	require.Len(t, GetCertificateChainsForDomain("leaf2"), 1)
+	require.Len(t, GetTrustRoots(), 1)
+	require.Equal(t, 3, len(certificateCache))
+
+	// removed certificates are requested again
+	require.Len(t, GetMissingCertificateHashesList(removed), 3)
+
+	_, err = RemoveTrustRoot(GetRawCertificateHash(secondChain[1]))
+	require.Error(t, err)
+}
+
+// check that a distrusted root and the certificates depending on it are
+// ignored until the root is trusted again
+func TestDistrustRoot(t *testing.T) {
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	secondChain := createSecondRootChain(t, "leaf2")
+	AddTrustRoots(secondChain[:1])
+	AddCertificatesToCache(secondChain[1:])
+	require.Len(t, GetCertificateChainsForDomain("leaf2"), 1)
+
+	rootHash := GetRawCertificateHash(secondChain[0])
+	removed, err := DistrustRoot(rootHash)
+	require.NoError(t, err)
+	require.Len(t, removed, 3)
+	require.Empty(t, GetCachedCertificatesForDomain("leaf2"))
+	require.True(t, GetIgnoreReason(rootHash).Ignored)
+	require.Contains(t, GetIgnoreReason(rootHash).Reason, "distrusted")
+
+	// a self-signed certificate with the distrusted key is not accepted
+	AddCertificatesToCache(secondChain)
+	require.Empty(t, GetCertificateChainsForDomain("leaf2"))
+
+	// trusting the root again
+	AddTrustRoots(secondChain[:1])
+	require.False(t, GetIgnoreReason(rootHash).Ignored)
+	AddCertificatesToCache(secondChain[1:])
+	require.Len(t, GetCertificateChainsForDomain("leaf2"), 1)
+}
+
+// check that certificates issued by roots that are not trusted for server
+// authentication are ignored until the root's metadata changes
+func TestTrustRootServerAuth(t *testing.T) {
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	secondChain := createSecondRootChain(t, "leaf2")
+	rootHash := GetRawCertificateHash(secondChain[0])
+	intermediateHash := GetRawCertificateHash(secondChain[1])
+	AddTrustRootsWithMetadata(secondChain[:1], &TrustRootMetadata{ServerAuth: false})
+
+	AddCertificatesToCache(secondChain[1:])
+	require.Empty(t, GetCachedCertificatesForDomain("leaf2"))
+	require.Contains(t, GetIgnoreReason(intermediateHash).Reason, "server authentication")
+
+	removed, err := SetTrustRootMetadata(rootHash, DefaultTrustRootMetadata())
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.False(t, GetIgnoreReason(intermediateHash).Ignored)
+	AddCertificatesToCache(secondChain[1:])
+	require.Len(t, GetCertificateChainsForDomain("leaf2"), 1)
+
+	removed, err = SetTrustRootMetadata(rootHash, &TrustRootMetadata{ServerAuth: false})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{intermediateHash, GetRawCertificateHash(secondChain[2])}, removed)
+	require.Empty(t, GetCachedCertificatesForDomain("leaf2"))
+	require.Len(t, GetTrustRoots(), 2)
+
+	_, err = SetTrustRootMetadata(intermediateHash, DefaultTrustRootMetadata())
+	require.Error(t, err)
+}
+
+// check that chains with leaf certificates issued after the root's distrust
+// date are pruned and listed in the explanation
+func TestTrustRootDistrustAfter(t *testing.T) {
+	reset(t)
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	InitializeLegacyTrustPreferences(loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json"))
+	secondChain := createSecondRootChain(t, "leaf2")
+	rootHash := GetRawCertificateHash(secondChain[0])
+	AddTrustRootsWithMetadata(secondChain[:1], &TrustRootMetadata{ServerAuth: true, DistrustAfter: time.Now().AddDate(0, 0, -1)})
+	AddCertificatesToCache(secondChain[1:])
+
+	// the certificates are cached, but their chain is not trusted
+	require.Len(t, GetCachedCertificatesForDomain("leaf2"), 1)
+	require.Empty(t, GetCertificateChainsForDomain("leaf2"))
+
+	// the connection chain is checked against the metadata of its root,
+	// regardless of whether it contains the root
+	for _, connectionChain := range [][]*x509.Certificate{{secondChain[2], secondChain[1], secondChain[0]}, {secondChain[2], secondChain[1]}} {
+		legacyTrustInfo := NewLegacyTrustInfo("leaf2", connectionChain)
+		VerifyLegacy(legacyTrustInfo)
+		require.Equal(t, FAILURE, legacyTrustInfo.EvaluationResult)
+		require.Len(t, legacyTrustInfo.Explanation.Notes, 1)
+		require.Contains(t, legacyTrustInfo.Explanation.Notes[0], "distrust date")
+	}
+
+	// the pruned cached chain is part of the explanation
+	otherLeaf, _ := createTestCertificate(t, 23, "leaf2", false, nil, nil)
+	legacyTrustInfo := NewLegacyTrustInfo("leaf2", []*x509.Certificate{otherLeaf})
+	VerifyLegacy(legacyTrustInfo)
+	require.Len(t, legacyTrustInfo.Explanation.PrunedChains, 1)
+	require.Contains(t, legacyTrustInfo.Explanation.PrunedChains[0].Reason, "distrust date")
+	require.Equal(t, GetRawCertificateHash(secondChain[2]), legacyTrustInfo.Explanation.PrunedChains[0].Chain.CertificateHashes[0])
+
+	removed, err := SetTrustRootMetadata(rootHash, &TrustRootMetadata{ServerAuth: true, DistrustAfter: time.Now().AddDate(0, 0, 1)})
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.Len(t, GetCertificateChainsForDomain("leaf2"), 1)
+}
+
+// check the name constraint overlay of trust roots
+func TestTrustRootNameConstraints(t *testing.T) {
+	require.True(t, matchesDomainConstraint("example.com", "example.com"))
+	require.True(t, matchesDomainConstraint("www.Example.com", "example.com"))
+	require.True(t, matchesDomainConstraint("*.example.com", "example.com"))
+	require.False(t, matchesDomainConstraint("example.com", ".example.com"))
+	require.True(t, matchesDomainConstraint("a.example.com", ".example.com"))
+	require.False(t, matchesDomainConstraint("badexample.com", "example.com"))
+	require.False(t, matchesDomainConstraint("*.example.com", "www.example.com"))
+	require.True(t, matchesDomainConstraint("*.example.com", ".example.com"))
+
+	// a wildcard matches an excluded constraint if any name it covers matches
+	require.True(t, matchesExcludedDomainConstraint("*.example.com", "www.example.com"))
+	require.True(t, matchesExcludedDomainConstraint("*.Example.com", "WWW.example.com"))
+	require.True(t, matchesExcludedDomainConstraint("*.example.com", "example.com"))
+	require.False(t, matchesExcludedDomainConstraint("*.example.com", "a.www.example.com"))
+	require.False(t, matchesExcludedDomainConstraint("*.example.com", ".www.example.com"))
+	require.False(t, matchesExcludedDomainConstraint("www.example.com", "a.www.example.com"))
+	wildcardChain := createSecondRootChain(t, "*.example.com")
+	require.Error(t, checkTrustRootMetadata(&TrustRootMetadata{ServerAuth: true, ExcludedDNSDomains: []string{"www.example.com"}}, wildcardChain[2]))
+	require.Error(t, checkTrustRootMetadata(&TrustRootMetadata{ServerAuth: true, PermittedDNSDomains: []string{"www.example.com"}}, wildcardChain[2]))
+	require.NoError(t, checkTrustRootMetadata(&TrustRootMetadata{ServerAuth: true, PermittedDNSDomains: []string{"example.com"}}, wildcardChain[2]))
+
+	resetCache(t)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	secondChain := createSecondRootChain(t, "leaf2.example.com")
+	rootHash := GetRawCertificateHash(secondChain[0])
+	AddTrustRootsWithMetadata(secondChain[:1], &TrustRootMetadata{ServerAuth: true, PermittedDNSDomains: []string{"example.org"}})
+	AddCertificatesToCache(secondChain[1:])
+	require.Empty(t, GetCertificateChainsForDomain("leaf2.example.com"))
+
+	_, err := SetTrustRootMetadata(rootHash, &TrustRootMetadata{ServerAuth: true, PermittedDNSDomains: []string{"example.org", "example.com"}})
+	require.NoError(t, err)
+	require.Len(t, GetCertificateChainsForDomain("leaf2.example.com"), 1)
+
+	_, err = SetTrustRootMetadata(rootHash, &TrustRootMetadata{ServerAuth: true, ExcludedDNSDomains: []string{"leaf2.example.com"}})
+	require.NoError(t, err)
+	require.Empty(t, GetCertificateChainsForDomain("leaf2.example.com"))
+
+	// the metadata is part of the cache introspection
+	roots := GetTrustRoots()
+	for _, root := range roots {
+		if root.Hash == rootHash {
+			require.Equal(t, []string{"leaf2.example.com"}, root.TrustRootMetadata.ExcludedDNSDomains)
+		}
+	}
+}
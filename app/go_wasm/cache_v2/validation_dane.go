@@ -0,0 +1,355 @@
+package cache_v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// certificate usages of TLSA records (RFC 6698, RFC 7218)
+const (
+	// CA constraint: a CA of the (PKIX validated) chain must match
+	TLSA_USAGE_PKIX_TA = 0
+
+	// service certificate constraint: the (PKIX validated) leaf must match
+	TLSA_USAGE_PKIX_EE = 1
+
+	// trust anchor assertion: a CA of the chain must match
+	TLSA_USAGE_DANE_TA = 2
+
+	// domain-issued certificate: the leaf must match
+	TLSA_USAGE_DANE_EE = 3
+)
+
+// selectors of TLSA records
+const (
+	TLSA_SELECTOR_CERT = 0
+	TLSA_SELECTOR_SPKI = 1
+)
+
+// matching types of TLSA records
+const (
+	TLSA_MATCHING_FULL   = 0
+	TLSA_MATCHING_SHA256 = 1
+	TLSA_MATCHING_SHA512 = 2
+)
+
+// DNSSEC status of a TLSA record set
+const (
+	// the records were validated by the (DNS-over-HTTPS) resolver (AD flag)
+	DNSSEC_RESOLVER_VALIDATED = "resolver-validated"
+
+	// the records are not authenticated and therefore not used
+	DNSSEC_INSECURE = "insecure"
+
+	// the record set contains DNSSEC chain data, which cannot be verified
+	DNSSEC_BOGUS = "bogus"
+)
+
+// maximum duration for which a DANE validation outcome can be cached
+const DANE_MAX_VALIDITY = 10 * time.Minute
+
+// minimum duration for which TLSA records are kept (records with a shorter
+// TTL would expire before the connection is validated)
+const TLSA_MIN_TTL = time.Minute
+
+// a TLSA record as published in the DNS
+type TLSARecord struct {
+	Usage        uint8 `json:"usage"`
+	Selector     uint8 `json:"selector"`
+	MatchingType uint8 `json:"matchingType"`
+
+	// hex encoded certificate association data
+	Data string `json:"data"`
+}
+
+// the TLSA records of a service (e.g., _443._tcp.example.com)
+type TLSARecordSet struct {
+	Name    string        `json:"name"`
+	Records []*TLSARecord `json:"records"`
+
+	// time to live of the records in seconds
+	TTL uint32 `json:"ttl"`
+
+	// true if the resolver validated the records (AD flag of the response)
+	AuthenticatedData bool `json:"authenticatedData"`
+
+	// DNSSEC authentication chain (RFC 9102 format). offline verification
+	// of chain data is not supported, so record sets containing a chain are
+	// rejected by AddTLSARecords and bogus for VerifyDANE instead of being
+	// treated as if the chain had been checked
+	DNSSECChain []byte `json:"dnssecChain,omitempty"`
+
+	// the records are not used after this time
+	// (set when the records are added to a MemoryTLSASource)
+	Expiry time.Time `json:"expiry"`
+}
+
+// source of TLSA records (e.g., filled by JS using DNS-over-HTTPS or
+// stubbed in tests)
+type TLSASource interface {
+	// get the TLSA records of the service name (nil if no records exist)
+	GetTLSARecords(name string) (*TLSARecordSet, error)
+}
+
+// TLSASource storing the record sets in memory
+type MemoryTLSASource struct {
+	mutex      sync.Mutex
+	recordSets map[string]*TLSARecordSet
+}
+
+// create an empty MemoryTLSASource
+func NewMemoryTLSASource() *MemoryTLSASource {
+	return &MemoryTLSASource{recordSets: map[string]*TLSARecordSet{}}
+}
+
+// add or replace the record set of recordSet.Name, which expires after its
+// TTL (but not before TLSA_MIN_TTL)
+func (source *MemoryTLSASource) SetTLSARecords(recordSet *TLSARecordSet, now time.Time) {
+	recordSet.Expiry = now.Add(max(time.Duration(recordSet.TTL)*time.Second, TLSA_MIN_TTL))
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.recordSets[recordSet.Name] = recordSet
+}
+
+// get the (non-expired) record set of a service name
+func (source *MemoryTLSASource) GetTLSARecords(name string) (*TLSARecordSet, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	recordSet, ok := source.recordSets[name]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(recordSet.Expiry) {
+		delete(source.recordSets, name)
+		return nil, nil
+	}
+	return recordSet, nil
+}
+
+// TLSA record source used by VerifyDANE.
+// by default, records are added by JS (see AddTLSARecords)
+var defaultTLSASource = NewMemoryTLSASource()
+var tlsaSource TLSASource = defaultTLSASource
+
+// replace the TLSA record source (nil restores the default source)
+func SetTLSASource(source TLSASource) {
+	if source == nil {
+		source = defaultTLSASource
+	}
+	tlsaSource = source
+}
+
+// add a record set to the default TLSA record source
+func AddTLSARecords(recordSet *TLSARecordSet, now time.Time) error {
+	if recordSet.Name == "" {
+		return fmt.Errorf("TLSA record set without name")
+	}
+	if len(recordSet.DNSSECChain) > 0 {
+		return fmt.Errorf("TLSA record set %s contains DNSSEC chain data, which is not supported", recordSet.Name)
+	}
+	for i, record := range recordSet.Records {
+		if record == nil {
+			return fmt.Errorf("missing TLSA record at index %d", i)
+		}
+	}
+	defaultTLSASource.SetTLSARecords(recordSet, now)
+	return nil
+}
+
+// name of the TLSA records of a TCP service
+func TLSAName(dnsName string, port int) string {
+	return fmt.Sprintf("_%d._tcp.%s", port, dnsName)
+}
+
+type DANETrustInfo struct {
+	// domain name and port used in the connection
+	DNSName string
+	Port    int
+
+	// certificate chain received during the connection establishment
+	CertificateChain []*x509.Certificate
+
+	// TLSA records of the service (nil if no records exist)
+	RecordSet *TLSARecordSet
+
+	// DNSSEC status of the record set
+	DNSSECStatus string
+
+	// true if authenticated and usable TLSA records exist
+	Applicable bool
+
+	// index of the matching record and of the certificate in the chain
+	// matching it (-1 if no record matches)
+	MatchedRecordIndex int
+	MatchedChainIndex  int
+
+	// result of DANE validation (SUCCESS or FAILURE)
+	EvaluationResult int
+
+	// timestamp indicating how long this
+	// validation outcome can be cached
+	MaxValidity time.Time
+
+	// report describing how the validation outcome was reached
+	Explanation *ValidationExplanation
+}
+
+// create new DANETrustInfo
+func NewDANETrustInfo(dnsName string, port int, certificateChain []*x509.Certificate) *DANETrustInfo {
+	daneTrustInfo := &DANETrustInfo{
+		DNSName:            dnsName,
+		Port:               port,
+		CertificateChain:   certificateChain,
+		MatchedRecordIndex: -1,
+		MatchedChainIndex:  -1,
+		EvaluationResult:   0,
+		Explanation:        newValidationExplanation(DANE_MODE, dnsName),
+	}
+	daneTrustInfo.Explanation.ConnectionChain = explainChain(certificateChain)
+	return daneTrustInfo
+}
+
+// check if a TLSA record can be used (unknown parameters are ignored, see RFC 6698, Section 4.1)
+func (record *TLSARecord) usable() error {
+	if record.Usage > TLSA_USAGE_DANE_EE {
+		return fmt.Errorf("unknown certificate usage %d", record.Usage)
+	}
+	if record.Selector > TLSA_SELECTOR_SPKI {
+		return fmt.Errorf("unknown selector %d", record.Selector)
+	}
+	if record.MatchingType > TLSA_MATCHING_SHA512 {
+		return fmt.Errorf("unknown matching type %d", record.MatchingType)
+	}
+	if _, err := hex.DecodeString(record.Data); err != nil {
+		return fmt.Errorf("invalid certificate association data: %s", err)
+	}
+	return nil
+}
+
+// check if the certificate association data of a (usable) TLSA record matches the certificate
+func (record *TLSARecord) matches(certificate *x509.Certificate) bool {
+	selected := certificate.Raw
+	if record.Selector == TLSA_SELECTOR_SPKI {
+		selected = certificate.RawSubjectPublicKeyInfo
+	}
+	switch record.MatchingType {
+	case TLSA_MATCHING_SHA256:
+		hash := sha256.Sum256(selected)
+		selected = hash[:]
+	case TLSA_MATCHING_SHA512:
+		hash := sha512.Sum512(selected)
+		selected = hash[:]
+	}
+	data, _ := hex.DecodeString(record.Data)
+	return bytes.Equal(selected, data)
+}
+
+// find the certificate of the chain matching a (usable) TLSA record.
+// returns -1 if no certificate matches
+func (record *TLSARecord) findMatchingCertificate(certificateChain []*x509.Certificate) int {
+	if record.Usage == TLSA_USAGE_PKIX_EE || record.Usage == TLSA_USAGE_DANE_EE {
+		if len(certificateChain) > 0 && record.matches(certificateChain[0]) {
+			return 0
+		}
+		return -1
+	}
+	for index := 1; index < len(certificateChain); index++ {
+		if record.matches(certificateChain[index]) {
+			return index
+		}
+	}
+	return -1
+}
+
+// determine the DNSSEC status of a record set
+func getDNSSECStatus(recordSet *TLSARecordSet) (string, error) {
+	if len(recordSet.DNSSECChain) > 0 {
+		// chain data (e.g., of a custom TLSASource) cannot be verified offline
+		return DNSSEC_BOGUS, fmt.Errorf("verification of DNSSEC chain data is not supported")
+	}
+	if recordSet.AuthenticatedData {
+		return DNSSEC_RESOLVER_VALIDATED, nil
+	}
+	return DNSSEC_INSECURE, nil
+}
+
+// Evaluate whether the connection should be allowed according to the TLSA
+// records of the service: the connection passes if a usable record matches
+// the chain or if no authenticated and usable records exist.
+// the PKIX validation of the connection chain required by the usages
+// PKIX-TA and PKIX-EE is done by the browser before the extension
+// receives the chain
+func VerifyDANE(trustInfo *DANETrustInfo) {
+	if trustInfo.Explanation == nil {
+		trustInfo.Explanation = newValidationExplanation(DANE_MODE, trustInfo.DNSName)
+	}
+	explanation := trustInfo.Explanation
+	now := time.Now()
+	trustInfo.MaxValidity = now.Add(DANE_MAX_VALIDITY)
+	trustInfo.EvaluationResult = SUCCESS
+
+	name := TLSAName(trustInfo.DNSName, trustInfo.Port)
+	daneExplanation := &DANEExplanation{Name: name, Records: []*TLSARecordExplanation{}, MatchedRecordIndex: -1}
+	explanation.DANE = daneExplanation
+	defer func() { explanation.EvaluationResult = trustInfo.EvaluationResult }()
+
+	recordSet, err := tlsaSource.GetTLSARecords(name)
+	if err != nil {
+		// a failed lookup could be caused by an attacker suppressing the records
+		trustInfo.EvaluationResult = FAILURE
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("failed to get TLSA records for %s: %s", name, err))
+		return
+	}
+	if recordSet == nil || len(recordSet.Records) == 0 {
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("no TLSA records for %s", name))
+		return
+	}
+	trustInfo.RecordSet = recordSet
+	if !recordSet.Expiry.IsZero() && recordSet.Expiry.Before(trustInfo.MaxValidity) {
+		trustInfo.MaxValidity = recordSet.Expiry
+	}
+
+	trustInfo.DNSSECStatus, err = getDNSSECStatus(recordSet)
+	daneExplanation.DNSSECStatus = trustInfo.DNSSECStatus
+	switch trustInfo.DNSSECStatus {
+	case DNSSEC_BOGUS:
+		trustInfo.EvaluationResult = FAILURE
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("failed to verify DNSSEC chain of %s: %s", name, err))
+		return
+	case DNSSEC_INSECURE:
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("TLSA records of %s are not authenticated by DNSSEC", name))
+		return
+	}
+
+	for index, record := range recordSet.Records {
+		recordExplanation := explainTLSARecord(record)
+		daneExplanation.Records = append(daneExplanation.Records, recordExplanation)
+		if err := record.usable(); err != nil {
+			recordExplanation.Reason = err.Error()
+			continue
+		}
+		recordExplanation.Usable = true
+		trustInfo.Applicable = true
+		recordExplanation.MatchedChainIndex = record.findMatchingCertificate(trustInfo.CertificateChain)
+		if recordExplanation.MatchedChainIndex != -1 && trustInfo.MatchedRecordIndex == -1 {
+			trustInfo.MatchedRecordIndex = index
+			trustInfo.MatchedChainIndex = recordExplanation.MatchedChainIndex
+		}
+	}
+	daneExplanation.MatchedRecordIndex = trustInfo.MatchedRecordIndex
+
+	if !trustInfo.Applicable {
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("no usable TLSA records for %s", name))
+		return
+	}
+	if trustInfo.MatchedRecordIndex == -1 {
+		trustInfo.EvaluationResult = FAILURE
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("no TLSA record of %s matches the connection chain", name))
+	}
+}
@@ -0,0 +1,149 @@
+package cache_v2
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TLSASource returning fixed record sets
+type stubTLSASource struct {
+	recordSets map[string]*TLSARecordSet
+	err        error
+}
+
+func (source *stubTLSASource) GetTLSARecords(name string) (*TLSARecordSet, error) {
+	return source.recordSets[name], source.err
+}
+
+// use source for the test and restore the default source afterwards
+func setStubTLSASource(t *testing.T, source TLSASource) {
+	t.Cleanup(func() { SetTLSASource(nil) })
+	SetTLSASource(source)
+}
+
+// verify the connection chain of leaf1 against the given TLSA records
+func verifyDANEWithRecords(t *testing.T, chain []*x509.Certificate, recordSet *TLSARecordSet) *DANETrustInfo {
+	recordSet.Name = TLSAName("leaf1", 443)
+	setStubTLSASource(t, &stubTLSASource{recordSets: map[string]*TLSARecordSet{recordSet.Name: recordSet}})
+	daneTrustInfo := NewDANETrustInfo("leaf1", 443, chain)
+	VerifyDANE(daneTrustInfo)
+	return daneTrustInfo
+}
+
+// check the certificate usages, selectors and matching types of TLSA records
+func TestDANEMatching(t *testing.T) {
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	chain := []*x509.Certificate{cc[2], cc[1], cc[0]}
+	leafSPKIHash := sha256.Sum256(cc[2].RawSubjectPublicKeyInfo)
+	rootHash := sha512.Sum512(cc[0].Raw)
+
+	// DANE-EE with the SHA-256 hash of the leaf public key
+	daneTrustInfo := verifyDANEWithRecords(t, chain, &TLSARecordSet{AuthenticatedData: true, Records: []*TLSARecord{
+		{Usage: TLSA_USAGE_DANE_EE, Selector: TLSA_SELECTOR_SPKI, MatchingType: TLSA_MATCHING_SHA256, Data: hex.EncodeToString(leafSPKIHash[:])},
+	}})
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.True(t, daneTrustInfo.Applicable)
+	require.Equal(t, DNSSEC_RESOLVER_VALIDATED, daneTrustInfo.DNSSECStatus)
+	require.Equal(t, 0, daneTrustInfo.MatchedChainIndex)
+
+	// PKIX-TA with the SHA-512 hash of the root, after a record with an unknown usage
+	daneTrustInfo = verifyDANEWithRecords(t, chain, &TLSARecordSet{AuthenticatedData: true, Records: []*TLSARecord{
+		{Usage: 4, Selector: TLSA_SELECTOR_SPKI, MatchingType: TLSA_MATCHING_SHA256, Data: hex.EncodeToString(leafSPKIHash[:])},
+		{Usage: TLSA_USAGE_PKIX_TA, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCHING_SHA512, Data: hex.EncodeToString(rootHash[:])},
+	}})
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.Equal(t, 1, daneTrustInfo.MatchedRecordIndex)
+	require.Equal(t, 2, daneTrustInfo.MatchedChainIndex)
+	require.False(t, daneTrustInfo.Explanation.DANE.Records[0].Usable)
+	require.Equal(t, "unknown certificate usage 4", daneTrustInfo.Explanation.DANE.Records[0].Reason)
+
+	// DANE-TA with the full leaf certificate does not match (only CAs are considered)
+	daneTrustInfo = verifyDANEWithRecords(t, chain, &TLSARecordSet{AuthenticatedData: true, Records: []*TLSARecord{
+		{Usage: TLSA_USAGE_DANE_TA, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCHING_FULL, Data: hex.EncodeToString(cc[2].Raw)},
+	}})
+	require.Equal(t, FAILURE, daneTrustInfo.EvaluationResult)
+	require.Equal(t, -1, daneTrustInfo.Explanation.DANE.MatchedRecordIndex)
+
+	daneTrustInfo = verifyDANEWithRecords(t, chain, &TLSARecordSet{AuthenticatedData: true, Records: []*TLSARecord{
+		{Usage: TLSA_USAGE_DANE_TA, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCHING_FULL, Data: hex.EncodeToString(cc[1].Raw)},
+	}})
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.Equal(t, 1, daneTrustInfo.MatchedChainIndex)
+
+	// only unusable records
+	daneTrustInfo = verifyDANEWithRecords(t, chain, &TLSARecordSet{AuthenticatedData: true, Records: []*TLSARecord{
+		{Usage: TLSA_USAGE_DANE_EE, Selector: TLSA_SELECTOR_SPKI, MatchingType: TLSA_MATCHING_SHA256, Data: "not hex"},
+	}})
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.False(t, daneTrustInfo.Applicable)
+}
+
+// check that only authenticated records are used and that DNSSEC chain data,
+// which cannot be verified, is rejected
+func TestDANEDNSSEC(t *testing.T) {
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	chain := []*x509.Certificate{cc[2], cc[1], cc[0]}
+	records := []*TLSARecord{{Usage: TLSA_USAGE_DANE_EE, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCHING_FULL, Data: hex.EncodeToString(cc[4].Raw)}}
+
+	// unauthenticated records are ignored
+	daneTrustInfo := verifyDANEWithRecords(t, chain, &TLSARecordSet{Records: records})
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.False(t, daneTrustInfo.Applicable)
+	require.Equal(t, DNSSEC_INSECURE, daneTrustInfo.DNSSECStatus)
+
+	// chain data is not added to the default source
+	err := AddTLSARecords(&TLSARecordSet{Name: TLSAName("leaf1", 443), Records: records, DNSSECChain: []byte("chain")}, time.Now())
+	require.ErrorContains(t, err, "DNSSEC chain data")
+
+	// chain data of other sources fails the connection even if the
+	// resolver validated the records
+	daneTrustInfo = verifyDANEWithRecords(t, chain, &TLSARecordSet{Records: records, AuthenticatedData: true, DNSSECChain: []byte("chain")})
+	require.Equal(t, DNSSEC_BOGUS, daneTrustInfo.DNSSECStatus)
+	require.Equal(t, FAILURE, daneTrustInfo.EvaluationResult)
+	require.Contains(t, daneTrustInfo.Explanation.Notes[0], "not supported")
+
+	// a failed lookup
+	setStubTLSASource(t, &stubTLSASource{err: fmt.Errorf("SERVFAIL")})
+	daneTrustInfo = NewDANETrustInfo("leaf1", 443, chain)
+	VerifyDANE(daneTrustInfo)
+	require.Equal(t, FAILURE, daneTrustInfo.EvaluationResult)
+}
+
+// check that records added to the default source are used until they expire
+func TestDANEMemorySource(t *testing.T) {
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	chain := []*x509.Certificate{cc[2], cc[1], cc[0]}
+	t.Cleanup(func() { defaultTLSASource = NewMemoryTLSASource(); SetTLSASource(nil) })
+	recordSet := &TLSARecordSet{
+		Name:              "_8443._tcp.leaf1",
+		TTL:               60,
+		AuthenticatedData: true,
+		Records:           []*TLSARecord{{Usage: TLSA_USAGE_DANE_EE, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCHING_FULL, Data: hex.EncodeToString(cc[2].Raw)}},
+	}
+	require.NoError(t, AddTLSARecords(recordSet, time.Now()))
+	require.Error(t, AddTLSARecords(&TLSARecordSet{}, time.Now()))
+
+	daneTrustInfo := NewDANETrustInfo("leaf1", 8443, chain)
+	VerifyDANE(daneTrustInfo)
+	require.True(t, daneTrustInfo.Applicable)
+	require.Equal(t, SUCCESS, daneTrustInfo.EvaluationResult)
+	require.False(t, daneTrustInfo.MaxValidity.After(recordSet.Expiry))
+
+	// records of other ports do not apply
+	daneTrustInfo = NewDANETrustInfo("leaf1", 443, chain)
+	VerifyDANE(daneTrustInfo)
+	require.False(t, daneTrustInfo.Applicable)
+
+	// expired records
+	require.NoError(t, AddTLSARecords(recordSet, time.Now().Add(-time.Hour)))
+	recordSetFound, err := defaultTLSASource.GetTLSARecords("_8443._tcp.leaf1")
+	require.NoError(t, err)
+	require.Nil(t, recordSetFound)
+}
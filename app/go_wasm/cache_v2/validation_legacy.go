@@ -2,6 +2,7 @@ package cache_v2
 
 import (
 	"crypto/x509"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -50,50 +51,58 @@ type LegacyTrustInfo struct {
 	// a value != 1 indicates failed validation
 	EvaluationResult int `default:"0"`
 
+	// forbidden CA in the connection certificate chain
+	// (validation fails if set)
+	ForbiddenCA *ForbiddenCA
+
 	// timestamp indicating how long this
 	// legacy validation outcome can be cached
 	MaxValidity time.Time
+
+	// report describing how the validation outcome was reached
+	Explanation *ValidationExplanation
 }
 
 // maps a domain name to a set of legacy trust preferences
 // to be used to compute certificate chain trust levels
 var legacyTrustPreferences = map[string][]*LegacyTrustPreference{}
 
-// initialize legacyTrustPreferences  with a config
-func InitializeLegacyTrustPreferences(configMap map[string]interface{}) {
-	legacyTrustPreferences = map[string][]*LegacyTrustPreference{}
+// maps a domain name to the CA sets that are forbidden for the domain and
+// its subdomains (the trust level of these preferences is unused)
+var forbiddenLegacyTrustPreferences = map[string][]*LegacyTrustPreference{}
 
-	// parse CA sets
-	caSetsMap := map[string][]string{}
-	caSets := configMap["ca-sets"].(map[string]interface{})
-	for ca, values := range caSets {
-		caSetsMap[ca] = []string{}
-		v := values.(map[string]interface{})
-		for _, value := range v["cas"].([]interface{}) {
-			caSetsMap[ca] = append(caSetsMap[ca], value.(string))
-		}
-	}
+// a CA of a forbidden CA set found in a certificate chain
+type ForbiddenCA struct {
+	// domain (or wildcard/parent domain) for which the CA set is forbidden
+	Domain          string
+	CASetIdentifier string
+
+	// index of the forbidden CA in the chain
+	ChainIndex int
+	Subject    string
+}
 
-	// get trust level map
-	trustLevelMap := configMap["trust-levels"].(map[string]interface{})
+// initialize legacyTrustPreferences and forbiddenLegacyTrustPreferences
+// with a (validated) config
+func InitializeLegacyTrustPreferences(config *Config) {
+	legacyTrustPreferences = map[string][]*LegacyTrustPreference{}
+	forbiddenLegacyTrustPreferences = map[string][]*LegacyTrustPreference{}
 
-	// parse legacy trust preferences
-	legacyTrustPreferencesJSON := configMap["legacy-trust-preference"].(map[string]interface{})
-	for domain, keys := range legacyTrustPreferencesJSON {
+	for domain, preferences := range config.LegacyTrustPreferences {
 		domainTrustPreferences := []*LegacyTrustPreference{}
-		objects := keys.([]interface{})
-		for _, object := range objects {
-			objectMap := object.(map[string]interface{})
-			caSetStr := objectMap["ca-set"].(string)
-			trustLevel := int(trustLevelMap[objectMap["level"].(string)].(float64))
+		for _, preference := range preferences {
 			caSubjectNames := map[string]struct{}{}
-			for _, caSubjectName := range caSetsMap[caSetStr] {
+			for _, caSubjectName := range config.CASets[preference.CASet].CAs {
 				caSubjectNames[caSubjectName] = struct{}{}
 			}
 			legacyTrustPreference := &LegacyTrustPreference{
-				CASetIdentifier: caSetStr,
+				CASetIdentifier: preference.CASet,
 				CASubjectNames:  caSubjectNames,
-				TrustLevel:      trustLevel,
+				TrustLevel:      config.TrustLevels[preference.Level],
+			}
+			if preference.Forbidden {
+				forbiddenLegacyTrustPreferences[domain] = append(forbiddenLegacyTrustPreferences[domain], legacyTrustPreference)
+				continue
 			}
 			domainTrustPreferences = append(domainTrustPreferences, legacyTrustPreference)
 		}
@@ -101,6 +110,31 @@ func InitializeLegacyTrustPreferences(configMap map[string]interface{}) {
 	}
 }
 
+// find a CA (including the root, excluding the leaf) in the certificate
+// chain that is forbidden for dnsName or one of its wildcard and parent
+// domains. returns nil if the chain contains no forbidden CA
+func FindForbiddenCA(dnsName string, certificateChain []*x509.Certificate) *ForbiddenCA {
+	if len(certificateChain) == 0 {
+		return nil
+	}
+	for _, domain := range generateWildcardAndParentDomain(dnsName) {
+		for _, preference := range forbiddenLegacyTrustPreferences[domain] {
+			for index, certificate := range certificateChain[1:] {
+				if _, forbidden := preference.CASubjectNames[certificate.Subject.String()]; forbidden {
+					return &ForbiddenCA{
+						Domain:          domain,
+						CASetIdentifier: preference.CASetIdentifier,
+						// increment the index since we skip the leaf certificate
+						ChainIndex: index + 1,
+						Subject:    certificate.Subject.String(),
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // compute the trust level of a single certificate for a domain (dnsName)
 func ComputeSingleCertificateTrustLevelForDomain(dnsName string, certificate *x509.Certificate) int {
 	trustLevel := 0
@@ -167,10 +201,10 @@ func ComputeChainTrustLevelForDomain(dnsName string, certificateChain []*x509.Ce
 	relevantCertificateChainIndex := 0
 	relevantCASetID := "DEFAULT"
 
-	// if there are no legacy trust preferences for the domain,
-	// the default trust level is 0
+	// if there are no legacy trust preferences for the domain (or no
+	// chain), the default trust level is 0
 	legacyTrustPreferencesForDomain, hasTrustPreference := legacyTrustPreferences[dnsName]
-	if !hasTrustPreference {
+	if !hasTrustPreference || len(certificateChain) == 0 {
 		return currentTrustLevel, relevantCASetID, relevantCertificateChainIndex, false
 	}
 	// iterate through all non-leaf certificates of the chain and determine
@@ -345,7 +379,8 @@ func checkIfLowerTrustLevelAllowed(connectionChain []*x509.Certificate, cachedCe
 
 // perform legacy validation of the certificate chain received in the  connection establishment
 // against a (potentially pruned) set of certificate chains
-func verifyLegacyAgainstChains(connectionTrustInfoToVerify *LegacyTrustInfo, certificateChains []*CertificateChainInfo) {
+// returns the cached certificate chains with the highest trust level
+func verifyLegacyAgainstChains(connectionTrustInfoToVerify *LegacyTrustInfo, certificateChains []*CertificateChainInfo) []*CertificateChainInfo {
 	connectionTrustLevel := connectionTrustInfoToVerify.ConnectionTrustLevel
 
 	// get all cached certificate chains with the highest trust level
@@ -372,6 +407,7 @@ func verifyLegacyAgainstChains(connectionTrustInfoToVerify *LegacyTrustInfo, cer
 		connectionTrustInfoToVerify.EvaluationResult = SUCCESS
 	}
 	connectionTrustInfoToVerify.MaxValidity = minNotAfterTsd
+	return highestTrustLevelCertificateChainsCached
 }
 
 // Evaluate whether connection should be allowed according to
@@ -381,8 +417,65 @@ func verifyLegacyAgainstChains(connectionTrustInfoToVerify *LegacyTrustInfo, cer
 // and if this fails, it filters out the invalid certificate chains and
 // attempts to verify the connection again).
 func VerifyLegacy(connectionTrustInfoToVerify *LegacyTrustInfo) {
-	certificateChains := GetCertificateChainsForDomain(connectionTrustInfoToVerify.DNSName)
-	verifyLegacyAgainstChains(connectionTrustInfoToVerify, certificateChains)
+	dnsName := connectionTrustInfoToVerify.DNSName
+	if connectionTrustInfoToVerify.Explanation == nil {
+		connectionTrustInfoToVerify.Explanation = newValidationExplanation(LEGACY_MODE, dnsName)
+	}
+	explanation := connectionTrustInfoToVerify.Explanation
+
+	// a connection certificate chain containing a forbidden CA fails
+	// regardless of the cached certificate chains
+	connectionTrustInfoToVerify.ForbiddenCA = FindForbiddenCA(dnsName, connectionTrustInfoToVerify.CertificateChain)
+	if forbiddenCA := connectionTrustInfoToVerify.ForbiddenCA; forbiddenCA != nil {
+		connectionTrustInfoToVerify.EvaluationResult = FAILURE
+		connectionTrustInfoToVerify.MaxValidity = time.Now().Add(10 * time.Minute)
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("connection chain contains %s of CA set %s, which is forbidden for %s",
+			forbiddenCA.Subject, forbiddenCA.CASetIdentifier, forbiddenCA.Domain))
+		explanation.EvaluationResult = FAILURE
+		explanation.Proofs = explainProofs(dnsName)
+		return
+	}
+
+	// a connection certificate chain violating the trust metadata of its
+	// root (e.g., distrust date, name constraints) fails as well
+	if reason := checkConnectionChainTrustRoot(connectionTrustInfoToVerify.CertificateChain); reason != "" {
+		connectionTrustInfoToVerify.EvaluationResult = FAILURE
+		connectionTrustInfoToVerify.MaxValidity = time.Now().Add(10 * time.Minute)
+		explanation.Notes = append(explanation.Notes, "connection chain violates the trust metadata of its root: "+reason)
+		explanation.EvaluationResult = FAILURE
+		explanation.Proofs = explainProofs(dnsName)
+		return
+	}
+
+	// describe all cached certificate chains and their trust levels.
+	// cached chains containing a forbidden CA would fail themselves and
+	// are therefore never considered
+	allCertificateChains, prunedChains := getCertificateChainsForDomainAndPruned(dnsName)
+	var certificateChains []*CertificateChainInfo
+	chainExplanations := map[*CertificateChainInfo]*ChainExplanation{}
+	for _, certificateChainInfo := range allCertificateChains {
+		chainExplanation := explainLegacyChain(dnsName, certificateChainInfo.certificateChain)
+		if chainExplanation.ForbiddenCA != nil {
+			explanation.PrunedChains = append(explanation.PrunedChains, &PrunedChainExplanation{
+				Chain:  chainExplanation,
+				Reason: "chain contains a forbidden CA: " + chainExplanation.ForbiddenCA.Subject,
+			})
+			continue
+		}
+		certificateChains = append(certificateChains, certificateChainInfo)
+		chainExplanations[certificateChainInfo] = chainExplanation
+		explanation.Chains = append(explanation.Chains, chainExplanation)
+	}
+
+	// chains violating the trust metadata of their root are never considered
+	for _, prunedChain := range prunedChains {
+		explanation.PrunedChains = append(explanation.PrunedChains, &PrunedChainExplanation{
+			Chain:  explainLegacyChain(dnsName, prunedChain.chainInfo.certificateChain),
+			Reason: "chain violates the trust metadata of its root: " + prunedChain.reason,
+		})
+	}
+
+	highestTrustLevelChains := verifyLegacyAgainstChains(connectionTrustInfoToVerify, certificateChains)
 	if connectionTrustInfoToVerify.EvaluationResult == FAILURE {
 		// certificate chains that do not satisfy constraints (e.g., extended key usages, name constraints)
 		// and therefore are invalid potentially prevent a successful verification.
@@ -395,6 +488,10 @@ func VerifyLegacy(connectionTrustInfoToVerify *LegacyTrustInfo) {
 			// check key usage of the certificate chain
 			if !x509.CheckChainForKeyUsage(certificateChainInfo.certificateChain, keyUsages) {
 				removedChains = true
+				explanation.PrunedChains = append(explanation.PrunedChains, &PrunedChainExplanation{
+					Chain:  chainExplanations[certificateChainInfo],
+					Reason: "chain is not valid for server authentication (extended key usage)",
+				})
 				continue
 			}
 
@@ -407,6 +504,10 @@ func VerifyLegacy(connectionTrustInfoToVerify *LegacyTrustInfo) {
 					certificateChainsPruned = append(certificateChainsPruned, certificateChainInfo)
 				} else {
 					removedChains = true
+					explanation.PrunedChains = append(explanation.PrunedChains, &PrunedChainExplanation{
+						Chain:  chainExplanations[certificateChainInfo],
+						Reason: "chain violates its constraints: " + err.Error(),
+					})
 				}
 			} else {
 				certificateChainsPruned = append(certificateChainsPruned, certificateChainInfo)
@@ -416,9 +517,15 @@ func VerifyLegacy(connectionTrustInfoToVerify *LegacyTrustInfo) {
 		// if some certificate chains were pruned, retry legacy validation
 		// using only the valid certificate chains
 		if removedChains {
-			verifyLegacyAgainstChains(connectionTrustInfoToVerify, certificateChainsPruned)
+			highestTrustLevelChains = verifyLegacyAgainstChains(connectionTrustInfoToVerify, certificateChainsPruned)
 		}
 	}
+
+	for _, certificateChainInfo := range highestTrustLevelChains {
+		chainExplanations[certificateChainInfo].HighestTrustLevel = true
+	}
+	explanation.EvaluationResult = connectionTrustInfoToVerify.EvaluationResult
+	explanation.Proofs = explainProofs(dnsName)
 }
 
 // create new LegacyTrustInfo and initialize trustLevel by
@@ -435,5 +542,8 @@ func NewLegacyTrustInfo(dnsName string, certificateChain []*x509.Certificate) *L
 	legacyTrustInfo.ConnectionTrustLevel = trustLevel
 	legacyTrustInfo.ConnectionTrustLevelCASet = relevantCASetID
 	legacyTrustInfo.ConnectionTrustLevelChainIndex = relevantCertificateChainIndex
+
+	legacyTrustInfo.Explanation = newValidationExplanation(LEGACY_MODE, dnsName)
+	legacyTrustInfo.Explanation.ConnectionChain = explainLegacyChain(dnsName, certificateChain)
 	return legacyTrustInfo
 }
@@ -0,0 +1,152 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// enforcement modes of SPKI pins
+const (
+	// connections violating the pins fail
+	SPKI_PIN_ENFORCE = "enforce"
+
+	// violations are reported, but connections do not fail
+	SPKI_PIN_REPORT_ONLY = "report-only"
+)
+
+// allowed public keys of a domain and its subdomains
+type SPKIPinSet struct {
+	// domain (or wildcard/parent domain) for which the pins are defined
+	Domain string
+
+	// SPKI_PIN_ENFORCE or SPKI_PIN_REPORT_ONLY
+	Mode string
+
+	// base64 encoded SHA-256 hashes of RawSubjectPublicKeyInfo
+	LeafSPKIHashes []string
+	CASPKIHashes   []string
+}
+
+type SPKIPinTrustInfo struct {
+	// domain name used in the connection
+	DNSName string
+
+	// certificate chain received during the connection establishment
+	CertificateChain []*x509.Certificate
+
+	// pin set applied to the connection (nil if no pins are defined
+	// for the domain and its wildcard and parent domains)
+	PinSet *SPKIPinSet
+
+	// index of the certificate in the chain whose public key is pinned
+	// (-1 if no public key is pinned)
+	MatchedChainIndex int
+
+	// true if the connection violates the pins (in report-only mode,
+	// the connection nevertheless passes validation)
+	Violation bool
+
+	// result of SPKI pin validation (SUCCESS or FAILURE)
+	EvaluationResult int
+
+	// timestamp indicating how long this
+	// validation outcome can be cached
+	MaxValidity time.Time
+
+	// report describing how the validation outcome was reached
+	Explanation *ValidationExplanation
+}
+
+// maps a domain name to its SPKI pin set
+var spkiPins = map[string]*SPKIPinSet{}
+
+// initialize spkiPins with a (validated) config
+func InitializeSPKIPins(config *Config) {
+	spkiPins = map[string]*SPKIPinSet{}
+	for domain, pins := range config.SPKIPins {
+		mode := pins.Mode
+		if mode == "" {
+			mode = SPKI_PIN_ENFORCE
+		}
+		spkiPins[domain] = &SPKIPinSet{
+			Domain:         domain,
+			Mode:           mode,
+			LeafSPKIHashes: pins.LeafSPKIHashes,
+			CASPKIHashes:   pins.CASPKIHashes,
+		}
+	}
+}
+
+// get the SPKI pin set of the most specific domain among dnsName and its
+// wildcard and parent domains (nil if no pins are defined)
+func GetSPKIPinSetForDomainAndParents(dnsName string) *SPKIPinSet {
+	for _, domain := range generateWildcardAndParentDomain(dnsName) {
+		if pinSet, ok := spkiPins[domain]; ok {
+			return pinSet
+		}
+	}
+	return nil
+}
+
+// create new SPKIPinTrustInfo
+func NewSPKIPinTrustInfo(dnsName string, certificateChain []*x509.Certificate) *SPKIPinTrustInfo {
+	spkiPinTrustInfo := &SPKIPinTrustInfo{
+		DNSName:           dnsName,
+		CertificateChain:  certificateChain,
+		MatchedChainIndex: -1,
+		EvaluationResult:  0,
+		Explanation:       newValidationExplanation(SPKI_PINNING_MODE, dnsName),
+	}
+	spkiPinTrustInfo.Explanation.ConnectionChain = explainChain(certificateChain)
+	return spkiPinTrustInfo
+}
+
+// Evaluate whether the connection should be allowed according to the SPKI
+// pins of the domain: the connection passes if the public key of the leaf
+// is a pinned leaf key or the public key of a CA in the chain is a pinned
+// CA key
+func VerifySPKIPins(trustInfo *SPKIPinTrustInfo) {
+	if trustInfo.Explanation == nil {
+		trustInfo.Explanation = newValidationExplanation(SPKI_PINNING_MODE, trustInfo.DNSName)
+	}
+	explanation := trustInfo.Explanation
+
+	// the outcome only depends on the config
+	trustInfo.MaxValidity = time.Now().Add(10 * time.Minute)
+	trustInfo.PinSet = GetSPKIPinSetForDomainAndParents(trustInfo.DNSName)
+	if trustInfo.PinSet == nil {
+		trustInfo.EvaluationResult = SUCCESS
+		explanation.EvaluationResult = SUCCESS
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("no SPKI pins defined for %s", trustInfo.DNSName))
+		return
+	}
+
+	spkiPinExplanation := explainSPKIPins(trustInfo.PinSet, trustInfo.CertificateChain)
+	explanation.SPKIPins = spkiPinExplanation
+	for index, certificate := range trustInfo.CertificateChain {
+		pinnedHashes := trustInfo.PinSet.CASPKIHashes
+		if index == 0 {
+			pinnedHashes = trustInfo.PinSet.LeafSPKIHashes
+		}
+		if slices.Contains(pinnedHashes, getPublicKeyHash(certificate)) {
+			trustInfo.MatchedChainIndex = index
+			break
+		}
+	}
+	spkiPinExplanation.MatchedChainIndex = trustInfo.MatchedChainIndex
+
+	trustInfo.EvaluationResult = SUCCESS
+	if trustInfo.MatchedChainIndex == -1 {
+		trustInfo.Violation = true
+		message := fmt.Sprintf("no public key of the connection chain is pinned for %s", trustInfo.PinSet.Domain)
+		if trustInfo.PinSet.Mode == SPKI_PIN_ENFORCE {
+			trustInfo.EvaluationResult = FAILURE
+		} else {
+			message += " (report-only)"
+		}
+		explanation.Notes = append(explanation.Notes, message)
+	}
+	explanation.EvaluationResult = trustInfo.EvaluationResult
+}
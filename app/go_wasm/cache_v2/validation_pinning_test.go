@@ -0,0 +1,98 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// load the unit test config with the given SPKI pins (removed again after the test)
+func loadTestConfigWithSPKIPins(t *testing.T, spkiPins map[string]*SPKIPinConfig) *Config {
+	t.Cleanup(func() { InitializeSPKIPins(&Config{}) })
+	config := loadTestConfig(t, "embedded/unit_test/validation/config_explanation.json")
+	config.SPKIPins = spkiPins
+	require.NoError(t, config.Validate())
+	return config
+}
+
+// check that connections only pass if a public key of the chain is pinned
+// and that violations of report-only pins do not fail the connection
+func TestSPKIPinning(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	chain := []*x509.Certificate{cc[2], cc[1], cc[0]}
+	chainWithoutRoot := []*x509.Certificate{cc[2], cc[1]}
+	chainWithoutLeaf := []*x509.Certificate{cc[1], cc[0]}
+	InitializeConfig(loadTestConfigWithSPKIPins(t, map[string]*SPKIPinConfig{
+		"leaf1":      {CASPKIHashes: []string{getPublicKeyHash(cc[0])}},
+		"*.leaf1":    {Mode: SPKI_PIN_REPORT_ONLY, LeafSPKIHashes: []string{getPublicKeyHash(cc[2])}},
+		"other.test": {LeafSPKIHashes: []string{getPublicKeyHash(cc[2])}},
+	}))
+
+	// enforced CA pin
+	spkiPinTrustInfo := NewSPKIPinTrustInfo("leaf1", chain)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, SUCCESS, spkiPinTrustInfo.EvaluationResult)
+	require.Equal(t, SPKI_PIN_ENFORCE, spkiPinTrustInfo.PinSet.Mode)
+	require.Equal(t, 2, spkiPinTrustInfo.MatchedChainIndex)
+	require.False(t, spkiPinTrustInfo.Violation)
+
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("leaf1", chainWithoutRoot)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, FAILURE, spkiPinTrustInfo.EvaluationResult)
+	require.True(t, spkiPinTrustInfo.Violation)
+	require.Equal(t, -1, spkiPinTrustInfo.Explanation.SPKIPins.MatchedChainIndex)
+	require.Equal(t, getPublicKeyHash(cc[1]), spkiPinTrustInfo.Explanation.SPKIPins.ChainSPKIHashes[1])
+	require.Len(t, spkiPinTrustInfo.Explanation.Notes, 1)
+
+	// report-only leaf pin of the wildcard domain
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("www.leaf1", chainWithoutRoot)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, SUCCESS, spkiPinTrustInfo.EvaluationResult)
+	require.Equal(t, "*.leaf1", spkiPinTrustInfo.PinSet.Domain)
+	require.Equal(t, 0, spkiPinTrustInfo.MatchedChainIndex)
+
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("www.leaf1", chainWithoutLeaf)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, SUCCESS, spkiPinTrustInfo.EvaluationResult)
+	require.True(t, spkiPinTrustInfo.Violation)
+	require.Contains(t, spkiPinTrustInfo.Explanation.Notes[0], "(report-only)")
+
+	// pins of a parent domain
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("a.b.other.test", chainWithoutLeaf)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, FAILURE, spkiPinTrustInfo.EvaluationResult)
+	require.Equal(t, "other.test", spkiPinTrustInfo.PinSet.Domain)
+
+	// a leaf pin does not match CA keys
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("other.test", []*x509.Certificate{cc[1], cc[2]})
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, FAILURE, spkiPinTrustInfo.EvaluationResult)
+
+	// no pins
+	spkiPinTrustInfo = NewSPKIPinTrustInfo("leaf2", chain)
+	VerifySPKIPins(spkiPinTrustInfo)
+	require.Equal(t, SUCCESS, spkiPinTrustInfo.EvaluationResult)
+	require.Nil(t, spkiPinTrustInfo.PinSet)
+	require.Nil(t, spkiPinTrustInfo.Explanation.SPKIPins)
+}
+
+// check that invalid SPKI pins are reported with their path
+func TestParseInvalidSPKIPins(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+		"spki-pins": {
+			"a.test": {"mode": "block", "leaf-spki-hashes": ["47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="]},
+			"b.test": {"ca-spki-hashes": ["not a hash", "AAAA"]},
+			"c.test": {"mode": "report-only"}
+		}
+	}`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 4)
+	require.Equal(t, `spki-pins["a.test"].mode`, errs[0].Path)
+	require.Equal(t, `spki-pins["b.test"].ca-spki-hashes[0]`, errs[1].Path)
+	require.Equal(t, `spki-pins["b.test"].ca-spki-hashes[1]`, errs[2].Path)
+	require.Equal(t, `spki-pins["c.test"]: no pinned public keys`, errs[3].Error())
+}
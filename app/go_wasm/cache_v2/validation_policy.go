@@ -24,7 +24,9 @@ func NewPolicyTrustInfo(dnsName string, certificateChain []*x509.Certificate) *P
 		EvaluationResult:            0,
 		MaxValidity:                 time.Unix(0, 0),
 		DomainExcluded:              false,
+		Explanation:                 newValidationExplanation(POLICY_MODE, dnsName),
 	}
+	policyTrustInfo.Explanation.ConnectionChain = explainChain(certificateChain)
 	return policyTrustInfo
 }
 
@@ -75,6 +77,9 @@ type PolicyTrustInfo struct {
 	// true if the most specific policy (i.e., highest number of subdomains) added DNSName (or a
 	// parent of DNSName) as an excluded subdomain where no policy attributes are applied
 	DomainExcluded bool
+
+	// report describing how the validation outcome was reached
+	Explanation *ValidationExplanation
 }
 
 // maps a domain name to a set of legacy trust preferences
@@ -128,45 +133,17 @@ func NewPolicyCertificateChain() *PolicyCertificateChain {
 	}
 }
 
-// initialize legacyTrustPreferences with a config
-func InitializePolicyTrustPreferences(configMap map[string]interface{}) {
+// initialize policyTrustPreferences with a (validated) config
+func InitializePolicyTrustPreferences(config *Config) {
 	policyTrustPreferences = map[string][]*PolicyTrustPreference{}
 
-	// parse policy CA sets
-	pcaSetsMap := map[string][]string{}
-	pcaSets := configMap["policy-ca-sets"].(map[string]interface{})
-	for pcaSetID, values := range pcaSets {
-		pcaSetsMap[pcaSetID] = []string{}
-		v := values.(map[string]interface{})
-		for _, value := range v["pcas"].([]interface{}) {
-			pcaSetsMap[pcaSetID] = append(pcaSetsMap[pcaSetID], value.(string))
-		}
-	}
-
-	// parse policy CAs
-	pcasPublicKeyMap := map[string]string{}
-	pcas := configMap["policy-cas"].(map[string]interface{})
-	for pcaID, values := range pcas {
-		v := values.(map[string]interface{})
-		pcasPublicKeyMap[pcaID] = v["publickey"].(string)
-	}
-
-	// get trust level map
-	trustLevelMap := configMap["trust-levels"].(map[string]interface{})
-
-	// parse policy trust preferences
-	policyTrustPreferencesJSON := configMap["policy-trust-preference"].(map[string]interface{})
-	for domain, entry := range policyTrustPreferencesJSON {
+	for domain, preferences := range config.PolicyTrustPreferences {
 		domainTrustPreferences := []*PolicyTrustPreference{}
-		objects := entry.([]interface{})
-		for _, object := range objects {
-			objectMap := object.(map[string]interface{})
-			trustLevel := int(trustLevelMap[objectMap["level"].(string)].(float64))
-			pcaSetID := objectMap["policy-ca-set"].(string)
-			for _, pca := range pcaSetsMap[pcaSetID] {
+		for _, preference := range preferences {
+			for _, pca := range config.PolicyCASets[preference.PolicyCASet].PCAs {
 				policyTrustPreference := &PolicyTrustPreference{
-					PCAPublicKey: pcasPublicKeyMap[pca],
-					TrustLevel:   trustLevel,
+					PCAPublicKey: config.PolicyCAs[pca].PublicKey,
+					TrustLevel:   config.TrustLevels[preference.Level],
 				}
 				domainTrustPreferences = append(domainTrustPreferences, policyTrustPreference)
 			}
@@ -347,6 +324,12 @@ func isSameOrSubdomain(d1, d2 string) bool {
 // Evaluate whether connection should be allowed according to
 // policy mode based on current state of the cache.
 func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
+	if trustInfo.Explanation == nil {
+		trustInfo.Explanation = newValidationExplanation(POLICY_MODE, trustInfo.DNSName)
+	}
+	explanation := trustInfo.Explanation
+	explanation.Proofs = explainProofs(trustInfo.DNSName)
+
 	e2ld, err := publicsuffix.EffectiveTLDPlusOne(trustInfo.DNSName)
 	if err != nil {
 		return fmt.Errorf("Failed to get E2LD of %s: %s", trustInfo.DNSName, err)
@@ -355,17 +338,19 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 	// TODO (cyrill): ensure that enough map servers are queried and that enough full responses were returned
 
 	// debug
-	// fmt.Printf("root cert subject: %s\n", trustInfo.CertificateChain[len(trustInfo.CertificateChain)-1].Subject.ToRDNSequence().String())
+	// fmt.Fprintf(logOutput, "root cert subject: %s\n", trustInfo.CertificateChain[len(trustInfo.CertificateChain)-1].Subject.ToRDNSequence().String())
 
 	// get all certificate chains for the E2LD
 	e2ldChains, err := findPolicyCertificateChainsForE2LD(e2ld)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("domain root chains: %+v\n", e2ldChains)
+	fmt.Fprintf(logOutput, "domain root chains: %+v\n", e2ldChains)
 	if len(e2ldChains) == 0 {
 		// no applicable policy certificates exist
 		trustInfo.EvaluationResult = 1
+		explanation.EvaluationResult = trustInfo.EvaluationResult
+		explanation.Notes = append(explanation.Notes, fmt.Sprintf("no policy certificates cached for %s", e2ld))
 		return nil
 	}
 
@@ -380,7 +365,7 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("applicable chain: %+v\n", applicableChain)
+	fmt.Fprintf(logOutput, "applicable chain: %+v\n", applicableChain)
 	trustInfo.PolicyChain = append(trustInfo.PolicyChain, applicableChain.PolicyCertificates...)
 
 	// extract policies and validate certificate based on extracted policies
@@ -390,6 +375,8 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 		if err != nil {
 			return fmt.Errorf("Failed to validate attributes for domain %s: %s", policyCert.Domain(), err)
 		}
+		policyExplanation := explainPolicy(policyCert)
+		explanation.Policies = append(explanation.Policies, policyExplanation)
 
 		// check for the status of the subdomains
 		policyCertDomain := normalizeDomain(policyCert.Domain())
@@ -398,6 +385,7 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 		// check if the domain should not consider policies
 		if idx == 0 && domainValidity == common.PolicyAttributeDomainExcluded {
 			trustInfo.DomainExcluded = true
+			explanation.Notes = append(explanation.Notes, fmt.Sprintf("%s is excluded by the policy of %s", trustInfo.DNSName, policyCert.Domain()))
 		}
 
 		// check if the domain is allowed or not
@@ -407,15 +395,17 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 			attr := &common.PolicyAttributes{AllowedSubdomains: policyCert.PolicyAttributes.AllowedSubdomains, DisallowedSubdomains: policyCert.PolicyAttributes.DisallowedSubdomains}
 			confAttr := &ConflictingPolicyAttribute{Domain: policyCert.Domain(), Attribute: attr}
 			trustInfo.ConflictingPolicyAttributes = append(trustInfo.ConflictingPolicyAttributes, confAttr)
+			policyExplanation.Conflicts = append(policyExplanation.Conflicts, attr)
 		}
 
 		// check for allowed CAs
 		if len(policyCert.PolicyAttributes.AllowedCAs) > 0 {
-			fmt.Printf("Checking if %s is contained in %+v\n", rootCertificate, policyCert.PolicyAttributes.AllowedCAs)
+			fmt.Fprintf(logOutput, "Checking if %s is contained in %+v\n", rootCertificate, policyCert.PolicyAttributes.AllowedCAs)
 			if !slices.Contains(policyCert.PolicyAttributes.AllowedCAs, rootCertificate) {
 				attr := &common.PolicyAttributes{AllowedCAs: policyCert.PolicyAttributes.AllowedCAs}
 				confAttr := &ConflictingPolicyAttribute{Domain: policyCert.Domain(), Attribute: attr}
 				trustInfo.ConflictingPolicyAttributes = append(trustInfo.ConflictingPolicyAttributes, confAttr)
+				policyExplanation.Conflicts = append(policyExplanation.Conflicts, attr)
 			}
 		}
 	}
@@ -424,6 +414,7 @@ func VerifyPolicy(trustInfo *PolicyTrustInfo) error {
 	} else {
 		trustInfo.EvaluationResult = 1
 	}
+	explanation.EvaluationResult = trustInfo.EvaluationResult
 
 	return nil
 }
@@ -0,0 +1,221 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"slices"
+	"time"
+)
+
+// precedence policies used by Verify to combine the validation modes
+const (
+	// if a policy applies to the domain (and the domain is not excluded by
+	// it), the policy result decides and legacy validation is skipped,
+	// otherwise the legacy result decides. auxiliary modes (e.g., SPKI
+	// pinning and DANE) must pass if they apply.
+	// a connection chain containing a CA forbidden by a legacy trust
+	// preference always fails, i.e., legacy validation is not skipped then
+	// (TOFU pins do not apply to domains with policies, see isTOFUApplicable)
+	VERDICT_POLICY_OVERRIDES_LEGACY = "policy-overrides-legacy"
+
+	// all enabled modes that apply to the connection must pass
+	VERDICT_ALL_MUST_PASS = "all-must-pass"
+)
+
+// the result of a single validation mode run by Verify
+type ModeResult struct {
+	Mode string `json:"mode"`
+
+	// false if the mode does not apply to the connection (e.g., no policy
+	// or no SPKI pins are defined for the domain)
+	Applicable bool `json:"applicable"`
+
+	// true if the result is part of the final decision
+	Deciding bool `json:"deciding"`
+
+	// reason why the mode was not run (e.g., overridden by a policy)
+	Skipped string `json:"skipped,omitempty"`
+
+	EvaluationResult int                    `json:"evaluationResult"`
+	MaxValidity      time.Time              `json:"maxValidity"`
+	Explanation      *ValidationExplanation `json:"explanation,omitempty"`
+
+	// mode specific trust info (*LegacyTrustInfo, *PolicyTrustInfo,
+	// *SPKIPinTrustInfo, *DANETrustInfo or *TOFUTrustInfo), nil if the
+	// mode was skipped
+	TrustInfo any `json:"-"`
+}
+
+// final decision of Verify and the results of the individual modes
+type Verdict struct {
+	DNSName string `json:"dnsName"`
+	Port    int    `json:"port"`
+
+	// precedence policy used to combine the modes
+	Precedence string `json:"precedence"`
+
+	// SUCCESS if all deciding modes passed, FAILURE otherwise
+	EvaluationResult int `json:"evaluationResult"`
+
+	// modes whose results are part of the final decision
+	DecidingModes []string `json:"decidingModes"`
+
+	// earliest MaxValidity of the modes that were run
+	MaxValidity time.Time `json:"maxValidity"`
+
+	// results of all enabled modes (in the order they were run)
+	Results []*ModeResult `json:"results"`
+}
+
+// runs a validation mode for a connection
+type verificationMode func(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult
+
+// validation modes that can be combined by Verify
+var verificationModes = map[string]verificationMode{
+	LEGACY_MODE:       verifyLegacyMode,
+	POLICY_MODE:       verifyPolicyMode,
+	SPKI_PINNING_MODE: verifySPKIPinsMode,
+	DANE_MODE:         verifyDANEMode,
+	TOFU_MODE:         verifyTOFUMode,
+}
+
+// order in which Verify runs the modes (policy validation runs before
+// legacy validation, which it can override). TOFU runs last since pins are
+// only created or extended by connections that passed all other modes
+var verificationModeOrder = []string{SPKI_PINNING_MODE, DANE_MODE, POLICY_MODE, LEGACY_MODE, TOFU_MODE}
+
+// modes run by Verify and the precedence policy (set by InitializeVerify)
+var verifyModes = []string{LEGACY_MODE, POLICY_MODE, SPKI_PINNING_MODE}
+var verdictPrecedence = VERDICT_POLICY_OVERRIDES_LEGACY
+
+// initialize the modes and precedence policy used by Verify with a (validated) config.
+// by default, legacy, policy and SPKI pinning validation are enabled
+// (and DANE validation if dane-validation is set and TOFU if tofu-pinning is set)
+func InitializeVerify(config *Config) {
+	verifyModes = config.VerifyModes
+	if len(verifyModes) == 0 {
+		verifyModes = []string{LEGACY_MODE, POLICY_MODE, SPKI_PINNING_MODE}
+		if config.DANEValidation {
+			verifyModes = append(verifyModes, DANE_MODE)
+		}
+		if config.TOFUPinning {
+			verifyModes = append(verifyModes, TOFU_MODE)
+		}
+	}
+	verdictPrecedence = config.VerdictPrecedence
+	if verdictPrecedence == "" {
+		verdictPrecedence = VERDICT_POLICY_OVERRIDES_LEGACY
+	}
+}
+
+func verifyLegacyMode(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+	legacyTrustInfo := NewLegacyTrustInfo(dnsName, certificateChain)
+	VerifyLegacy(legacyTrustInfo)
+	return &ModeResult{
+		Applicable:       true,
+		EvaluationResult: legacyTrustInfo.EvaluationResult,
+		MaxValidity:      legacyTrustInfo.MaxValidity,
+		Explanation:      legacyTrustInfo.Explanation,
+		TrustInfo:        legacyTrustInfo,
+	}
+}
+
+func verifyPolicyMode(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+	policyTrustInfo := NewPolicyTrustInfo(dnsName, certificateChain)
+	VerifyPolicy(policyTrustInfo)
+	return &ModeResult{
+		Applicable:       len(policyTrustInfo.PolicyChain) > 0 && !policyTrustInfo.DomainExcluded,
+		EvaluationResult: policyTrustInfo.EvaluationResult,
+		MaxValidity:      policyTrustInfo.MaxValidity,
+		Explanation:      policyTrustInfo.Explanation,
+		TrustInfo:        policyTrustInfo,
+	}
+}
+
+func verifySPKIPinsMode(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+	spkiPinTrustInfo := NewSPKIPinTrustInfo(dnsName, certificateChain)
+	VerifySPKIPins(spkiPinTrustInfo)
+	return &ModeResult{
+		Applicable:       spkiPinTrustInfo.PinSet != nil,
+		EvaluationResult: spkiPinTrustInfo.EvaluationResult,
+		MaxValidity:      spkiPinTrustInfo.MaxValidity,
+		Explanation:      spkiPinTrustInfo.Explanation,
+		TrustInfo:        spkiPinTrustInfo,
+	}
+}
+
+func verifyDANEMode(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+	daneTrustInfo := NewDANETrustInfo(dnsName, port, certificateChain)
+	VerifyDANE(daneTrustInfo)
+	return &ModeResult{
+		// a failed lookup or bogus DNSSEC chain fails the connection
+		// even if no usable records are known
+		Applicable:       daneTrustInfo.Applicable || daneTrustInfo.EvaluationResult != SUCCESS,
+		EvaluationResult: daneTrustInfo.EvaluationResult,
+		MaxValidity:      daneTrustInfo.MaxValidity,
+		Explanation:      daneTrustInfo.Explanation,
+		TrustInfo:        daneTrustInfo,
+	}
+}
+
+func verifyTOFUMode(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+	tofuTrustInfo := NewTOFUTrustInfo(dnsName, certificateChain)
+	VerifyTOFU(tofuTrustInfo)
+	return &ModeResult{
+		Applicable:       tofuTrustInfo.Result.Status != TOFU_NOT_APPLICABLE,
+		EvaluationResult: tofuTrustInfo.EvaluationResult,
+		MaxValidity:      tofuTrustInfo.MaxValidity,
+		Explanation:      tofuTrustInfo.Explanation,
+		TrustInfo:        tofuTrustInfo,
+	}
+}
+
+// Run all enabled validation modes for the connection and combine their
+// results according to the precedence policy of the config
+func Verify(dnsName string, port int, certificateChain []*x509.Certificate) *Verdict {
+	verdict := &Verdict{
+		DNSName:          dnsName,
+		Port:             port,
+		Precedence:       verdictPrecedence,
+		EvaluationResult: SUCCESS,
+		DecidingModes:    []string{},
+		Results:          []*ModeResult{},
+	}
+
+	policyApplies := false
+	for _, mode := range verificationModeOrder {
+		if !slices.Contains(verifyModes, mode) {
+			continue
+		}
+		var result *ModeResult
+		if mode == LEGACY_MODE && policyApplies && verdictPrecedence == VERDICT_POLICY_OVERRIDES_LEGACY &&
+			FindForbiddenCA(dnsName, certificateChain) == nil {
+			result = &ModeResult{Skipped: "overridden by policy validation"}
+		} else if mode == TOFU_MODE && verdict.EvaluationResult != SUCCESS {
+			// flagged connections must not create or extend pins
+			result = &ModeResult{Skipped: "connection failed another validation mode"}
+		} else {
+			result = verificationModes[mode](dnsName, port, certificateChain)
+			if verdict.MaxValidity.IsZero() || result.MaxValidity.Before(verdict.MaxValidity) {
+				verdict.MaxValidity = result.MaxValidity
+			}
+		}
+		result.Mode = mode
+		if mode == POLICY_MODE {
+			policyApplies = result.Applicable
+		}
+
+		result.Deciding = result.Applicable && result.Skipped == ""
+		if result.Deciding {
+			verdict.DecidingModes = append(verdict.DecidingModes, mode)
+			if result.EvaluationResult != SUCCESS {
+				verdict.EvaluationResult = FAILURE
+			}
+		}
+		verdict.Results = append(verdict.Results, result)
+	}
+
+	if verdict.MaxValidity.IsZero() {
+		verdict.MaxValidity = time.Now()
+	}
+	return verdict
+}
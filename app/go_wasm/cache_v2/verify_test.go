@@ -0,0 +1,143 @@
+package cache_v2
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// replace a validation mode by a stub returning a fixed result (restored after the test).
+// returns a pointer to the number of times the stub was run
+func stubVerificationMode(t *testing.T, mode string, applicable bool, evaluationResult int) *int {
+	original := verificationModes[mode]
+	t.Cleanup(func() { verificationModes[mode] = original })
+	nCalls := 0
+	verificationModes[mode] = func(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+		nCalls++
+		return &ModeResult{
+			Applicable:       applicable,
+			EvaluationResult: evaluationResult,
+			MaxValidity:      time.Now().Add(time.Minute),
+		}
+	}
+	return &nCalls
+}
+
+// check that the legacy and policy validation and the SPKI pins of the config are combined
+func TestVerify(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	t.Cleanup(func() { InitializeVerify(&Config{}) })
+	config := loadTestConfigWithSPKIPins(t, map[string]*SPKIPinConfig{
+		"leaf1": {CASPKIHashes: []string{getPublicKeyHash(cc[0])}},
+	})
+	InitializeConfig(config)
+	AddCertificatesToCache([]*x509.Certificate{cc[2], cc[1]})
+
+	verdict := Verify("leaf1", 443, []*x509.Certificate{cc[2], cc[1], cc[0]})
+	require.Equal(t, SUCCESS, verdict.EvaluationResult)
+	require.Equal(t, VERDICT_POLICY_OVERRIDES_LEGACY, verdict.Precedence)
+	require.Equal(t, []string{SPKI_PINNING_MODE, LEGACY_MODE}, verdict.DecidingModes)
+	require.Len(t, verdict.Results, 3)
+	require.Equal(t, POLICY_MODE, verdict.Results[1].Mode)
+	require.False(t, verdict.Results[1].Deciding)
+	_, ok := verdict.Results[2].TrustInfo.(*LegacyTrustInfo)
+	require.True(t, ok)
+
+	// the pins are violated
+	verdict = Verify("leaf1", 443, []*x509.Certificate{cc[2], cc[1]})
+	require.Equal(t, FAILURE, verdict.EvaluationResult)
+	require.Equal(t, FAILURE, verdict.Results[0].EvaluationResult)
+	require.Equal(t, SUCCESS, verdict.Results[2].EvaluationResult)
+
+	// only the configured modes are run
+	config.VerifyModes = []string{LEGACY_MODE}
+	InitializeVerify(config)
+	verdict = Verify("leaf1", 443, []*x509.Certificate{cc[2], cc[1]})
+	require.Equal(t, SUCCESS, verdict.EvaluationResult)
+	require.Len(t, verdict.Results, 1)
+}
+
+// check the precedence policies using stubbed policy and legacy validation
+func TestVerifyPrecedence(t *testing.T) {
+	t.Cleanup(func() { InitializeVerify(&Config{}) })
+	InitializeVerify(&Config{VerifyModes: []string{LEGACY_MODE, POLICY_MODE}})
+	nLegacyCalls := stubVerificationMode(t, LEGACY_MODE, true, FAILURE)
+
+	// an applicable policy overrides legacy validation
+	stubVerificationMode(t, POLICY_MODE, true, SUCCESS)
+	verdict := Verify("leaf1", 443, nil)
+	require.Equal(t, SUCCESS, verdict.EvaluationResult)
+	require.Equal(t, []string{POLICY_MODE}, verdict.DecidingModes)
+	require.Equal(t, 0, *nLegacyCalls)
+	require.Equal(t, "overridden by policy validation", verdict.Results[1].Skipped)
+	require.False(t, verdict.MaxValidity.IsZero())
+
+	// without applicable policy (e.g., excluded domain), legacy validation decides
+	stubVerificationMode(t, POLICY_MODE, false, SUCCESS)
+	verdict = Verify("leaf1", 443, nil)
+	require.Equal(t, FAILURE, verdict.EvaluationResult)
+	require.Equal(t, []string{LEGACY_MODE}, verdict.DecidingModes)
+	require.Equal(t, 1, *nLegacyCalls)
+
+	// all applicable modes must pass
+	InitializeVerify(&Config{VerifyModes: []string{LEGACY_MODE, POLICY_MODE}, VerdictPrecedence: VERDICT_ALL_MUST_PASS})
+	stubVerificationMode(t, POLICY_MODE, true, SUCCESS)
+	verdict = Verify("leaf1", 443, nil)
+	require.Equal(t, FAILURE, verdict.EvaluationResult)
+	require.Equal(t, []string{POLICY_MODE, LEGACY_MODE}, verdict.DecidingModes)
+	require.Equal(t, 2, *nLegacyCalls)
+}
+
+// check that a forbidden CA fails the connection even if an applicable policy
+// overrides legacy validation
+func TestVerifyPolicyOverrideForbiddenCA(t *testing.T) {
+	resetCache(t)
+	cc, _ := testTwoChainsSameLeafDNSNameCreate(t, nil, nil)
+	InitializeCache("embedded/unit_test/cache/root_certificates")
+	t.Cleanup(func() { InitializeVerify(&Config{}) })
+	InitializeLegacyTrustPreferences(loadTestConfig(t, "embedded/unit_test/validation/config_forbidden.json"))
+	InitializeVerify(&Config{VerifyModes: []string{LEGACY_MODE, POLICY_MODE}})
+	nLegacyCalls := 0
+	verifyLegacy := verificationModes[LEGACY_MODE]
+	t.Cleanup(func() { verificationModes[LEGACY_MODE] = verifyLegacy })
+	verificationModes[LEGACY_MODE] = func(dnsName string, port int, certificateChain []*x509.Certificate) *ModeResult {
+		nLegacyCalls++
+		return verifyLegacy(dnsName, port, certificateChain)
+	}
+	stubVerificationMode(t, POLICY_MODE, true, SUCCESS)
+
+	verdict := Verify("leaf1", 443, []*x509.Certificate{cc[2], cc[1], cc[0]})
+	require.Equal(t, FAILURE, verdict.EvaluationResult)
+	require.Equal(t, []string{POLICY_MODE, LEGACY_MODE}, verdict.DecidingModes)
+	require.Empty(t, verdict.Results[1].Skipped)
+	require.Equal(t, 1, nLegacyCalls)
+	legacyTrustInfo, ok := verdict.Results[1].TrustInfo.(*LegacyTrustInfo)
+	require.True(t, ok)
+	require.Equal(t, "Test Intermediate 1", legacyTrustInfo.ForbiddenCA.CASetIdentifier)
+
+	// without forbidden CA, the policy still overrides legacy validation
+	verdict = Verify("leaf1", 443, []*x509.Certificate{cc[4], cc[3], cc[0]})
+	require.Equal(t, SUCCESS, verdict.EvaluationResult)
+	require.Equal(t, []string{POLICY_MODE}, verdict.DecidingModes)
+	require.Equal(t, "overridden by policy validation", verdict.Results[1].Skipped)
+	require.Equal(t, 1, nLegacyCalls)
+
+	// an empty chain contains no forbidden CA
+	require.Nil(t, FindForbiddenCA("leaf1", nil))
+	verdict = Verify("leaf1", 443, nil)
+	require.Equal(t, []string{POLICY_MODE}, verdict.DecidingModes)
+}
+
+// check that unknown modes and precedence policies are rejected
+func TestParseInvalidVerifyConfig(t *testing.T) {
+	_, err := ParseConfig([]byte(`{"verify-modes": ["legacy", "ct"], "verdict-precedence": "legacy-first"}`))
+	var errs ConfigErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	require.Equal(t, `verify-modes[1]: unknown validation mode "ct"`, errs[0].Error())
+	require.Equal(t, "verdict-precedence", errs[1].Path)
+}
@@ -0,0 +1,378 @@
+// fpki-verify runs the validation pipeline of the browser extension
+// (verifyAndGetMissingIDs -> addMissingPayloads -> VerifyLegacy/VerifyPolicy/VerifySPKIPins/VerifyDANE)
+// natively, without a browser.
+//
+// Example (recorded map server responses):
+//
+//	fpki-verify -config config.json -domain example.com -chain chain.pem \
+//		-mapserver local-mapserver -getproof getproof.json -getpayloads getpayloads.json
+//
+// Example (live map server):
+//
+//	fpki-verify -config config.json -domain example.com -chain chain.pem -url http://localhost:8080
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go_wasm/cache_v2"
+)
+
+// trust stores used if no directory is specified
+// (same as in the browser extension)
+const (
+	DEFAULT_TRUST_STORE_DIR        = "embedded/ca-certificates"
+	DEFAULT_POLICY_TRUST_STORE_DIR = "embedded/pca-certificates"
+)
+
+// exit codes
+const (
+	EXIT_SUCCESS = 0
+	EXIT_FAILURE = 1
+	EXIT_ERROR   = 2
+)
+
+// timeout for requests to a live map server
+const MAPSERVER_TIMEOUT = 30 * time.Second
+
+// output of a single run (printed as JSON)
+type VerifyOutput struct {
+	DNSName     string                                 `json:"dnsName"`
+	MapserverID string                                 `json:"mapserverId,omitempty"`
+	Proofs      *cache_v2.VerifyAndGetMissingIDsResult `json:"proofs,omitempty"`
+	Legacy      *cache_v2.ValidationExplanation        `json:"legacy,omitempty"`
+	Policy      *cache_v2.ValidationExplanation        `json:"policy,omitempty"`
+	SPKIPins    *cache_v2.ValidationExplanation        `json:"spkiPins,omitempty"`
+	DANE        *cache_v2.ValidationExplanation        `json:"dane,omitempty"`
+	Verdict     *cache_v2.Verdict                      `json:"verdict,omitempty"`
+	Success     bool                                   `json:"success"`
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to the extension config (JSON, as exported by the config page)")
+	trustStoreDir := flag.String("ca-dir", "", "directory containing PEM encoded trust root certificates (default: embedded trust store)")
+	policyTrustStoreDir := flag.String("pca-dir", "", "directory containing root policy certificates (*.pc) (default: embedded PCA trust store)")
+	dnsName := flag.String("domain", "", "domain name of the connection")
+	chainPath := flag.String("chain", "", "PEM file containing the connection certificate chain (leaf first)")
+	mapserverID := flag.String("mapserver", "", "identity of the map server as defined in the config (default: derived from -url)")
+	mapserverURL := flag.String("url", "", "base URL of a live map server")
+	getproofPath := flag.String("getproof", "", "file containing a recorded response of the map server's getproof endpoint")
+	getpayloadsPath := flag.String("getpayloads", "", "file containing a recorded response of the map server's getpayloads endpoint")
+	tlsaPath := flag.String("tlsa", "", "file containing the TLSA records of the service (JSON, see cache_v2.TLSARecordSet)")
+	port := flag.Int("port", 443, "port of the connection (used to look up TLSA records)")
+	mode := flag.String("mode", "all", "validation mode: legacy, policy, spki-pinning, dane, all (each mode separately) or verify (modes and precedence of the config combined)")
+	jsonOutput := flag.Bool("json", false, "print the verdict and explanations as JSON")
+	flag.Parse()
+
+	if *configPath == "" || *dnsName == "" || *chainPath == "" {
+		flag.Usage()
+		os.Exit(EXIT_ERROR)
+	}
+	if *mode != "legacy" && *mode != "policy" && *mode != "spki-pinning" && *mode != "dane" && *mode != "all" && *mode != "verify" {
+		exitWithError(fmt.Errorf("unknown validation mode: %s", *mode))
+	}
+
+	// log to stderr such that stdout only contains the verdict
+	cache_v2.SetLogOutput(os.Stderr)
+
+	config, err := readConfig(*configPath)
+	if err != nil {
+		exitWithError(err)
+	}
+	if *mapserverID == "" && *mapserverURL != "" {
+		*mapserverID, err = findMapserverID(config, *mapserverURL)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	// initialize the same data structures as initializeGODatastructures
+	if *trustStoreDir == "" {
+		cache_v2.InitializeCache(DEFAULT_TRUST_STORE_DIR)
+	} else {
+		cache_v2.InitializeCacheFromFS(os.DirFS(*trustStoreDir), ".")
+	}
+	if *policyTrustStoreDir == "" {
+		cache_v2.InitializePolicyCache(DEFAULT_POLICY_TRUST_STORE_DIR)
+	} else {
+		cache_v2.InitializePolicyCacheFromFS(os.DirFS(*policyTrustStoreDir), ".")
+	}
+	cache_v2.InitializeConfig(config)
+	if *tlsaPath != "" {
+		var recordSet cache_v2.TLSARecordSet
+		if err := readJSONFile(*tlsaPath, &recordSet); err != nil {
+			exitWithError(fmt.Errorf("failed to read TLSA records: %s", err))
+		}
+		if err := cache_v2.AddTLSARecords(&recordSet, time.Now()); err != nil {
+			exitWithError(err)
+		}
+	}
+
+	certificateChain, err := readCertificateChain(*chainPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	output := &VerifyOutput{DNSName: *dnsName, MapserverID: *mapserverID, Success: true}
+
+	// fetch and verify map server proofs and add missing payloads to the cache
+	if *getproofPath != "" || *mapserverURL != "" {
+		if *mapserverID == "" {
+			exitWithError(fmt.Errorf("map server identity required (-mapserver)"))
+		}
+		var responses []cache_v2.MapServerProofResponse
+		if *getproofPath != "" {
+			err = readJSONFile(*getproofPath, &responses)
+		} else {
+			err = fetchJSON(*mapserverURL+"/getproof?domain="+url.QueryEscape(*dnsName), &responses)
+		}
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to get map server proofs: %s", err))
+		}
+
+		output.Proofs = cache_v2.VerifyAndGetMissingIDs(*mapserverID, responses)
+		if !output.Proofs.Success() {
+			output.Success = false
+			printOutput(os.Stdout, output, *jsonOutput)
+			os.Exit(EXIT_FAILURE)
+		}
+
+		missingIDs := append(append([]string{}, output.Proofs.MissingCertificateIDs...), output.Proofs.MissingPolicyIDs...)
+		if len(missingIDs) > 0 {
+			payloadsResponse := &cache_v2.MapServerMissingPayloadsResponse{
+				CertificateIDs: output.Proofs.MissingCertificateIDs,
+				PolicyIDs:      output.Proofs.MissingPolicyIDs,
+			}
+			if *getpayloadsPath != "" {
+				err = readJSONFile(*getpayloadsPath, &payloadsResponse.Payloads)
+			} else if *mapserverURL != "" {
+				err = fetchJSON(*mapserverURL+"/getpayloads?ids="+base64IDsToHex(missingIDs), &payloadsResponse.Payloads)
+			} else {
+				err = fmt.Errorf("%d payloads missing, but neither -getpayloads nor -url provided", len(missingIDs))
+			}
+			if err != nil {
+				exitWithError(fmt.Errorf("failed to get map server payloads: %s", err))
+			}
+
+			processedCertificates, processedPolicies, err := cache_v2.AddMissingPayloads(payloadsResponse)
+			if err != nil {
+				exitWithError(err)
+			}
+			warnIfUnprovided("certificates", payloadsResponse.CertificateIDs, processedCertificates)
+			warnIfUnprovided("policies", payloadsResponse.PolicyIDs, processedPolicies)
+		}
+	}
+
+	// run the validation
+	if *mode == "legacy" || *mode == "all" {
+		legacyTrustInfo := cache_v2.NewLegacyTrustInfo(*dnsName, certificateChain)
+		cache_v2.VerifyLegacy(legacyTrustInfo)
+		output.Legacy = legacyTrustInfo.Explanation
+		output.Success = output.Success && legacyTrustInfo.EvaluationResult == cache_v2.SUCCESS
+	}
+	if *mode == "policy" || *mode == "all" {
+		policyTrustInfo := cache_v2.NewPolicyTrustInfo(*dnsName, certificateChain)
+		// an error means that the policy validation could not be run (e.g.,
+		// the E2LD of the domain cannot be determined), which is not a failed validation
+		if err := cache_v2.VerifyPolicy(policyTrustInfo); err != nil {
+			exitWithError(fmt.Errorf("policy validation failed: %s", err))
+		}
+		output.Policy = policyTrustInfo.Explanation
+		output.Success = output.Success && policyTrustInfo.EvaluationResult == cache_v2.SUCCESS
+	}
+	if *mode == "spki-pinning" || *mode == "all" {
+		spkiPinTrustInfo := cache_v2.NewSPKIPinTrustInfo(*dnsName, certificateChain)
+		cache_v2.VerifySPKIPins(spkiPinTrustInfo)
+		output.SPKIPins = spkiPinTrustInfo.Explanation
+		output.Success = output.Success && spkiPinTrustInfo.EvaluationResult == cache_v2.SUCCESS
+	}
+	if *mode == "dane" || *mode == "all" {
+		daneTrustInfo := cache_v2.NewDANETrustInfo(*dnsName, *port, certificateChain)
+		cache_v2.VerifyDANE(daneTrustInfo)
+		output.DANE = daneTrustInfo.Explanation
+		output.Success = output.Success && daneTrustInfo.EvaluationResult == cache_v2.SUCCESS
+	}
+	if *mode == "verify" {
+		output.Verdict = cache_v2.Verify(*dnsName, *port, certificateChain)
+		output.Success = output.Verdict.EvaluationResult == cache_v2.SUCCESS
+	}
+
+	printOutput(os.Stdout, output, *jsonOutput)
+	if !output.Success {
+		os.Exit(EXIT_FAILURE)
+	}
+	os.Exit(EXIT_SUCCESS)
+}
+
+// print an error and exit
+func exitWithError(err error) {
+	fmt.Fprintf(os.Stderr, "fpki-verify: %s\n", err)
+	os.Exit(EXIT_ERROR)
+}
+
+// read and validate a config in the format exported by the extension
+func readConfig(configPath string) (*cache_v2.Config, error) {
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+	return cache_v2.ParseConfig(configBytes)
+}
+
+// decode a JSON file into v
+func readJSONFile(filePath string, v any) error {
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(fileBytes, v)
+}
+
+// query a live map server and decode the JSON response into v
+func fetchJSON(requestURL string, v any) error {
+	client := &http.Client{Timeout: MAPSERVER_TIMEOUT}
+	response, err := client.Get(requestURL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %s", requestURL, response.Status)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// find the identity of the map server with the given URL in the config
+func findMapserverID(config *cache_v2.Config, mapserverURL string) (string, error) {
+	for _, mapserver := range config.Mapservers {
+		if strings.TrimSuffix(mapserver.Domain, "/") == strings.TrimSuffix(mapserverURL, "/") {
+			return mapserver.Identity, nil
+		}
+	}
+	return "", fmt.Errorf("no map server with URL %s in config (use -mapserver)", mapserverURL)
+}
+
+// read a PEM encoded certificate chain (leaf first)
+func readCertificateChain(chainPath string) ([]*x509.Certificate, error) {
+	pemBytes, err := os.ReadFile(chainPath)
+	if err != nil {
+		return nil, err
+	}
+	var certificateChain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %s", err)
+		}
+		certificateChain = append(certificateChain, certificate)
+	}
+	if len(certificateChain) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", chainPath)
+	}
+	return certificateChain, nil
+}
+
+// encode base64 encoded IDs as concatenated hex string
+// (as expected by the map server's getpayloads endpoint)
+func base64IDsToHex(ids []string) string {
+	var hexIDs strings.Builder
+	for _, id := range ids {
+		idBytes, err := base64.StdEncoding.DecodeString(id)
+		if err != nil {
+			exitWithError(fmt.Errorf("invalid ID %s: %s", id, err))
+		}
+		hexIDs.WriteString(hex.EncodeToString(idBytes))
+	}
+	return hexIDs.String()
+}
+
+// report requested payloads that the map server did not provide
+func warnIfUnprovided(payloadType string, requestedIDs []string, processedIDs []string) {
+	processed := cache_v2.SliceToSet(processedIDs)
+	for _, id := range requestedIDs {
+		if _, ok := processed[id]; !ok {
+			fmt.Fprintf(os.Stderr, "fpki-verify: map server did not provide all %s: missing %s\n", payloadType, id)
+		}
+	}
+}
+
+// print the verdict (and explanations)
+func printOutput(w io.Writer, output *VerifyOutput, jsonOutput bool) {
+	if jsonOutput {
+		outputJSON, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Fprintln(w, string(outputJSON))
+		return
+	}
+
+	fmt.Fprintf(w, "domain: %s\n", output.DNSName)
+	if output.Proofs != nil {
+		for _, verificationResult := range output.Proofs.MHTProofVerificationResults {
+			fmt.Fprintf(w, "proof (%s): %s\n", output.MapserverID, verificationResult)
+		}
+	}
+	for _, explanation := range []*cache_v2.ValidationExplanation{output.Legacy, output.Policy, output.SPKIPins, output.DANE} {
+		if explanation == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s validation: %s\n", explanation.Mode, verdict(explanation.EvaluationResult == cache_v2.SUCCESS))
+		explanationJSON, err := json.MarshalIndent(explanation, "  ", "  ")
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Fprintf(w, "  %s\n", explanationJSON)
+	}
+	if output.Verdict != nil {
+		for _, result := range output.Verdict.Results {
+			if result.Skipped != "" {
+				fmt.Fprintf(w, "%s validation: skipped (%s)\n", result.Mode, result.Skipped)
+				continue
+			}
+			deciding := ""
+			if !result.Deciding {
+				deciding = " (not applicable)"
+			}
+			fmt.Fprintf(w, "%s validation: %s%s\n", result.Mode, verdict(result.EvaluationResult == cache_v2.SUCCESS), deciding)
+			explanationJSON, err := json.MarshalIndent(result.Explanation, "  ", "  ")
+			if err != nil {
+				exitWithError(err)
+			}
+			fmt.Fprintf(w, "  %s\n", explanationJSON)
+		}
+		fmt.Fprintf(w, "precedence: %s (deciding: %s)\n", output.Verdict.Precedence, strings.Join(output.Verdict.DecidingModes, ", "))
+	}
+	fmt.Fprintf(w, "verdict: %s\n", verdict(output.Success))
+}
+
+func verdict(success bool) string {
+	if success {
+		return "SUCCESS"
+	}
+	return "FAILURE"
+}
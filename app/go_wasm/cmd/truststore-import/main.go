@@ -0,0 +1,85 @@
+// truststore-import generates the trust store of the browser extension
+// from Mozilla's root store: the embedded trust root directory loaded by
+// InitializeCache (including the trust metadata of the roots) and the
+// "All Trust-Store CAs" CA set (js_lib/trust_store_cas.js).
+//
+// Example (NSS certdata.txt):
+//
+//	truststore-import -certdata certdata.txt \
+//		-out cache_v2/embedded/ca-certificates -js ../js_lib/trust_store_cas.js
+//
+// Example (CCADB export):
+//
+//	truststore-import -ccadb MozillaIncludedCACertificateReportPEMCSV.csv \
+//		-out cache_v2/embedded/ca-certificates -js ../js_lib/trust_store_cas.js
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go_wasm/truststore"
+)
+
+func main() {
+	certdataPath := flag.String("certdata", "", "NSS certdata.txt")
+	ccadbPath := flag.String("ccadb", "", "CCADB CSV export of the included root certificates")
+	outDir := flag.String("out", "", "trust store directory to (re)generate")
+	jsPath := flag.String("js", "", "JS module to generate containing the \"All Trust-Store CAs\" CA set")
+	flag.Parse()
+
+	if (*certdataPath == "") == (*ccadbPath == "") || (*outDir == "" && *jsPath == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of -certdata and -ccadb and at least one of -out and -js are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var parse func(io.Reader) ([]*truststore.Root, error)
+	inputPath := *certdataPath
+	if inputPath != "" {
+		parse = truststore.ParseCertdata
+	} else {
+		inputPath = *ccadbPath
+		parse = truststore.ParseCCADBCSV
+	}
+	input, err := os.Open(inputPath)
+	if err != nil {
+		exitWithError(err)
+	}
+	roots, err := parse(input)
+	input.Close()
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to parse %s: %s", inputPath, err))
+	}
+	roots = truststore.ServerAuthRoots(roots)
+	fmt.Printf("Imported %d roots trusted for server authentication\n", len(roots))
+
+	if *outDir != "" {
+		if err := truststore.WriteTrustStoreDir(*outDir, roots); err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Wrote trust store to %s\n", *outDir)
+	}
+	if *jsPath != "" {
+		output, err := os.Create(*jsPath)
+		if err != nil {
+			exitWithError(err)
+		}
+		err = truststore.WriteCASetJS(output, truststore.CASet(roots))
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Wrote CA set to %s\n", *jsPath)
+	}
+}
+
+// print an error and exit
+func exitWithError(err error) {
+	fmt.Fprintf(os.Stderr, "truststore-import: %s\n", err)
+	os.Exit(1)
+}
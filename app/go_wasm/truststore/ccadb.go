@@ -0,0 +1,114 @@
+package truststore
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go_wasm/cache_v2"
+)
+
+// columns of the CCADB CSV export (e.g., MozillaIncludedCACertificateReportPEMCSV)
+const (
+	CCADB_PEM_COLUMN            = "PEM Info"
+	CCADB_TRUST_BITS_COLUMN     = "Trust Bits"
+	CCADB_NAME_COLUMN           = "Common Name or Certificate Name"
+	CCADB_DISTRUST_AFTER_COLUMN = "Distrust for TLS After Date"
+	CCADB_CONSTRAINTS_COLUMN    = "Mozilla Applied Constraints"
+)
+
+// date formats used by CCADB exports
+var ccadbDateFormats = []string{"2006.01.02", "2006-01-02"}
+
+// parse a CCADB CSV export of the included root certificates.
+//
+// The PEM Info and Trust Bits columns are required: roots with the
+// "Websites" trust bit are trusted for server authentication. The TLS
+// distrust date (the end of the given day) and the DNS name constraints
+// applied by Mozilla (e.g., "*.gr; *.eu") are imported if present.
+func ParseCCADBCSV(r io.Reader) ([]*Root, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %s", err)
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.TrimSpace(column)] = i
+	}
+	for _, required := range []string{CCADB_PEM_COLUMN, CCADB_TRUST_BITS_COLUMN} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing CSV column: %s", required)
+		}
+	}
+
+	var roots []*Root
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(column string) string {
+			i, ok := columns[column]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		block, _ := pem.Decode([]byte(strings.Trim(field(CCADB_PEM_COLUMN), "'")))
+		if block == nil {
+			return nil, fmt.Errorf("line %d: missing PEM encoded certificate", line)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: failed to parse certificate: %s", line, err)
+		}
+
+		var metadata cache_v2.TrustRootMetadata
+		for _, trustBit := range strings.Split(field(CCADB_TRUST_BITS_COLUMN), ";") {
+			trustBit = strings.ToLower(strings.TrimSpace(trustBit))
+			if trustBit == "websites" || trustBit == "server authentication" {
+				metadata.ServerAuth = true
+			}
+		}
+		if date := field(CCADB_DISTRUST_AFTER_COLUMN); date != "" {
+			distrustAfter, err := parseCCADBDate(date)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			metadata.DistrustAfter = distrustAfter
+		}
+		for _, constraint := range strings.FieldsFunc(field(CCADB_CONSTRAINTS_COLUMN), func(r rune) bool {
+			return r == ';' || r == ',' || r == ' '
+		}) {
+			metadata.PermittedDNSDomains = append(metadata.PermittedDNSDomains, strings.TrimPrefix(constraint, "*."))
+		}
+
+		label := field(CCADB_NAME_COLUMN)
+		if label == "" {
+			label = certificate.Subject.CommonName
+		}
+		roots = append(roots, &Root{Label: label, Certificate: certificate, Metadata: metadata})
+	}
+	return roots, nil
+}
+
+// parse a CCADB date and return the end of the day (UTC)
+func parseCCADBDate(date string) (time.Time, error) {
+	for _, format := range ccadbDateFormats {
+		if day, err := time.Parse(format, date); err == nil {
+			return day.Add(24*time.Hour - time.Second), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %s", date)
+}
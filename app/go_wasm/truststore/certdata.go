@@ -0,0 +1,172 @@
+package truststore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_wasm/cache_v2"
+)
+
+// an object (certificate or trust record) in certdata.txt
+type certdataObject struct {
+	// attribute values by name (MULTILINE_OCTAL values are decoded,
+	// UTF8 values are unquoted, other values are kept as is)
+	attributes map[string][]byte
+
+	// line of the CKA_CLASS attribute (for error messages)
+	line int
+}
+
+func (o *certdataObject) get(attribute string) string {
+	return string(o.attributes[attribute])
+}
+
+// parse NSS certdata.txt (as found in the NSS sources at lib/ckfw/builtins/certdata.txt).
+//
+// The trust of a certificate is defined by the CKO_NSS_TRUST object with
+// the same SHA-1 hash (or issuer and serial number): only roots with
+// CKA_TRUST_SERVER_AUTH CKT_NSS_TRUSTED_DELEGATOR are trusted for server
+// authentication. Certificates without trust object and explicitly
+// distrusted certificates (CKT_NSS_NOT_TRUSTED) are skipped.
+// CKA_NSS_SERVER_DISTRUST_AFTER is imported as distrust date.
+func ParseCertdata(r io.Reader) ([]*Root, error) {
+	objects, err := parseCertdataObjects(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// index the trust objects
+	trustBySHA1 := map[string]*certdataObject{}
+	trustByIssuerSerial := map[string]*certdataObject{}
+	for _, object := range objects {
+		if object.get("CKA_CLASS") != "CKO_NSS_TRUST" {
+			continue
+		}
+		if sha1Hash, ok := object.attributes["CKA_CERT_SHA1_HASH"]; ok {
+			trustBySHA1[string(sha1Hash)] = object
+		}
+		trustByIssuerSerial[object.get("CKA_ISSUER")+object.get("CKA_SERIAL_NUMBER")] = object
+	}
+
+	var roots []*Root
+	for _, object := range objects {
+		if object.get("CKA_CLASS") != "CKO_CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(object.attributes["CKA_VALUE"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: failed to parse certificate: %s", object.line, err)
+		}
+		sha1Hash := sha1.Sum(certificate.Raw)
+		trust, ok := trustBySHA1[string(sha1Hash[:])]
+		if !ok {
+			trust, ok = trustByIssuerSerial[object.get("CKA_ISSUER")+object.get("CKA_SERIAL_NUMBER")]
+		}
+		if !ok {
+			continue
+		}
+
+		var metadata cache_v2.TrustRootMetadata
+		switch trust.get("CKA_TRUST_SERVER_AUTH") {
+		case "CKT_NSS_TRUSTED_DELEGATOR":
+			metadata.ServerAuth = true
+		case "CKT_NSS_NOT_TRUSTED":
+			// explicitly distrusted certificate
+			continue
+		}
+		if rawDate, ok := object.attributes["CKA_NSS_SERVER_DISTRUST_AFTER"]; ok && string(rawDate) != "CK_FALSE" {
+			distrustAfter, err := time.Parse("060102150405Z", string(rawDate))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid distrust date: %s", object.line, err)
+			}
+			metadata.DistrustAfter = distrustAfter
+		}
+		if metadata.ServerAuth || trust.get("CKA_TRUST_EMAIL_PROTECTION") == "CKT_NSS_TRUSTED_DELEGATOR" {
+			roots = append(roots, &Root{Label: object.get("CKA_LABEL"), Certificate: certificate, Metadata: metadata})
+		}
+	}
+	return roots, nil
+}
+
+// split certdata.txt into objects. Each object starts with a CKA_CLASS
+// attribute, attributes have the form "<name> <type> <value>" or
+// "<name> MULTILINE_OCTAL" followed by octal escaped lines and "END"
+func parseCertdataObjects(r io.Reader) ([]*certdataObject, error) {
+	var objects []*certdataObject
+	var current *certdataObject
+	scanner := bufio.NewScanner(r)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "BEGINDATA" || strings.HasPrefix(line, "CVS_ID") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: invalid attribute: %s", lineNr, line)
+		}
+		name, attributeType := fields[0], fields[1]
+		if name == "CKA_CLASS" {
+			current = &certdataObject{attributes: map[string][]byte{}, line: lineNr}
+			objects = append(objects, current)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("line %d: attribute outside of an object: %s", lineNr, line)
+		}
+
+		switch {
+		case attributeType == "MULTILINE_OCTAL":
+			var value bytes.Buffer
+			terminated := false
+			for scanner.Scan() {
+				lineNr++
+				octalLine := strings.TrimSpace(scanner.Text())
+				if octalLine == "END" {
+					terminated = true
+					break
+				}
+				if err := decodeOctal(&value, octalLine); err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineNr, err)
+				}
+			}
+			if !terminated {
+				return nil, fmt.Errorf("line %d: unterminated value of %s", lineNr, name)
+			}
+			current.attributes[name] = value.Bytes()
+		case len(fields) < 3:
+			return nil, fmt.Errorf("line %d: missing value of %s", lineNr, name)
+		case attributeType == "UTF8":
+			value, err := strconv.Unquote(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid string: %s", lineNr, fields[2])
+			}
+			current.attributes[name] = []byte(value)
+		default:
+			current.attributes[name] = []byte(fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// decode a line of octal escaped bytes (e.g., \060\202\005)
+func decodeOctal(buffer *bytes.Buffer, line string) error {
+	for _, octal := range strings.Split(line, `\`)[1:] {
+		b, err := strconv.ParseUint(octal, 8, 8)
+		if err != nil {
+			return fmt.Errorf("invalid octal value: %s", octal)
+		}
+		buffer.WriteByte(byte(b))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package truststore imports the trust roots of the browser extension from
+// Mozilla's root store (NSS certdata.txt or a CCADB CSV export).
+//
+// The same import produces the trust store directory used by
+// cache_v2.InitializeCache (PEM encoded roots and their trust metadata) and
+// the "All Trust-Store CAs" CA set used by the legacy trust preferences, so
+// the two cannot drift apart.
+package truststore
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go_wasm/cache_v2"
+)
+
+// a root certificate of the imported root store
+type Root struct {
+	// name of the root in the root store (e.g., the NSS label)
+	Label string
+
+	Certificate *x509.Certificate
+
+	// trust bits, distrust date and name constraints of the root
+	Metadata cache_v2.TrustRootMetadata
+}
+
+// returns the roots that are trusted for server authentication
+func ServerAuthRoots(roots []*Root) []*Root {
+	var serverAuthRoots []*Root
+	for _, root := range roots {
+		if root.Metadata.ServerAuth {
+			serverAuthRoots = append(serverAuthRoots, root)
+		}
+	}
+	return serverAuthRoots
+}
+
+// returns the (deduplicated) subject names of the roots in the format used
+// by the CA sets of the legacy trust preferences
+func CASet(roots []*Root) []string {
+	subjects := []string{}
+	seen := map[string]bool{}
+	for _, root := range roots {
+		subject := root.Certificate.Subject.String()
+		if !seen[subject] {
+			seen[subject] = true
+			subjects = append(subjects, subject)
+		}
+	}
+	return subjects
+}
+
+// returns the file name (without extension) of a root in the trust store
+// directory, e.g., "Amazon Root CA 1" -> "Amazon_Root_CA_1"
+func fileName(label string) string {
+	name := strings.ReplaceAll(strings.TrimSpace(label), " ", "_")
+	name = regexp.MustCompile(`[^A-Za-z0-9_.\-]`).ReplaceAllString(name, "")
+	if name == "" {
+		name = "root"
+	}
+	return name
+}
+
+// write the roots to a trust store directory that can be loaded with
+// cache_v2.InitializeCacheFromFS. Existing roots (*.crt) and trust metadata
+// in the directory are replaced.
+// metadata that differs from cache_v2.DefaultTrustRootMetadata is written
+// to cache_v2.TRUST_METADATA_FILE
+func WriteTrustStoreDir(dir string, roots []*Root) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	oldFiles, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	oldFiles = append(oldFiles, filepath.Join(dir, cache_v2.TRUST_METADATA_FILE))
+	for _, oldFile := range oldFiles {
+		if err := os.Remove(oldFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	metadata := map[string]*cache_v2.TrustRootMetadata{}
+	usedNames := map[string]int{}
+	for _, root := range roots {
+		name := fileName(root.Label)
+		usedNames[name]++
+		if usedNames[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, usedNames[name])
+		}
+		pemBytes := cache_v2.EncodePEM(root.Certificate.Raw, cache_v2.CERTIFICATE)
+		if err := os.WriteFile(filepath.Join(dir, name+".crt"), pemBytes, 0644); err != nil {
+			return err
+		}
+		if !isDefaultMetadata(&root.Metadata) {
+			rootMetadata := root.Metadata
+			metadata[cache_v2.GetRawCertificateHash(root.Certificate)] = &rootMetadata
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, cache_v2.TRUST_METADATA_FILE), append(metadataBytes, '\n'), 0644)
+}
+
+func isDefaultMetadata(metadata *cache_v2.TrustRootMetadata) bool {
+	return metadata.ServerAuth && metadata.DistrustAfter.IsZero() &&
+		len(metadata.PermittedDNSDomains) == 0 && len(metadata.ExcludedDNSDomains) == 0
+}
+
+// write the CA set as JS module (js_lib/trust_store_cas.js) exporting
+// firefox_trust_store_cas
+func WriteCASetJS(w io.Writer, subjects []string) error {
+	var builder strings.Builder
+	builder.WriteString("// generated by go_wasm/cmd/truststore-import, do not edit\n")
+	builder.WriteString("export const firefox_trust_store_cas = [\n")
+	for _, subject := range subjects {
+		subjectJSON, err := json.Marshal(subject)
+		if err != nil {
+			return err
+		}
+		builder.WriteString("    " + string(subjectJSON) + ",\n")
+	}
+	builder.WriteString("];\n")
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
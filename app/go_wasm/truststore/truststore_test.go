@@ -0,0 +1,162 @@
+package truststore
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go_wasm/cache_v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// create a self-signed root certificate
+func createTestRoot(t *testing.T, serialNr int64, name string) *x509.Certificate {
+	template, err := cache_v2.CreateCertificateTemplate(big.NewInt(serialNr), []string{name}, 1, 0, 0, 0, true, nil, x509.SHA256WithRSA)
+	require.NoError(t, err)
+	privateKey, err := cache_v2.CreateAndStoreRSAPrivateKey(rand.New(rand.NewSource(serialNr)))
+	require.NoError(t, err)
+	pemBytes, err := cache_v2.CreateCertificate(template, privateKey.Public(), nil, privateKey, rand.New(rand.NewSource(0)))
+	require.NoError(t, err)
+	block, _ := pem.Decode(pemBytes)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return certificate
+}
+
+// encode bytes in the MULTILINE_OCTAL format of certdata.txt
+func encodeOctal(data []byte) string {
+	var builder strings.Builder
+	for i, b := range data {
+		fmt.Fprintf(&builder, "\\%03o", b)
+		if i%16 == 15 || i == len(data)-1 {
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String() + "END\n"
+}
+
+// create a certdata.txt entry (certificate and trust object)
+func certdataEntry(certificate *x509.Certificate, label string, serverAuth string, distrustAfter string) string {
+	sha1Hash := sha1.Sum(certificate.Raw)
+	entry := "\n# Certificate \"" + label + "\"\n" +
+		"CKA_CLASS CK_OBJECT_CLASS CKO_CERTIFICATE\n" +
+		"CKA_TOKEN CK_BBOOL CK_TRUE\n" +
+		"CKA_LABEL UTF8 \"" + label + "\"\n" +
+		"CKA_CERTIFICATE_TYPE CK_CERTIFICATE_TYPE CKC_X_509\n" +
+		"CKA_ISSUER MULTILINE_OCTAL\n" + encodeOctal(certificate.RawIssuer) +
+		"CKA_SERIAL_NUMBER MULTILINE_OCTAL\n" + encodeOctal(certificate.SerialNumber.Bytes()) +
+		"CKA_VALUE MULTILINE_OCTAL\n" + encodeOctal(certificate.Raw)
+	if distrustAfter == "" {
+		entry += "CKA_NSS_SERVER_DISTRUST_AFTER CK_BBOOL CK_FALSE\n"
+	} else {
+		entry += "CKA_NSS_SERVER_DISTRUST_AFTER MULTILINE_OCTAL\n" + encodeOctal([]byte(distrustAfter))
+	}
+	return entry + "\n# Trust for \"" + label + "\"\n" +
+		"CKA_CLASS CK_OBJECT_CLASS CKO_NSS_TRUST\n" +
+		"CKA_LABEL UTF8 \"" + label + "\"\n" +
+		"CKA_CERT_SHA1_HASH MULTILINE_OCTAL\n" + encodeOctal(sha1Hash[:]) +
+		"CKA_TRUST_SERVER_AUTH CK_TRUST " + serverAuth + "\n" +
+		"CKA_TRUST_EMAIL_PROTECTION CK_TRUST CKT_NSS_TRUSTED_DELEGATOR\n"
+}
+
+// check that roots, trust bits and distrust dates are imported from certdata.txt
+func TestParseCertdata(t *testing.T) {
+	trusted := createTestRoot(t, 1, "Trusted Root")
+	distrusted := createTestRoot(t, 2, "Distrusted Root")
+	emailOnly := createTestRoot(t, 3, "Email Root")
+	notTrusted := createTestRoot(t, 4, "Not Trusted Root")
+	certdata := "# This Source Code Form is subject to the terms of the Mozilla Public\n" +
+		"BEGINDATA\n" +
+		certdataEntry(trusted, "Trusted Root", "CKT_NSS_TRUSTED_DELEGATOR", "") +
+		certdataEntry(distrusted, "Distrusted Root", "CKT_NSS_TRUSTED_DELEGATOR", "241130235959Z") +
+		certdataEntry(emailOnly, "Email Root", "CKT_NSS_MUST_VERIFY_TRUST", "") +
+		certdataEntry(notTrusted, "Not Trusted Root", "CKT_NSS_NOT_TRUSTED", "")
+
+	roots, err := ParseCertdata(strings.NewReader(certdata))
+	require.NoError(t, err)
+	require.Len(t, roots, 3)
+	require.Equal(t, "Trusted Root", roots[0].Label)
+	require.Equal(t, trusted.Raw, roots[0].Certificate.Raw)
+	require.True(t, roots[0].Metadata.ServerAuth)
+	require.True(t, roots[0].Metadata.DistrustAfter.IsZero())
+	require.Equal(t, time.Date(2024, 11, 30, 23, 59, 59, 0, time.UTC), roots[1].Metadata.DistrustAfter)
+	require.False(t, roots[2].Metadata.ServerAuth)
+
+	serverAuthRoots := ServerAuthRoots(roots)
+	require.Len(t, serverAuthRoots, 2)
+	require.Equal(t, []string{trusted.Subject.String(), distrusted.Subject.String()}, CASet(serverAuthRoots))
+
+	_, err = ParseCertdata(strings.NewReader("CKA_CLASS CK_OBJECT_CLASS CKO_CERTIFICATE\nCKA_VALUE MULTILINE_OCTAL\n\\060\n"))
+	require.ErrorContains(t, err, "unterminated")
+}
+
+// check that roots, trust bits, distrust dates and constraints are imported from a CCADB CSV export
+func TestParseCCADBCSV(t *testing.T) {
+	trusted := createTestRoot(t, 1, "Trusted Root")
+	constrained := createTestRoot(t, 2, "Constrained Root")
+	var builder strings.Builder
+	writer := csv.NewWriter(&builder)
+	require.NoError(t, writer.WriteAll([][]string{
+		{"Owner", CCADB_NAME_COLUMN, CCADB_TRUST_BITS_COLUMN, CCADB_DISTRUST_AFTER_COLUMN, CCADB_CONSTRAINTS_COLUMN, CCADB_PEM_COLUMN},
+		{"CA 1", "Trusted Root", "Email;Websites", "2024.11.30", "", "'" + string(cache_v2.EncodePEM(trusted.Raw, cache_v2.CERTIFICATE)) + "'"},
+		{"CA 2", "Constrained Root", "Websites", "", "*.gr; *.eu", string(cache_v2.EncodePEM(constrained.Raw, cache_v2.CERTIFICATE))},
+	}))
+
+	roots, err := ParseCCADBCSV(strings.NewReader(builder.String()))
+	require.NoError(t, err)
+	require.Len(t, roots, 2)
+	require.Equal(t, trusted.Raw, roots[0].Certificate.Raw)
+	require.True(t, roots[0].Metadata.ServerAuth)
+	require.Equal(t, time.Date(2024, 11, 30, 23, 59, 59, 0, time.UTC), roots[0].Metadata.DistrustAfter)
+	require.Equal(t, []string{"gr", "eu"}, roots[1].Metadata.PermittedDNSDomains)
+
+	_, err = ParseCCADBCSV(strings.NewReader("Owner,Trust Bits\nCA 1,Websites\n"))
+	require.ErrorContains(t, err, CCADB_PEM_COLUMN)
+}
+
+// check that the generated trust store directory is loaded with the
+// imported trust metadata and that the CA set matches the roots
+func TestWriteTrustStore(t *testing.T) {
+	trusted := createTestRoot(t, 1, "Trusted Root")
+	distrusted := createTestRoot(t, 2, "Distrusted Root")
+	distrustAfter := time.Date(2024, 11, 30, 23, 59, 59, 0, time.UTC)
+	roots := []*Root{
+		{Label: "Trusted Root", Certificate: trusted, Metadata: *cache_v2.DefaultTrustRootMetadata()},
+		{Label: "Distrusted Root", Certificate: distrusted, Metadata: cache_v2.TrustRootMetadata{ServerAuth: true, DistrustAfter: distrustAfter}},
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Old_Root.crt"), []byte("old"), 0644))
+	require.NoError(t, WriteTrustStoreDir(dir, roots))
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{
+		filepath.Join(dir, "Trusted_Root.crt"),
+		filepath.Join(dir, "Distrusted_Root.crt"),
+		filepath.Join(dir, cache_v2.TRUST_METADATA_FILE),
+	}, files)
+
+	require.Equal(t, 2, cache_v2.InitializeCacheFromFS(os.DirFS(dir), "."))
+	for _, root := range cache_v2.GetTrustRoots() {
+		if root.Hash == cache_v2.GetRawCertificateHash(distrusted) {
+			require.True(t, root.TrustRootMetadata.DistrustAfter.Equal(distrustAfter))
+		} else {
+			require.True(t, root.TrustRootMetadata.DistrustAfter.IsZero())
+		}
+	}
+
+	var js strings.Builder
+	require.NoError(t, WriteCASetJS(&js, CASet(roots)))
+	require.Contains(t, js.String(), "export const firefox_trust_store_cas = [\n")
+	require.Contains(t, js.String(), "    \""+trusted.Subject.String()+"\",\n")
+}
@@ -190,36 +190,40 @@ export async function reloadSettings() {
     document.querySelector("input.proof-fetch-max-tries").value = json_config['proof-fetch-max-tries'];
     document.querySelector("input.mapserver-quorum").value = json_config['mapserver-quorum'];
     document.querySelector("input.mapserver-instances-queried").value = json_config['mapserver-instances-queried'];
-    document.querySelector("input.send-log-entries-via-event").value = json_config['send-log-entries-via-event'];
-    document.querySelector("input.wasm-certificate-parsing").value = json_config['wasm-certificate-parsing'];
-    document.querySelector("input.wasm-certificate-caching").value = json_config['wasm-certificate-caching'];
+    document.querySelector("input.send-log-entries-via-event").checked = json_config['send-log-entries-via-event'] === true || json_config['send-log-entries-via-event'] === "true";
+    document.querySelector("input.wasm-certificate-parsing").checked = json_config['wasm-certificate-parsing'] === true || json_config['wasm-certificate-parsing'] === "true";
+    document.querySelector("input.wasm-certificate-caching").checked = json_config['wasm-certificate-caching'] === true || json_config['wasm-certificate-caching'] === "true";
+    document.querySelector("input.wasm-binary-encoding").checked = json_config['wasm-binary-encoding'] === true || json_config['wasm-binary-encoding'] === "true";
 
     document.querySelector('input.cache-timeout').addEventListener("input", () => {
-        json_config['cache-timeout'] = document.querySelector("input.cache-timeout").value;
+        json_config['cache-timeout'] = Number(document.querySelector("input.cache-timeout").value);
     });
     document.querySelector('input.max-connection-setup-time').addEventListener("input", () => {
-        json_config['max-connection-setup-time'] = document.querySelector("input.max-connection-setup-time").value;
+        json_config['max-connection-setup-time'] = Number(document.querySelector("input.max-connection-setup-time").value);
     });
     document.querySelector('input.proof-fetch-timeout').addEventListener("input", () => {
-        json_config['proof-fetch-timeout'] = document.querySelector("input.proof-fetch-timeout").value;
+        json_config['proof-fetch-timeout'] = Number(document.querySelector("input.proof-fetch-timeout").value);
     });
     document.querySelector('input.proof-fetch-max-tries').addEventListener("input", () => {
-        json_config['proof-fetch-max-tries'] = document.querySelector("input.proof-fetch-max-tries").value;
+        json_config['proof-fetch-max-tries'] = Number(document.querySelector("input.proof-fetch-max-tries").value);
     });
     document.querySelector('input.mapserver-quorum').addEventListener("input", () => {
-        json_config['mapserver-quorum'] = document.querySelector("input.mapserver-quorum").value;
+        json_config['mapserver-quorum'] = Number(document.querySelector("input.mapserver-quorum").value);
     });
     document.querySelector('input.mapserver-instances-queried').addEventListener("input", () => {
-        json_config['mapserver-instances-queried'] = document.querySelector("input.mapserver-instances-queried").value;
+        json_config['mapserver-instances-queried'] = Number(document.querySelector("input.mapserver-instances-queried").value);
     });
-    document.querySelector('input.send-log-entries-via-event').addEventListener("input", () => {
-        json_config['send-log-entries-via-event'] = document.querySelector("input.send-log-entries-via-event").value;
+    document.querySelector('input.send-log-entries-via-event').addEventListener("change", () => {
+        json_config['send-log-entries-via-event'] = document.querySelector("input.send-log-entries-via-event").checked;
     });
-    document.querySelector('input.wasm-certificate-parsing').addEventListener("input", () => {
-        json_config['wasm-certificate-parsing'] = document.querySelector("input.wasm-certificate-parsing").value;
+    document.querySelector('input.wasm-certificate-parsing').addEventListener("change", () => {
+        json_config['wasm-certificate-parsing'] = document.querySelector("input.wasm-certificate-parsing").checked;
     });
-    document.querySelector('input.wasm-certificate-caching').addEventListener("input", () => {
-        json_config['wasm-certificate-caching'] = document.querySelector("input.wasm-certificate-caching").value;
+    document.querySelector('input.wasm-certificate-caching').addEventListener("change", () => {
+        json_config['wasm-certificate-caching'] = document.querySelector("input.wasm-certificate-caching").checked;
+    });
+    document.querySelector('input.wasm-binary-encoding').addEventListener("change", () => {
+        json_config['wasm-binary-encoding'] = document.querySelector("input.wasm-binary-encoding").checked;
     });
 
 
@@ -464,7 +468,11 @@ function loadMapserverSettings() {
     mapserver_rows +=   "<tr id='row_mapserver_add'>" + 
                             "<td><input id='input_mapserver_add_identity' type='text' placeholder='Identity' /></td>" +
                             "<td><input id='input_mapserver_add_domain' type='text' placeholder='Domain' /></td>" +
-                            "<td><input type='text' placeholder='lfpki-http-get' disabled='disabled' /></td>" +
+                            "<td><select id='input_mapserver_add_querytype'>" +
+                                "<option value='lfpki-http-get'>lfpki-http-get</option>" +
+                                "<option value='lfpki-http-batch'>lfpki-http-batch</option>" +
+                                "<option value='lfpki-http-prefix'>lfpki-http-prefix</option>" +
+                            "</select></td>" +
                             "<td> <button id='btn_mapserver_add'>Add Mapserver</button> </td>" +
                         "</tr>";
     document.getElementById('mapservers-table-body').innerHTML = mapserver_rows;
@@ -485,7 +493,7 @@ function loadMapserverSettings() {
         json_config.mapservers.push({
             "identity": document.getElementById('input_mapserver_add_identity').value,
             "domain": document.getElementById('input_mapserver_add_domain').value,
-            "querytype": "lfpki-http-get"
+            "querytype": document.getElementById('input_mapserver_add_querytype').value
         })
         
         reloadSettings();
@@ -549,6 +557,7 @@ async function resetChanges(e) {
         json_config['send-log-entries-via-event'] = live_config['send-log-entries-via-event'];
         json_config['wasm-certificate-parsing'] = live_config['wasm-certificate-parsing'];
         json_config['wasm-certificate-caching'] = live_config['wasm-certificate-caching'];
+        json_config['wasm-binary-encoding'] = live_config['wasm-binary-encoding'];
         //
         reloadSettings();
     }
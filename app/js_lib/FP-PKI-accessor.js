@@ -4,6 +4,7 @@ import * as verifier from "./verifier.js"
 import { cLog, convertArrayBufferToBase64, hashPemCertificateWithoutHeader, arrayToHexString, base64ToHex, trimString } from "./helper.js"
 import { addCertificateChainToCacheIfNecessary, getCertificateChainFromCacheByHash } from "./cache.js"
 import { config } from "./config.js"
+import { encodeMapServerResponses, encodeMissingPayloads } from "./go-binary-codec.js"
 
 // get map server response and check the connection
 async function getMapServerResponseAndCheck(url, needVerification, remoteInfo) {
@@ -204,7 +205,18 @@ export class AddMissingPayloadsResponseGo {
     }
 }
 
-async function retrieveMissingCertificatesAndPolicies(mapResponse, requestId, mapResponseNew, mapserverDomain, mapserverID) {
+// log completed stages of asynchronous Go (WASM) requests
+function logGoProgress(requestId) {
+    return ({ stage, done, total }) => {
+        if (done === total) {
+            cLog(requestId, `[Go] processed ${total} ${stage}`);
+        }
+    };
+}
+
+// mapResponseNew contains the response of the map server for its query type
+// (see queryMapServerIdsWithProof, queryMapServerBatch and queryMapServerPrefixes)
+async function retrieveMissingCertificatesAndPolicies(mapResponse, requestId, mapResponseNew, mapserverDomain, mapserverID, querytype = "lfpki-http-get") {
     const startRawExtraction = performance.now();
     const rawDomainMap = new Map()
     const endRawExtraction = performance.now();
@@ -213,16 +225,39 @@ async function retrieveMissingCertificatesAndPolicies(mapResponse, requestId, ma
 
     if (window.GOCACHEV2) {
         cLog(requestId, "Verifying MHT inclusion proof and finding missing IDs");
-        let json = JSON.stringify(mapResponseNew);
+        // encode map server responses as JSON or in the binary format
+        // configs saved by older versions of the config page store the flag as a string
+        const binaryEncoding = config.get("wasm-binary-encoding") === true || config.get("wasm-binary-encoding") === "true";
         const enc = new TextEncoder();
-        let jsonBytes = enc.encode(json);
-        const { verificationResults, certificateIDs: missingCertificateIDs, policyIDs: missingPolicyIDs } = verifyAndGetMissingIDs(mapserverID, jsonBytes, jsonBytes.length);
+        let inputBytes, verifyResponse;
+        switch (querytype) {
+        case "lfpki-http-batch":
+            // the binary format does not support batch and prefix responses
+            inputBytes = enc.encode(JSON.stringify(mapResponseNew));
+            verifyResponse = await verifyBatchAndGetMissingIDsAsync(mapserverID, inputBytes, inputBytes.length, { onProgress: logGoProgress(requestId) });
+            break;
+        case "lfpki-http-prefix":
+            inputBytes = enc.encode(JSON.stringify(mapResponseNew));
+            verifyResponse = await verifyPrefixAndGetMissingIDsAsync(mapserverID, inputBytes, inputBytes.length, { onProgress: logGoProgress(requestId) });
+            break;
+        default:
+            inputBytes = binaryEncoding ? encodeMapServerResponses(mapResponseNew) : enc.encode(JSON.stringify(mapResponseNew));
+            verifyResponse = await verifyAndGetMissingIDsAsync(mapserverID, inputBytes, inputBytes.length, { onProgress: logGoProgress(requestId) });
+        }
+        const { verificationResults, certificateIDs: missingCertificateIDs, policyIDs: missingPolicyIDs } = verifyResponse;
         if (verificationResults.some(e => e != "success")) {
             console.log(verificationResults);
             throw new FpkiError(errorTypes.MAPSERVER_INVALID_RESPONSE, verificationResults.find(e => e != "success"));
         }
 
         const missingIDs = missingCertificateIDs.concat(missingPolicyIDs);
+        if (missingIDs.length > 0 && querytype === "lfpki-http-prefix") {
+            // prefix responses contain the certificates of all entries (which
+            // cache_v2 adds during the verification). fetching the missing IDs
+            // would reveal the queried domain to the map server
+            console.log(`The prefix responses of map server ${mapserverDomain} are missing ${missingIDs.length} payloads: ${missingIDs}`);
+            throw new FpkiError(errorTypes.MAPSERVER_INVALID_RESPONSE, "map server did not provide all payloads in its prefix responses");
+        }
         if (missingIDs.length > 0) {
             cLog(requestId, `Detected ${missingIDs.length} missing IDs (${missingCertificateIDs.length} certs, ${missingPolicyIDs.length} policies): Fetching missing payloads...`);
             // fetch missing certificates
@@ -241,11 +276,10 @@ async function retrieveMissingCertificatesAndPolicies(mapResponse, requestId, ma
                 policyIDs: missingPolicyIDs,
                 payloads: [...result.response]
             };
-            json = JSON.stringify(obj);
-            jsonBytes = enc.encode(json);
+            inputBytes = binaryEncoding ? encodeMissingPayloads(obj.certificateIDs, obj.policyIDs, obj.payloads) : enc.encode(JSON.stringify(obj));
 
             cLog(requestId, `Adding ${obj.payloads.length} payloads to the cache...`);
-            const { processedCertificateIDs, processedPolicyIDs } = addMissingPayloads(jsonBytes, jsonBytes.length);
+            const { processedCertificateIDs, processedPolicyIDs } = await addMissingPayloadsAsync(inputBytes, inputBytes.length, { onProgress: logGoProgress(requestId) });
             cLog(requestId, `Added ${processedCertificateIDs.length} certificates and ${processedPolicyIDs.length} policies to the cache`);
 
             const processedCertificatesSet = new Set(processedCertificateIDs)
@@ -402,6 +436,60 @@ async function queryMapServerIdsWithProof(mapServerUrl, domainName, options) {
     return { response: decodedResponse, fetchUrl: fetchUrl, nRetries: maxTries - triesLeft };
 }
 
+// query map server for the proofs of the domains (and their parent domains)
+// under a single signed root
+async function queryMapServerBatch(mapServerUrl, domainNames, options) {
+    const fetchUrl = mapServerUrl + "/getproofs";
+    console.log(`initiating request: ${trimString(fetchUrl)}`);
+    const { delay = 0, timeout = 60000, maxTries = 3, requestId } = options;
+    const fetchOptions = { keepalive: true, method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ domains: domainNames }) };
+    const { response, triesLeft } = await fetchRetry(fetchUrl, delay, maxTries, timeout, requestId, 0, fetchOptions);
+    const decodedResponse = await response.json();
+
+    return { response: decodedResponse, fetchUrl: fetchUrl, nRetries: maxTries - triesLeft };
+}
+
+// the domain and its parent domains without the TLD (the domains whose
+// proofs are returned by the getproof endpoint)
+function getDomainAndParentDomains(domainName) {
+    const domainNames = [];
+    for (let name = domainName; !domainFunc.isTopLevelDomain(name); name = domainFunc.getParentDomain(name)) {
+        domainNames.push(name);
+    }
+    return domainNames;
+}
+
+// first bits bits of the SHA-256 hash of the domain name as hex string (the
+// last byte is padded with zeros, see PrefixOfDomain in cache_v2)
+async function getPrefixOfDomain(domainName, bits) {
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", new TextEncoder().encode(domainName)));
+    const prefix = hash.slice(0, Math.ceil(bits / 8));
+    if (bits % 8 !== 0) {
+        prefix[prefix.length - 1] &= 0xff << (8 - bits % 8);
+    }
+    return arrayToHexString(prefix);
+}
+
+// query map server for all entries under the hash prefixes of the domain and
+// its parent domains, so that the map server does not learn the queried domain
+async function queryMapServerPrefixes(mapServerUrl, domainName, prefixBits, options) {
+    const { delay = 0, timeout = 60000, maxTries = 3, requestId } = options;
+    const domainNames = getDomainAndParentDomains(domainName);
+    const prefixes = new Set(await Promise.all(domainNames.map(name => getPrefixOfDomain(name, prefixBits))));
+    const responses = [];
+    let fetchUrl = null;
+    let nRetries = 0;
+    for (const prefix of prefixes) {
+        fetchUrl = mapServerUrl + "/prefix?prefix=" + prefix + "&bits=" + prefixBits;
+        console.log(`initiating request: ${trimString(fetchUrl)}`);
+        const { response, triesLeft } = await fetchRetry(fetchUrl, delay, maxTries, timeout, requestId, 0, { keepalive: true });
+        responses.push(await response.json());
+        nRetries += maxTries - triesLeft;
+    }
+
+    return { response: { DomainNames: domainNames, Responses: responses }, fetchUrl: fetchUrl, nRetries: nRetries };
+}
+
 // query map server for certificate and policy payloads
 async function queryMapServerPayloads(mapServerUrl, ids, options) {
     const fetchUrl = mapServerUrl + "/getpayloads?ids=" + ids;
@@ -439,6 +527,8 @@ export {
     queryMapServer,
     queryMapServerHttp,
     queryMapServerIdsWithProof,
+    queryMapServerBatch,
+    queryMapServerPrefixes,
     queryMapServerPayloads,
     extractPolicy,
     retrieveMissingCertificatesAndPolicies,
@@ -0,0 +1,82 @@
+import {errorTypes, FpkiError} from "./errors.js"
+
+// DNS type and response codes used in DNS-over-HTTPS JSON responses
+const DNS_TYPE_TLSA = 52;
+const DNS_RCODE_NOERROR = 0;
+const DNS_RCODE_NXDOMAIN = 3;
+
+// record sets are cached for their TTL, but at least for a minute (same as
+// cache_v2.TLSA_MIN_TTL)
+const TLSA_MIN_TTL = 60 * 1000;
+
+// TLSA record sets fetched by getTLSARecords, by service name
+const tlsaRecordCache = new Map();
+
+/**
+ * Parse the data of a TLSA record in a DNS-over-HTTPS JSON response.
+ * Resolvers either use the presentation format ("3 1 1 abcd...") or the
+ * generic format of RFC 3597 ("\# 35 03 01 01 ab cd ...").
+ */
+function parseTLSARecordData(data) {
+    const fields = data.trim().split(/\s+/);
+    if (fields[0] === "\\#") {
+        const bytes = fields.slice(2).join("");
+        return {
+            usage: parseInt(bytes.slice(0, 2), 16),
+            selector: parseInt(bytes.slice(2, 4), 16),
+            matchingType: parseInt(bytes.slice(4, 6), 16),
+            data: bytes.slice(6).toLowerCase(),
+        };
+    }
+    return {
+        usage: parseInt(fields[0]),
+        selector: parseInt(fields[1]),
+        matchingType: parseInt(fields[2]),
+        data: fields.slice(3).join("").toLowerCase(),
+    };
+}
+
+/**
+ * Fetch the TLSA records of a TCP service from a DNS-over-HTTPS resolver
+ * (JSON API, e.g., https://cloudflare-dns.com/dns-query).
+ * Returns a record set in the format expected by addTLSARecords (see cache_v2.TLSARecordSet).
+ */
+export async function fetchTLSARecords(resolver, hostname, port) {
+    const name = `_${port}._tcp.${hostname}`;
+    const url = new URL(resolver);
+    url.searchParams.set("name", name);
+    url.searchParams.set("type", "TLSA");
+    url.searchParams.set("do", "1");
+    const response = await fetch(url, {headers: {"accept": "application/dns-json"}});
+    if (!response.ok) {
+        throw new FpkiError(errorTypes.DANE_VALIDATION_ERROR, `DNS-over-HTTPS query for ${name} failed with status ${response.status}`);
+    }
+    const dnsResponse = await response.json();
+    if (dnsResponse.Status !== DNS_RCODE_NOERROR && dnsResponse.Status !== DNS_RCODE_NXDOMAIN) {
+        throw new FpkiError(errorTypes.DANE_VALIDATION_ERROR, `DNS-over-HTTPS query for ${name} failed with response code ${dnsResponse.Status}`);
+    }
+    const answers = (dnsResponse.Answer || []).filter(a => a.type === DNS_TYPE_TLSA);
+    return {
+        name: name,
+        ttl: answers.length > 0 ? Math.min(...answers.map(a => a.TTL)) : 0,
+        authenticatedData: dnsResponse.AD === true,
+        records: answers.map(a => parseTLSARecordData(a.data)),
+    };
+}
+
+/**
+ * Same as fetchTLSARecords, but returns the cached record set of the service
+ * until its TTL expires. The TTL of a cached record set is reduced to the
+ * remaining time, such that the records also expire in time in Go.
+ */
+export async function getTLSARecords(resolver, hostname, port) {
+    const name = `_${port}._tcp.${hostname}`;
+    const now = Date.now();
+    const cached = tlsaRecordCache.get(name);
+    if (cached !== undefined && cached.resolver === resolver && now < cached.expiry) {
+        return {...cached.recordSet, ttl: Math.floor((cached.expiry - now) / 1000)};
+    }
+    const recordSet = await fetchTLSARecords(resolver, hostname, port);
+    tlsaRecordCache.set(name, {resolver: resolver, recordSet: recordSet, expiry: now + Math.max(recordSet.ttl * 1000, TLSA_MIN_TTL)});
+    return recordSet;
+}
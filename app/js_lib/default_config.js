@@ -1,6 +1,7 @@
 import {firefox_trust_store_cas} from "./trust_store_cas.js"
 
 export const defaultConfig = {
+    "config-version": 1,
     "legacy-trust-preference": {
         "*": [
             {
@@ -90,4 +91,12 @@ export const defaultConfig = {
     "send-log-entries-via-event": true,
     "wasm-certificate-parsing": false,
     "wasm-certificate-caching": true,
+    "wasm-binary-encoding": false,
+    "tofu-pinning": false,
+    "tofu-pin-expiry": 7776000000,
+    "spki-pins": {},
+    "dane-validation": false,
+    "dane-resolver": "https://cloudflare-dns.com/dns-query",
+    "verify-modes": [],
+    "verdict-precedence": "policy-overrides-legacy",
 }
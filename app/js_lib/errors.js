@@ -4,6 +4,9 @@ export const errorTypes = {
     MAPSERVER_NETWORK_ERROR: "Map server network connection error",
     LEGACY_MODE_VALIDATION_ERROR: "Legacy mode validation error",
     POLICY_MODE_VALIDATION_ERROR: "Policy mode validation error",
+    SPKI_PIN_VALIDATION_ERROR: "SPKI pinning validation error",
+    DANE_VALIDATION_ERROR: "DANE validation error",
+    TOFU_VALIDATION_ERROR: "Trust on first use validation error",
     MAPSERVER_INVALID_RESPONSE: "Map server returned invalid response",
 }
 
@@ -1,5 +1,5 @@
 import {errorTypes, FpkiError} from "./errors.js"
-import {queryMapServerHttp, queryMapServerIdsWithProof, queryMapServerPayloads, extractPolicy, retrieveMissingCertificatesAndPolicies} from "./FP-PKI-accessor.js"
+import {queryMapServerHttp, queryMapServerIdsWithProof, queryMapServerBatch, queryMapServerPrefixes, queryMapServerPayloads, extractPolicy, retrieveMissingCertificatesAndPolicies} from "./FP-PKI-accessor.js"
 import {mapGetList, cLog, printMap} from "./helper.js"
 import {config} from "./config.js"
 import * as verifier from "./verifier.js"
@@ -8,6 +8,47 @@ var fpkiRequests = new Map();
 
 var mapserverResponseCache = new Map();
 
+// prefix length (in bits) of prefix queries if the map server config does not
+// set prefix-bits
+const DEFAULT_PREFIX_BITS = 16;
+
+// requests to a map server with the query type lfpki-http-batch that are
+// initiated within this window (in ms) are combined into a single getproofs
+// query, e.g., the hosts of the resources of a page
+const BATCH_WINDOW = 100;
+
+// maps a map server identity to the batch collecting domains
+var pendingBatches = new Map();
+
+// add the domain to the pending batch of the map server (or start a new batch).
+// the batch is queried once the window has passed and its proofs are verified
+// and the missing payloads are fetched once for all domains of the batch.
+// returns a promise resolving to the query result and the result of
+// retrieveMissingCertificatesAndPolicies
+function queryMapServerBatched(mapserver, domain, requestId) {
+    let batch = pendingBatches.get(mapserver.identity);
+    if (batch === undefined) {
+        batch = {domains: []};
+        batch.promise = new Promise(resolve => setTimeout(resolve, BATCH_WINDOW)).then(async () => {
+            pendingBatches.delete(mapserver.identity);
+            cLog(requestId, `querying batch of ${batch.domains.length} domains [${mapserver.identity}]: ${batch.domains}`);
+            let result;
+            try {
+                result = await queryMapServerBatch(mapserver.domain, batch.domains, {timeout: config.get("proof-fetch-timeout"), requestId, maxTries: config.get("proof-fetch-max-tries")});
+            } catch(error) {
+                throw new FpkiError(errorTypes.MAPSERVER_NETWORK_ERROR, error);
+            }
+            const retrieved = await retrieveMissingCertificatesAndPolicies(undefined, requestId, result.response, mapserver.domain, mapserver.identity, mapserver.querytype);
+            return {result, retrieved};
+        });
+        pendingBatches.set(mapserver.identity, batch);
+    }
+    if (!batch.domains.includes(domain)) {
+        batch.domains.push(domain);
+    }
+    return batch.promise;
+}
+
 export class FpkiRequest {
     constructor(mapserver, domain, requestId) {
         this.mapserver = mapserver;
@@ -94,7 +135,7 @@ export class FpkiRequest {
 
             // execute the fetching and response parsing in a try block to ensure that the active request is dropped whether the operations succeed or fail
             try {
-                let mapResponse, performanceResourceEntry, nRetries, mapResponseNew;
+                let mapResponse, performanceResourceEntry, nRetries, mapResponseNew, retrieved;
                 // fetch policy for the mapserver over the configured channel (e.g., http get)
                 switch (this.mapserver.querytype) {
                 case "lfpki-http-get":
@@ -110,6 +151,26 @@ export class FpkiRequest {
                     nRetries = resultIdsOnly.nRetries;
                     performanceResourceEntry = this.#getLatestPerformanceResourceEntry(resultIdsOnly.fetchUrl);
                     break;
+                case "lfpki-http-batch":
+                    // the batch response is verified and its missing payloads
+                    // are fetched once for all requests of the batch
+                    const {result: resultBatch, retrieved: retrievedBatch} = await queryMapServerBatched(this.mapserver, this.domain, this.requestId);
+                    mapResponseNew = resultBatch.response;
+                    retrieved = retrievedBatch;
+                    nRetries = resultBatch.nRetries;
+                    performanceResourceEntry = this.#getLatestPerformanceResourceEntry(resultBatch.fetchUrl);
+                    break;
+                case "lfpki-http-prefix":
+                    let resultPrefixes;
+                    try {
+                        resultPrefixes = await queryMapServerPrefixes(this.mapserver.domain, this.domain, this.mapserver["prefix-bits"] || DEFAULT_PREFIX_BITS, {timeout: config.get("proof-fetch-timeout"), requestId: this.requestId, maxTries: config.get("proof-fetch-max-tries")});
+                    } catch(error) {
+                        throw new FpkiError(errorTypes.MAPSERVER_NETWORK_ERROR, error);
+                    }
+                    mapResponseNew = resultPrefixes.response;
+                    nRetries = resultPrefixes.nRetries;
+                    performanceResourceEntry = this.#getLatestPerformanceResourceEntry(resultPrefixes.fetchUrl);
+                    break;
                 default:
                     throw new FpkiError(errorTypes.INVALID_CONFIG, "Invalid mapserver config: "+this.mapserver.querytype)
                     break;
@@ -140,7 +201,10 @@ export class FpkiRequest {
                 const policies = new Map();
 
                 // TODO: also return policies
-                const { certificatesOld } = await retrieveMissingCertificatesAndPolicies(mapResponse, this.requestId, mapResponseNew, this.mapserver.domain, this.mapserver.identity);
+                if (retrieved === undefined) {
+                    retrieved = await retrieveMissingCertificatesAndPolicies(mapResponse, this.requestId, mapResponseNew, this.mapserver.domain, this.mapserver.identity, this.mapserver.querytype);
+                }
+                const { certificatesOld } = retrieved;
                 cLog(this.requestId, "fetch finished for: "+this.domain);
 
                 // add policies to policy cache
@@ -0,0 +1,135 @@
+// compact binary encoding of the inputs passed to the Go (WASM) functions
+// verifyAndGetMissingIDs, addMissingPayloads, verifyLegacy and verifyPolicy.
+// Avoids the JSON and base64 encoding/decoding overhead for large map server
+// responses. The format is documented in go_wasm/bridge/binary.go.
+
+const BINARY_MAGIC = 0xfb;
+const BINARY_VERSION = 0x02;
+
+// growable buffer for the binary encoding
+class BinaryWriter {
+    constructor(initialSize = 4096) {
+        this.buffer = new Uint8Array(initialSize);
+        this.view = new DataView(this.buffer.buffer);
+        this.offset = 0;
+        this.writeByte(BINARY_MAGIC);
+        this.writeByte(BINARY_VERSION);
+    }
+
+    ensureCapacity(n) {
+        if (this.offset + n <= this.buffer.length) {
+            return;
+        }
+        let newSize = this.buffer.length * 2;
+        while (newSize < this.offset + n) {
+            newSize *= 2;
+        }
+        const newBuffer = new Uint8Array(newSize);
+        newBuffer.set(this.buffer.subarray(0, this.offset));
+        this.buffer = newBuffer;
+        this.view = new DataView(this.buffer.buffer);
+    }
+
+    writeByte(b) {
+        this.ensureCapacity(1);
+        this.buffer[this.offset] = b;
+        this.offset += 1;
+    }
+
+    writeUint32(v) {
+        this.ensureCapacity(4);
+        this.view.setUint32(this.offset, v, false);
+        this.offset += 4;
+    }
+
+    // non-negative integer below 2^53 (e.g., an epoch or a unix timestamp)
+    writeUint64(v) {
+        this.ensureCapacity(8);
+        this.view.setBigUint64(this.offset, BigInt(v || 0), false);
+        this.offset += 8;
+    }
+
+    writeBytes(bytes) {
+        this.writeUint32(bytes.length);
+        this.ensureCapacity(bytes.length);
+        this.buffer.set(bytes, this.offset);
+        this.offset += bytes.length;
+    }
+
+    // base64 encoded bytes (null and undefined are encoded as empty bytes)
+    writeBase64(b64) {
+        this.writeBytes(b64 ? base64ToBytes(b64) : new Uint8Array(0));
+    }
+
+    writeString(s) {
+        this.writeBytes(new TextEncoder().encode(s || ""));
+    }
+
+    bytes() {
+        return this.buffer.subarray(0, this.offset);
+    }
+}
+
+function base64ToBytes(b64) {
+    const s = window.atob(b64);
+    const bytes = new Uint8Array(s.length);
+    for (let i = 0; i < s.length; i++) {
+        bytes[i] = s.charCodeAt(i);
+    }
+    return bytes;
+}
+
+// encode the (JSON parsed) responses of the map server's getproof endpoint
+export function encodeMapServerResponses(responses) {
+    const w = new BinaryWriter();
+    w.writeUint32(responses.length);
+    for (const response of responses) {
+        const domainEntry = response.DomainEntry || {};
+        const poi = response.PoI || {};
+        w.writeString(domainEntry.DomainName);
+        w.writeBase64(domainEntry.CertIDs);
+        w.writeBase64(domainEntry.PolicyIDs);
+        w.writeByte(poi.ProofType || 0);
+        const proof = poi.Proof || [];
+        w.writeUint32(proof.length);
+        for (const node of proof) {
+            w.writeBase64(node);
+        }
+        w.writeBase64(poi.Root);
+        w.writeBase64(poi.ProofKey);
+        w.writeBase64(poi.ProofValue);
+        w.writeBase64(response.TreeHeadSig);
+        w.writeString(response.KeyID);
+        w.writeUint64(response.Epoch);
+        w.writeUint64(response.Timestamp);
+        w.writeBase64(response.EpochSig);
+    }
+    return w.bytes();
+}
+
+// encode the requested (base64 encoded) certificate and policy IDs and the
+// (base64 encoded) payloads returned by the map server's getpayloads endpoint
+export function encodeMissingPayloads(certificateIDs, policyIDs, payloads) {
+    const w = new BinaryWriter();
+    for (const ids of [certificateIDs, policyIDs]) {
+        w.writeUint32(ids.length);
+        for (const id of ids) {
+            w.writeBase64(id);
+        }
+    }
+    w.writeUint32(payloads.length);
+    for (const payload of payloads) {
+        w.writeBase64(payload);
+    }
+    return w.bytes();
+}
+
+// encode a list of base64 encoded DER certificates
+export function encodeCertificateChain(certificateChainb64) {
+    const w = new BinaryWriter();
+    w.writeUint32(certificateChainb64.length);
+    for (const certificate of certificateChainb64) {
+        w.writeBase64(certificate);
+    }
+    return w.bytes();
+}
@@ -215,3 +215,13 @@ export function clone(json_object) {
 
     return cloned_config;
 }
+
+// Synchronous Go (WASM) functions return an Error object instead of throwing,
+// since a panic in Go stops the WASM program. Throws the returned error and
+// returns the result otherwise.
+export function checkGoResult(result) {
+    if (result instanceof Error) {
+        throw result;
+    }
+    return result;
+}
@@ -41,7 +41,7 @@ export class LegacyTrustDecision {
 }
 
 export class PolicyTrustDecisionGo {
-    constructor(domain, evaluationResult, policyChain, conflictingPolicies, validUntilUnix, domainExcluded) {
+    constructor(domain, evaluationResult, policyChain, conflictingPolicies, validUntilUnix, domainExcluded, explanationJSON) {
         this.type = "policy";
         this.domain = domain;
         this.connectionCertificateChain = null;
@@ -56,12 +56,118 @@ export class PolicyTrustDecisionGo {
         this.conflictingPolicies = conflictingPolicies;
 
         this.domainExcluded = domainExcluded;
+
+        // structured report describing how the decision was reached
+        this.explanation = JSON.parse(explanationJSON);
+    }
+}
+
+export class SPKIPinTrustDecisionGo {
+    constructor(domain, evaluationResult, pinDomain, mode, violation, matchedChainIndex, validUntilUnix, explanationJSON) {
+        this.type = "spki-pinning";
+        this.domain = domain;
+        this.connectionCertificateChain = null;
+
+        this.evaluationResult = evaluationResult;
+
+        // domain (or wildcard/parent domain) whose pins were applied
+        // (empty if no pins are defined)
+        this.pinDomain = pinDomain;
+
+        // "enforce" or "report-only"
+        this.mode = mode;
+
+        // true if no public key of the chain is pinned (in report-only
+        // mode, the evaluation result is nevertheless successful)
+        this.violation = violation;
+
+        // index of the certificate whose public key is pinned (-1 if none)
+        this.matchedChainIndex = matchedChainIndex;
+
+        // timestamp until which this entry can be cached
+        this.validUntil = new Date(validUntilUnix*1000);
+
+        // structured report describing how the decision was reached
+        this.explanation = JSON.parse(explanationJSON);
+    }
+}
+
+export class DANETrustDecisionGo {
+    constructor(domain, evaluationResult, tlsaName, dnssecStatus, applicable, matchedRecordIndex, matchedChainIndex, validUntilUnix, explanationJSON) {
+        this.type = "dane";
+        this.domain = domain;
+        this.connectionCertificateChain = null;
+
+        this.evaluationResult = evaluationResult;
+
+        // service name of the TLSA records (e.g., _443._tcp.example.com)
+        // and their DNSSEC status
+        this.tlsaName = tlsaName;
+        this.dnssecStatus = dnssecStatus;
+
+        // true if authenticated and usable TLSA records exist
+        this.applicable = applicable;
+
+        // index of the matching record and certificate (-1 if none)
+        this.matchedRecordIndex = matchedRecordIndex;
+        this.matchedChainIndex = matchedChainIndex;
+
+        // timestamp until which this entry can be cached
+        this.validUntil = new Date(validUntilUnix*1000);
+
+        // structured report describing how the decision was reached
+        this.explanation = JSON.parse(explanationJSON);
+    }
+}
+
+export class TOFUTrustDecisionGo {
+    constructor(domain, evaluationResult, status, validUntilUnix, explanationJSON) {
+        this.type = "tofu";
+        this.domain = domain;
+        this.connectionCertificateChain = null;
+
+        this.evaluationResult = evaluationResult;
+
+        // outcome of the check against the pin of the domain
+        // ("not-applicable", "pinned", "match", "updated" or "violation")
+        this.status = status;
+
+        // timestamp until which this entry can be cached
+        this.validUntil = new Date(validUntilUnix*1000);
+
+        // structured report describing how the decision was reached
+        this.explanation = JSON.parse(explanationJSON);
+    }
+}
+
+// final decision of all enabled validation modes (see cache_v2.Verify)
+export class VerdictGo {
+    constructor(domain, evaluationResult, precedence, decidingModes, decisions, validUntilUnix, resultsJSON) {
+        this.type = "verdict";
+        this.domain = domain;
+        this.evaluationResult = evaluationResult;
+
+        // precedence policy used to combine the modes and the modes whose
+        // results are part of the final decision
+        this.precedence = precedence;
+        this.decidingModes = decidingModes;
+
+        // trust decisions of the modes that were run (LegacyTrustDecisionGo,
+        // PolicyTrustDecisionGo, SPKIPinTrustDecisionGo, DANETrustDecisionGo
+        // or TOFUTrustDecisionGo)
+        this.decisions = decisions;
+
+        // timestamp until which this entry can be cached
+        this.validUntil = new Date(validUntilUnix*1000);
+
+        // results of all enabled modes (including skipped modes)
+        this.results = JSON.parse(resultsJSON);
     }
 }
 
 export class LegacyTrustDecisionGo {
     constructor(domain, connectionTrustLevel, connectionTrustLevelCASet, connectionTrustLevelChainIndex, evaluationResult,
-                highestTrustLevel, highestTrustLevelCASets, highestTrustLevelChainIndices, highestTrustLevelChainHashes, highestTrustLevelChainSubjects, validUntilUnix) {
+                highestTrustLevel, highestTrustLevelCASets, highestTrustLevelChainIndices, highestTrustLevelChainHashes, highestTrustLevelChainSubjects, validUntilUnix, explanationJSON) {
 
         // information describing the certificate obtained in the
         // handshake and its trust level
@@ -89,6 +195,10 @@ export class LegacyTrustDecisionGo {
 
         // timestamp until which this entry can be cached
         this.validUntil = new Date(validUntilUnix*1000);
+
+        // structured report describing how the decision was reached
+        // (considered chains, trust levels, pruned chains and proofs)
+        this.explanation = JSON.parse(explanationJSON);
     }
 }
 
@@ -174,6 +284,12 @@ export function getShortErrorMessages(trustDecision) {
 }
 
 export function getLegacyValidationErrorMessageGo(legacyTrustDecisionGo) {
+    const connectionChainExplanation = legacyTrustDecisionGo.explanation.connectionChain;
+    if (connectionChainExplanation && connectionChainExplanation.forbiddenCA) {
+        const forbiddenCA = connectionChainExplanation.forbiddenCA;
+        return "Connection certificate chain contains certificate \"" + forbiddenCA.subject + "\" within CA Set " + forbiddenCA.caSet + ", which is forbidden for " + forbiddenCA.domain + ".";
+    }
+
     let errorMessage = "";
     errorMessage += "Detected " + legacyTrustDecisionGo.highestTrustLevelCASets.length +" more highly trusted certificate chains than the chain received in the connection.";
     if (legacyTrustDecisionGo.connectionTrustLevelCASet === "DEFAULT") {
@@ -190,6 +306,50 @@ export function getLegacyValidationErrorMessageGo(legacyTrustDecisionGo) {
     return errorMessage;
 }
 
+export function getSPKIPinValidationErrorMessageGo(spkiPinTrustDecisionGo) {
+    let m = "";
+    m += "No public key of the connection certificate chain is pinned for " + spkiPinTrustDecisionGo.pinDomain + ".";
+    const spkiPins = spkiPinTrustDecisionGo.explanation.spkiPins;
+    if (spkiPins) {
+        m += " Pinned leaf keys: [" + spkiPins.leafSPKIHashes.join(", ") + "], pinned CA keys: [" + spkiPins.caSPKIHashes.join(", ") + "].";
+    }
+    return m;
+}
+
+export function getDANEValidationErrorMessageGo(daneTrustDecisionGo) {
+    if (daneTrustDecisionGo.dnssecStatus === "bogus") {
+        return "Failed to verify the DNSSEC chain of the TLSA records of " + daneTrustDecisionGo.tlsaName + ".";
+    }
+    if (!daneTrustDecisionGo.applicable) {
+        return daneTrustDecisionGo.explanation.notes.join(" ");
+    }
+    return "No TLSA record of " + daneTrustDecisionGo.tlsaName + " matches the connection certificate chain.";
+}
+
+export function getTOFUValidationErrorMessageGo(tofuTrustDecisionGo) {
+    const tofu = tofuTrustDecisionGo.explanation.tofu;
+    return "Connection certificate was issued by \"" + tofu.issuerSubject + "\", but only " + tofu.pin.issuerSubjects.map(s => "\"" + s + "\"").join(", ") + " issued certificates for " + tofuTrustDecisionGo.domain + " since " + tofu.pin.firstSeen + " (trust on first use) and no map server record for the new CA exists.";
+}
+
+// returns the error describing the first failed deciding mode of a verdict
+export function getVerdictErrorGo(verdictGo) {
+    const failedDecision = verdictGo.decisions.find(td => verdictGo.decidingModes.includes(td.type) && td.evaluationResult !== 1);
+    switch (failedDecision ? failedDecision.type : "") {
+    case "legacy":
+        return new FpkiError(errorTypes.LEGACY_MODE_VALIDATION_ERROR, getLegacyValidationErrorMessageGo(failedDecision));
+    case "policy":
+        return new FpkiError(errorTypes.POLICY_MODE_VALIDATION_ERROR, getPolicyValidationErrorMessageGo(failedDecision));
+    case "spki-pinning":
+        return new FpkiError(errorTypes.SPKI_PIN_VALIDATION_ERROR, getSPKIPinValidationErrorMessageGo(failedDecision));
+    case "dane":
+        return new FpkiError(errorTypes.DANE_VALIDATION_ERROR, getDANEValidationErrorMessageGo(failedDecision));
+    case "tofu":
+        return new FpkiError(errorTypes.TOFU_VALIDATION_ERROR, getTOFUValidationErrorMessageGo(failedDecision));
+    default:
+        return new FpkiError(errorTypes.INTERNAL_ERROR, "Validation failed without a failed validation mode");
+    }
+}
+
 export function getPolicyValidationErrorMessageGo(policyTrustDecisionGo) {
     const policyChainDescriptors = getPolicyChainDescriptors(policyTrustDecisionGo.policyChain);
     let m = "";
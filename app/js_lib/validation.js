@@ -1,6 +1,8 @@
 import * as domainFunc from "./domain.js"
 import {FpkiError} from "./errors.js"
 import {printMap} from "./helper.js"
+import {config} from "./config.js"
+import {encodeCertificateChain} from "./go-binary-codec.js"
 import {LegacyTrustInfo, LegacyTrustDecision, PolicyEvaluation, PolicyTrustInfo, PolicyTrustDecision, PolicyAttributes, EvaluationResult} from "./validation-types.js"
 
 // policy mode
@@ -87,6 +89,43 @@ function policyValidateParentDomain(tlsCertificateChain, config, actualDomain, p
     return {trustInfos};
 }
 
+// validate a connection against the user-defined SPKI pins using the WASM validation function
+export async function spkiPinValidateConnectionGo(tlsCertificateChain, domainName) {
+    var connectionChainArray = encodeConnectionCertificateChain(tlsCertificateChain);
+
+    var spkiPinTrustDecision = await verifySPKIPinsAsync(domainName, connectionChainArray, connectionChainArray.length);
+    spkiPinTrustDecision.connectionCertificateChain = tlsCertificateChain;
+    console.log(`SPKI Pin Verification result=${spkiPinTrustDecision.evaluationResult}, pinDomain=${spkiPinTrustDecision.pinDomain}, violation=${spkiPinTrustDecision.violation}`);
+
+    return spkiPinTrustDecision;
+}
+
+// validate a connection using all validation modes enabled in the config (see cache_v2.Verify)
+export async function validateConnectionGo(tlsCertificateChain, domainName, port) {
+    var connectionChainArray = encodeConnectionCertificateChain(tlsCertificateChain);
+
+    const verifyStart = performance.now();
+    var verdict = await verifyAsync(domainName, connectionChainArray, connectionChainArray.length, port);
+    verdict.decisions.forEach(td => {
+        td.connectionCertificateChain = tlsCertificateChain;
+    });
+    const verifyEnd = performance.now();
+    console.log(`[Go] verify took ${verifyEnd - verifyStart} ms ${domainName}: result=${verdict.evaluationResult}, precedence=${verdict.precedence}, deciding=${verdict.decidingModes}`);
+
+    return verdict;
+}
+
+// validate a connection against the TLSA records of the service (added using addTLSARecords) using the WASM validation function
+export async function daneValidateConnectionGo(tlsCertificateChain, hostname, port) {
+    var connectionChainArray = encodeConnectionCertificateChain(tlsCertificateChain);
+
+    var daneTrustDecision = await verifyDANEAsync(hostname, connectionChainArray, connectionChainArray.length, port);
+    daneTrustDecision.connectionCertificateChain = tlsCertificateChain;
+    console.log(`DANE Verification result=${daneTrustDecision.evaluationResult}, tlsaName=${daneTrustDecision.tlsaName}, dnssecStatus=${daneTrustDecision.dnssecStatus}`);
+
+    return daneTrustDecision;
+}
+
 // check connection using the policies retrieved from a single mapserver
 // allPolicies has the following structure: {domain: {pca: SP}}, where SP has the structure: {attribute: value}, e.g., {AllowedSubdomains: ["allowed.mydomain.com"]}
 export function policyValidateConnection(tlsCertificateChain, config, domainName, allPolicies, mapserver) {
@@ -201,26 +240,35 @@ function legacyValidateActualDomain(connectionTrustInfo, config, actualDomain, d
     return {trustInfos};
 }
 
-// validate a connection against the cached certificate chains and the 
-// user-defined preferences 
-export function legacyValidateConnectionGo(tlsCertificateChain, domainName) {
-    
-    // encode connection certificate chain as JSON
-    var enc = new TextEncoder(); 
+// encode connection certificate chain as JSON or in the binary format
+function encodeConnectionCertificateChain(tlsCertificateChain) {
     var connectionChainArray = [];
     for (var i in tlsCertificateChain) {
         connectionChainArray.push(tlsCertificateChain[i].pem);
     }
-    
+    // configs saved by older versions of the config page store the flag as a string
+    const binaryEncoding = config.get("wasm-binary-encoding");
+    if (binaryEncoding === true || binaryEncoding === "true") {
+        return encodeCertificateChain(connectionChainArray);
+    }
+
+    var enc = new TextEncoder();
     var obj = {
         connectionCertificateChainb64: connectionChainArray
     };
     var json = JSON.stringify(obj);
-    connectionChainArray = enc.encode(json);
+    return enc.encode(json);
+}
+
+// validate a connection against the cached certificate chains and the 
+// user-defined preferences 
+export async function legacyValidateConnectionGo(tlsCertificateChain, domainName) {
+    
+    var connectionChainArray = encodeConnectionCertificateChain(tlsCertificateChain);
 
     // perform validation
     const verifyLegacyStart = performance.now();
-    var legacyTrustDecision = verifyLegacy(domainName, connectionChainArray, connectionChainArray.length);
+    var legacyTrustDecision = await verifyLegacyAsync(domainName, connectionChainArray, connectionChainArray.length);
     legacyTrustDecision.connectionCertificateChain = tlsCertificateChain;
 
     const verifyLegacyEnd = performance.now();
@@ -233,23 +281,12 @@ export function legacyValidateConnectionGo(tlsCertificateChain, domainName) {
 }
 
 // validate a connection against the cached policies and the user-defined preferences using the WASM validation function
-export function policyValidateConnectionGo(tlsCertificateChain, domainName) {
-    // encode connection certificate chain as JSON
-    var enc = new TextEncoder();
-    var connectionChainArray = [];
-    for (var i in tlsCertificateChain) {
-        connectionChainArray.push(tlsCertificateChain[i].pem);
-    }
-
-    var obj = {
-        connectionCertificateChainb64: connectionChainArray
-    };
-    var json = JSON.stringify(obj);
-    connectionChainArray = enc.encode(json);
+export async function policyValidateConnectionGo(tlsCertificateChain, domainName) {
+    var connectionChainArray = encodeConnectionCertificateChain(tlsCertificateChain);
 
     // perform validation
     const verifyPolicyStart = performance.now();
-    var policyTrustDecision = verifyPolicy(domainName, connectionChainArray, connectionChainArray.length);
+    var policyTrustDecision = await verifyPolicyAsync(domainName, connectionChainArray, connectionChainArray.length);
     policyTrustDecision.connectionCertificateChain = tlsCertificateChain;
 
     const verifyPolicyEnd = performance.now();
@@ -132,7 +132,7 @@ async function updateValidationResult() {
     // get last result for each domain/mapserver
     const lastIndexMap = new Map();
     validationResult.forEach((td, index) => {
-        lastIndexMap.set(JSON.stringify({domain: td.domain}), index);
+        lastIndexMap.set(JSON.stringify({domain: td.domain, type: td.type}), index);
     });
 
     const recentTrustDecisions = Array.from(lastIndexMap.values()).map(index => validationResult[index]);
@@ -142,6 +142,12 @@ async function updateValidationResult() {
     recentTrustDecisions.toReversed().forEach((td, index) => {
         if (td.type === "legacy") {
             currentElement = addLegacyValidationResult(td, currentElement, index);
+        } else if (td.type === "spki-pinning") {
+            currentElement = addSPKIPinValidationResult(td, currentElement, index);
+        } else if (td.type === "dane") {
+            currentElement = addDANEValidationResult(td, currentElement, index);
+        } else if (td.type === "tofu") {
+            currentElement = addTOFUValidationResult(td, currentElement, index);
         } else {
             currentElement = addPolicyValidationResult(td, currentElement, index);
         }
@@ -237,12 +243,38 @@ function addPolicyValidationResult(trustDecision, predecessor, index) {
         }
     }
 
+    addExplanation(trustDecision, div, "policy", index);
+
     // add button to collapse a section (all sessions are initially collapsed)
     addCollapsibleButton("policy-validation-result-"+index, "Policy Validation ("+trustDecision.domain+") reported", finalDecision);
 
     return div;
 }
 
+// render the pruned chains and map server proofs of a Go validation explanation
+function addExplanation(trustDecision, div, type, index) {
+    const explanation = trustDecision.explanation;
+    if (!explanation) {
+        return;
+    }
+    if (explanation.prunedChains.length > 0) {
+        createElementIn("p", {"id": type+"-pruned-title-"+index}, "Ignored Certificate Chains", div);
+        let table = "<tr><th>Leaf Certificate</th><th>Reason</th></tr>";
+        explanation.prunedChains.forEach(pruned => {
+            table += "<tr><td>"+pruned.chain.certificateSubjects[0]+"</td><td>"+pruned.reason+"</td></tr>";
+        });
+        createElementIn("table", {"id": type+"-pruned-chains-"+index}, table, div);
+    }
+    if (explanation.proofs.length > 0) {
+        createElementIn("p", {"id": type+"-proofs-title-"+index}, "Map Server Proofs", div);
+        let table = "<tr><th>Domain</th><th>Map Server</th><th>Proof</th><th>Verified</th></tr>";
+        explanation.proofs.forEach(proof => {
+            table += "<tr><td>"+proof.domain+"</td><td>"+proof.mapserverId+"</td><td>"+proof.proofType+"</td><td>"+proof.verified+"</td></tr>";
+        });
+        createElementIn("table", {"id": type+"-proofs-"+index}, table, div);
+    }
+}
+
 function addLegacyValidationResult(trustDecision, predecessor, index) {
     if (trustDecision.type !== "legacy") {
         return predecessor;
@@ -277,8 +309,16 @@ function addLegacyValidationResult(trustDecision, predecessor, index) {
 
     // fill in information about conflicts if any conflicts exist
     let confTitle;
+    const connectionChainExplanation = trustDecision.explanation.connectionChain;
+    const forbiddenCA = connectionChainExplanation ? connectionChainExplanation.forbiddenCA : null;
     if (trustDecision.evaluationResult === 1) {
         confTitle = createElementAfter("p", {"id": "legacy-conflicts-title-"+index, "class": "validation-success"}, "No Conflicting Certificates for "+trustDecision.domain+" reported", connTable);
+    } else if (forbiddenCA) {
+        confTitle = createElementAfter("p", {"id": "legacy-conflicts-title-"+index, "class": "validation-warning"}, "Forbidden CA for "+trustDecision.domain+" reported", connTable);
+        table = "<tr><th>CA Set</th><th>Forbidden for</th><th>Subject</th></tr>";
+        table += "<tr><td>"+forbiddenCA.caSet+"</td><td>"+forbiddenCA.domain+"</td><td>"+forbiddenCA.subject+"</td></tr>";
+        const confTable = createElementAfter("table", {"id": "legacy-conflicts-certs-"+index}, "", confTitle);
+        confTable.innerHTML = table;
     } else {
         confTitle = createElementAfter("p", {"id": "legacy-conflicts-title-"+index, "class": "validation-warning"}, "Conflicting Certificates for "+trustDecision.domain+" reported", connTable);
         table = "<tr><th colspan=\"3\">Conflicting Certificates ("+convertTrustLevelToLabel(trustDecision.highestTrustLevel)+")</th></tr>";
@@ -294,6 +334,7 @@ function addLegacyValidationResult(trustDecision, predecessor, index) {
         });
         confTable.innerHTML = table;
     }
+    addExplanation(trustDecision, div, "legacy", index);
 
     // add button to collapse a section (all sessions are initially collapsed)
     addCollapsibleButton("legacy-validation-result-"+index, "Legacy Validation ("+trustDecision.domain+") reported", trustDecision.evaluationResult === 0 ? "warn" : "allow");
@@ -301,6 +342,106 @@ function addLegacyValidationResult(trustDecision, predecessor, index) {
     return div;
 }
 
+function addSPKIPinValidationResult(trustDecision, predecessor, index) {
+    if (trustDecision.type !== "spki-pinning") {
+        return predecessor;
+    }
+
+    // create the various container elements
+    const div = createElementAfter("div", {"id": "spki-pinning-validation-result-"+index, "class": "content"}, "", predecessor);
+    const spkiPins = trustDecision.explanation.spkiPins;
+    let titleText;
+    let titleClass = "validation-success";
+    if (!trustDecision.violation) {
+        titleText = "Connection matches the SPKI pins of "+trustDecision.pinDomain;
+    } else if (trustDecision.mode === "report-only") {
+        titleText = "Connection violates the SPKI pins of "+trustDecision.pinDomain+" (report-only)";
+        titleClass = "validation-warning";
+    } else {
+        titleText = "Connection violates the SPKI pins of "+trustDecision.pinDomain;
+        titleClass = "validation-warning";
+    }
+    const title = createElementIn("p", {"id": "spki-pinning-title-"+index, "class": titleClass}, titleText, div);
+
+    // list the public key hashes of the connection chain and whether they are pinned
+    let table = "<tr><th>Type</th><th>Subject</th><th>SPKI Hash</th><th>Pinned</th></tr>";
+    trustDecision.connectionCertificateChain.forEach((c, chainIndex) => {
+        const spkiHash = spkiPins.chainSPKIHashes[chainIndex];
+        const pinnedHashes = chainIndex === 0 ? spkiPins.leafSPKIHashes : spkiPins.caSPKIHashes;
+        table += "<tr><td>"+(chainIndex === 0 ? "Leaf" : "CA")+"</td><td>"+getSubject(c)+"</td><td>"+spkiHash+"</td><td>"+pinnedHashes.includes(spkiHash)+"</td></tr>";
+    });
+    createElementAfter("table", {"id": "spki-pinning-chain-"+index}, table, title);
+
+    // add button to collapse a section (all sessions are initially collapsed)
+    addCollapsibleButton("spki-pinning-validation-result-"+index, "SPKI Pinning ("+trustDecision.domain+", "+trustDecision.mode+")", trustDecision.evaluationResult === 0 ? "warn" : "allow");
+
+    return div;
+}
+
+function addTOFUValidationResult(trustDecision, predecessor, index) {
+    if (trustDecision.type !== "tofu") {
+        return predecessor;
+    }
+
+    // create the various container elements
+    const div = createElementAfter("div", {"id": "tofu-validation-result-"+index, "class": "content"}, "", predecessor);
+    const tofu = trustDecision.explanation.tofu;
+    let titleText;
+    if (trustDecision.evaluationResult === 1) {
+        titleText = "Issuing CA of "+trustDecision.domain+" is pinned ("+trustDecision.status+")";
+    } else {
+        titleText = "Issuing CA of "+trustDecision.domain+" changed (trust on first use)";
+    }
+    const title = createElementIn("p", {"id": "tofu-title-"+index, "class": trustDecision.evaluationResult === 1 ? "validation-success" : "validation-warning"}, titleText, div);
+
+    // list the pinned CAs and the issuing CA of the connection
+    if (tofu.pin) {
+        let table = "<tr><th>Pinned CAs</th><th>Pinned since</th><th>Connection CA</th></tr>";
+        table += "<tr><td>"+tofu.pin.issuerSubjects.join("<br>")+"</td><td>"+tofu.pin.firstSeen+"</td><td>"+tofu.issuerSubject+"</td></tr>";
+        createElementAfter("table", {"id": "tofu-pin-"+index}, table, title);
+    }
+
+    // add button to collapse a section (all sessions are initially collapsed)
+    addCollapsibleButton("tofu-validation-result-"+index, "Trust on First Use ("+trustDecision.domain+")", trustDecision.evaluationResult === 0 ? "warn" : "allow");
+
+    return div;
+}
+
+function addDANEValidationResult(trustDecision, predecessor, index) {
+    if (trustDecision.type !== "dane") {
+        return predecessor;
+    }
+
+    // create the various container elements
+    const div = createElementAfter("div", {"id": "dane-validation-result-"+index, "class": "content"}, "", predecessor);
+    const dane = trustDecision.explanation.dane;
+    let titleText;
+    if (trustDecision.evaluationResult === 1) {
+        titleText = "Connection matches the TLSA records of "+trustDecision.tlsaName+" ("+trustDecision.dnssecStatus+")";
+    } else if (trustDecision.dnssecStatus === "bogus") {
+        titleText = "DNSSEC chain of the TLSA records of "+trustDecision.tlsaName+" is invalid";
+    } else {
+        titleText = "Connection does not match the TLSA records of "+trustDecision.tlsaName;
+    }
+    const title = createElementIn("p", {"id": "dane-title-"+index, "class": trustDecision.evaluationResult === 1 ? "validation-success" : "validation-warning"}, titleText, div);
+
+    // list the TLSA records and the certificates matching them
+    let table = "<tr><th>Usage</th><th>Selector</th><th>Matching Type</th><th>Matching Certificate</th></tr>";
+    dane.records.forEach(record => {
+        let match = record.usable ? "none" : "unusable ("+record.reason+")";
+        if (record.matchedChainIndex !== -1) {
+            match = getSubject(trustDecision.connectionCertificateChain[record.matchedChainIndex]);
+        }
+        table += "<tr><td>"+record.usage+"</td><td>"+record.selector+"</td><td>"+record.matchingType+"</td><td>"+match+"</td></tr>";
+    });
+    createElementAfter("table", {"id": "dane-records-"+index}, table, title);
+
+    // add button to collapse a section (all sessions are initially collapsed)
+    addCollapsibleButton("dane-validation-result-"+index, "DANE Validation ("+trustDecision.domain+")", trustDecision.evaluationResult === 0 ? "warn" : "allow");
+
+    return div;
+}
+
 // communication from background script to popup
 port.onMessage.addListener(async function(msg) {
     const {msgType, value, config} = msg;
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/domain"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// config of the map server (paths of the keys used to sign tree heads)
+const mapServerConfigPath = "./config/mapserver_config.json"
+
+// height of the cached part of the tree used by the fpki updater and responder
+const cacheHeight = 32
+
+// storage backend of the map server. changes are collected until Commit is
+// called, proofs are served for the last committed root
+type MapBackend interface {
+	// remove all domain entries
+	Reset() error
+
+	// add certificates (DER encoded) and their certificate chains
+	UpdateCerts(ctx context.Context, certs [][]byte, certChains [][][]byte) error
+
+	// add RPCs and SPs
+	UpdatePolicies(ctx context.Context, rpcs []*common.RPC, sps []*common.SP) error
+
+	// commit the changes and serve proofs for the new root
+	Commit(ctx context.Context) error
+
+	// the last committed root and its signature
+	TreeHead() SignedTreeHead
+
+	// the signed root of an epoch of the root history (errUnknownEpoch if
+	// the epoch does not exist)
+	TreeHeadOfEpoch(epoch uint64) (SignedTreeHead, error)
+
+	// proofs for the domain and its parent domains
+	GetProof(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error)
+
+	// proofs for several domains and their parent domains, all under the
+	// same root
+	GetProofs(ctx context.Context, domainNames []string) (*ProofBatch, error)
+
+	// the entries and audit path of the subtree of a key prefix
+	// (errPrefixLookupUnsupported if not supported by the backend)
+	GetPrefixProof(ctx context.Context, prefix []byte, bits int) (*PrefixProof, error)
+
+	Close() error
+}
+
+// root of the tree signed by the map server
+type SignedTreeHead struct {
+	Root        []byte
+	TreeHeadSig []byte
+
+	// ID of the key that signed TreeHeadSig and EpochSig (see mapServerKeyID)
+	KeyID string `json:",omitempty"`
+
+	// epoch of the root in the root history, the time it was committed (unix
+	// time in seconds) and the signature of the root together with both (see
+	// epochSignatureInput). not set for roots outside of the history
+	Epoch     uint64 `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	EpochSig  []byte `json:",omitempty"`
+}
+
+// proofs for several domains under a single signed root. each domain (queried
+// or parent domain) is only contained once and the responses do not contain
+// the tree head signature
+type ProofBatch struct {
+	SignedTreeHead
+	Responses []mapCommon.MapServerResponse
+
+	// queried domains that are not valid domain names
+	Errors map[string]string `json:",omitempty"`
+}
+
+// response of GET /?domain= for a domain or one of its parent domains: the
+// response of the fpki responder and the fields of the signed root that are
+// not part of it, so that clients can check the epoch of the root
+type ProofResponse struct {
+	mapCommon.MapServerResponse
+	KeyID     string `json:",omitempty"`
+	Epoch     uint64 `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	EpochSig  []byte `json:",omitempty"`
+}
+
+// the responses of the batch in the format of GET /?domain=
+func (batch *ProofBatch) proofResponses() []ProofResponse {
+	responses := make([]ProofResponse, len(batch.Responses))
+	for i, response := range batch.Responses {
+		response.TreeHeadSig = batch.TreeHeadSig
+		responses[i] = ProofResponse{MapServerResponse: response, KeyID: batch.KeyID,
+			Epoch: batch.Epoch, Timestamp: batch.Timestamp, EpochSig: batch.EpochSig}
+	}
+	return responses
+}
+
+// collect the proofs returned by getProof for domainNames into a batch.
+// getProof must return proofs for the root of treeHead
+func collectProofs(ctx context.Context, treeHead SignedTreeHead, domainNames []string,
+	getProof func(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error)) (*ProofBatch, error) {
+	batch := &ProofBatch{SignedTreeHead: treeHead, Responses: []mapCommon.MapServerResponse{}}
+	included := map[string]bool{}
+	for _, domainName := range domainNames {
+		responses, err := getProof(ctx, domainName)
+		if err == domain.ErrInvalidDomainName {
+			if batch.Errors == nil {
+				batch.Errors = map[string]string{}
+			}
+			batch.Errors[domainName] = "Invalid domain name"
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("collectProofs | %s | %w", domainName, err)
+		}
+		for _, response := range responses {
+			if included[response.Domain] {
+				continue
+			}
+			included[response.Domain] = true
+			response.TreeHeadSig = nil
+			batch.Responses = append(batch.Responses, response)
+		}
+	}
+	return batch, nil
+}
+
+// returned by backends that cannot enumerate the keys of a subtree
+var errPrefixLookupUnsupported = errors.New("prefix lookups are not supported by this backend")
+
+// returned if the subtree of a prefix contains more than maxPrefixEntries keys
+var errPrefixTooShort = errors.New("prefix matches too many entries")
+
+// all entries whose key (SHA-256 hash of the domain name) starts with the
+// first PrefixBits bits of Prefix. the subtree containing these keys is proven
+// as a whole, so that clients can derive the proof of presence or absence for
+// any key with the prefix without revealing the key
+type PrefixProof struct {
+	SignedTreeHead
+	Prefix     []byte
+	PrefixBits int
+
+	// audit path of the subtree, starting with the sibling closest to the
+	// subtree. shorter than PrefixBits if the path of the prefix ends in an
+	// empty subtree or a single leaf (which may have a different prefix)
+	Proof [][]byte
+
+	// entries in the subtree, sorted by key
+	Entries []PrefixEntry
+}
+
+type PrefixEntry struct {
+	Domain           string
+	DomainEntryBytes []byte
+}
+
+// config file of the fpki responder. KeyPath is the active key, which signs
+// all tree heads (the fpki responder only reads KeyPath). after a key
+// rotation, the previous keys are listed in RetiringKeyPaths, so that their
+// public keys are still published while clients update their config
+type mapServerConfig struct {
+	KeyPath          string
+	RetiringKeyPaths []string `json:",omitempty"`
+}
+
+// key of the map server and its key ID
+type mapServerKey struct {
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// active and retiring keys of the map server
+type mapServerKeys struct {
+	Active   *mapServerKey
+	Retiring []*mapServerKey
+}
+
+// public key of the map server as returned by the keys endpoint
+type PublicKeyInfo struct {
+	KeyID string
+
+	// base64 encoded DER public key (the format of the extension config)
+	PublicKey string
+
+	// "active" or "retiring"
+	Status string
+}
+
+// ID of a map server key: the base64 encoded SHA-256 hash of the DER encoded
+// public key (SubjectPublicKeyInfo)
+func mapServerKeyID(publicKey *rsa.PublicKey) (string, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("mapServerKeyID | MarshalPKIXPublicKey | %w", err)
+	}
+	keyHash := sha256.Sum256(publicKeyBytes)
+	return base64.StdEncoding.EncodeToString(keyHash[:]), nil
+}
+
+func loadKeyFromFile(keyPath string) (*mapServerKey, error) {
+	key, err := common.LoadRSAKeyPairFromFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRSAKeyPairFromFile | %s | %w", keyPath, err)
+	}
+	keyID, err := mapServerKeyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &mapServerKey{ID: keyID, Key: key}, nil
+}
+
+// load the active and retiring keys from the map server config
+func loadMapServerKeys(configPath string) (*mapServerKeys, error) {
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loadMapServerKeys | ReadFile | %w", err)
+	}
+	config := &mapServerConfig{}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("loadMapServerKeys | Unmarshal | %w", err)
+	}
+
+	keys := &mapServerKeys{}
+	keys.Active, err = loadKeyFromFile(config.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loadMapServerKeys | %w", err)
+	}
+	keyIDs := map[string]bool{keys.Active.ID: true}
+	for _, keyPath := range config.RetiringKeyPaths {
+		key, err := loadKeyFromFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loadMapServerKeys | %w", err)
+		}
+		if keyIDs[key.ID] {
+			return nil, fmt.Errorf("loadMapServerKeys | %s: duplicate key %s", keyPath, key.ID)
+		}
+		keyIDs[key.ID] = true
+		keys.Retiring = append(keys.Retiring, key)
+	}
+	return keys, nil
+}
+
+// load the active key used to sign tree heads from the map server config
+func loadMapServerKey(configPath string) (*mapServerKey, error) {
+	keys, err := loadMapServerKeys(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return keys.Active, nil
+}
+
+// the public keys of the active and retiring keys
+func (k *mapServerKeys) PublicKeys() ([]PublicKeyInfo, error) {
+	publicKeys := []PublicKeyInfo{}
+	for i, key := range append([]*mapServerKey{k.Active}, k.Retiring...) {
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.Key.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("PublicKeys | MarshalPKIXPublicKey | %w", err)
+		}
+		status := "retiring"
+		if i == 0 {
+			status = "active"
+		}
+		publicKeys = append(publicKeys, PublicKeyInfo{
+			KeyID:     key.ID,
+			PublicKey: base64.StdEncoding.EncodeToString(publicKeyBytes),
+			Status:    status,
+		})
+	}
+	return publicKeys, nil
+}
+
+// sign a root the same way as the fpki responder
+func signTreeHead(root []byte, key *mapServerKey) (SignedTreeHead, error) {
+	treeHeadSig, err := common.SignStructRSASHA256(root, key.Key)
+	if err != nil {
+		return SignedTreeHead{}, fmt.Errorf("signTreeHead | SignStructRSASHA256 | %w", err)
+	}
+	return SignedTreeHead{Root: root, TreeHeadSig: treeHeadSig, KeyID: key.ID}, nil
+}
+
+// create the backend with the given name ("sql" or "memory").
+// root is the root of the existing tree (only used by the SQL backend), the
+// committed roots are added to history
+func newMapBackend(name string, root []byte, history *rootHistory) (MapBackend, error) {
+	switch name {
+	case "sql":
+		return newSQLBackend(root, mapServerConfigPath, history)
+	case "memory":
+		return newMemoryBackend(mapServerConfigPath, history)
+	default:
+		return nil, fmt.Errorf("newMapBackend | unknown backend %q", name)
+	}
+}
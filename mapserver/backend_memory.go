@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/domain"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// backend keeping the domain entries and the tree in memory (for local
+// development and integration tests). entries are built the same way as by
+// the fpki updater, i.e., certificates and policies are grouped by CA in the
+// entries of all affected domains
+type memoryBackend struct {
+	mutex sync.RWMutex
+
+	// key used to sign the tree head
+	key *mapServerKey
+
+	// epochs of the committed roots
+	history *rootHistory
+
+	// domain entries including uncommitted changes
+	domainEntries map[string]*mapCommon.DomainEntry
+
+	// domains with uncommitted changes
+	changedDomains map[string]struct{}
+
+	// serialized entries of the last commit
+	committedEntries map[string][]byte
+
+	// domain names of the keys of the last commit
+	committedNames map[string]string
+
+	// tree of the last commit and its signed root
+	smt      *memorySMT
+	treeHead SignedTreeHead
+}
+
+func newMemoryBackend(configPath string, history *rootHistory) (*memoryBackend, error) {
+	key, err := loadMapServerKey(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("newMemoryBackend | %w", err)
+	}
+
+	b := &memoryBackend{key: key, history: history}
+	b.Reset()
+	return b, nil
+}
+
+func (b *memoryBackend) Reset() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.domainEntries = map[string]*mapCommon.DomainEntry{}
+	b.changedDomains = map[string]struct{}{}
+	b.committedEntries = map[string][]byte{}
+	b.committedNames = map[string]string{}
+	b.smt = newMemorySMT(nil)
+	b.treeHead = SignedTreeHead{Root: b.smt.Root()}
+	return nil
+}
+
+// get the entry of caName in the domain entry of domainName (creating both if necessary)
+func (b *memoryBackend) getCAEntry(domainName string, caName string) *mapCommon.CAEntry {
+	b.changedDomains[domainName] = struct{}{}
+	domainEntry, ok := b.domainEntries[domainName]
+	if !ok {
+		domainEntry = &mapCommon.DomainEntry{DomainName: domainName}
+		b.domainEntries[domainName] = domainEntry
+	}
+	for i := range domainEntry.CAEntry {
+		if domainEntry.CAEntry[i].CAName == caName {
+			return &domainEntry.CAEntry[i]
+		}
+	}
+	domainEntry.CAEntry = append(domainEntry.CAEntry, mapCommon.CAEntry{
+		CAName: caName,
+		CAHash: common.SHA256Hash([]byte(caName)),
+	})
+	return &domainEntry.CAEntry[len(domainEntry.CAEntry)-1]
+}
+
+func (b *memoryBackend) UpdateCerts(ctx context.Context, certs [][]byte, certChains [][][]byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, certBytes := range certs {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return fmt.Errorf("UpdateCerts | ParseCertificate | %w", err)
+		}
+		domainNames := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		for _, domainName := range domain.ExtractAffectedDomains(domainNames) {
+			caEntry := b.getCAEntry(domainName, cert.Issuer.String())
+			if containsCert(caEntry.DomainCerts, certBytes) {
+				continue
+			}
+			caEntry.DomainCerts = append(caEntry.DomainCerts, certBytes)
+			caEntry.DomainCertChains = append(caEntry.DomainCertChains, certChains[i])
+		}
+	}
+	return nil
+}
+
+func containsCert(certs [][]byte, cert []byte) bool {
+	for _, c := range certs {
+		if bytes.Equal(c, cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *memoryBackend) UpdatePolicies(ctx context.Context, rpcs []*common.RPC, sps []*common.SP) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, rpc := range rpcs {
+		b.getCAEntry(rpc.Subject, rpc.CAName).CurrentRPC = *rpc
+	}
+	for _, sp := range sps {
+		b.getCAEntry(sp.Subject, sp.CAName).CurrentPC = *sp
+	}
+	return nil
+}
+
+func (b *memoryBackend) Commit(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for domainName := range b.changedDomains {
+		domainEntryBytes, err := mapCommon.SerializeDomainEntry(b.domainEntries[domainName])
+		if err != nil {
+			return fmt.Errorf("Commit | SerializeDomainEntry | %w", err)
+		}
+		b.committedEntries[domainName] = domainEntryBytes
+	}
+	b.changedDomains = map[string]struct{}{}
+
+	// the tree maps the hash of the domain name to the hash of the domain entry
+	leaves := map[string][]byte{}
+	for domainName, domainEntryBytes := range b.committedEntries {
+		key := string(common.SHA256Hash([]byte(domainName)))
+		leaves[key] = common.SHA256Hash(domainEntryBytes)
+		b.committedNames[key] = domainName
+	}
+	smt := newMemorySMT(leaves)
+	treeHead, err := b.history.Add(smt.Root(), b.key)
+	if err != nil {
+		return fmt.Errorf("Commit | %w", err)
+	}
+	b.smt = smt
+	b.treeHead = treeHead
+	fmt.Printf("root: %x\n", smt.Root())
+	return nil
+}
+
+func (b *memoryBackend) TreeHead() SignedTreeHead {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.treeHead
+}
+
+func (b *memoryBackend) TreeHeadOfEpoch(epoch uint64) (SignedTreeHead, error) {
+	return b.history.Get(epoch)
+}
+
+func (b *memoryBackend) GetProof(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.getProofLocked(ctx, domainName)
+}
+
+func (b *memoryBackend) GetProofs(ctx context.Context, domainNames []string) (*ProofBatch, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return collectProofs(ctx, b.treeHead, domainNames, b.getProofLocked)
+}
+
+func (b *memoryBackend) GetPrefixProof(ctx context.Context, prefix []byte, bits int) (*PrefixProof, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	auditPath, start, end := b.smt.ProvePrefix(prefix, bits)
+	if end-start > maxPrefixEntries {
+		return nil, errPrefixTooShort
+	}
+	proof := &PrefixProof{SignedTreeHead: b.treeHead, Prefix: prefix, PrefixBits: bits, Proof: auditPath, Entries: []PrefixEntry{}}
+	for _, key := range b.smt.keys[start:end] {
+		domainName := b.committedNames[string(key)]
+		proof.Entries = append(proof.Entries, PrefixEntry{Domain: domainName, DomainEntryBytes: b.committedEntries[domainName]})
+	}
+	return proof, nil
+}
+
+// must be called with the mutex held
+func (b *memoryBackend) getProofLocked(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error) {
+	domainNames, err := domain.ParseDomainName(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []mapCommon.MapServerResponse
+	for _, name := range domainNames {
+		poi := b.smt.Prove(common.SHA256Hash([]byte(name)))
+		response := mapCommon.MapServerResponse{Domain: name, PoI: poi, TreeHeadSig: b.treeHead.TreeHeadSig}
+		if poi.ProofType == mapCommon.PoP {
+			response.DomainEntryBytes = b.committedEntries[name]
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/responder"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+)
+
+// backend storing the tree and domain entries in the MySQL database of the
+// fpki updater (tables domainEntries, updates and tree)
+type sqlBackend struct {
+	root       []byte
+	configPath string
+
+	// key used to sign the tree head
+	key *mapServerKey
+
+	// epochs of the committed roots
+	history *rootHistory
+
+	// updater collecting the changes (nil if there are no changes)
+	mapUpdater *updater.MapUpdater
+
+	// protects the responder and tree head, which are replaced by Commit
+	// while proofs are served
+	mutex sync.RWMutex
+
+	// responder and signed root of the last commit (nil before the first commit)
+	mapResponder *responder.MapResponder
+	treeHead     SignedTreeHead
+}
+
+func newSQLBackend(root []byte, configPath string, history *rootHistory) (*sqlBackend, error) {
+	key, err := loadMapServerKey(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("newSQLBackend | %w", err)
+	}
+	return &sqlBackend{root: root, configPath: configPath, key: key, history: history}, nil
+}
+
+func openDb() (db *sql.DB, err error) {
+	env := map[string]string{"MYSQL_USER": "root", "MYSQL_PASSWORD": "", "MYSQL_HOST": "localhost", "MYSQL_PORT": ""}
+	for k := range env {
+		v, exists := os.LookupEnv(k)
+		if exists {
+			env[k] = v
+		}
+	}
+	dsnString := env["MYSQL_USER"]
+	if env["MYSQL_PASSWORD"] != "" {
+		dsnString += ":" + env["MYSQL_PASSWORD"]
+	}
+	dsnString += "@tcp(" + env["MYSQL_HOST"]
+	if env["MYSQL_PORT"] != "" {
+		dsnString += ":" + env["MYSQL_PORT"]
+	}
+	dsnString += ")/fpki?maxAllowedPacket=1073741824"
+	fmt.Printf("mapserver | truncateTable | using dsn: %s\n", dsnString)
+	db, err = sql.Open("mysql", dsnString)
+	return
+}
+
+func (b *sqlBackend) Reset() error {
+	db, err := openDb()
+	if err != nil {
+		return fmt.Errorf("Reset | openDb | %w", err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"domainEntries", "updates", "tree"} {
+		_, err = db.Exec("TRUNCATE " + table + ";")
+		if err != nil {
+			return fmt.Errorf("Reset | TRUNCATE %s | %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (b *sqlBackend) getMapUpdater() (*updater.MapUpdater, error) {
+	if b.mapUpdater == nil {
+		mapUpdater, err := updater.NewMapUpdater(b.root, cacheHeight)
+		if err != nil {
+			return nil, fmt.Errorf("NewMapUpdater | %w", err)
+		}
+		b.mapUpdater = mapUpdater
+	}
+	return b.mapUpdater, nil
+}
+
+func (b *sqlBackend) UpdateCerts(ctx context.Context, certs [][]byte, certChains [][][]byte) error {
+	mapUpdater, err := b.getMapUpdater()
+	if err != nil {
+		return fmt.Errorf("UpdateCerts | %w", err)
+	}
+	err = mapUpdater.UpdateCertsLocally(ctx, certs, certChains)
+	if err != nil {
+		return fmt.Errorf("UpdateCerts | UpdateCertsLocally | %w", err)
+	}
+	return nil
+}
+
+func (b *sqlBackend) UpdatePolicies(ctx context.Context, rpcs []*common.RPC, sps []*common.SP) error {
+	mapUpdater, err := b.getMapUpdater()
+	if err != nil {
+		return fmt.Errorf("UpdatePolicies | %w", err)
+	}
+	err = mapUpdater.UpdateRPCAndPCLocally(ctx, sps, rpcs)
+	if err != nil {
+		return fmt.Errorf("UpdatePolicies | UpdateRPCAndPCLocally | %w", err)
+	}
+	return nil
+}
+
+func (b *sqlBackend) Commit(ctx context.Context) error {
+	if b.mapUpdater != nil {
+		err := b.mapUpdater.CommitSMTChanges(ctx)
+		if err != nil {
+			return fmt.Errorf("Commit | CommitSMTChanges | %w", err)
+		}
+		b.root = b.mapUpdater.GetRoot()
+		err = b.mapUpdater.Close()
+		b.mapUpdater = nil
+		if err != nil {
+			return fmt.Errorf("Commit | Close | %w", err)
+		}
+	}
+	fmt.Printf("root: %x\n", b.root)
+
+	// get a new responder, and load an existing tree
+	mapResponder, err := responder.NewMapResponder(ctx, b.root, cacheHeight, b.configPath)
+	if err != nil {
+		return fmt.Errorf("Commit | NewMapResponder | %w", err)
+	}
+	treeHead, err := b.history.Add(b.root, b.key)
+	if err != nil {
+		return fmt.Errorf("Commit | %w", err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.mapResponder = mapResponder
+	b.treeHead = treeHead
+	return nil
+}
+
+func (b *sqlBackend) TreeHead() SignedTreeHead {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.treeHead
+}
+
+func (b *sqlBackend) TreeHeadOfEpoch(epoch uint64) (SignedTreeHead, error) {
+	return b.history.Get(epoch)
+}
+
+func (b *sqlBackend) GetProof(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error) {
+	b.mutex.RLock()
+	mapResponder := b.mapResponder
+	b.mutex.RUnlock()
+
+	if mapResponder == nil {
+		return nil, fmt.Errorf("GetProof | no committed root")
+	}
+	return mapResponder.GetProof(ctx, domainName)
+}
+
+func (b *sqlBackend) GetProofs(ctx context.Context, domainNames []string) (*ProofBatch, error) {
+	// the responder only serves proofs for the root it was created with
+	b.mutex.RLock()
+	mapResponder := b.mapResponder
+	treeHead := b.treeHead
+	b.mutex.RUnlock()
+
+	if mapResponder == nil {
+		return nil, fmt.Errorf("GetProofs | no committed root")
+	}
+	return collectProofs(ctx, treeHead, domainNames, mapResponder.GetProof)
+}
+
+// the fpki responder only serves proofs for domain names
+func (b *sqlBackend) GetPrefixProof(ctx context.Context, prefix []byte, bits int) (*PrefixProof, error) {
+	return nil, errPrefixLookupUnsupported
+}
+
+func (b *sqlBackend) Close() error {
+	if b.mapUpdater != nil {
+		return b.mapUpdater.Close()
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// generate a map server key
+func newTestKey(t *testing.T) *mapServerKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := mapServerKeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mapServerKey{ID: keyID, Key: key}
+}
+
+// write the key to a PEM file in dir and return its path
+func writeTestKey(t *testing.T, dir string, name string, key *mapServerKey) string {
+	path := filepath.Join(dir, name)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key.Key)})
+	if err := os.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// check that the active and retiring keys are loaded with their key IDs
+func TestLoadMapServerKeys(t *testing.T) {
+	dir := t.TempDir()
+	activeKey, retiringKey := newTestKey(t), newTestKey(t)
+	activePath := writeTestKey(t, dir, "active.pem", activeKey)
+	retiringPath := writeTestKey(t, dir, "retiring.pem", retiringKey)
+
+	configPath := filepath.Join(dir, "mapserver_config.json")
+	err := os.WriteFile(configPath, []byte(`{"KeyPath": "`+activePath+`", "RetiringKeyPaths": ["`+retiringPath+`"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadMapServerKeys(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Active.ID != activeKey.ID || len(keys.Retiring) != 1 || keys.Retiring[0].ID != retiringKey.ID {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	publicKeys, err := keys.PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKeys) != 2 || publicKeys[0].Status != "active" || publicKeys[1].KeyID != retiringKey.ID {
+		t.Fatalf("unexpected public keys %+v", publicKeys)
+	}
+
+	// a key cannot be both active and retiring
+	err = os.WriteFile(configPath, []byte(`{"KeyPath": "`+activePath+`", "RetiringKeyPaths": ["`+activePath+`"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadMapServerKeys(configPath); err == nil {
+		t.Fatal("expected an error for a duplicate key")
+	}
+}
+
+// check that certificates and policies added to the memory backend are only
+// served after a commit and that the served proofs and entries match the
+// signed root
+func TestMemoryBackendRoundTrip(t *testing.T) {
+	history, err := loadRootHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &memoryBackend{key: newTestKey(t), history: history}
+	backend.Reset()
+	ctx := context.Background()
+
+	cert := newTestCertificate(t, "www.example.com")
+	if err = backend.UpdateCerts(ctx, [][]byte{cert}, [][][]byte{nil}); err != nil {
+		t.Fatal(err)
+	}
+	rpc := &common.RPC{Subject: "example.com", CAName: "policy CA"}
+	if err = backend.UpdatePolicies(ctx, []*common.RPC{rpc}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// uncommitted changes are not served
+	responses, err := backend.GetProof(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, response := range responses {
+		if response.PoI.ProofType != mapCommon.PoA {
+			t.Fatalf("expected a proof of absence for %s before the commit", response.Domain)
+		}
+	}
+
+	if err = backend.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	treeHead := backend.TreeHead()
+	if treeHead.Epoch != 1 || len(treeHead.TreeHeadSig) == 0 {
+		t.Fatalf("unexpected tree head %+v", treeHead)
+	}
+	if epochTreeHead, err := backend.TreeHeadOfEpoch(1); err != nil || !bytes.Equal(epochTreeHead.Root, treeHead.Root) {
+		t.Fatalf("unexpected tree head of epoch 1 %+v (%v)", epochTreeHead, err)
+	}
+
+	// the certificate is in the entries of the domain and its parent domain,
+	// the policy only in the entry of the parent domain
+	responses, err = backend.GetProof(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected proofs for 2 domains, got %d", len(responses))
+	}
+	for _, response := range responses {
+		if response.PoI.ProofType != mapCommon.PoP || !bytes.Equal(response.PoI.Root, treeHead.Root) {
+			t.Fatalf("unexpected proof %+v for %s", response.PoI, response.Domain)
+		}
+		key := common.SHA256Hash([]byte(response.Domain))
+		if !VerifyInclusion(response.PoI.Root, response.PoI.Proof, key, common.SHA256Hash(response.DomainEntryBytes)) {
+			t.Fatalf("invalid proof of presence for %s", response.Domain)
+		}
+		domainEntry, err := mapCommon.DeserializeDomainEntry(response.DomainEntryBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var certs [][]byte
+		var rpcSubjects []string
+		for _, caEntry := range domainEntry.CAEntry {
+			certs = append(certs, caEntry.DomainCerts...)
+			if caEntry.CurrentRPC.Subject != "" {
+				rpcSubjects = append(rpcSubjects, caEntry.CurrentRPC.Subject)
+			}
+		}
+		if domainEntry.DomainName != response.Domain || len(certs) != 1 || !bytes.Equal(certs[0], cert) {
+			t.Fatalf("unexpected entry %+v for %s", domainEntry, response.Domain)
+		}
+		expectedRPCs := []string{}
+		if response.Domain == "example.com" {
+			expectedRPCs = []string{"example.com"}
+		}
+		requireEqualStrings(t, expectedRPCs, rpcSubjects)
+	}
+
+	// adding the same certificate again does not change the root or start a
+	// new epoch
+	if err = backend.UpdateCerts(ctx, [][]byte{cert}, [][][]byte{nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backend.TreeHead().Root, treeHead.Root) || backend.TreeHead().Epoch != 1 {
+		t.Fatalf("unexpected tree head %+v after adding a duplicate certificate", backend.TreeHead())
+	}
+
+	// batched proofs are the same as the proofs of the single domains
+	batch, err := backend.GetProofs(ctx, []string{"www.example.com", "other.org", "invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(batch.Root, treeHead.Root) || len(batch.Errors) != 1 || batch.Errors["invalid"] == "" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	for _, response := range batch.Responses {
+		expectedType := mapCommon.PoA
+		if response.Domain == "www.example.com" || response.Domain == "example.com" {
+			expectedType = mapCommon.PoP
+		}
+		if response.PoI.ProofType != expectedType {
+			t.Fatalf("unexpected proof type %v for %s", response.PoI.ProofType, response.Domain)
+		}
+	}
+
+	// after a reset, the entries are gone
+	if err = backend.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	responses, err = backend.GetProof(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].PoI.ProofType != mapCommon.PoA {
+		t.Fatalf("expected a proof of absence after the reset, got %+v", responses)
+	}
+}
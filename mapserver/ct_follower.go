@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+)
+
+// CT log followed by the map server
+type CTLogConfig struct {
+	// base URL of the log (e.g. https://ct.googleapis.com/logs/argon2023)
+	URL string `json:"url"`
+
+	// public key of the log (PEM), used to verify the signed tree heads (optional)
+	PublicKey string `json:"public-key"`
+
+	// file storing the position of the follower
+	Checkpoint string `json:"checkpoint"`
+
+	// index of the first entry if there is no checkpoint yet
+	StartIndex int64 `json:"start-index"`
+
+	// number of entries fetched and committed together
+	BatchSize int64 `json:"batch-size"`
+
+	// interval in which new tree heads are fetched once the follower caught up
+	PollInterval string `json:"poll-interval"`
+
+	// same filters as for the ingestion sources
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (config *CTLogConfig) validate() error {
+	if config.URL == "" {
+		return fmt.Errorf("CT log without url")
+	}
+	if config.Checkpoint == "" {
+		return fmt.Errorf("CT log %s: checkpoint not set", config.URL)
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 1000
+	}
+	if config.PollInterval == "" {
+		config.PollInterval = "1m"
+	}
+	_, err := time.ParseDuration(config.PollInterval)
+	if err != nil {
+		return fmt.Errorf("CT log %s: invalid poll interval: %w", config.URL, err)
+	}
+	return nil
+}
+
+// position of a follower: all entries before NextIndex are committed
+type ctCheckpoint struct {
+	NextIndex int64  `json:"next-index"`
+	TreeSize  uint64 `json:"tree-size"`
+	RootHash  []byte `json:"root-hash"`
+}
+
+func loadCTCheckpoint(path string) (*ctCheckpoint, error) {
+	checkpointBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &ctCheckpoint{}
+	err = json.Unmarshal(checkpointBytes, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("loadCTCheckpoint | Unmarshal | %w", err)
+	}
+	return checkpoint, nil
+}
+
+// write the checkpoint to a temporary file and rename it, such that a crash
+// never leaves a partially written checkpoint
+func (checkpoint *ctCheckpoint) save(path string) error {
+	checkpointBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(checkpointBytes)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// follows a CT log and queues its certificates for the map server
+type ctLogFollower struct {
+	config     *CTLogConfig
+	client     *client.LogClient
+	queue      *ingestQueue
+	filter     *IngestSource
+	checkpoint *ctCheckpoint
+}
+
+func newCTLogFollower(config *CTLogConfig, queue *ingestQueue) (*ctLogFollower, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	logClient, err := client.New(config.URL, &http.Client{Timeout: time.Minute}, jsonclient.Options{PublicKey: config.PublicKey})
+	if err != nil {
+		return nil, fmt.Errorf("newCTLogFollower | %s | %w", config.URL, err)
+	}
+
+	checkpoint, err := loadCTCheckpoint(config.Checkpoint)
+	if os.IsNotExist(err) {
+		checkpoint, err = &ctCheckpoint{NextIndex: config.StartIndex}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("newCTLogFollower | %s | %w", config.URL, err)
+	}
+	return &ctLogFollower{
+		config:     config,
+		client:     logClient,
+		queue:      queue,
+		filter:     &IngestSource{Allow: config.Allow, Deny: config.Deny},
+		checkpoint: checkpoint,
+	}, nil
+}
+
+// follow the log until ctx is done. errors are logged and retried from the
+// last checkpoint after the poll interval
+func (f *ctLogFollower) Run(ctx context.Context) {
+	pollInterval, _ := time.ParseDuration(f.config.PollInterval)
+	for {
+		err := f.catchUp(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("mapserver | ct | %s: %s\n", f.config.URL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// fetch the current tree head and commit all entries up to its size
+func (f *ctLogFollower) catchUp(ctx context.Context) error {
+	sth, err := f.client.GetSTH(ctx)
+	if err != nil {
+		return fmt.Errorf("GetSTH | %w", err)
+	}
+	treeSize := int64(sth.TreeSize)
+	for f.checkpoint.NextIndex < treeSize {
+		end := f.checkpoint.NextIndex + f.config.BatchSize
+		if end > treeSize {
+			end = treeSize
+		}
+		next, err := f.commitEntries(ctx, f.checkpoint.NextIndex, end)
+		if err != nil {
+			return err
+		}
+		f.checkpoint = &ctCheckpoint{NextIndex: next, TreeSize: sth.TreeSize, RootHash: sth.SHA256RootHash[:]}
+		err = f.checkpoint.save(f.config.Checkpoint)
+		if err != nil {
+			return fmt.Errorf("saving checkpoint | %w", err)
+		}
+	}
+	return nil
+}
+
+// fetch the entries [start, end), queue their certificates and wait for the
+// commit. the log may return fewer entries than requested, the index of the
+// first entry that was not fetched is returned
+func (f *ctLogFollower) commitEntries(ctx context.Context, start int64, end int64) (int64, error) {
+	response, err := f.client.GetRawEntries(ctx, start, end-1)
+	if err != nil {
+		return start, fmt.Errorf("GetRawEntries | %w", err)
+	}
+	if len(response.Entries) == 0 {
+		return start, fmt.Errorf("GetRawEntries | no entries returned for %d-%d", start, end-1)
+	}
+
+	var certs [][]byte
+	var certChains [][][]byte
+	for i := range response.Entries {
+		index := start + int64(i)
+		entry, err := ct.RawLogEntryFromLeaf(index, &response.Entries[i])
+		if err != nil {
+			fmt.Printf("mapserver | ct | %s: skipping entry %d: %s\n", f.config.URL, index, err)
+			continue
+		}
+		chain := rawLogEntryChain(entry)
+		if chain == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(chain[0])
+		if err != nil {
+			fmt.Printf("mapserver | ct | %s: skipping entry %d: %s\n", f.config.URL, index, err)
+			continue
+		}
+		if !f.filter.accepts(cert) {
+			continue
+		}
+		certs = append(certs, chain[0])
+		certChains = append(certChains, chain[1:])
+	}
+	next := start + int64(len(response.Entries))
+	if len(certs) == 0 {
+		return next, nil
+	}
+
+	committed := make(chan error, 1)
+	f.queue.AddCertificates(certs, certChains, func(err error) { committed <- err })
+	// the queue commits the remaining certificates when it is stopped, so the
+	// commit is awaited even if ctx is done
+	err = <-committed
+	if err != nil {
+		return start, err
+	}
+	fmt.Printf("mapserver | ct | %s: committed %d certificates of entries %d-%d\n", f.config.URL, len(certs), start, next-1)
+	return next, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// CT log serving the get-sth and get-entries endpoints of RFC 6962 for a
+// fixed list of entries
+type fakeCTLog struct {
+	mutex   sync.Mutex
+	entries []ct.LeafEntry
+
+	// maximum number of entries returned by get-entries
+	maxEntries int
+}
+
+func (l *fakeCTLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	switch r.URL.Path {
+	case "/ct/v1/get-sth":
+		json.NewEncoder(w).Encode(&ct.GetSTHResponse{
+			TreeSize:       uint64(len(l.entries)),
+			Timestamp:      uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+			SHA256RootHash: make([]byte, 32),
+			// DigitallySigned: SHA-256, ECDSA, empty signature (not verified
+			// without public key)
+			TreeHeadSignature: []byte{4, 3, 0, 0},
+		})
+	case "/ct/v1/get-entries":
+		start, err1 := strconv.Atoi(r.URL.Query().Get("start"))
+		end, err2 := strconv.Atoi(r.URL.Query().Get("end"))
+		if err1 != nil || err2 != nil || start > end || end >= len(l.entries) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if end-start+1 > l.maxEntries {
+			end = start + l.maxEntries - 1
+		}
+		json.NewEncoder(w).Encode(&ct.GetEntriesResponse{Entries: l.entries[start : end+1]})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (l *fakeCTLog) add(entries ...ct.LeafEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, entries...)
+}
+
+func appendUint24Prefixed(data []byte, value []byte) []byte {
+	return append(append(data, byte(len(value)>>16), byte(len(value)>>8), byte(len(value))), value...)
+}
+
+// X.509 entry of a CT log containing cert and its chain
+func newX509LeafEntry(cert []byte, chain ...[]byte) ct.LeafEntry {
+	// MerkleTreeLeaf: version, leaf type, timestamp, entry type, certificate, extensions
+	leafInput := make([]byte, 12)
+	leafInput = appendUint24Prefixed(leafInput, cert)
+	leafInput = append(leafInput, 0, 0)
+
+	var chainBytes []byte
+	for _, c := range chain {
+		chainBytes = appendUint24Prefixed(chainBytes, c)
+	}
+	return ct.LeafEntry{LeafInput: leafInput, ExtraData: appendUint24Prefixed(nil, chainBytes)}
+}
+
+// precertificate entry of a CT log containing precert and its chain
+func newPrecertLeafEntry(precert []byte, chain ...[]byte) ct.LeafEntry {
+	// MerkleTreeLeaf: version, leaf type, timestamp, entry type, issuer key
+	// hash, TBS certificate, extensions
+	leafInput := make([]byte, 12)
+	leafInput[11] = 1
+	leafInput = append(leafInput, make([]byte, 32)...)
+	leafInput = appendUint24Prefixed(leafInput, precert)
+	leafInput = append(leafInput, 0, 0)
+
+	var chainBytes []byte
+	for _, c := range chain {
+		chainBytes = appendUint24Prefixed(chainBytes, c)
+	}
+	return ct.LeafEntry{LeafInput: leafInput, ExtraData: appendUint24Prefixed(appendUint24Prefixed(nil, precert), chainBytes)}
+}
+
+// self-signed certificate for domainName
+func newTestCertificate(t *testing.T, domainName string) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domainName},
+		DNSNames:     []string{domainName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	return createTestCertificate(t, template)
+}
+
+// self-signed precertificate (with the CT poison extension) for domainName
+func newTestPrecertificate(t *testing.T, domainName string) []byte {
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domainName},
+		DNSNames:        []string{domainName},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: ctPoisonExtensionOID, Critical: true, Value: []byte{5, 0}}},
+	}
+	return createTestCertificate(t, template)
+}
+
+func createTestCertificate(t *testing.T, template *x509.Certificate) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// backend recording the committed certificates (and policies)
+type recordingBackend struct {
+	mutex     sync.Mutex
+	pending   []string
+	committed []string
+	fail      bool
+}
+
+func (b *recordingBackend) Reset() error { return nil }
+
+func (b *recordingBackend) UpdateCerts(ctx context.Context, certs [][]byte, certChains [][][]byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, certBytes := range certs {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return err
+		}
+		b.pending = append(b.pending, fmt.Sprintf("%s/%d", cert.Subject.CommonName, len(certChains[i])))
+	}
+	return nil
+}
+
+func (b *recordingBackend) UpdatePolicies(ctx context.Context, rpcs []*common.RPC, sps []*common.SP) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, rpc := range rpcs {
+		b.pending = append(b.pending, "RPC "+rpc.Subject)
+	}
+	for _, sp := range sps {
+		b.pending = append(b.pending, "SP "+sp.Subject)
+	}
+	return nil
+}
+
+func (b *recordingBackend) Commit(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.fail {
+		b.pending = nil
+		return fmt.Errorf("commit failed")
+	}
+	b.committed = append(b.committed, b.pending...)
+	b.pending = nil
+	return nil
+}
+
+func (b *recordingBackend) TreeHead() SignedTreeHead { return SignedTreeHead{} }
+
+func (b *recordingBackend) TreeHeadOfEpoch(epoch uint64) (SignedTreeHead, error) {
+	return SignedTreeHead{}, errUnknownEpoch
+}
+
+func (b *recordingBackend) GetProof(ctx context.Context, domainName string) ([]mapCommon.MapServerResponse, error) {
+	return nil, nil
+}
+
+func (b *recordingBackend) GetProofs(ctx context.Context, domainNames []string) (*ProofBatch, error) {
+	return &ProofBatch{}, nil
+}
+
+func (b *recordingBackend) GetPrefixProof(ctx context.Context, prefix []byte, bits int) (*PrefixProof, error) {
+	return nil, errPrefixLookupUnsupported
+}
+
+func (b *recordingBackend) Close() error { return nil }
+
+func (b *recordingBackend) committedCerts() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string{}, b.committed...)
+}
+
+func requireEqualStrings(t *testing.T, expected []string, actual []string) {
+	t.Helper()
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+}
+
+// check that the follower commits the filtered entries of the log, including
+// the chain, and resumes from its checkpoint
+func TestCTLogFollower(t *testing.T) {
+	ca := newTestCertificate(t, "ca.test")
+	log := &fakeCTLog{maxEntries: 2}
+	log.add(
+		newX509LeafEntry(newTestCertificate(t, "a.example.com"), ca),
+		newX509LeafEntry(newTestCertificate(t, "denied.example.com")),
+		ct.LeafEntry{LeafInput: []byte{0, 0, 1}},
+		newX509LeafEntry(newTestCertificate(t, "other.org")),
+		newX509LeafEntry(newTestCertificate(t, "b.example.com")),
+	)
+	server := httptest.NewServer(log)
+	defer server.Close()
+
+	backend := &recordingBackend{}
+	queue := newIngestQueue(1000)
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+	go queue.Run(ctx, backend, 10*time.Millisecond)
+
+	config := &CTLogConfig{
+		URL:        server.URL,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json"),
+		BatchSize:  3,
+		Allow:      []string{"*.example.com"},
+		Deny:       []string{"denied.example.com"},
+	}
+	follower, err := newCTLogFollower(config, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = follower.catchUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqualStrings(t, []string{"a.example.com/1", "b.example.com/0"}, backend.committedCerts())
+	checkpoint, err := loadCTCheckpoint(config.Checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.NextIndex != 5 || checkpoint.TreeSize != 5 {
+		t.Fatalf("unexpected checkpoint %+v", checkpoint)
+	}
+
+	// a new follower continues after the checkpoint
+	log.add(newX509LeafEntry(newTestCertificate(t, "c.example.com")))
+	follower, err = newCTLogFollower(config, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = follower.catchUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqualStrings(t, []string{"a.example.com/1", "b.example.com/0", "c.example.com/0"}, backend.committedCerts())
+}
+
+// check that the checkpoint does not advance if the commit fails
+func TestCTLogFollowerCommitFailure(t *testing.T) {
+	log := &fakeCTLog{maxEntries: 10}
+	log.add(newX509LeafEntry(newTestCertificate(t, "a.example.com")))
+	server := httptest.NewServer(log)
+	defer server.Close()
+
+	backend := &recordingBackend{fail: true}
+	queue := newIngestQueue(1000)
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+	go queue.Run(ctx, backend, 10*time.Millisecond)
+
+	config := &CTLogConfig{URL: server.URL, Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json")}
+	follower, err := newCTLogFollower(config, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = follower.catchUp(ctx)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if follower.checkpoint.NextIndex != 0 {
+		t.Fatalf("checkpoint advanced to %d", follower.checkpoint.NextIndex)
+	}
+
+	backend.mutex.Lock()
+	backend.fail = false
+	backend.mutex.Unlock()
+	err = follower.catchUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqualStrings(t, []string{"a.example.com/0"}, backend.committedCerts())
+}
+
+// check that precertificate entries and precertificates logged as X.509
+// entries are not ingested
+func TestCTLogFollowerSkipsPrecertificates(t *testing.T) {
+	ca := newTestCertificate(t, "ca.test")
+	log := &fakeCTLog{maxEntries: 10}
+	log.add(
+		newPrecertLeafEntry(newTestPrecertificate(t, "a.example.com"), ca),
+		newX509LeafEntry(newTestPrecertificate(t, "b.example.com"), ca),
+		newX509LeafEntry(newTestCertificate(t, "c.example.com"), ca),
+	)
+	server := httptest.NewServer(log)
+	defer server.Close()
+
+	backend := &recordingBackend{}
+	queue := newIngestQueue(1000)
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+	go queue.Run(ctx, backend, 10*time.Millisecond)
+
+	config := &CTLogConfig{URL: server.URL, Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json")}
+	follower, err := newCTLogFollower(config, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = follower.catchUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqualStrings(t, []string{"c.example.com/1"}, backend.committedCerts())
+	if follower.checkpoint.NextIndex != 3 {
+		t.Fatalf("unexpected checkpoint %+v", follower.checkpoint)
+	}
+}
@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/google/certificate-transparency-go v1.1.3
 	github.com/netsec-ethz/fpki v0.0.0-20230113162440-2f74786143c5
 )
 
@@ -38,7 +39,6 @@ require (
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/btree v1.0.1 // indirect
-	github.com/google/certificate-transparency-go v1.1.3 // indirect
 	github.com/google/go-cmp v0.5.8 // indirect
 	github.com/google/trillian v1.4.1 // indirect
 	github.com/googleapis/gax-go/v2 v2.3.0 // indirect
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// maximum size of a submission
+const maxSubmissionSize = 10 << 20
+
+// submissions that are committed together
+type ingestBatch struct {
+	certs      [][]byte
+	certChains [][][]byte
+	rpcs       []*common.RPC
+	sps        []*common.SP
+
+	// called after the commit (with its error, if any)
+	committed []func(error)
+}
+
+func (batch *ingestBatch) size() int {
+	return len(batch.certs) + len(batch.rpcs) + len(batch.sps)
+}
+
+// submissions that have not been committed yet
+type ingestQueue struct {
+	mutex   sync.Mutex
+	pending ingestBatch
+
+	// number of queued items that triggers a commit
+	batchSize int
+
+	// signaled if the queue contains a full batch
+	batchFull chan struct{}
+}
+
+func newIngestQueue(batchSize int) *ingestQueue {
+	return &ingestQueue{batchSize: batchSize, batchFull: make(chan struct{}, 1)}
+}
+
+// must be called with the mutex held
+func (q *ingestQueue) notifyIfFull() {
+	if q.pending.size() < q.batchSize {
+		return
+	}
+	select {
+	case q.batchFull <- struct{}{}:
+	default:
+	}
+}
+
+// queue a certificate (DER encoded) and its certificate chain
+func (q *ingestQueue) AddCertificate(cert []byte, certChain [][]byte) {
+	q.AddCertificates([][]byte{cert}, [][][]byte{certChain}, nil)
+}
+
+// queue certificates and their certificate chains. if committed is not nil,
+// it is called after the commit containing the certificates
+func (q *ingestQueue) AddCertificates(certs [][]byte, certChains [][][]byte, committed func(error)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending.certs = append(q.pending.certs, certs...)
+	q.pending.certChains = append(q.pending.certChains, certChains...)
+	if committed != nil {
+		q.pending.committed = append(q.pending.committed, committed)
+	}
+	q.notifyIfFull()
+}
+
+func (q *ingestQueue) AddPolicies(rpcs []*common.RPC, sps []*common.SP) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending.rpcs = append(q.pending.rpcs, rpcs...)
+	q.pending.sps = append(q.pending.sps, sps...)
+	q.notifyIfFull()
+}
+
+// remove and return all queued submissions
+func (q *ingestQueue) take() ingestBatch {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	batch := q.pending
+	q.pending = ingestBatch{}
+	return batch
+}
+
+// commit the queued submissions to the backend
+func (q *ingestQueue) Commit(ctx context.Context, backend MapBackend) error {
+	batch := q.take()
+	err := commitBatch(ctx, backend, &batch)
+	for _, committed := range batch.committed {
+		committed(err)
+	}
+	return err
+}
+
+func commitBatch(ctx context.Context, backend MapBackend, batch *ingestBatch) error {
+	if batch.size() == 0 {
+		return nil
+	}
+	fmt.Printf("mapserver | ingest | committing %d certificates, %d RPCs and %d SPs\n", len(batch.certs), len(batch.rpcs), len(batch.sps))
+
+	if len(batch.certs) > 0 {
+		err := backend.UpdateCerts(ctx, batch.certs, batch.certChains)
+		if err != nil {
+			return fmt.Errorf("Commit | %w", err)
+		}
+	}
+	if len(batch.rpcs)+len(batch.sps) > 0 {
+		err := backend.UpdatePolicies(ctx, batch.rpcs, batch.sps)
+		if err != nil {
+			return fmt.Errorf("Commit | %w", err)
+		}
+	}
+	err := backend.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("Commit | %w", err)
+	}
+	return nil
+}
+
+// commit the queued submissions every interval or as soon as a batch is full.
+// when ctx is done, the remaining submissions are committed before returning
+func (q *ingestQueue) Run(ctx context.Context, backend MapBackend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stopping := false
+		select {
+		case <-ticker.C:
+		case <-q.batchFull:
+		case <-ctx.Done():
+			stopping = true
+		}
+		commitCtx, cancelF := context.WithTimeout(context.Background(), time.Minute*10)
+		err := q.Commit(commitCtx, backend)
+		cancelF()
+		if err != nil {
+			fmt.Println("mapserver | ingest | commit failed:", err)
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// parse a certificate chain (leaf first) consisting of PEM encoded or
+// concatenated DER encoded certificates. returns the DER encoded certificates
+func parseCertificateChain(data []byte) ([][]byte, error) {
+	var chain [][]byte
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				return nil, fmt.Errorf("Certificate input | contains data other than certificate")
+			}
+			chain = append(chain, block.Bytes)
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			return nil, fmt.Errorf("Certificate input | invalid pem block")
+		}
+	} else {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("Certificate input | parsing error")
+		}
+		for _, cert := range certs {
+			chain = append(chain, cert.Raw)
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("Certificate input | no certificate")
+	}
+	for _, certBytes := range chain {
+		if _, err := x509.ParseCertificate(certBytes); err != nil {
+			return nil, fmt.Errorf("Certificate input | parsing error")
+		}
+	}
+	return chain, nil
+}
+
+// policies submitted to the policy endpoint
+type policySubmission struct {
+	RPCs []*common.RPC `json:"rpcs"`
+	SPs  []*common.SP  `json:"sps"`
+}
+
+// handlers of the admin endpoints, authenticated by a bearer token
+type ingestHandler struct {
+	queue      *ingestQueue
+	adminToken string
+}
+
+func (h *ingestHandler) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return false
+	}
+	return true
+}
+
+// read the body of an authenticated POST request (writes the error response
+// and returns nil otherwise)
+func (h *ingestHandler) readSubmission(w http.ResponseWriter, r *http.Request) []byte {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		return nil
+	}
+	if !h.authenticate(w, r) {
+		return nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSubmissionSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Submission too large"))
+		return nil
+	}
+	return body
+}
+
+func writeAccepted(w http.ResponseWriter, nQueued int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"queued": nQueued})
+}
+
+// POST /admin/certificates: queue a PEM or DER encoded certificate chain (leaf first)
+func (h *ingestHandler) certificatesHandler(w http.ResponseWriter, r *http.Request) {
+	body := h.readSubmission(w, r)
+	if body == nil {
+		return
+	}
+	chain, err := parseCertificateChain(body)
+	if err != nil {
+		fmt.Println("mapserver | ingest | invalid certificate submission:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.queue.AddCertificate(chain[0], chain[1:])
+	writeAccepted(w, 1)
+}
+
+// POST /admin/policies: queue RPCs and SPs ({"rpcs": [...], "sps": [...]})
+func (h *ingestHandler) policiesHandler(w http.ResponseWriter, r *http.Request) {
+	body := h.readSubmission(w, r)
+	if body == nil {
+		return
+	}
+	submission := &policySubmission{}
+	err := json.Unmarshal(body, submission)
+	if err == nil {
+		err = validatePolicySubmission(submission)
+	}
+	if err != nil {
+		fmt.Println("mapserver | ingest | invalid policy submission:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.queue.AddPolicies(submission.RPCs, submission.SPs)
+	writeAccepted(w, len(submission.RPCs)+len(submission.SPs))
+}
+
+func validatePolicySubmission(submission *policySubmission) error {
+	if len(submission.RPCs)+len(submission.SPs) == 0 {
+		return fmt.Errorf("Policy input | no policies")
+	}
+	for _, rpc := range submission.RPCs {
+		if rpc == nil || rpc.Subject == "" || rpc.CAName == "" {
+			return fmt.Errorf("Policy input | RPC without subject or CA name")
+		}
+	}
+	for _, sp := range submission.SPs {
+		if sp == nil || sp.Subject == "" || sp.CAName == "" {
+			return fmt.Errorf("Policy input | SP without subject or CA name")
+		}
+	}
+	return nil
+}
+
+// GET /root: the last committed root and its signature.
+// GET /root?epoch=<n>: the signed root of epoch n
+func treeHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	treeHead := mapBackend.TreeHead()
+	if epochParam := r.URL.Query().Get("epoch"); epochParam != "" {
+		epoch, err := strconv.ParseUint(epochParam, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid epoch"))
+			return
+		}
+		treeHead, err = mapBackend.TreeHeadOfEpoch(epoch)
+		if err == errUnknownEpoch {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Unknown epoch"))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(treeHead)
+}
+
+// GET /keys: the public keys of the active key (which signs the tree heads)
+// and the retiring keys, identified by the KeyID of the tree heads
+func newKeysHandler(publicKeys []PublicKeyInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(publicKeys)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// mapserver ingest: read the sources of an ingestion config and either commit
+// them to the database or submit them to the admin endpoints of a running map server
+func runIngestCommand(args []string) error {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	configFlag := flags.String("config", ingestConfigPath, "path of the ingestion config")
+	serverFlag := flags.String("server", "", "URL of a running map server to submit the data to (authenticated with MAPSERVER_ADMIN_TOKEN) instead of writing to the database")
+	rootFlag := flags.String("root", "", "hexadecimal form of the root of the existing tree in the database")
+	rootFileFlag := flags.String("rootfile", "", "path to the file storing the root of the existing tree in hexadecimal form (updated with the new root)")
+	replaceDbFlag := flags.Bool("replace-db", false, "remove the content of the database before ingesting")
+	flags.Parse(args)
+
+	config, err := LoadIngestConfig(*configFlag)
+	if err != nil {
+		return err
+	}
+
+	if *serverFlag != "" {
+		return submitToServer(*serverFlag, os.Getenv("MAPSERVER_ADMIN_TOKEN"), config)
+	}
+
+	// the tree is extended unless the database is replaced
+	var root []byte
+	if !*replaceDbFlag {
+		root, err = parseRoot(*rootFlag, *rootFileFlag)
+		if err != nil {
+			return err
+		}
+		if root == nil {
+			return fmt.Errorf("Must specify either 'root', 'rootfile' or 'replace-db'")
+		}
+	}
+	// the new root is added to the root history when it is served
+	backend, err := newSQLBackend(root, mapServerConfigPath, &rootHistory{})
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if *replaceDbFlag {
+		err = backend.Reset()
+		if err != nil {
+			return err
+		}
+	}
+	err = loadTestData(backend, config, true, true)
+	if err != nil {
+		return err
+	}
+	newRoot := hex.EncodeToString(backend.TreeHead().Root)
+	fmt.Println(newRoot)
+	if *rootFileFlag != "" {
+		return os.WriteFile(*rootFileFlag, []byte(newRoot), 0644)
+	}
+	return nil
+}
+
+// submit the certificates and policies of the config to the admin endpoints of a map server
+func submitToServer(serverURL string, adminToken string, config *IngestConfig) error {
+	certs, certChains, rpcs, sps, err := config.ReadAll()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	post := func(endpoint string, contentType string, body []byte) error {
+		request, err := http.NewRequest("POST", strings.TrimSuffix(serverURL, "/")+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", contentType)
+		request.Header.Set("Authorization", "Bearer "+adminToken)
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusAccepted {
+			message, _ := io.ReadAll(response.Body)
+			return fmt.Errorf("%s: %s: %s", endpoint, response.Status, message)
+		}
+		return nil
+	}
+
+	for i, cert := range certs {
+		var chainPEM []byte
+		for _, c := range append([][]byte{cert}, certChains[i]...) {
+			chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+		}
+		err = post("/admin/certificates", "application/x-pem-file", chainPEM)
+		if err != nil {
+			return fmt.Errorf("submitToServer | %w", err)
+		}
+	}
+	if len(rpcs)+len(sps) > 0 {
+		body, err := json.Marshal(&policySubmission{RPCs: rpcs, SPs: sps})
+		if err != nil {
+			return fmt.Errorf("submitToServer | Marshal | %w", err)
+		}
+		err = post("/admin/policies", "application/json", body)
+		if err != nil {
+			return fmt.Errorf("submitToServer | %w", err)
+		}
+	}
+	fmt.Printf("mapserver | ingest | submitted %d certificates, %d RPCs and %d SPs to %s\n", len(certs), len(rpcs), len(sps), serverURL)
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// source types of the ingestion config
+const (
+	// CSV file with a column containing the PEM encoded leaf certificate and
+	// an optional column containing the PEM encoded chain
+	sourceTypeCSV = "csv"
+
+	// directory of PEM bundles (*.pem, *.crt), each containing a certificate
+	// chain (leaf first)
+	sourceTypePEMDirectory = "pem-dir"
+
+	// JSONL file, each line containing a certificate chain (leaf first) as
+	// JSON array of base64 encoded DER certificates
+	sourceTypeJSONL = "jsonl"
+
+	// CT log dump: file or directory of JSON files containing responses of
+	// the get-entries endpoint of a CT log (RFC 6962)
+	sourceTypeCTDump = "ct-dump"
+)
+
+// default path of the ingestion config
+const ingestConfigPath = "./config/ingest_config.json"
+
+// config of the ingestion pipeline
+type IngestConfig struct {
+	Sources []*IngestSource `json:"sources"`
+
+	// directories containing RPCs (*rpc) and SPs (*_sp)
+	PolicyDirectories []string `json:"policy-directories"`
+}
+
+type IngestSource struct {
+	Type string `json:"type"`
+
+	// file or directory (files ending with .gz are decompressed)
+	Path string `json:"path"`
+
+	// CSV only: columns of the leaf certificate and the chain (optional),
+	// whether the first line is a header and the separator of multiple PEM
+	// certificates in a column (default ";")
+	CertColumn  int    `json:"cert-column"`
+	ChainColumn *int   `json:"chain-column,omitempty"`
+	Header      bool   `json:"header"`
+	Separator   string `json:"separator"`
+
+	// only certificates with a name in allow (if not empty) and no name in
+	// deny are ingested. "*.example.com" matches all subdomains of example.com
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// parse and validate an ingestion config
+func ParseIngestConfig(configBytes []byte) (*IngestConfig, error) {
+	config := &IngestConfig{}
+	err := json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("ParseIngestConfig | Unmarshal | %w", err)
+	}
+	for i, source := range config.Sources {
+		switch source.Type {
+		case sourceTypeCSV:
+			if source.CertColumn < 0 || (source.ChainColumn != nil && *source.ChainColumn < 0) {
+				return nil, fmt.Errorf("ParseIngestConfig | sources[%d]: invalid column", i)
+			}
+			if source.Separator == "" {
+				source.Separator = ";"
+			}
+		case sourceTypePEMDirectory, sourceTypeJSONL, sourceTypeCTDump:
+		default:
+			return nil, fmt.Errorf("ParseIngestConfig | sources[%d]: unknown source type %q", i, source.Type)
+		}
+		if source.Path == "" {
+			return nil, fmt.Errorf("ParseIngestConfig | sources[%d]: missing path", i)
+		}
+	}
+	return config, nil
+}
+
+func LoadIngestConfig(path string) (*IngestConfig, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadIngestConfig | ReadFile | %w", err)
+	}
+	return ParseIngestConfig(configBytes)
+}
+
+func domainFilterMatches(filter []string, name string) bool {
+	for _, entry := range filter {
+		if entry == name || (strings.HasPrefix(entry, "*.") && strings.HasSuffix(name, entry[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// extension marking a precertificate (RFC 6962, section 3.1)
+var ctPoisonExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+func isPrecertificate(cert *x509.Certificate) bool {
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(ctPoisonExtensionOID) {
+			return true
+		}
+	}
+	return false
+}
+
+// check the names of a certificate (common name and DNS names) against the
+// allow and deny filters of the source. precertificates are never accepted
+func (source *IngestSource) accepts(cert *x509.Certificate) bool {
+	if isPrecertificate(cert) {
+		return false
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	allowed := len(source.Allow) == 0
+	for _, name := range names {
+		if domainFilterMatches(source.Deny, name) {
+			return false
+		}
+		if domainFilterMatches(source.Allow, name) {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// call add for each certificate chain (leaf first, DER encoded) of the source
+// accepted by the filters. returns the number of chains that were filtered
+func (source *IngestSource) Read(add func(chain [][]byte) error) (int, error) {
+	nFiltered := 0
+	filteredAdd := func(chain [][]byte) error {
+		cert, err := x509.ParseCertificate(chain[0])
+		if err != nil {
+			return fmt.Errorf("parsing error: %w", err)
+		}
+		if !source.accepts(cert) {
+			nFiltered++
+			return nil
+		}
+		return add(chain)
+	}
+
+	var err error
+	switch source.Type {
+	case sourceTypeCSV:
+		err = source.readCSV(filteredAdd)
+	case sourceTypePEMDirectory:
+		err = source.readPEMDirectory(filteredAdd)
+	case sourceTypeJSONL:
+		err = source.readJSONL(filteredAdd)
+	case sourceTypeCTDump:
+		err = source.readCTDump(filteredAdd)
+	}
+	if err != nil {
+		return nFiltered, fmt.Errorf("%s source %s | %w", source.Type, source.Path, err)
+	}
+	return nFiltered, nil
+}
+
+// open a file, decompressing it if it ends with .gz
+func openSourceFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// files in path (or path itself if it is a file) with one of the extensions, sorted by name
+func sourceFiles(path string, extensions ...string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".gz")
+		for _, extension := range extensions {
+			if !entry.IsDir() && strings.HasSuffix(name, extension) {
+				files = append(files, filepath.Join(path, entry.Name()))
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func decodeCerts(encodedCerts string, separator string) ([]*x509.Certificate, [][]byte, error) {
+	var certs []*x509.Certificate
+	var certBytes [][]byte
+	for _, encodedCert := range strings.Split(encodedCerts, separator) {
+		var block *pem.Block
+		block, _ = pem.Decode([]byte(encodedCert))
+
+		switch {
+		case block == nil:
+			return nil, nil, fmt.Errorf("Certificate input | no pem block")
+		case block.Type != "CERTIFICATE":
+			return nil, nil, fmt.Errorf("Certificate input | contains data other than certificate")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Certificate input | parsing error")
+		}
+
+		certs = append(certs, cert)
+		certBytes = append(certBytes, block.Bytes)
+	}
+	return certs, certBytes, nil
+}
+
+func (source *IngestSource) readCSV(add func(chain [][]byte) error) error {
+	f, err := openSourceFile(source.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+	for line := 1; ; line++ {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 && source.Header {
+			continue
+		}
+		if source.CertColumn >= len(rec) || (source.ChainColumn != nil && *source.ChainColumn >= len(rec)) {
+			return fmt.Errorf("line %d: missing column", line)
+		}
+
+		leafCerts, leafCertBytes, err := decodeCerts(rec[source.CertColumn], source.Separator)
+		if err != nil {
+			return fmt.Errorf("line %d: failed to decode certs: %w", line, err)
+		}
+		if len(leafCerts) != 1 {
+			return fmt.Errorf("line %d: wrong number of leaf certificates", line)
+		}
+		chain := leafCertBytes
+		if source.ChainColumn != nil && rec[*source.ChainColumn] != "" {
+			_, certChainBytes, err := decodeCerts(rec[*source.ChainColumn], source.Separator)
+			if err != nil {
+				return fmt.Errorf("line %d: failed to decode certchain: %w", line, err)
+			}
+			chain = append(chain, certChainBytes...)
+		}
+		err = add(chain)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (source *IngestSource) readPEMDirectory(add func(chain [][]byte) error) error {
+	files, err := sourceFiles(source.Path, ".pem", ".crt")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := openSourceFile(file)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		chain, err := parseCertificateChain(data)
+		if err == nil {
+			err = add(chain)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func (source *IngestSource) readJSONL(add func(chain [][]byte) error) error {
+	f, err := openSourceFile(source.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxSubmissionSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var chain [][]byte
+		err := json.Unmarshal(scanner.Bytes(), &chain)
+		if err == nil && len(chain) == 0 {
+			err = fmt.Errorf("empty chain")
+		}
+		if err == nil {
+			err = add(chain)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// extract the certificate chain of a CT log entry. returns nil for
+// precertificate entries, whose leaf (the precertificate) is never seen by
+// browsers
+func rawLogEntryChain(entry *ct.RawLogEntry) [][]byte {
+	if entry.Leaf.TimestampedEntry != nil && entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+		return nil
+	}
+	chain := [][]byte{entry.Cert.Data}
+	for _, cert := range entry.Chain {
+		chain = append(chain, cert.Data)
+	}
+	return chain
+}
+
+func (source *IngestSource) readCTDump(add func(chain [][]byte) error) error {
+	files, err := sourceFiles(source.Path, ".json")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := openSourceFile(file)
+		if err != nil {
+			return err
+		}
+		response := &ct.GetEntriesResponse{}
+		err = json.NewDecoder(f).Decode(response)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for i, entry := range response.Entries {
+			rawEntry, err := ct.RawLogEntryFromLeaf(int64(i), &entry)
+			if err != nil {
+				return fmt.Errorf("%s: entry %d: %w", file, i, err)
+			}
+			chain := rawLogEntryChain(rawEntry)
+			if chain == nil {
+				continue
+			}
+			err = add(chain)
+			if err != nil {
+				return fmt.Errorf("%s: entry %d: %w", file, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// read all certificates and policies of the config. certs contains the leaf
+// certificates and certChains the remaining certificates of each chain
+func (config *IngestConfig) ReadAll() ([][]byte, [][][]byte, []*common.RPC, []*common.SP, error) {
+	certs := [][]byte{}
+	certChains := [][][]byte{}
+	for i, source := range config.Sources {
+		nCerts := len(certs)
+		nFiltered, err := source.Read(func(chain [][]byte) error {
+			certs = append(certs, chain[0])
+			certChains = append(certChains, chain[1:])
+			return nil
+		})
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("ReadAll | sources[%d] | %w", i, err)
+		}
+		fmt.Printf("mapserver | ingest | %s source %s: %d certificates, %d filtered\n", source.Type, source.Path, len(certs)-nCerts, nFiltered)
+	}
+
+	rpcs := []*common.RPC{}
+	sps := []*common.SP{}
+	for _, dir := range config.PolicyDirectories {
+		dirRPCs, dirSPs, err := getRPCAndSP(dir)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("ReadAll | %w", err)
+		}
+		rpcs = append(rpcs, dirRPCs...)
+		sps = append(sps, dirSPs...)
+	}
+	return certs, certChains, rpcs, sps, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PEM encode the certificates, separated by the default separator
+func encodePEM(certs ...[]byte) string {
+	var encodedCerts []string
+	for _, cert := range certs {
+		encodedCerts = append(encodedCerts, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})))
+	}
+	return strings.Join(encodedCerts, ";")
+}
+
+// write the records to a CSV file in dir and return its path
+func writeTestCSV(t *testing.T, dir string, records [][]string) string {
+	path := filepath.Join(dir, "certs.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	if err = writer.WriteAll(records); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// check that the CSV source reads the leaf certificate and the chain from the
+// configured columns and applies the allow and deny filters
+func TestIngestCSVSource(t *testing.T) {
+	ca1, ca2 := newTestCertificate(t, "ca1.test"), newTestCertificate(t, "ca2.test")
+	path := writeTestCSV(t, t.TempDir(), [][]string{
+		{"chain", "id", "cert"},
+		{encodePEM(ca1, ca2), "1", encodePEM(newTestCertificate(t, "a.example.com"))},
+		{"", "2", encodePEM(newTestCertificate(t, "b.example.com"))},
+		{encodePEM(ca1), "3", encodePEM(newTestCertificate(t, "denied.example.com"))},
+		{"", "4", encodePEM(newTestCertificate(t, "example.com"))},
+		{"", "5", encodePEM(newTestCertificate(t, "other.org"))},
+	})
+	config, err := ParseIngestConfig([]byte(`{"sources": [{"type": "csv", "path": "` + path + `", "cert-column": 2,
+		"chain-column": 0, "header": true, "allow": ["*.example.com"], "deny": ["denied.example.com"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Sources[0].Separator != ";" {
+		t.Fatalf("expected the default separator, got %q", config.Sources[0].Separator)
+	}
+
+	var read []string
+	nFiltered, err := config.Sources[0].Read(func(chain [][]byte) error {
+		for _, certBytes := range chain {
+			cert, err := x509.ParseCertificate(certBytes)
+			if err != nil {
+				return err
+			}
+			read = append(read, cert.Subject.CommonName)
+		}
+		read = append(read, "|")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// denied.example.com is denied, example.com and other.org are not allowed
+	// (*.example.com only matches subdomains)
+	if nFiltered != 3 {
+		t.Fatalf("expected 3 filtered certificates, got %d", nFiltered)
+	}
+	requireEqualStrings(t, []string{"a.example.com", "ca1.test", "ca2.test", "|", "b.example.com", "|"}, read)
+
+	// all certificates are read without filters, with the leaf certificate and
+	// chain returned separately
+	config.Sources[0].Allow, config.Sources[0].Deny = nil, nil
+	certs, certChains, _, _, err := config.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 5 || len(certChains) != 5 || len(certChains[0]) != 2 || len(certChains[1]) != 0 || len(certChains[2]) != 1 {
+		t.Fatalf("unexpected certificates %d and chains %v", len(certs), certChains)
+	}
+
+	// the certificate column must exist in every line
+	config.Sources[0].CertColumn = 3
+	if _, err = config.Sources[0].Read(func(chain [][]byte) error { return nil }); err == nil || !strings.Contains(err.Error(), "line 2: missing column") {
+		t.Fatalf("expected a missing column error, got %v", err)
+	}
+}
+
+// check that invalid sources are rejected
+func TestParseIngestConfig(t *testing.T) {
+	for _, configJSON := range []string{
+		`{"sources": [{"type": "csv", "path": "certs.csv", "cert-column": -1}]}`,
+		`{"sources": [{"type": "csv", "path": "certs.csv", "chain-column": -1}]}`,
+		`{"sources": [{"type": "csv"}]}`,
+		`{"sources": [{"type": "xml", "path": "certs.xml"}]}`,
+	} {
+		if _, err := ParseIngestConfig([]byte(configJSON)); err == nil {
+			t.Fatalf("expected an error for %s", configJSON)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wait until the backend has committed n certificates or policies
+func waitForCommitted(t *testing.T, backend *recordingBackend, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.committedCerts()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d committed items, got %v", n, backend.committedCerts())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// submit body to the handler with the authorization header (if not "")
+func submit(handler http.HandlerFunc, method string, authorization string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/admin/submission", strings.NewReader(body))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+// check that submissions are only queued with the admin token
+func TestIngestAuthentication(t *testing.T) {
+	queue := newIngestQueue(1000)
+	h := &ingestHandler{queue: queue, adminToken: "secret"}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCertificate(t, "a.example.com")}))
+
+	for _, authorization := range []string{"", "secret", "Bearer", "Bearer wrong", "Bearer secret2", "Basic secret"} {
+		response := submit(h.certificatesHandler, "POST", authorization, certPEM)
+		if response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("expected status 401 for authorization %q, got %d", authorization, response.Code)
+		}
+		response = submit(h.policiesHandler, "POST", authorization, `{"rpcs": [{"Subject": "example.com", "CAName": "CA"}]}`)
+		if response.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401 for authorization %q, got %d", authorization, response.Code)
+		}
+	}
+	if response := submit(h.certificatesHandler, "GET", "Bearer secret", ""); response.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", response.Code)
+	}
+	if batch := queue.take(); batch.size() != 0 {
+		t.Fatalf("unauthenticated submissions were queued: %+v", batch)
+	}
+
+	// authenticated submissions are queued, invalid ones are rejected
+	if response := submit(h.certificatesHandler, "POST", "Bearer secret", certPEM); response.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", response.Code, response.Body)
+	}
+	if response := submit(h.certificatesHandler, "POST", "Bearer secret", "not a certificate"); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", response.Code)
+	}
+	response := submit(h.policiesHandler, "POST", "Bearer secret", `{"rpcs": [{"Subject": "example.com", "CAName": "CA"}], "sps": [{"Subject": "example.com", "CAName": "CA"}]}`)
+	if response.Code != http.StatusAccepted || strings.TrimSpace(response.Body.String()) != `{"queued":2}` {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+	if response := submit(h.policiesHandler, "POST", "Bearer secret", `{"rpcs": [{"Subject": "example.com"}]}`); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", response.Code)
+	}
+	if batch := queue.take(); len(batch.certs) != 1 || len(batch.rpcs) != 1 || len(batch.sps) != 1 {
+		t.Fatalf("unexpected queued submissions %+v", batch)
+	}
+}
+
+// check that the queue commits as soon as a batch is full and commits the
+// remaining submissions when it is stopped
+func TestIngestBatching(t *testing.T) {
+	backend := &recordingBackend{}
+	queue := newIngestQueue(2)
+	h := &ingestHandler{queue: queue, adminToken: "secret"}
+	ctx, cancelF := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		// the interval is long enough that only full batches are committed
+		queue.Run(ctx, backend, time.Hour)
+		close(stopped)
+	}()
+
+	submitCertificate := func(domainName string) {
+		certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCertificate(t, domainName)}))
+		if response := submit(h.certificatesHandler, "POST", "Bearer secret", certPEM); response.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", response.Code, response.Body)
+		}
+	}
+
+	// a single certificate is not a full batch
+	submitCertificate("a.example.com")
+	time.Sleep(50 * time.Millisecond)
+	requireEqualStrings(t, []string{}, backend.committedCerts())
+	submitCertificate("b.example.com")
+	waitForCommitted(t, backend, 2)
+	requireEqualStrings(t, []string{"a.example.com/0", "b.example.com/0"}, backend.committedCerts())
+
+	submitCertificate("c.example.com")
+	time.Sleep(50 * time.Millisecond)
+	requireEqualStrings(t, []string{"a.example.com/0", "b.example.com/0"}, backend.committedCerts())
+
+	// policies count towards the batch size
+	response := submit(h.policiesHandler, "POST", "Bearer secret", `{"rpcs": [{"Subject": "example.com", "CAName": "CA"}]}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", response.Code, response.Body)
+	}
+	waitForCommitted(t, backend, 4)
+	requireEqualStrings(t, []string{"a.example.com/0", "b.example.com/0", "c.example.com/0", "RPC example.com"}, backend.committedCerts())
+
+	// the remaining submissions are committed when the queue is stopped
+	submit(h.policiesHandler, "POST", "Bearer secret", `{"sps": [{"Subject": "example.com", "CAName": "CA"}]}`)
+	cancelF()
+	<-stopped
+	requireEqualStrings(t, []string{"a.example.com/0", "b.example.com/0", "c.example.com/0", "RPC example.com", "SP example.com"}, backend.committedCerts())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// fetch a JSON response from a running map server
+func getFromServer(serverURL string, path string, response interface{}) error {
+	client := &http.Client{Timeout: time.Minute}
+	r, err := client.Get(strings.TrimSuffix(serverURL, "/") + path)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s: %s: %s", path, r.Status, body)
+	}
+	return json.Unmarshal(body, response)
+}
+
+// mapserver root: print the signed root of a running map server, or sign a given root
+func runRootCommand(args []string) error {
+	flags := flag.NewFlagSet("root", flag.ExitOnError)
+	serverFlag := flags.String("server", "", "URL of a running map server to get the root from")
+	epochFlag := flags.Uint64("epoch", 0, "epoch of the root to get from the server (default: latest)")
+	rootFlag := flags.String("root", "", "hexadecimal form of the root to sign")
+	rootFileFlag := flags.String("rootfile", "", "path to the file storing the root to sign in hexadecimal form")
+	jsonFlag := flags.Bool("json", false, "print the signed root as JSON")
+	flags.Parse(args)
+
+	if *epochFlag != 0 && *serverFlag == "" {
+		return fmt.Errorf("'epoch' requires 'server'")
+	}
+	var treeHead SignedTreeHead
+	if *serverFlag != "" {
+		path := "/root"
+		if *epochFlag != 0 {
+			path += fmt.Sprintf("?epoch=%d", *epochFlag)
+		}
+		err := getFromServer(*serverFlag, path, &treeHead)
+		if err != nil {
+			return err
+		}
+	} else {
+		root, err := parseRoot(*rootFlag, *rootFileFlag)
+		if err != nil {
+			return err
+		}
+		if root == nil {
+			return fmt.Errorf("Must specify either 'server', 'root' or 'rootfile'")
+		}
+		key, err := loadMapServerKey(mapServerConfigPath)
+		if err != nil {
+			return err
+		}
+		treeHead, err = signTreeHead(root, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *jsonFlag {
+		return json.NewEncoder(os.Stdout).Encode(treeHead)
+	}
+	fmt.Printf("root: %x\n", treeHead.Root)
+	fmt.Printf("signature: %s\n", base64.StdEncoding.EncodeToString(treeHead.TreeHeadSig))
+	if treeHead.KeyID != "" {
+		fmt.Printf("key ID: %s\n", treeHead.KeyID)
+	}
+	if treeHead.Epoch != 0 {
+		fmt.Printf("epoch: %d (%s)\n", treeHead.Epoch, time.Unix(treeHead.Timestamp, 0).UTC().Format(time.RFC3339))
+		fmt.Printf("epoch signature: %s\n", base64.StdEncoding.EncodeToString(treeHead.EpochSig))
+	}
+	return nil
+}
+
+// verify the proof of a map server response against the root it contains
+func verifyMapServerResponse(response mapCommon.MapServerResponse) bool {
+	key := common.SHA256Hash([]byte(response.Domain))
+	poi := response.PoI
+	switch poi.ProofType {
+	case mapCommon.PoP:
+		return VerifyInclusion(poi.Root, poi.Proof, key, common.SHA256Hash(response.DomainEntryBytes))
+	case mapCommon.PoA:
+		if len(poi.ProofKey) == 0 {
+			// the path of the key ends in an empty subtree
+			return bytes.Equal(poi.Root, verifyInclusion(poi.Proof, 0, key, smtDefaultLeaf))
+		}
+		// the path of the key ends in the leaf of another key
+		leafHash := common.SHA256Hash(poi.ProofKey, poi.ProofValue, []byte{byte(256 - len(poi.Proof))})
+		return !bytes.Equal(poi.ProofKey, key) && bytes.Equal(poi.Root, verifyInclusion(poi.Proof, 0, key, leafHash))
+	}
+	return false
+}
+
+// response of a map server with the decoded domain entry
+type inspectedResponse struct {
+	Domain      string
+	Presence    bool
+	ProofLength int
+	Root        []byte
+	ProofValid  bool
+	DomainEntry *mapCommon.DomainEntry `json:",omitempty"`
+}
+
+// mapserver inspect: dump the domain entries and proofs returned for a domain name
+func runInspectCommand(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	serverFlag := flags.String("server", "http://localhost:8080", "URL of a running map server (used if neither 'root' nor 'rootfile' is set)")
+	rootFlag := flags.String("root", "", "hexadecimal form of the root of the tree in the database")
+	rootFileFlag := flags.String("rootfile", "", "path to the file storing the root of the tree in the database in hexadecimal form")
+	jsonFlag := flags.Bool("json", false, "print the responses and domain entries as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s inspect [flags] <domain>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	domainName := flags.Arg(0)
+
+	var responses []mapCommon.MapServerResponse
+	root, err := parseRoot(*rootFlag, *rootFileFlag)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		backend, err := newSQLBackend(root, mapServerConfigPath, &rootHistory{})
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+		ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+		defer cancelF()
+		err = backend.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		responses, err = backend.GetProof(ctx, domainName)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = getFromServer(*serverFlag, "/?domain="+url.QueryEscape(domainName), &responses)
+		if err != nil {
+			return err
+		}
+	}
+
+	var inspected []inspectedResponse
+	for _, response := range responses {
+		r := inspectedResponse{
+			Domain:      response.Domain,
+			Presence:    response.PoI.ProofType == mapCommon.PoP,
+			ProofLength: len(response.PoI.Proof),
+			Root:        response.PoI.Root,
+			ProofValid:  verifyMapServerResponse(response),
+		}
+		if len(response.DomainEntryBytes) > 0 {
+			r.DomainEntry, err = mapCommon.DeserializeDomainEntry(response.DomainEntryBytes)
+			if err != nil {
+				return fmt.Errorf("Failed to deserialize domain entry of %s: %w", response.Domain, err)
+			}
+		}
+		inspected = append(inspected, r)
+	}
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(inspected)
+	}
+	for _, r := range inspected {
+		proofType := "absence"
+		if r.Presence {
+			proofType = "presence"
+		}
+		validity := "valid"
+		if !r.ProofValid {
+			validity = "INVALID"
+		}
+		fmt.Printf("%s: proof of %s (%d nodes, %s), root %x\n", r.Domain, proofType, r.ProofLength, validity, r.Root)
+		if r.DomainEntry == nil {
+			continue
+		}
+		for _, caEntry := range r.DomainEntry.CAEntry {
+			policy := ""
+			if caEntry.CurrentPC.CAName != "" {
+				policy = ", contains signed policy"
+			}
+			var nCertChains []int
+			for _, certChain := range caEntry.DomainCertChains {
+				nCertChains = append(nCertChains, len(certChain))
+			}
+			fmt.Printf("  %s: %d domain certs (cert chain lengths: %v)%s\n", caEntry.CAName, len(caEntry.DomainCerts), nCertChains, policy)
+		}
+	}
+	return nil
+}
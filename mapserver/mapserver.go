@@ -3,93 +3,96 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/x509"
-	"database/sql"
 	"encoding/base64"
-	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
-	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-
 	"github.com/netsec-ethz/fpki/pkg/common"
-	"github.com/netsec-ethz/fpki/pkg/domain"
 	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
-	"github.com/netsec-ethz/fpki/pkg/mapserver/responder"
-	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
 )
 
 // global var for now
-var mapResponder *responder.MapResponder
+var mapBackend MapBackend
 
 var queryCounterChannel = make(chan int)
 
-// ugly version.... I will refactor it later.
+// subcommands of the map server binary
+var commands = []struct {
+	name        string
+	description string
+	run         func(args []string) error
+}{
+	{"serve", "load or open the tree and serve proofs", runServeCommand},
+	{"ingest", "load the data of an ingestion config into the database or a running map server", runIngestCommand},
+	{"root", "print and sign the current root", runRootCommand},
+	{"inspect", "dump the domain entries and proofs for a domain name", runInspectCommand},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", command.name, command.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
 func main() {
-	replaceDbFlag := flag.Bool("replace-db", true, "replace the content of the database with test data")
-	includeCertificatesFlag := flag.Bool("include-certificates", true, "include some example certificates")
-	includePoliciesFlag := flag.Bool("include-policies", true, "include some example policies")
-	rootFlag := flag.String("root", "", "hexadecimal form of root value without leading '0x'")
-	rootFileFlag := flag.String("rootfile", "", "path to the file storing the root in hexadecimal form without leading '0x'")
-	flag.Parse()
-
-	if len(*rootFlag) > 0 && len(*rootFileFlag) > 0 {
-		log.Fatal("Can only specify either 'root' or 'rootfile'")
-	} else if len(*rootFlag) == 0 && len(*rootFileFlag) == 0 && !*replaceDbFlag {
-		log.Fatal("Must specify either 'root' or 'rootfile'")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
 	}
-	var root []byte
-	var err error
-	if len(*rootFlag) > 0 {
-		root, err = hex.DecodeString(*rootFlag)
-	} else if len(*rootFileFlag) > 0 {
-		dat, err := os.ReadFile(*rootFileFlag)
-		if err != nil {
-			log.Fatalf("Error reading file %s: %s", *rootFileFlag, err)
+	for _, command := range commands {
+		if command.name == os.Args[1] {
+			err := command.run(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
 		}
-		root, err = hex.DecodeString(string(dat))
 	}
-	if err != nil {
-		log.Fatal("Failed to parse root value")
+	if os.Args[1] != "-h" && os.Args[1] != "-help" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
 	}
+	usage()
+	os.Exit(2)
+}
 
-	flag.Parse()
-	if *replaceDbFlag {
-		truncateTable()
-		mapResponder = prepareMapServer(root, *includeCertificatesFlag, *includePoliciesFlag)
-	} else {
-		mapResponder = startMapServer(root)
+// parse the root given either in hexadecimal form or as path of a file
+// containing the root in hexadecimal form. returns nil if neither is given
+func parseRoot(rootHex string, rootFile string) ([]byte, error) {
+	if len(rootHex) > 0 && len(rootFile) > 0 {
+		return nil, fmt.Errorf("Can only specify either 'root' or 'rootfile'")
 	}
-
-	go func(counterChannel chan int) {
-		counter := 0
-		for {
-			counterChannel <- counter
-			counter += 1
+	if len(rootFile) > 0 {
+		dat, err := os.ReadFile(rootFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading file %s: %w", rootFile, err)
 		}
-	}(queryCounterChannel)
-
-	var s = http.Server{
-		Addr:        ":8080",
-		Handler:     http.HandlerFunc(mapServerQueryHandler),
-		IdleTimeout: 5 * time.Second,
+		rootHex = strings.TrimSpace(string(dat))
 	}
-	s.ListenAndServe()
-	fmt.Println("Mapserver ready")
+	root, err := hex.DecodeString(rootHex)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse root value")
+	}
+	if len(root) == 0 {
+		return nil, nil
+	}
+	return root, nil
 }
 
+// GET /?domain= (or /getproof?domain=): proofs for a domain and its parent
+// domains, see ProofResponse
 func mapServerQueryHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
+	if r.URL.Path != "/" && r.URL.Path != "/getproof" {
 		http.NotFound(w, r)
 		return
 	}
@@ -126,8 +129,10 @@ func mapServerQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Println("[", queryIndex, "] receive a request from:", r.RemoteAddr, r.Header)
 
-		response, err := mapResponder.GetProof(ctx, queriedDomain)
-		if err == domain.ErrInvalidDomainName {
+		// a single domain batch, so that the proofs and the signed root
+		// belong to the same commit
+		batch, err := mapBackend.GetProofs(ctx, []string{queriedDomain})
+		if err == nil && len(batch.Errors) > 0 {
 			fmt.Println("[", queryIndex, "] invalid domain name")
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Invalid domain name"))
@@ -140,6 +145,7 @@ func mapServerQueryHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		response := batch.proofResponses()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(response)
@@ -148,7 +154,7 @@ func mapServerQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Println("[", queryIndex, "] replying for domain request: ", queriedDomain, ", size=", len(buf.String()))
 		// inspectResponse(response)
-		inspectDomainEntries(queryIndex, response)
+		inspectDomainEntries(queryIndex, batch.Responses)
 
 	default:
 		w.WriteHeader(http.StatusNotImplemented)
@@ -156,6 +162,111 @@ func mapServerQueryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maximum number of domains in a batch query
+const maxBatchDomains = 100
+
+// request of the batch query endpoint
+type batchQuery struct {
+	Domains []string `json:"domains"`
+}
+
+// POST /getproofs: proofs for a list of domains ({"domains": [...]}) under a
+// single signed root, see ProofBatch
+func batchQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	queryIndex := <-queryCounterChannel
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancelF()
+
+	query := &batchQuery{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmissionSize)).Decode(query)
+	if err != nil {
+		fmt.Println("[", queryIndex, "] invalid batch query:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid batch query"))
+		return
+	}
+	if len(query.Domains) == 0 || len(query.Domains) > maxBatchDomains {
+		fmt.Println("[", queryIndex, "] batch query with", len(query.Domains), "domains")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Batch query must contain between 1 and %d domains", maxBatchDomains)))
+		return
+	}
+	fmt.Println("[", queryIndex, "] batch request for", len(query.Domains), "domains from:", r.RemoteAddr)
+
+	batch, err := mapBackend.GetProofs(ctx, query.Domains)
+	if err != nil {
+		fmt.Println("[", queryIndex, "] internal server error: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+	fmt.Println("[", queryIndex, "] replying to batch request with", len(batch.Responses), "proofs,", len(batch.Errors), "invalid domains")
+}
+
+// range of the prefix length (in bits) of prefix queries and the maximum
+// number of entries returned for a prefix
+const (
+	minPrefixBits    = 8
+	maxPrefixBits    = 32
+	maxPrefixEntries = 1000
+)
+
+// GET /prefix?prefix=<hex>&bits=<n>: all entries whose key starts with the
+// first n bits of prefix (default: all bits of prefix) and the proof of their
+// subtree, see PrefixProof
+func prefixQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	queryIndex := <-queryCounterChannel
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancelF()
+
+	prefix, err := hex.DecodeString(r.URL.Query().Get("prefix"))
+	bits := len(prefix) * 8
+	if err == nil && r.URL.Query().Get("bits") != "" {
+		bits, err = strconv.Atoi(r.URL.Query().Get("bits"))
+	}
+	if err != nil || bits < minPrefixBits || bits > maxPrefixBits || bits > len(prefix)*8 {
+		fmt.Println("[", queryIndex, "] invalid prefix query:", r.URL.RawQuery)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Prefix must be hexadecimal with between %d and %d bits", minPrefixBits, maxPrefixBits)))
+		return
+	}
+	fmt.Printf("[ %d ] prefix request: %x/%d\n", queryIndex, prefix, bits)
+
+	proof, err := mapBackend.GetPrefixProof(ctx, prefix, bits)
+	switch {
+	case err == errPrefixLookupUnsupported:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Prefix queries are not supported by this map server"))
+		return
+	case err == errPrefixTooShort:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Prefix matches too many entries, use a longer prefix"))
+		return
+	case err != nil:
+		fmt.Println("[", queryIndex, "] internal server error: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+	fmt.Println("[", queryIndex, "] replying to prefix request with", len(proof.Entries), "entries")
+}
+
 func inspectDomainEntries(queryIndex int, response []mapCommon.MapServerResponse) {
 	for i, v := range response {
 		if len(v.DomainEntryBytes) == 0 {
@@ -221,27 +332,13 @@ func VerifyInclusion(root []byte, ap [][]byte, key, value []byte) bool {
 // verifyInclusion returns the merkle root by hashing the merkle proof items
 func verifyInclusion(ap [][]byte, keyIndex int, key, leafHash []byte) []byte {
 	if keyIndex == len(ap) {
-		fmt.Println("hash at ", keyIndex, " ", leafHash)
 		return leafHash
 	}
+	neighbor := verifyInclusion(ap, keyIndex+1, key, leafHash)
 	if bitIsSet(key, keyIndex) {
-		neighbor := verifyInclusion(ap, keyIndex+1, key, leafHash)
-		result := common.SHA256Hash(ap[len(ap)-keyIndex-1], neighbor)
-		fmt.Println("hash at ", keyIndex, " ", result, " ", len(ap)-keyIndex-1)
-		fmt.Println(ap[len(ap)-keyIndex-1])
-		fmt.Println(neighbor)
-		fmt.Println("*******************************")
-		return result
+		return common.SHA256Hash(ap[len(ap)-keyIndex-1], neighbor)
 	}
-
-	neighbor := verifyInclusion(ap, keyIndex+1, key, leafHash)
-	result := common.SHA256Hash(neighbor, ap[len(ap)-keyIndex-1])
-	fmt.Println("hash at ", keyIndex, " ", result, " ", len(ap)-keyIndex-1)
-	fmt.Println(neighbor)
-	fmt.Println(ap[len(ap)-keyIndex-1])
-	fmt.Println("*******************************")
-
-	return result
+	return common.SHA256Hash(neighbor, ap[len(ap)-keyIndex-1])
 }
 
 func bitIsSet(bits []byte, i int) bool {
@@ -263,143 +360,42 @@ func bitIsSet(bits []byte, i int) bool {
 	return hash.Sum(nil)
     }*/
 
-func openDb() (db *sql.DB, err error) {
-	env := map[string]string{"MYSQL_USER": "root", "MYSQL_PASSWORD": "", "MYSQL_HOST": "localhost", "MYSQL_PORT": ""}
-	for k := range env {
-		v, exists := os.LookupEnv(k)
-		if exists {
-			env[k] = v
-		}
-	}
-	dsnString := env["MYSQL_USER"]
-	if env["MYSQL_PASSWORD"] != "" {
-		dsnString += ":" + env["MYSQL_PASSWORD"]
-	}
-	dsnString += "@tcp(" + env["MYSQL_HOST"]
-	if env["MYSQL_PORT"] != "" {
-		dsnString += ":" + env["MYSQL_PORT"]
-	}
-	dsnString += ")/fpki?maxAllowedPacket=1073741824"
-	fmt.Printf("mapserver | truncateTable | using dsn: %s\n", dsnString)
-	db, err = sql.Open("mysql", dsnString)
-	return
-}
-
-func truncateTable() {
-	db, err := openDb()
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec("TRUNCATE domainEntries;")
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec("TRUNCATE updates;")
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec("TRUNCATE tree;")
-	if err != nil {
-		panic(err)
-	}
-
-	err = db.Close()
-	if err != nil {
-		panic(err)
+// load the certificates and policies of the ingestion config into the backend and commit them
+func loadTestData(backend MapBackend, config *IngestConfig, includeCertificates bool, includePolicies bool) error {
+	if !includeCertificates {
+		config.Sources = nil
 	}
-}
-
-func startMapServer(root []byte) *responder.MapResponder {
-	mapUpdater, err := updater.NewMapUpdater(nil, 32)
-	if err != nil {
-		panic(err)
+	if !includePolicies {
+		config.PolicyDirectories = nil
 	}
-
-	// mapUpdater.GetRoot()
-	fmt.Printf("root: %x\n", root)
-	err = mapUpdater.Close()
+	certs, certChains, rpcs, sps, err := config.ReadAll()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("loadTestData | %w", err)
 	}
 
 	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
 	defer cancelF()
 
-	// get a new responder, and load an existing tree
-	mapResponder, err := responder.NewMapResponder(ctx, root, 32, "./config/mapserver_config.json")
-	if err != nil {
-		panic(err)
-	}
-
-	return mapResponder
-}
-
-func prepareMapServer(root []byte, includeCertificates bool, includePolicies bool) *responder.MapResponder {
-	mapUpdater, err := updater.NewMapUpdater(root, 32)
-	if err != nil {
-		panic(err)
-	}
-
-	if includeCertificates {
-		certs, certChains, err := getCerts()
-		if err != nil {
-			panic(err)
-		}
-
-		ctx, cancelFCerts := context.WithTimeout(context.Background(), time.Minute)
-		defer cancelFCerts()
-		err = mapUpdater.UpdateCertsLocally(ctx, certs, certChains)
+	if len(certs) > 0 {
+		err = backend.UpdateCerts(ctx, certs, certChains)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("loadTestData | %w", err)
 		}
 	}
-
-	if includePolicies {
-		rpcs, sps, err := getRPCAndSP()
+	if len(rpcs)+len(sps) > 0 {
+		err = backend.UpdatePolicies(ctx, rpcs, sps)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("loadTestData | %w", err)
 		}
-
-		ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
-		defer cancelF()
-
-		err = mapUpdater.UpdateRPCAndPCLocally(ctx, sps, rpcs)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	ctx, cancelFCommit := context.WithTimeout(context.Background(), time.Minute)
-	defer cancelFCommit()
-	err = mapUpdater.CommitSMTChanges(ctx)
-	if err != nil {
-		panic(err)
-	}
-
-	root = mapUpdater.GetRoot()
-	fmt.Printf("root: %x\n", root)
-	err = mapUpdater.Close()
-	if err != nil {
-		panic(err)
 	}
-
-	// get a new responder, and load an existing tree
-	mapResponder, err := responder.NewMapResponder(ctx, root, 32, "./config/mapserver_config.json")
-	if err != nil {
-		panic(err)
-	}
-
-	return mapResponder
+	return backend.Commit(ctx)
 }
 
-func getRPCAndSP() ([]*common.RPC, []*common.SP, error) {
+func getRPCAndSP(dir string) ([]*common.RPC, []*common.SP, error) {
 	rpcs := []*common.RPC{}
 	sps := []*common.SP{}
 
-	fileInfos, err := ioutil.ReadDir("./rpc_and_sp")
+	fileInfos, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("getRPCAndSP | ReadDir | %w", err)
 	}
@@ -408,14 +404,14 @@ func getRPCAndSP() ([]*common.RPC, []*common.SP, error) {
 		switch f.Name()[len(f.Name())-3:] {
 		case "_sp":
 			sp := &common.SP{}
-			err = common.JsonFileToSP(sp, "./rpc_and_sp/"+f.Name())
+			err = common.JsonFileToSP(sp, filepath.Join(dir, f.Name()))
 			if err != nil {
 				return nil, nil, fmt.Errorf("getRPCAndSP | JsonFileToSP | %w", err)
 			}
 			sps = append(sps, sp)
 		case "rpc":
 			rpc := &common.RPC{}
-			err = common.JsonFileToRPC(rpc, "./rpc_and_sp/"+f.Name())
+			err = common.JsonFileToRPC(rpc, filepath.Join(dir, f.Name()))
 			if err != nil {
 				return nil, nil, fmt.Errorf("getRPCAndSP | JsonFileToRPC | %w", err)
 			}
@@ -426,118 +422,3 @@ func getRPCAndSP() ([]*common.RPC, []*common.SP, error) {
 	}
 	return rpcs, sps, nil
 }
-
-func decodeCerts(encodedCerts string, separator string) ([]*x509.Certificate, [][]byte, error) {
-	var certs []*x509.Certificate
-	var certBytes [][]byte
-	for _, encodedCert := range strings.Split(encodedCerts, separator) {
-		var block *pem.Block
-		block, _ = pem.Decode([]byte(encodedCert))
-
-		switch {
-		case block == nil:
-			return nil, nil, fmt.Errorf("Certificate input | no pem block")
-		case block.Type != "CERTIFICATE":
-			return nil, nil, fmt.Errorf("Certificate input | contains data other than certificate")
-		}
-
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Certificate input | parsing error")
-		}
-
-		certs = append(certs, cert)
-		certBytes = append(certBytes, block.Bytes)
-	}
-	return certs, certBytes, nil
-}
-
-func appendCertsFromCsv(path string, certColumn int, certChainColumn int, domainFilter map[string]struct{}, certs [][]byte, certChains [][][]byte) ([][]byte, [][][]byte, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// remember to close the file at the end of the program
-	defer f.Close()
-
-	csvReader := csv.NewReader(f)
-	isFirstLine := true
-	for {
-		rec, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-
-		if !isFirstLine {
-			// do something with read line
-			// fmt.Printf("%+v\n", rec)
-
-			leafCerts, leafCertBytes, err := decodeCerts(rec[certColumn], ";")
-			if err != nil {
-				return nil, nil, fmt.Errorf("Failed to decode certs: %s", err)
-			}
-			if len(leafCerts) != 1 {
-				return nil, nil, fmt.Errorf("Wrong number of leaf certificates")
-			}
-			var domains []string
-			domains = append(domains, leafCerts[0].Subject.CommonName)
-			domains = append(domains, leafCerts[0].DNSNames...)
-			addCertificate := false
-			for _, v := range domains {
-				if _, ok := domainFilter[v]; ok {
-					addCertificate = true
-					break
-				}
-			}
-
-			if addCertificate {
-				fmt.Println(domains)
-				certs = append(certs, leafCertBytes[0])
-				if certChainColumn != -1 {
-					_, certChainBytes, err := decodeCerts(rec[certChainColumn], ";")
-					if err != nil {
-						return nil, nil, fmt.Errorf("Failed to decode certchain: %s", err)
-					}
-					certChains = append(certChains, certChainBytes)
-				} else {
-					certChains = append(certChains, [][]byte{})
-				}
-			}
-		}
-		isFirstLine = false
-	}
-	return certs, certChains, nil
-}
-
-func getCerts() ([][]byte, [][][]byte, error) {
-	certsRaw := [][]byte{}
-	certChainsRaw := [][][]byte{}
-
-	type void struct{}
-	var member void
-	includedDomains := make(map[string]struct{})
-	includedDomains["microsoft.com"] = member
-	includedDomains["azure.microsoft.com"] = member
-	includedDomains["bing.com"] = member
-	includedDomains["google.com"] = member
-	includedDomains["baidu.com"] = member
-	includedDomains["amazon.com"] = member
-	includedDomains["pay.amazon.com"] = member
-	includedDomains["ethz.ch"] = member
-	includedDomains["netsec.ethz.ch"] = member
-	includedDomains["facebook.com"] = member
-	includedDomains["www.facebook.com"] = member
-	includedDomains["qq.com"] = member
-	includedDomains["wikipedia.org"] = member
-
-	var err error
-	if certsRaw, certChainsRaw, err = appendCertsFromCsv("./testdata/ct_monitor_certs/certs.csv", 1, -1, includedDomains, certsRaw, certChainsRaw); err != nil {
-		return nil, nil, err
-	}
-	if certsRaw, certChainsRaw, err = appendCertsFromCsv("./testdata/additional_certs/certs.csv", 0, 1, includedDomains, certsRaw, certChainsRaw); err != nil {
-		return nil, nil, err
-	}
-
-	return certsRaw, certChainsRaw, nil
-}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// returned for epochs that are not (yet) in the root history
+var errUnknownEpoch = errors.New("unknown epoch")
+
+// content signed by the epoch signature of a tree head. clients verify the
+// signature over the JSON encoding of this struct, so the fields must not be
+// changed
+type epochSignatureInput struct {
+	Epoch     uint64
+	Timestamp int64
+	Root      []byte
+}
+
+// sequence of the roots committed by the map server. each committed root that
+// differs from the previous one starts a new epoch (the first epoch is 1) and
+// is signed together with its epoch and timestamp, such that clients can
+// detect if they are served an older root than they have already seen.
+// the history is appended to a file (one signed tree head per line) to keep
+// the epochs increasing across restarts
+type rootHistory struct {
+	mutex sync.RWMutex
+
+	// file storing the history ("" to keep it in memory only)
+	path string
+
+	// signed tree heads, treeHeads[i] is the tree head of epoch i+1
+	treeHeads []SignedTreeHead
+}
+
+// load the root history stored in path (an empty history if the file does
+// not exist). if path is "", the history is kept in memory only
+func loadRootHistory(path string) (*rootHistory, error) {
+	history := &rootHistory{path: path}
+	if path == "" {
+		return history, nil
+	}
+	historyFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadRootHistory | %w", err)
+	}
+	defer historyFile.Close()
+
+	scanner := bufio.NewScanner(historyFile)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		treeHead := SignedTreeHead{}
+		err = json.Unmarshal(scanner.Bytes(), &treeHead)
+		if err != nil {
+			return nil, fmt.Errorf("loadRootHistory | %s: epoch %d | %w", path, len(history.treeHeads)+1, err)
+		}
+		if treeHead.Epoch != uint64(len(history.treeHeads)+1) {
+			return nil, fmt.Errorf("loadRootHistory | %s: expected epoch %d, found %d", path, len(history.treeHeads)+1, treeHead.Epoch)
+		}
+		history.treeHeads = append(history.treeHeads, treeHead)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loadRootHistory | %w", err)
+	}
+	return history, nil
+}
+
+// the tree head of the latest epoch (false if the history is empty)
+func (h *rootHistory) Latest() (SignedTreeHead, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.treeHeads) == 0 {
+		return SignedTreeHead{}, false
+	}
+	return h.treeHeads[len(h.treeHeads)-1], true
+}
+
+// the tree head of an epoch (errUnknownEpoch if the epoch does not exist)
+func (h *rootHistory) Get(epoch uint64) (SignedTreeHead, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if epoch == 0 || epoch > uint64(len(h.treeHeads)) {
+		return SignedTreeHead{}, errUnknownEpoch
+	}
+	return h.treeHeads[epoch-1], nil
+}
+
+// add a committed root to the history and return its signed tree head. if the
+// root is the root of the latest epoch, no new epoch is started (unless the
+// latest epoch was signed with a different key, e.g., after a key rotation)
+func (h *rootHistory) Add(root []byte, key *mapServerKey) (SignedTreeHead, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var latest *SignedTreeHead
+	if len(h.treeHeads) > 0 {
+		latest = &h.treeHeads[len(h.treeHeads)-1]
+		if bytes.Equal(latest.Root, root) && latest.KeyID == key.ID {
+			return *latest, nil
+		}
+	}
+
+	treeHead, err := signTreeHead(root, key)
+	if err != nil {
+		return SignedTreeHead{}, fmt.Errorf("rootHistory.Add | %w", err)
+	}
+	treeHead.Epoch = uint64(len(h.treeHeads) + 1)
+	treeHead.Timestamp = time.Now().Unix()
+	if latest != nil && treeHead.Timestamp < latest.Timestamp {
+		// timestamps never decrease, even if the clock is set back
+		treeHead.Timestamp = latest.Timestamp
+	}
+	treeHead.EpochSig, err = common.SignStructRSASHA256(&epochSignatureInput{
+		Epoch:     treeHead.Epoch,
+		Timestamp: treeHead.Timestamp,
+		Root:      treeHead.Root,
+	}, key.Key)
+	if err != nil {
+		return SignedTreeHead{}, fmt.Errorf("rootHistory.Add | SignStructRSASHA256 | %w", err)
+	}
+
+	err = h.appendToFile(treeHead)
+	if err != nil {
+		return SignedTreeHead{}, fmt.Errorf("rootHistory.Add | %s | %w", h.path, err)
+	}
+	h.treeHeads = append(h.treeHeads, treeHead)
+	fmt.Printf("mapserver | epoch %d: root %x\n", treeHead.Epoch, treeHead.Root)
+	return treeHead, nil
+}
+
+// append a tree head to the history file (if any). the file is synced before
+// the epoch is served, so that it cannot be reused after a crash
+func (h *rootHistory) appendToFile(treeHead SignedTreeHead) error {
+	if h.path == "" {
+		return nil
+	}
+	treeHeadBytes, err := json.Marshal(treeHead)
+	if err != nil {
+		return err
+	}
+	historyFile, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = historyFile.Write(append(treeHeadBytes, '\n'))
+	if err == nil {
+		err = historyFile.Sync()
+	}
+	if closeErr := historyFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
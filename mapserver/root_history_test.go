@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// check that epochs are only started for new roots and survive a restart
+func TestRootHistory(t *testing.T) {
+	key := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "root_history.jsonl")
+	history, err := loadRootHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := history.Latest(); ok {
+		t.Fatal("expected an empty history")
+	}
+
+	for i, root := range [][]byte{{1}, {1}, {2}, {1}} {
+		treeHead, err := history.Add(root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedEpoch := []uint64{1, 1, 2, 3}[i]
+		if treeHead.Epoch != expectedEpoch || !bytes.Equal(treeHead.Root, root) || len(treeHead.EpochSig) == 0 || treeHead.KeyID != key.ID {
+			t.Fatalf("unexpected tree head %+v for root %x", treeHead, root)
+		}
+	}
+
+	history, err = loadRootHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, ok := history.Latest()
+	if !ok || latest.Epoch != 3 {
+		t.Fatalf("unexpected latest tree head %+v", latest)
+	}
+	treeHead, err := history.Get(2)
+	if err != nil || !bytes.Equal(treeHead.Root, []byte{2}) {
+		t.Fatalf("unexpected tree head %+v (%v)", treeHead, err)
+	}
+	if _, err = history.Get(4); err != errUnknownEpoch {
+		t.Fatalf("expected errUnknownEpoch, got %v", err)
+	}
+	treeHead, err = history.Add([]byte{3}, key)
+	if err != nil || treeHead.Epoch != 4 || treeHead.Timestamp < latest.Timestamp {
+		t.Fatalf("unexpected tree head %+v (%v)", treeHead, err)
+	}
+
+	// the same root signed with a new key starts a new epoch
+	rotatedKey := newTestKey(t)
+	treeHead, err = history.Add([]byte{3}, rotatedKey)
+	if err != nil || treeHead.Epoch != 5 || treeHead.KeyID != rotatedKey.ID {
+		t.Fatalf("unexpected tree head %+v (%v)", treeHead, err)
+	}
+	treeHead, err = history.Get(4)
+	if err != nil || treeHead.KeyID != key.ID {
+		t.Fatalf("unexpected tree head %+v (%v)", treeHead, err)
+	}
+}
+
+// hand out query indices to the handlers until the test ends
+func serveQueryCounter(t *testing.T) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case queryCounterChannel <- 0:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// check that the responses of GET /getproof contain the epoch of their root
+func TestGetProofEpoch(t *testing.T) {
+	history, err := loadRootHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &memoryBackend{key: newTestKey(t), history: history}
+	backend.Reset()
+	if err = backend.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	previousBackend := mapBackend
+	mapBackend = backend
+	t.Cleanup(func() { mapBackend = previousBackend })
+	serveQueryCounter(t)
+
+	recorder := httptest.NewRecorder()
+	mapServerQueryHandler(recorder, httptest.NewRequest("GET", "/getproof?domain=www.example.com", nil))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var responses []ProofResponse
+	if err = json.Unmarshal(recorder.Body.Bytes(), &responses); err != nil {
+		t.Fatal(err)
+	}
+	treeHead := backend.TreeHead()
+	if len(responses) != 2 {
+		t.Fatalf("expected responses for the domain and its parent domain, got %d", len(responses))
+	}
+	for _, response := range responses {
+		if response.Epoch != 1 || response.KeyID != treeHead.KeyID || !bytes.Equal(response.EpochSig, treeHead.EpochSig) ||
+			!bytes.Equal(response.TreeHeadSig, treeHead.TreeHeadSig) || !bytes.Equal(response.PoI.Root, treeHead.Root) {
+			t.Fatalf("unexpected response %+v for tree head %+v", response, treeHead)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	mapServerQueryHandler(recorder, httptest.NewRequest("GET", "/?domain=invalid", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid domain name, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default path of the serve config
+const serveConfigPath = "./config/serve_config.json"
+
+// default path of the root history
+const rootHistoryPath = "./root_history.jsonl"
+
+// time given to open connections and queued submissions when shutting down
+const shutdownTimeout = 30 * time.Second
+
+// config of the serve command (flags override the values of the config file)
+type ServeConfig struct {
+	// address to listen on
+	Listen string `json:"listen"`
+
+	// certificate and key (PEM files) to serve HTTPS (HTTP if not set)
+	TLSCert string `json:"tls-cert"`
+	TLSKey  string `json:"tls-key"`
+
+	// storage backend ("sql" or "memory")
+	Backend string `json:"backend"`
+
+	// root of the existing tree (SQL backend only), either in hexadecimal
+	// form or as path of a file containing it
+	Root     string `json:"root"`
+	RootFile string `json:"root-file"`
+
+	// file storing the signed roots of all epochs ("" to keep them in memory
+	// only, such that the epochs restart at 1)
+	RootHistory string `json:"root-history"`
+
+	// load the data of the ingestion config at startup (replacing the
+	// content of the database)
+	Load         bool   `json:"load"`
+	IngestConfig string `json:"ingest-config"`
+
+	// submissions to the admin endpoints are committed every CommitInterval
+	// or as soon as BatchSize submissions are queued
+	CommitInterval string `json:"commit-interval"`
+	BatchSize      int    `json:"batch-size"`
+
+	// CT logs whose certificates are continuously added to the map
+	CTLogs []*CTLogConfig `json:"ct-logs"`
+}
+
+func defaultServeConfig() *ServeConfig {
+	return &ServeConfig{
+		Listen:         ":8080",
+		Backend:        "sql",
+		RootHistory:    rootHistoryPath,
+		IngestConfig:   ingestConfigPath,
+		CommitInterval: "10s",
+		BatchSize:      1000,
+	}
+}
+
+// load a serve config, using the default values for missing fields
+func LoadServeConfig(path string) (*ServeConfig, error) {
+	config := defaultServeConfig()
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadServeConfig | ReadFile | %w", err)
+	}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("LoadServeConfig | Unmarshal | %w", err)
+	}
+	return config, nil
+}
+
+// flags of the serve command, writing to the fields of config
+func newServeFlagSet(config *ServeConfig) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFlag := flags.String("config", serveConfigPath, "path of the serve config (ignored if it does not exist and the default path is used)")
+	flags.StringVar(&config.Listen, "listen", config.Listen, "address to listen on")
+	flags.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "certificate (PEM) used to serve HTTPS")
+	flags.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "private key (PEM) used to serve HTTPS")
+	flags.StringVar(&config.Backend, "backend", config.Backend, "storage backend ('sql' for the MySQL database or 'memory')")
+	flags.StringVar(&config.Root, "root", config.Root, "hexadecimal form of root value without leading '0x'")
+	flags.StringVar(&config.RootFile, "rootfile", config.RootFile, "path to the file storing the root in hexadecimal form without leading '0x'")
+	flags.StringVar(&config.RootHistory, "root-history", config.RootHistory, "path of the file storing the signed roots of all epochs ('' to keep them in memory only)")
+	flags.BoolVar(&config.Load, "load", config.Load, "load the data of the ingestion config at startup (replacing the content of the database)")
+	flags.StringVar(&config.IngestConfig, "ingest-config", config.IngestConfig, "path of the ingestion config used with 'load'")
+	flags.StringVar(&config.CommitInterval, "commit-interval", config.CommitInterval, "interval in which submissions to the admin endpoints are committed")
+	flags.IntVar(&config.BatchSize, "batch-size", config.BatchSize, "number of queued submissions that triggers a commit")
+	return flags, configFlag
+}
+
+// parse the flags of the serve command and the config file they refer to
+func parseServeConfig(args []string) (*ServeConfig, error) {
+	// the flags are parsed twice: first to find the config file and then to
+	// override its values
+	flags, configFlag := newServeFlagSet(defaultServeConfig())
+	flags.Parse(args)
+
+	config := defaultServeConfig()
+	_, err := os.Stat(*configFlag)
+	if err == nil || *configFlag != serveConfigPath {
+		config, err = LoadServeConfig(*configFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flags, _ = newServeFlagSet(config)
+	flags.Parse(args)
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("Must specify both 'tls-cert' and 'tls-key'")
+	}
+	if config.Backend == "memory" && (config.Root != "" || config.RootFile != "") {
+		return nil, fmt.Errorf("The memory backend always starts empty, 'root' and 'rootfile' are not supported")
+	}
+	if config.Backend != "memory" && config.Root == "" && config.RootFile == "" && !config.Load {
+		return nil, fmt.Errorf("Must specify either 'root', 'rootfile' or 'load'")
+	}
+	_, err = time.ParseDuration(config.CommitInterval)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid commit interval: %w", err)
+	}
+	for _, ctLog := range config.CTLogs {
+		err = ctLog.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// open the backend of the config and load the initial data
+func openServeBackend(config *ServeConfig) (MapBackend, error) {
+	root, err := parseRoot(config.Root, config.RootFile)
+	if err != nil {
+		return nil, err
+	}
+	history, err := loadRootHistory(config.RootHistory)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := newMapBackend(config.Backend, root, history)
+	if err != nil {
+		return nil, err
+	}
+	if !config.Load {
+		err = backend.Commit(context.Background())
+		return backend, err
+	}
+
+	err = backend.Reset()
+	if err != nil {
+		return backend, err
+	}
+	ingestConfig, err := LoadIngestConfig(config.IngestConfig)
+	if err != nil {
+		return backend, err
+	}
+	return backend, loadTestData(backend, ingestConfig, true, true)
+}
+
+// mapserver serve: serve proofs (and accept submissions if MAPSERVER_ADMIN_TOKEN
+// is set) until SIGINT or SIGTERM is received
+func runServeCommand(args []string) error {
+	config, err := parseServeConfig(args)
+	if err != nil {
+		return err
+	}
+	mapBackend, err = openServeBackend(config)
+	if mapBackend != nil {
+		defer mapBackend.Close()
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := loadMapServerKeys(mapServerConfigPath)
+	if err != nil {
+		return err
+	}
+	publicKeys, err := keys.PublicKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("mapserver | signing with key %s (%d retiring keys)\n", keys.Active.ID, len(keys.Retiring))
+
+	go func(counterChannel chan int) {
+		counter := 0
+		for {
+			counterChannel <- counter
+			counter += 1
+		}
+	}(queryCounterChannel)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", mapServerQueryHandler)
+	mux.HandleFunc("/getproof", mapServerQueryHandler)
+	mux.HandleFunc("/getproofs", batchQueryHandler)
+	mux.HandleFunc("/prefix", prefixQueryHandler)
+	mux.HandleFunc("/root", treeHeadHandler)
+	mux.HandleFunc("/keys", newKeysHandler(publicKeys))
+
+	// submissions and CT log entries are committed by the queue
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	queueDone := make(chan struct{})
+	commitInterval, _ := time.ParseDuration(config.CommitInterval)
+	queue := newIngestQueue(config.BatchSize)
+	go func() {
+		queue.Run(queueCtx, mapBackend, commitInterval)
+		close(queueDone)
+	}()
+
+	// the admin endpoints are only enabled if a token is configured
+	adminToken, exists := os.LookupEnv("MAPSERVER_ADMIN_TOKEN")
+	if exists && adminToken != "" {
+		ingest := &ingestHandler{queue: queue, adminToken: adminToken}
+		mux.HandleFunc("/admin/certificates", ingest.certificatesHandler)
+		mux.HandleFunc("/admin/policies", ingest.policiesHandler)
+	} else {
+		fmt.Println("mapserver | MAPSERVER_ADMIN_TOKEN not set, admin endpoints disabled")
+	}
+
+	followerCtx, stopFollowers := context.WithCancel(context.Background())
+	defer stopFollowers()
+	var followers sync.WaitGroup
+	for _, ctLog := range config.CTLogs {
+		follower, err := newCTLogFollower(ctLog, queue)
+		if err != nil {
+			return err
+		}
+		followers.Add(1)
+		go func() {
+			follower.Run(followerCtx)
+			followers.Done()
+		}()
+	}
+
+	var s = http.Server{
+		Addr:        config.Listen,
+		Handler:     mux,
+		IdleTimeout: 5 * time.Second,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		if config.TLSCert != "" {
+			serverErr <- s.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			serverErr <- s.ListenAndServe()
+		}
+	}()
+	fmt.Println("Mapserver ready, listening on", config.Listen)
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err = <-serverErr:
+		return err
+	case <-signalCtx.Done():
+	}
+
+	fmt.Println("mapserver | shutting down")
+	return shutdownServe(&s, stopFollowers, &followers, stopQueue, queueDone)
+}
+
+// stop accepting requests and following the CT logs (the followers wait
+// for the commit of their last batch), then commit the remaining submissions
+func shutdownServe(s *http.Server, stopFollowers func(), followers *sync.WaitGroup, stopQueue func(), queueDone <-chan struct{}) error {
+	shutdownCtx, cancelF := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelF()
+	err := s.Shutdown(shutdownCtx)
+	stopFollowers()
+	followers.Wait()
+	stopQueue()
+	<-queueDone
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// check that shutting down waits for the submissions in flight and the last
+// batch of the CT log followers before the queue commits the remaining
+// submissions and stops
+func TestShutdownServe(t *testing.T) {
+	backend := &recordingBackend{}
+	queue := newIngestQueue(1000)
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	queueDone := make(chan struct{})
+	go func() {
+		queue.Run(queueCtx, backend, 10*time.Millisecond)
+		close(queueDone)
+	}()
+
+	// follower queueing a last batch and waiting for its commit when stopped
+	followerCtx, stopFollowers := context.WithCancel(context.Background())
+	defer stopFollowers()
+	var followers sync.WaitGroup
+	followers.Add(1)
+	followerCert := newTestCertificate(t, "follower.example.com")
+	go func() {
+		defer followers.Done()
+		<-followerCtx.Done()
+		committed := make(chan error, 1)
+		queue.AddCertificates([][]byte{followerCert}, [][][]byte{nil}, func(err error) { committed <- err })
+		<-committed
+	}()
+
+	// submission that is still in flight when the shutdown starts
+	ingest := &ingestHandler{queue: queue, adminToken: "secret"}
+	submissionStarted := make(chan struct{})
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(submissionStarted)
+		time.Sleep(100 * time.Millisecond)
+		ingest.certificatesHandler(w, r)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+
+	submissionStatus := make(chan int, 1)
+	go func() {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCertificate(t, "submitted.example.com")})
+		request, _ := http.NewRequest("POST", "http://"+listener.Addr().String()+"/admin/certificates", strings.NewReader(string(certPEM)))
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			submissionStatus <- 0
+			return
+		}
+		response.Body.Close()
+		submissionStatus <- response.StatusCode
+	}()
+	<-submissionStarted
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- shutdownServe(s, stopFollowers, &followers, stopQueue, queueDone) }()
+	select {
+	case err = <-shutdownDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if status := <-submissionStatus; status != http.StatusAccepted {
+		t.Fatalf("expected status 202 for the submission in flight, got %d", status)
+	}
+	select {
+	case <-queueDone:
+	default:
+		t.Fatal("the queue is still running after the shutdown")
+	}
+	requireEqualStrings(t, []string{"submitted.example.com/0", "follower.example.com/0"}, backend.committedCerts())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// height of the sparse Merkle tree (SHA-256 keys)
+const smtHeight = 256
+
+// value of empty subtrees (same as the default leaf of the fpki trie)
+var smtDefaultLeaf = []byte{0}
+
+// in-memory sparse Merkle tree with shortcut leaves, producing the same roots
+// and proofs as the fpki trie (see VerifyInclusion).
+// the tree is rebuilt from the sorted key-value pairs on every commit, which
+// is fast enough for development and test data sets
+type memorySMT struct {
+	// sorted keys and the corresponding values
+	keys   [][]byte
+	values [][]byte
+	root   []byte
+}
+
+// build a tree from key-value pairs (keys and values are SHA-256 hashes)
+func newMemorySMT(leaves map[string][]byte) *memorySMT {
+	smt := &memorySMT{}
+	for key := range leaves {
+		smt.keys = append(smt.keys, []byte(key))
+	}
+	sort.Slice(smt.keys, func(i, j int) bool { return bytes.Compare(smt.keys[i], smt.keys[j]) < 0 })
+	for _, key := range smt.keys {
+		smt.values = append(smt.values, leaves[string(key)])
+	}
+	smt.root = smt.subtreeHash(0, len(smt.keys), 0)
+	return smt
+}
+
+func (smt *memorySMT) Root() []byte {
+	return smt.root
+}
+
+// hash of the subtree at the given depth containing the keys [start, end)
+func (smt *memorySMT) subtreeHash(start, end, depth int) []byte {
+	switch end - start {
+	case 0:
+		return smtDefaultLeaf
+	case 1:
+		return common.SHA256Hash(smt.keys[start], smt.values[start], []byte{byte(smtHeight - depth)})
+	}
+	split := smt.splitIndex(start, end, depth)
+	return common.SHA256Hash(smt.subtreeHash(start, split, depth+1), smt.subtreeHash(split, end, depth+1))
+}
+
+// index of the first key in [start, end) whose bit at depth is set
+func (smt *memorySMT) splitIndex(start, end, depth int) int {
+	return start + sort.Search(end-start, func(i int) bool { return bitIsSet(smt.keys[start+i], depth) })
+}
+
+// create a proof of presence or absence of key.
+// the audit path starts with the sibling closest to the leaf
+func (smt *memorySMT) Prove(key []byte) mapCommon.PoI {
+	start, end := 0, len(smt.keys)
+	var auditPath [][]byte
+	depth := 0
+	for ; end-start > 1; depth++ {
+		split := smt.splitIndex(start, end, depth)
+		if bitIsSet(key, depth) {
+			auditPath = append([][]byte{smt.subtreeHash(start, split, depth+1)}, auditPath...)
+			start = split
+		} else {
+			auditPath = append([][]byte{smt.subtreeHash(split, end, depth+1)}, auditPath...)
+			end = split
+		}
+	}
+
+	poi := mapCommon.PoI{ProofType: mapCommon.PoA, Proof: auditPath, Root: smt.root}
+	if end-start == 1 {
+		if bytes.Equal(smt.keys[start], key) {
+			poi.ProofType = mapCommon.PoP
+		} else {
+			// the path of key ends in the shortcut leaf of another key
+			poi.ProofKey = smt.keys[start]
+			poi.ProofValue = smt.values[start]
+		}
+	}
+	return poi
+}
+
+// audit path of the node at the end of the path of prefix (its first bits
+// bits) and the range [start, end) of keys in the subtree of this node.
+// the path ends before depth bits if the subtree contains at most one key,
+// in which case the key does not necessarily start with prefix
+func (smt *memorySMT) ProvePrefix(prefix []byte, bits int) ([][]byte, int, int) {
+	start, end := 0, len(smt.keys)
+	var auditPath [][]byte
+	for depth := 0; end-start > 1 && depth < bits; depth++ {
+		split := smt.splitIndex(start, end, depth)
+		if bitIsSet(prefix, depth) {
+			auditPath = append([][]byte{smt.subtreeHash(start, split, depth+1)}, auditPath...)
+			start = split
+		} else {
+			auditPath = append([][]byte{smt.subtreeHash(split, end, depth+1)}, auditPath...)
+			end = split
+		}
+	}
+	return auditPath, start, end
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+)
+
+// prefix proof shared with the cache_v2 tests of the extension, which derive
+// and verify the proofs of the domains of the prefix from it
+const prefixProofFixturePath = "../app/go_wasm/cache_v2/embedded/unit_test/prefix/prefix_proof.json"
+
+var updatePrefixFixture = flag.Bool("update-prefix-fixture", false, "regenerate the prefix proof fixture of the cache_v2 tests")
+
+// prefix proof of the memory backend and domains covered by the prefix that
+// are not in the tree
+type prefixProofFixture struct {
+	PrefixProof
+	AbsentDomains []string
+}
+
+// memory backend with nDomains committed domains, each with a certificate
+// issued by a test CA. the certificates are signed with ed25519 keys derived
+// from fixed seeds, so that the entries (and the fixture) are reproducible
+func newPrefixTestBackend(t *testing.T, nDomains int) *memoryBackend {
+	history, err := loadRootHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &memoryBackend{key: newTestKey(t), history: history}
+	backend.Reset()
+
+	caKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "prefix test CA"},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca, err := x509.CreateCertificate(nil, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCertificate, err := x509.ParseCertificate(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	var certs [][]byte
+	var certChains [][][]byte
+	for i := 0; i < nDomains; i++ {
+		domainName := fmt.Sprintf("domain%d.com", i)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: domainName},
+			DNSNames:     []string{domainName},
+			NotBefore:    caTemplate.NotBefore,
+			NotAfter:     caTemplate.NotAfter,
+		}
+		cert, err := x509.CreateCertificate(nil, template, caCertificate, leafKey.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+		certChains = append(certChains, [][]byte{ca})
+	}
+	if err = backend.UpdateCerts(context.Background(), certs, certChains); err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// check that the prefix proof of a subtree with several entries is
+// consistent with the proofs of its entries and that the fixture of the
+// cache_v2 tests is up to date
+func TestPrefixProofFixture(t *testing.T) {
+	backend := newPrefixTestBackend(t, 2000)
+	prefix := common.SHA256Hash([]byte("domain0.com"))[:1]
+	proof, err := backend.GetPrefixProof(context.Background(), prefix, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.Entries) < 3 || len(proof.Proof) != 8 {
+		t.Fatalf("expected several entries below a subtree of depth 8, got %d entries and %d nodes", len(proof.Entries), len(proof.Proof))
+	}
+	for _, entry := range proof.Entries {
+		key := common.SHA256Hash([]byte(entry.Domain))
+		if key[0] != prefix[0] {
+			t.Fatalf("entry %s is not covered by the prefix %x", entry.Domain, prefix)
+		}
+		// the audit path of the entry ends with the audit path of the subtree
+		poi := backend.smt.Prove(key)
+		if poi.ProofType != mapCommon.PoP || len(poi.Proof) <= len(proof.Proof) {
+			t.Fatalf("unexpected proof %+v for %s", poi, entry.Domain)
+		}
+		for i, node := range proof.Proof {
+			if !bytes.Equal(poi.Proof[len(poi.Proof)-len(proof.Proof)+i], node) {
+				t.Fatalf("audit path of %s does not end with the audit path of the subtree", entry.Domain)
+			}
+		}
+	}
+
+	// the tree head is signed with a random key at commit time, the cache_v2
+	// tests sign the root with their own key
+	fixture := prefixProofFixture{PrefixProof: *proof}
+	fixture.SignedTreeHead = SignedTreeHead{Root: proof.Root}
+	for i := 0; len(fixture.AbsentDomains) < 3; i++ {
+		domainName := fmt.Sprintf("absent%d.com", i)
+		if common.SHA256Hash([]byte(domainName))[0] == prefix[0] {
+			fixture.AbsentDomains = append(fixture.AbsentDomains, domainName)
+		}
+	}
+	fixtureJSON, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtureJSON = append(fixtureJSON, '\n')
+	if *updatePrefixFixture {
+		if err = os.WriteFile(prefixProofFixturePath, fixtureJSON, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expectedJSON, err := os.ReadFile(prefixProofFixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expectedJSON, fixtureJSON) {
+		t.Fatalf("%s is outdated, run the test with -update-prefix-fixture", prefixProofFixturePath)
+	}
+}